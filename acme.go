@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeConfig obtains and renews the server certificate from an ACME CA (Let's Encrypt,
+// step-ca, ...) for the listed DNS names. Certificates and the account key are kept in
+// cacheDir so restarts don't hit CA rate limits.
+type acmeConfig struct {
+	manager  *autocert.Manager
+	domains  []string
+	httpAddr string // HTTP-01 challenge listener; empty = TLS-ALPN-01 on the server port only
+}
+
+// acmeFromEnv reads SERVER_ACME_DOMAINS (off when unset), SERVER_ACME_EMAIL,
+// SERVER_ACME_DIRECTORY_URL, SERVER_ACME_CA_FILE, SERVER_ACME_CACHE_DIR and
+// SERVER_ACME_HTTP_ADDR
+func acmeFromEnv() (*acmeConfig, error) {
+	var domains []string
+	for _, d := range strings.Split(os.Getenv("SERVER_ACME_DOMAINS"), ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	if len(domains) == 0 {
+		return nil, nil
+	}
+	if os.Getenv("SERVER_TLS_CERT_FILE") != "" || os.Getenv("SERVER_TLS_KEY_FILE") != "" {
+		return nil, errors.New("SERVER_ACME_DOMAINS and SERVER_TLS_CERT_FILE/KEY_FILE are mutually exclusive")
+	}
+	cacheDir := envString("SERVER_ACME_CACHE_DIR", "acme-cache")
+	if err := os.MkdirAll(cacheDir, 0o700); err != nil {
+		return nil, fmt.Errorf("SERVER_ACME_CACHE_DIR: %w", err)
+	}
+
+	client := &acme.Client{DirectoryURL: envString("SERVER_ACME_DIRECTORY_URL", autocert.DefaultACMEDirectory)}
+	// Internal ACME CAs usually serve their directory under a private root
+	if caFile := os.Getenv("SERVER_ACME_CA_FILE"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read SERVER_ACME_CA_FILE: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("SERVER_ACME_CA_FILE contains no PEM certificates")
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.HTTPClient = &http.Client{Transport: transport, Timeout: 30 * time.Second}
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Email:      os.Getenv("SERVER_ACME_EMAIL"),
+		Client:     client,
+	}
+	log.Printf("Obtaining the server certificate for %s from %s (cache %s)", strings.Join(domains, ", "), client.DirectoryURL, cacheDir)
+	return &acmeConfig{manager: m, domains: domains, httpAddr: os.Getenv("SERVER_ACME_HTTP_ADDR")}, nil
+}
+
+// apply serves certificates from the ACME manager, answering TLS-ALPN-01 challenges
+// on the server port itself
+func (a *acmeConfig) apply(cfg *tls.Config) {
+	cfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := a.manager.GetCertificate(hello)
+		// Issuance errors otherwise only reach the caller as a TLS alert; names outside
+		// the list are scanners and not worth a line
+		if err != nil && slices.Contains(a.domains, hello.ServerName) {
+			log.Printf("WARNING: ACME certificate for %s: %v", hello.ServerName, err)
+		}
+		return cert, err
+	}
+	cfg.NextProtos = []string{"h2", acme.ALPNProto}
+}
+
+// serveHTTPChallenges answers HTTP-01 challenges on httpAddr (usually :80), for CAs
+// that cannot reach the gRPC port on 443
+func (a *acmeConfig) serveHTTPChallenges() error {
+	if a.httpAddr == "" {
+		return nil
+	}
+	lis, err := net.Listen("tcp", a.httpAddr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: a.manager.HTTPHandler(nil), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			log.Printf("ACME challenge server: %v", err)
+		}
+	}()
+	log.Printf("Answering ACME HTTP-01 challenges on %s", lis.Addr())
+	return nil
+}
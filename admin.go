@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"systemiq.ai/auth"
+	"systemiq.ai/protos"
+)
+
+// adminTokenMetadataKey carries ADMIN_TOKEN on admin calls
+const adminTokenMetadataKey = "x-admin-token"
+
+// defaultAdminAddr is where the admin CLI connects when -addr is not given
+const defaultAdminAddr = "127.0.0.1:50061"
+
+// adminServer implements runtime control for incident response and migrations
+type adminServer struct {
+	protos.UnimplementedAdminServer
+	upstream    *upstreamSet
+	authHandler *auth.AuthHandler
+	leader      *leaderElector
+	inFlight    *upstreamLimiter  // nil without MAX_IN_FLIGHT
+	buffer      *observationSpool // nil without BUFFER_DIR
+}
+
+func (a *adminServer) status() *protos.AdminStatus {
+	st := &protos.AdminStatus{
+		Endpoint:      a.upstream.Endpoint(),
+		ObserverState: a.upstream.Conn().GetState().String(),
+		TestMode:      testMode.Load(),
+		AuthReady:     a.authHandler.Ready(),
+		Version:       version,
+		Commit:        commit,
+		BuildDate:     buildDate,
+		GoVersion:     runtime.Version(),
+		LogLevel:      logLevel(),
+		Leader:        a.leader.IsLeader(),
+		UptimeSeconds: int64(time.Since(startedAt).Seconds()),
+	}
+	if a.inFlight != nil {
+		inFlight, queued, limit := a.inFlight.Stats()
+		st.InFlight, st.Queued, st.ConcurrencyLimit = int32(inFlight), int32(queued), int32(limit)
+	}
+	if b := a.buffer.lastStats(); b != nil {
+		st.BufferedObservations, st.BufferedBytes, st.BufferAlert = int64(b.observations), b.bytes, b.alert
+		if !b.oldest.IsZero() {
+			st.BufferedOldestUnixMs = b.oldest.UnixMilli()
+		}
+	}
+	active := a.upstream.active.Load()
+	for _, m := range a.upstream.members {
+		h := m.health()
+		e := &protos.EndpointHealth{
+			Endpoint:       m.Endpoint(),
+			Active:         m == active,
+			ProbeHealthy:   m.healthy.Load(),
+			ProbeLatencyMs: float64(m.latency.Load()) / 1e6,
+			Score:          h.score,
+			FailureRate:    h.failureRate,
+			AvgLatencyMs:   float64(h.avgLatency) / 1e6,
+			Calls:          int64(h.calls),
+			Weight:         int32(m.weight),
+		}
+		e.CallsTotal, e.ErrorsTotal = m.totals()
+		cs := m.connectivityState()
+		e.State = cs.state.String()
+		if !cs.since.IsZero() {
+			e.StateSinceUnixMs = cs.since.UnixMilli()
+		}
+		if m.ejected() {
+			e.EjectedUntilUnix = h.ejectedUntil.Unix()
+		}
+		if caps := m.caps.Load(); caps != nil {
+			e.ObserverVersion = caps.version
+			e.Compression = caps.compressor
+			e.MaxMessageBytes = int64(caps.maxMsgBytes)
+		}
+		st.Endpoints = append(st.Endpoints, e)
+	}
+	st.Transitions = a.upstream.transitions.recent()
+	return st
+}
+
+func (a *adminServer) Status(context.Context, *protos.StatusRequest) (*protos.AdminStatus, error) {
+	return a.status(), nil
+}
+
+func (a *adminServer) Reconnect(ctx context.Context, _ *protos.ReconnectRequest) (*protos.AdminStatus, error) {
+	for _, m := range a.upstream.members {
+		if err := m.Redial("", "admin request"); err != nil {
+			return nil, status.Errorf(codes.Internal, "re-dial %s: %v", m.Endpoint(), err)
+		}
+	}
+	auditTrail.record("reconnect", adminActor(ctx), "")
+	return a.status(), nil
+}
+
+func (a *adminServer) SetEndpoint(ctx context.Context, req *protos.SetEndpointRequest) (*protos.AdminStatus, error) {
+	if req.GetEndpoint() == "" {
+		return nil, status.Error(codes.InvalidArgument, "endpoint is required")
+	}
+	if len(a.upstream.members) > 1 {
+		return nil, status.Error(codes.FailedPrecondition, "endpoint switching is unavailable with OBSERVER_ENDPOINTS")
+	}
+	if err := a.upstream.members[0].Redial(req.GetEndpoint(), "admin endpoint switch"); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "dial %s: %v", req.GetEndpoint(), err)
+	}
+	auditTrail.record("set-endpoint", adminActor(ctx), req.GetEndpoint())
+	return a.status(), nil
+}
+
+func (a *adminServer) SetTestMode(ctx context.Context, req *protos.SetTestModeRequest) (*protos.AdminStatus, error) {
+	testMode.Store(req.GetEnabled())
+	state := map[bool]string{true: "enabled", false: "disabled"}[req.GetEnabled()]
+	log.Printf("Test mode %s by admin request", state)
+	auditTrail.record("test-mode", adminActor(ctx), state)
+	return a.status(), nil
+}
+
+func (a *adminServer) SetLogLevel(ctx context.Context, req *protos.SetLogLevelRequest) (*protos.AdminStatus, error) {
+	if err := setLogLevel(req.GetLevel(), "admin request"); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	auditTrail.record("log-level", adminActor(ctx), req.GetLevel())
+	return a.status(), nil
+}
+
+// WatchStatus streams the status every interval until the caller goes away
+func (a *adminServer) WatchStatus(req *protos.WatchStatusRequest, stream protos.Admin_WatchStatusServer) error {
+	interval := time.Second
+	if req.GetIntervalMs() > 0 {
+		interval = max(time.Duration(req.GetIntervalMs())*time.Millisecond, 100*time.Millisecond)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := stream.Send(a.status()); err != nil {
+			return err
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// adminTokenInterceptor requires ADMIN_TOKEN in x-admin-token metadata
+func adminTokenInterceptor(token string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := checkAdminToken(ctx, token); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// adminTokenStreamInterceptor is adminTokenInterceptor for WatchStatus
+func adminTokenStreamInterceptor(token string) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := checkAdminToken(ss.Context(), token); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// loopbackAddr reports whether addr binds only a loopback interface
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func checkAdminToken(ctx context.Context, token string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	v := md.Get(adminTokenMetadataKey)
+	if len(v) == 0 || subtle.ConstantTimeCompare([]byte(v[0]), []byte(token)) != 1 {
+		return status.Error(codes.Unauthenticated, "admin token required")
+	}
+	return nil
+}
+
+// ListBuffered pages through the observations waiting in BUFFER_DIR
+func (a *adminServer) ListBuffered(_ context.Context, req *protos.ListBufferedRequest) (*protos.ListBufferedResponse, error) {
+	if a.buffer == nil {
+		return nil, status.Error(codes.FailedPrecondition, "no BUFFER_DIR configured")
+	}
+	size := int(req.GetPageSize())
+	if size <= 0 {
+		size = 100
+	}
+	page, next, err := a.buffer.list(req.GetPageToken(), min(size, 1000), int(req.GetPreviewBytes()))
+	if errors.Is(err, errObservationID) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &protos.ListBufferedResponse{Observations: page, NextPageToken: next}, nil
+}
+
+// runAdminCLI implements "observer_middleware admin <command>" against ADMIN_ADDR
+func runAdminCLI(args []string) int {
+	fs := flag.NewFlagSet("admin", flag.ExitOnError)
+	addr := fs.String("addr", os.Getenv("ADMIN_ADDR"), "admin listener address")
+	watch := fs.Bool("watch", false, "with status: keep a live view open until Ctrl-C")
+	interval := fs.Duration("interval", time.Second, "refresh interval of -watch")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: observer_middleware admin [-addr host:port] [-watch] status | reconnect | endpoint <target> | test-mode on|off | log-level debug|info")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *addr == "" {
+		*addr = defaultAdminAddr
+	}
+
+	conn, err := grpc.NewClient(*addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer conn.Close()
+	client := protos.NewAdminClient(conn)
+
+	ctx := context.Background()
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, adminTokenMetadataKey, token)
+	}
+	if *watch {
+		if fs.Arg(0) != "status" {
+			fs.Usage()
+			return 2
+		}
+		return watchStatus(ctx, client, *interval)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var st *protos.AdminStatus
+	switch cmd := fs.Arg(0); {
+	case cmd == "status":
+		st, err = client.Status(ctx, &protos.StatusRequest{})
+	case cmd == "reconnect":
+		st, err = client.Reconnect(ctx, &protos.ReconnectRequest{})
+	case cmd == "endpoint" && fs.NArg() == 2:
+		st, err = client.SetEndpoint(ctx, &protos.SetEndpointRequest{Endpoint: fs.Arg(1)})
+	case cmd == "test-mode" && (fs.Arg(1) == "on" || fs.Arg(1) == "off"):
+		st, err = client.SetTestMode(ctx, &protos.SetTestModeRequest{Enabled: fs.Arg(1) == "on"})
+	case cmd == "log-level" && fs.NArg() == 2:
+		st, err = client.SetLogLevel(ctx, &protos.SetLogLevelRequest{Level: fs.Arg(1)})
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Printf("endpoint:       %s\nobserver state: %s\ntest mode:      %v\nauth ready:     %v\nlog level:      %s\nleader:         %v\nversion:        %s\n",
+		st.GetEndpoint(), st.GetObserverState(), st.GetTestMode(), st.GetAuthReady(), st.GetLogLevel(), st.GetLeader(), st.GetVersion())
+	if st.GetCommit() != "" {
+		fmt.Printf("build:          %s, %s, %s\n", st.GetCommit(), orUnknown(st.GetBuildDate()), st.GetGoVersion())
+	}
+	if st.GetConcurrencyLimit() > 0 {
+		fmt.Printf("upstream:       %d in flight, %d queued (limit %d)\n", st.GetInFlight(), st.GetQueued(), st.GetConcurrencyLimit())
+	}
+	if st.GetBufferedObservations() > 0 || st.GetBufferAlert() != "" {
+		fmt.Printf("buffer:         %s\n", bufferSummary(st))
+	}
+	if eps := st.GetEndpoints(); len(eps) == 1 && eps[0].GetObserverVersion() != "" {
+		fmt.Printf("observer:       %s\n", capsSummary(eps[0]))
+	}
+	if len(st.GetEndpoints()) > 1 {
+		fmt.Println("endpoints:")
+		for _, e := range st.GetEndpoints() {
+			marker := " "
+			if e.GetActive() {
+				marker = "*"
+			}
+			state := "in rotation"
+			switch {
+			case e.GetEjectedUntilUnix() > 0:
+				state = "ejected until " + time.Unix(e.GetEjectedUntilUnix(), 0).Format(time.TimeOnly)
+			case !e.GetProbeHealthy():
+				state = "probe failing"
+			}
+			if e.GetWeight() > 0 {
+				state = fmt.Sprintf("weight %d, %s", e.GetWeight(), state)
+			}
+			if e.GetObserverVersion() != "" {
+				state += ", observer " + capsSummary(e)
+			}
+			fmt.Printf("  %s %-40s score %.2f  failures %3.0f%% of %d  call %.1fms  probe %.1fms  %s\n",
+				marker, e.GetEndpoint(), e.GetScore(), e.GetFailureRate()*100, e.GetCalls(), e.GetAvgLatencyMs(), e.GetProbeLatencyMs(), state)
+		}
+	}
+	return 0
+}
+
+// watchStatus redraws a live view from the status stream until interrupted; rates are
+// computed from the call totals of consecutive updates
+func watchStatus(ctx context.Context, client protos.AdminClient, interval time.Duration) int {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stream, err := client.WatchStatus(ctx, &protos.WatchStatusRequest{IntervalMs: interval.Milliseconds()})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	prev := map[string]*protos.EndpointHealth{}
+	var prevAt time.Time
+	for {
+		st, err := stream.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0
+			}
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		now := time.Now()
+		elapsed := now.Sub(prevAt).Seconds()
+
+		var b strings.Builder
+		b.WriteString("\033[H\033[2J") // home and clear
+		fmt.Fprintf(&b, "observer_middleware %s, up %v  %s  (Ctrl-C to quit)\n\n", st.GetVersion(), time.Duration(st.GetUptimeSeconds())*time.Second, now.Format(time.TimeOnly))
+		fmt.Fprintf(&b, "connection  %s  %s\n", st.GetEndpoint(), st.GetObserverState())
+		fmt.Fprintf(&b, "state       leader %v, auth ready %v, test mode %v, log level %s\n", st.GetLeader(), st.GetAuthReady(), st.GetTestMode(), st.GetLogLevel())
+		if st.GetConcurrencyLimit() > 0 {
+			fmt.Fprintf(&b, "queue       %d in flight, %d queued (limit %d)\n", st.GetInFlight(), st.GetQueued(), st.GetConcurrencyLimit())
+		}
+		if st.GetBufferedObservations() > 0 || st.GetBufferAlert() != "" {
+			fmt.Fprintf(&b, "buffer      %s\n", bufferSummary(st))
+		}
+
+		var calls, errs, callRate, errRate float64
+		rows := make([]string, 0, len(st.GetEndpoints()))
+		for _, e := range st.GetEndpoints() {
+			var c, f float64
+			if p, ok := prev[e.GetEndpoint()]; ok && elapsed > 0 {
+				c = float64(e.GetCallsTotal()-p.GetCallsTotal()) / elapsed
+				f = float64(e.GetErrorsTotal()-p.GetErrorsTotal()) / elapsed
+			}
+			calls += float64(e.GetCallsTotal())
+			errs += float64(e.GetErrorsTotal())
+			callRate += c
+			errRate += f
+			marker := " "
+			if e.GetActive() {
+				marker = "*"
+			}
+			state := "in rotation"
+			switch {
+			case e.GetEjectedUntilUnix() > 0:
+				state = "ejected until " + time.Unix(e.GetEjectedUntilUnix(), 0).Format(time.TimeOnly)
+			case !e.GetProbeHealthy():
+				state = "probe failing"
+			}
+			rows = append(rows, fmt.Sprintf("  %s %-40s %8.1f/s %8.1f/s  probe %6.1fms  %s", marker, e.GetEndpoint(), c, f, e.GetProbeLatencyMs(), state))
+			prev[e.GetEndpoint()] = e
+		}
+		errPercent := 0.0
+		if callRate > 0 {
+			errPercent = 100 * errRate / callRate
+		}
+		fmt.Fprintf(&b, "throughput  %.1f calls/s, %.1f errors/s (%.1f%%)\n", callRate, errRate, errPercent)
+		fmt.Fprintf(&b, "totals      %.0f calls, %.0f errors\n", calls, errs)
+		if len(rows) > 1 {
+			fmt.Fprintf(&b, "\n    %-40s %10s %10s\n", "endpoint", "calls", "errors")
+			b.WriteString(strings.Join(rows, "\n") + "\n")
+		}
+		if events := st.GetTransitions(); len(events) > 0 {
+			b.WriteString("\nrecent connectivity changes:\n")
+			for _, e := range events[max(len(events)-5, 0):] {
+				fmt.Fprintf(&b, "  %s  %-40s %s -> %s after %v\n", time.UnixMilli(e.GetAtUnixMs()).Format(time.TimeOnly), e.GetEndpoint(),
+					e.GetFrom(), e.GetTo(), (time.Duration(e.GetAfterSeconds() * float64(time.Second))).Round(time.Millisecond))
+			}
+		}
+		os.Stdout.WriteString(b.String())
+		prevAt = now
+	}
+}
+
+// bufferSummary describes what BUFFER_DIR holds
+func bufferSummary(st *protos.AdminStatus) string {
+	s := fmt.Sprintf("%d observations, %.1f MB", st.GetBufferedObservations(), float64(st.GetBufferedBytes())/(1<<20))
+	if st.GetBufferedOldestUnixMs() > 0 {
+		s += fmt.Sprintf(", oldest %v ago", time.Since(time.UnixMilli(st.GetBufferedOldestUnixMs())).Round(time.Second))
+	}
+	if st.GetBufferAlert() != "" {
+		s += " (NOT READY: " + st.GetBufferAlert() + ")"
+	}
+	return s
+}
+
+// capsSummary formats the capabilities an endpoint advertised
+func capsSummary(e *protos.EndpointHealth) string {
+	s := e.GetObserverVersion()
+	if e.GetCompression() != "" {
+		s += " (" + e.GetCompression() + ")"
+	}
+	if e.GetMaxMessageBytes() > 0 {
+		s += fmt.Sprintf(" max %d bytes", e.GetMaxMessageBytes())
+	}
+	return s
+}
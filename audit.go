@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/peer"
+)
+
+// auditTrail is the process-wide audit log, nil without AUDIT_LOG_FILE; set once at
+// startup before anything can record into it
+var auditTrail *auditLog
+
+// auditLog appends administrative actions (admin API calls, log-level and live config
+// changes) to a JSON-lines file. Every entry carries the hash of the previous one, so
+// editing, removing or reordering entries breaks the chain "audit verify" checks.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+	seq  uint64
+	prev string // hash of the last entry
+}
+
+// auditEntry is one line of the audit log; Hash is the hex SHA-256 of the line up to
+// (excluding) `,"hash":`, with the closing brace appended
+type auditEntry struct {
+	Seq    uint64 `json:"seq"`
+	Time   string `json:"time"`
+	Action string `json:"action"`
+	Actor  string `json:"actor,omitempty"`
+	Detail string `json:"detail,omitempty"`
+	Prev   string `json:"prev"`
+	Hash   string `json:"hash,omitempty"`
+}
+
+// genesisHash is the prev of the first entry
+var genesisHash = strings.Repeat("0", sha256.Size*2)
+
+// auditLogFromEnv opens AUDIT_LOG_FILE for appending, continuing the chain of the
+// entries already in it
+func auditLogFromEnv() (*auditLog, error) {
+	name := os.Getenv("AUDIT_LOG_FILE")
+	if name == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("AUDIT_LOG_FILE: %w", err)
+	}
+	a := &auditLog{file: f, prev: genesisHash}
+	res, err := verifyAuditLog(f)
+	if err != nil {
+		// Keep appending after the last entry so the break stays visible to verify
+		log.Printf("WARNING: audit log %s fails verification: %v", name, err)
+	}
+	if res.entries > 0 {
+		a.seq, a.prev = res.last.Seq, res.last.Hash
+	}
+	log.Printf("Recording administrative actions in %s (%d earlier entries)", name, res.entries)
+	return a, nil
+}
+
+// record appends one entry; failures are logged, never fatal
+func (a *auditLog) record(action, actor, detail string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e := auditEntry{Seq: a.seq + 1, Time: time.Now().UTC().Format(time.RFC3339Nano), Action: action, Actor: actor, Detail: detail, Prev: a.prev}
+	body, _ := json.Marshal(e)
+	e.Hash = auditHash(body)
+	line := append(body[:len(body)-1], `,"hash":"`+e.Hash+`"}`+"\n"...)
+	if _, err := a.file.Write(line); err != nil {
+		log.Printf("WARNING: audit log: %v", err)
+		return
+	}
+	a.file.Sync()
+	a.seq, a.prev = e.Seq, e.Hash
+}
+
+// auditHash hashes an entry marshalled without its hash
+func auditHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashField matches the trailing hash an entry line must end with
+var hashField = regexp.MustCompile(`,"hash":"([0-9a-f]{64})"}$`)
+
+// auditVerifyResult summarises a verified log
+type auditVerifyResult struct {
+	entries int
+	first   auditEntry
+	last    auditEntry
+}
+
+// verifyAuditLog checks every line's hash and its link to the previous line; it
+// reports the first break, with the entries verified up to it
+func verifyAuditLog(r io.Reader) (auditVerifyResult, error) {
+	var res auditVerifyResult
+	prev := genesisHash
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Bytes()
+		m := hashField.FindSubmatchIndex(line)
+		if m == nil {
+			return res, fmt.Errorf("line %d: no hash", n)
+		}
+		var e auditEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return res, fmt.Errorf("line %d: %v", n, err)
+		}
+		body := append(bytes.Clone(line[:m[0]]), '}')
+		if auditHash(body) != e.Hash {
+			return res, fmt.Errorf("line %d (seq %d): content does not match its hash", n, e.Seq)
+		}
+		if e.Prev != prev {
+			return res, fmt.Errorf("line %d (seq %d): previous entry missing or changed", n, e.Seq)
+		}
+		if e.Seq != uint64(n) {
+			return res, fmt.Errorf("line %d: sequence %d out of order", n, e.Seq)
+		}
+		if res.entries == 0 {
+			res.first = e
+		}
+		res.entries++
+		res.last = e
+		prev = e.Hash
+	}
+	return res, sc.Err()
+}
+
+// adminActor names the admin API caller by address; the shared admin token says
+// nothing more about who it is
+func adminActor(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return "admin " + p.Addr.String()
+	}
+	return "admin"
+}
+
+// runAudit implements "audit verify [file]"
+func runAudit(args []string) int {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	expect := fs.String("expect-head", "", "fail unless the last entry has this hash (as recorded elsewhere)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: observer_middleware audit [-expect-head hash] verify [file]\n\nfile defaults to AUDIT_LOG_FILE.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.Arg(0) != "verify" || fs.NArg() > 2 {
+		fs.Usage()
+		return 2
+	}
+	name := fs.Arg(1)
+	if name == "" {
+		name = os.Getenv("AUDIT_LOG_FILE")
+	}
+	if name == "" {
+		fmt.Fprintln(os.Stderr, "no file given and AUDIT_LOG_FILE is unset")
+		return 2
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+
+	res, err := verifyAuditLog(f)
+	if err != nil {
+		fmt.Printf("FAIL  %s: %v (%d entries verified before it)\n", name, err, res.entries)
+		return 1
+	}
+	if res.entries == 0 {
+		fmt.Printf("OK    %s: empty\n", name)
+		return 0
+	}
+	if *expect != "" && *expect != res.last.Hash {
+		fmt.Printf("FAIL  %s: last entry hash %s, expected %s (entries removed from the end?)\n", name, res.last.Hash, *expect)
+		return 1
+	}
+	fmt.Printf("OK    %s: %d entries, %s .. %s\n", name, res.entries, res.first.Time, res.last.Time)
+	fmt.Printf("head  %s\n", res.last.Hash)
+	return 0
+}
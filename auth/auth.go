@@ -2,60 +2,22 @@ package auth
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
-	"strconv"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"systemiq.ai/jwks"
+	"systemiq.ai/metrics"
 )
 
-// Global variables for environment configurations
-var (
-	authLoginEndpoint   string
-	authRefreshEndpoint string
-	authEmail           string
-	authPassword        string
-	authClientID        int
-)
-
-// Initialize environment variables once at startup
-func init() {
-	authLoginEndpoint = os.Getenv("AUTH_LOGIN_ENDPOINT")
-	if authLoginEndpoint == "" {
-		authLoginEndpoint = "https://api.systemiq.ai/auth/login" // Default value
-	}
-
-	authRefreshEndpoint = os.Getenv("AUTH_REFRESH_ENDPOINT")
-	if authRefreshEndpoint == "" {
-		authRefreshEndpoint = "https://api.systemiq.ai/auth/refresh-token" // Default value
-	}
-
-	authEmail = os.Getenv("AUTH_EMAIL")
-	authPassword = os.Getenv("AUTH_PASSWORD")
-
-	clientIDStr := os.Getenv("AUTH_CLIENT_ID")
-	if clientIDStr == "" {
-		log.Fatal("AUTH_CLIENT_ID is not set")
-	}
-
-	var err error
-	authClientID, err = strconv.Atoi(clientIDStr)
-	if err != nil || authClientID == 0 {
-		log.Fatal("AUTH_CLIENT_ID must be a valid integer")
-	}
-
-	// Check other required environment variables
-	if authLoginEndpoint == "" || authRefreshEndpoint == "" || authEmail == "" || authPassword == "" {
-		log.Fatal("One or more required environment variables are missing")
-	}
-}
-
 // TokenResponse represents the structure of the login response
 type TokenResponse struct {
 	AccessToken  string `json:"access_token"`
@@ -76,126 +38,357 @@ type LoginResponse struct {
 	Clients []ClientToken `json:"clients"`
 }
 
-// AuthHandler manages authentication and token refreshing
-type AuthHandler struct {
+// Credentials identifies one IAM user and the client IDs it forwards under
+type Credentials struct {
+	Email     string `json:"email"`
+	Password  string `json:"password"`
+	ClientIDs []int  `json:"client_ids"` // the first ID is the default client
+}
+
+// tokenState holds the current tokens of one client
+type tokenState struct {
 	accessToken  string
 	refreshToken string
 	expiry       time.Time
-	client       *http.Client
-	mu           sync.Mutex
-	ticker       *time.Ticker
-	stopChan     chan struct{}
 }
 
-// NewAuthHandler creates a new AuthHandler instance and starts the background refresher
-func NewAuthHandler() (*AuthHandler, error) {
+// refreshWindow is how long before expiry the background refresher renews a token
+const refreshWindow = 5 * time.Minute
+
+// AuthHandler manages authentication and token refreshing
+type AuthHandler struct {
+	cfg       Config
+	clientIDs []int
+	tokens    map[int]*tokenState // keyed by client ID, guarded by mu
+	client    *http.Client
+	jwks      *jwks.Set // nil unless signature verification is configured
+	mu        sync.Mutex
+	ticker    *time.Ticker
+	ctx       context.Context // scopes background logins/refreshes, cancelled by StopRefresher
+	stop      context.CancelFunc
+	renewSem  chan struct{} // serialises login/refresh so a rotated refresh token is never sent twice
+	ready     atomic.Bool   // set once the first login has succeeded
+	loggedOut atomic.Bool   // set by Logout, after which no token is handed out
+	offset    atomic.Int64  // issuer clock minus local clock (ns), from the latest token's iat
+	hasOffset atomic.Bool
+	hooksMu   sync.Mutex
+	hooks     hooks
+}
+
+// NewAuthHandler creates a new AuthHandler from cfg and starts the background refresher
+func NewAuthHandler(cfg Config) (*AuthHandler, error) {
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
 	handler := &AuthHandler{
-		client:   &http.Client{},
-		ticker:   time.NewTicker(1 * time.Minute), // Check every minute
-		stopChan: make(chan struct{}),
+		cfg:       cfg,
+		clientIDs: cfg.Credentials.ClientIDs,
+		tokens:    make(map[int]*tokenState, len(cfg.Credentials.ClientIDs)),
+		client:    cfg.HTTPClient,
+		ticker:    time.NewTicker(1 * time.Minute), // Check every minute
+		renewSem:  make(chan struct{}, 1),
+	}
+	handler.ctx, handler.stop = context.WithCancel(context.Background())
+
+	if cfg.JWKSURL != "" {
+		handler.jwks = jwks.New(cfg.JWKSURL, cfg.HTTPClient, cfg.JWKSCacheTTL)
+		log.Printf("Verifying access tokens against JWKS at %s", cfg.JWKSURL)
 	}
-	if err := handler.Login(); err != nil {
+
+	// LazyLogin returns immediately and keeps logging in from the background;
+	// until that succeeds GetToken fails fast with ErrNotReady
+	if cfg.LazyLogin {
+		go func() {
+			if err := handler.retryWithBackoff("Login", 0, func() error { return handler.initialLogin(handler.ctx) }); err != nil {
+				log.Printf("Background login abandoned: %v", err)
+				return
+			}
+			handler.ready.Store(true)
+			handler.startRefresher()
+		}()
+		return handler, nil
+	}
+
+	// Retry the initial login with backoff; StartupRetry keeps trying until it succeeds
+	maxAttempts := cfg.RetryMaxAttempts
+	if cfg.StartupRetry {
+		maxAttempts = 0
+	}
+	if err := handler.retryWithBackoff("Login", maxAttempts, func() error { return handler.initialLogin(handler.ctx) }); err != nil {
 		return nil, err
 	}
+	handler.ready.Store(true)
 
 	// Start background token refresh
 	go handler.startRefresher()
 	return handler, nil
 }
 
-// startRefresher runs in the background to refresh the token before expiration
+// Ready reports whether the first login has completed
+func (a *AuthHandler) Ready() bool {
+	return a.ready.Load()
+}
+
+// ClientIDs returns the configured client IDs; the first one is the default
+func (a *AuthHandler) ClientIDs() []int {
+	return slices.Clone(a.clientIDs)
+}
+
+// HasClient reports whether clientID is one of the configured clients
+func (a *AuthHandler) HasClient(clientID int) bool {
+	return slices.Contains(a.clientIDs, clientID)
+}
+
+// startRefresher runs in the background to refresh the tokens before expiration
 func (a *AuthHandler) startRefresher() {
 	for {
 		select {
 		case <-a.ticker.C:
-			var expiryUTC time.Time
-			a.mu.Lock()
-			expiryUTC = a.expiry.UTC()
-			a.mu.Unlock()
-
-			if time.Until(expiryUTC) < 5*time.Minute { // Refresh if token expires within 5 minutes
-				log.Println("Token nearing expiration, refreshing...")
-				if err := a.RefreshToken(); err != nil {
-					log.Printf("Failed to refresh token: %v", err)
-					if loginErr := a.Login(); loginErr != nil {
-						log.Printf("Failed to re-login: %v", loginErr)
+			for _, clientID := range a.clientIDs {
+				if time.Until(a.expiry(clientID)) >= refreshWindow {
+					continue
+				}
+
+				log.Printf("Token for client %d nearing expiration, refreshing...", clientID)
+				refresh := func() error { return a.refreshClient(a.ctx, clientID) }
+				if err := a.retryWithBackoff("Refresh", a.cfg.RetryMaxAttempts, refresh); err != nil {
+					log.Printf("Failed to refresh token for client %d: %v", clientID, err)
+					login := func() error { return a.loginClient(a.ctx, clientID) }
+					if loginErr := a.retryWithBackoff("Login", a.cfg.RetryMaxAttempts, login); loginErr != nil {
+						log.Printf("Failed to re-login client %d: %v", clientID, loginErr)
 					}
 				}
 			}
-		case <-a.stopChan:
+		case <-a.ctx.Done():
 			log.Print("Stopping refresher")
 			return
 		}
 	}
 }
 
-// Login authenticates with the server and retrieves the access and refresh tokens
-func (a *AuthHandler) Login() error {
+// expiry returns the local-clock expiry of clientID's token (zero if none yet)
+func (a *AuthHandler) expiry(clientID int) time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if state, ok := a.tokens[clientID]; ok {
+		return state.expiry
+	}
+	return time.Time{}
+}
+
+// initialLogin resumes from refresh tokens persisted in the token file when
+// possible and falls back to a full login otherwise
+func (a *AuthHandler) initialLogin(ctx context.Context) error {
+	if a.restoreRefreshTokens() {
+		err := a.RefreshToken(ctx)
+		if err == nil {
+			log.Println("Resumed session from persisted refresh tokens")
+			return nil
+		}
+		log.Printf("Persisted refresh tokens unusable (%v), logging in", err)
+	}
+	return a.Login(ctx)
+}
+
+// lockRenew waits for exclusive use of the login/refresh path, giving up when ctx ends
+func (a *AuthHandler) lockRenew(ctx context.Context) error {
+	select {
+	case a.renewSem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *AuthHandler) unlockRenew() {
+	<-a.renewSem
+}
+
+// Login authenticates with the server and retrieves tokens for every configured client
+func (a *AuthHandler) Login(ctx context.Context) error {
+	if err := a.lockRenew(ctx); err != nil {
+		return err
+	}
+	defer a.unlockRenew()
+
+	harvested := map[int]bool{}
+	for _, clientID := range a.clientIDs {
+		if harvested[clientID] {
+			continue // already returned by an earlier login in this round
+		}
+		got, err := a.loginTracked(ctx, clientID)
+		if err != nil {
+			return err
+		}
+		for _, id := range got {
+			harvested[id] = true
+		}
+	}
+	return nil
+}
+
+// loginClient logs in again for a single client
+func (a *AuthHandler) loginClient(ctx context.Context, clientID int) error {
+	if err := a.lockRenew(ctx); err != nil {
+		return err
+	}
+	defer a.unlockRenew()
+
+	_, err := a.loginTracked(ctx, clientID)
+	return err
+}
+
+// loginTracked wraps login with metrics, hooks and persistence; callers hold the renew lock
+func (a *AuthHandler) loginTracked(ctx context.Context, clientID int) ([]int, error) {
+	metrics.AuthLoginAttempts.Inc()
+	var got []int
+	err := a.withSharedCache(ctx, clientID, func() error {
+		var err error
+		got, err = a.login(ctx, clientID)
+		return err
+	})
+	if err != nil {
+		metrics.AuthLoginFailures.Inc()
+		a.fireFailure(clientID, err)
+		return nil, err
+	}
+	if got == nil {
+		got = []int{clientID} // adopted from the shared cache
+	}
+	a.persistRefreshTokens()
+	for _, id := range got {
+		a.fireSuccess(id, false)
+	}
+	return got, nil
+}
+
+// login requests tokens for clientID and stores every configured client found in
+// the response, returning the IDs it stored
+func (a *AuthHandler) login(ctx context.Context, clientID int) ([]int, error) {
 	payload := map[string]string{
-		"email":     authEmail,
-		"password":  authPassword,
-		"client_id": fmt.Sprintf("%d", authClientID),
+		"email":     a.cfg.Credentials.Email,
+		"password":  a.cfg.Credentials.Password,
+		"client_id": fmt.Sprintf("%d", clientID),
 	}
 	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", authLoginEndpoint, bytes.NewBuffer(payloadBytes))
+	req, err := http.NewRequestWithContext(ctx, "POST", a.cfg.LoginEndpoint, bytes.NewBuffer(payloadBytes))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := a.client.Do(req)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("%w: %w", ErrAuthUnreachable, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return errors.New("failed to authenticate: " + resp.Status)
+		return nil, statusError("login", resp, ErrInvalidCredentials)
 	}
 
 	var loginResponse LoginResponse
 	if err := json.NewDecoder(resp.Body).Decode(&loginResponse); err != nil {
-		return err
+		return nil, err
 	}
 
-	var foundClient *ClientToken
+	states := map[int]*tokenState{}
 	for _, client := range loginResponse.Clients {
-		if client.ClientID == authClientID {
-			foundClient = &client
-			break
+		if !a.HasClient(client.ClientID) {
+			continue
+		}
+		expiry, err := a.parseTokenExpiry(client.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		states[client.ClientID] = &tokenState{
+			accessToken:  client.AccessToken,
+			refreshToken: client.RefreshToken,
+			expiry:       expiry,
 		}
 	}
 
-	if foundClient == nil {
-		return errors.New("client_id not found in login response")
+	if _, ok := states[clientID]; !ok {
+		return nil, fmt.Errorf("%w: %d not in login response", ErrClientNotFound, clientID)
 	}
 
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	a.accessToken = foundClient.AccessToken
-	a.refreshToken = foundClient.RefreshToken
-	a.expiry, err = parseTokenExpiry(a.accessToken)
-	if err != nil {
+	got := make([]int, 0, len(states))
+	for id, state := range states {
+		a.tokens[id] = state
+		metrics.AuthSucceeded(id, state.expiry)
+		got = append(got, id)
+	}
+
+	log.Printf("Successfully authenticated client(s) %v", got)
+	return got, nil
+}
+
+// RefreshToken refreshes the access tokens of every configured client
+func (a *AuthHandler) RefreshToken(ctx context.Context) error {
+	for _, clientID := range a.clientIDs {
+		if err := a.refreshClient(ctx, clientID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshClient refreshes a single client's token
+func (a *AuthHandler) refreshClient(ctx context.Context, clientID int) error {
+	if err := a.lockRenew(ctx); err != nil {
 		return err
 	}
+	defer a.unlockRenew()
 
-	log.Println("Successfully authenticated")
+	return a.refreshTracked(ctx, clientID)
+}
+
+// refreshTracked wraps refresh with metrics, hooks and persistence; callers hold the renew lock
+func (a *AuthHandler) refreshTracked(ctx context.Context, clientID int) error {
+	metrics.AuthRefreshAttempts.Inc()
+	if err := a.withSharedCache(ctx, clientID, func() error { return a.refresh(ctx, clientID) }); err != nil {
+		metrics.AuthRefreshFailures.Inc()
+		if errors.Is(err, ErrRefreshRejected) {
+			// Never present a rejected refresh token again; the next renewal must log in
+			a.dropRefreshToken(clientID)
+			log.Printf("Refresh token for client %d rejected (%v); a full login is required", clientID, err)
+		}
+		a.fireFailure(clientID, err)
+		return err
+	}
+	a.persistRefreshTokens()
+	a.fireSuccess(clientID, true)
 	return nil
 }
 
-// RefreshToken refreshes the access token using the refresh token
-func (a *AuthHandler) RefreshToken() error {
+// dropRefreshToken forgets clientID's refresh token while keeping its access token usable
+func (a *AuthHandler) dropRefreshToken(clientID int) {
 	a.mu.Lock()
-	refreshToken := a.refreshToken
+	defer a.mu.Unlock()
+	if state, ok := a.tokens[clientID]; ok {
+		a.tokens[clientID] = &tokenState{accessToken: state.accessToken, expiry: state.expiry}
+	}
+}
+
+func (a *AuthHandler) refresh(ctx context.Context, clientID int) error {
+	var refreshToken string
+	a.mu.Lock()
+	if state, ok := a.tokens[clientID]; ok {
+		refreshToken = state.refreshToken
+	}
 	a.mu.Unlock()
 
 	if refreshToken == "" {
-		return errors.New("no refresh token available")
+		return fmt.Errorf("%w: no refresh token available", ErrRefreshRejected)
 	}
 
 	payload := map[string]string{
@@ -206,7 +399,7 @@ func (a *AuthHandler) RefreshToken() error {
 		return err
 	}
 
-	req, err := http.NewRequest("POST", authRefreshEndpoint, bytes.NewBuffer(payloadBytes))
+	req, err := http.NewRequestWithContext(ctx, "POST", a.cfg.RefreshEndpoint, bytes.NewBuffer(payloadBytes))
 	if err != nil {
 		return err
 	}
@@ -214,12 +407,12 @@ func (a *AuthHandler) RefreshToken() error {
 
 	resp, err := a.client.Do(req)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", ErrAuthUnreachable, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return errors.New("failed to refresh token: " + resp.Status)
+		return refreshError(resp)
 	}
 
 	var tokenResponse TokenResponse
@@ -227,65 +420,151 @@ func (a *AuthHandler) RefreshToken() error {
 		return err
 	}
 
-	if tokenResponse.ClientID != authClientID {
-		return errors.New("client_id mismatch in refresh response")
+	if tokenResponse.ClientID != clientID {
+		return fmt.Errorf("%w: client_id mismatch in refresh response", ErrRefreshRejected)
+	}
+	if tokenResponse.RefreshToken == "" {
+		// Backends that don't rotate may omit the refresh token; keep using the current one
+		tokenResponse.RefreshToken = refreshToken
+	}
+
+	expiry, err := a.parseTokenExpiry(tokenResponse.AccessToken)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.tokens[clientID] = &tokenState{
+		accessToken:  tokenResponse.AccessToken,
+		refreshToken: tokenResponse.RefreshToken,
+		expiry:       expiry,
 	}
+	metrics.AuthSucceeded(clientID, expiry)
 
+	log.Printf("Successfully refreshed access token for client %d", clientID)
+	return nil
+}
+
+// GetToken returns a valid access token for the default client, ensuring it is refreshed if necessary.
+// Any refresh or login this triggers is bounded by ctx.
+func (a *AuthHandler) GetToken(ctx context.Context) (string, error) {
+	return a.GetTokenFor(ctx, a.clientIDs[0])
+}
+
+// GetTokenFor returns a valid access token for clientID, ensuring it is refreshed if necessary.
+// Any refresh or login this triggers is bounded by ctx.
+func (a *AuthHandler) GetTokenFor(ctx context.Context, clientID int) (string, error) {
+	if !a.HasClient(clientID) {
+		return "", fmt.Errorf("%w: %d is not configured", ErrClientNotFound, clientID)
+	}
+	if a.loggedOut.Load() {
+		return "", ErrLoggedOut
+	}
+	if !a.Ready() {
+		return "", ErrNotReady
+	}
+
+	if time.Now().UTC().After(a.expiry(clientID)) {
+		if err := a.renewExpired(ctx, clientID); err != nil {
+			return "", err
+		}
+	}
+	return a.accessToken(clientID)
+}
+
+// accessToken returns clientID's current access token; its state is only missing once
+// Logout dropped it
+func (a *AuthHandler) accessToken(clientID int) (string, error) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
+	state, ok := a.tokens[clientID]
+	if !ok || a.loggedOut.Load() {
+		return "", ErrLoggedOut
+	}
+	return state.accessToken, nil
+}
 
-	a.accessToken = tokenResponse.AccessToken
-	a.refreshToken = tokenResponse.RefreshToken
-	a.expiry, err = parseTokenExpiry(a.accessToken)
-	if err != nil {
+// renewExpired refreshes (or failing that, re-logs in) an expired token. Concurrent
+// callers queue on the renew lock and find the token already renewed by the first one.
+func (a *AuthHandler) renewExpired(ctx context.Context, clientID int) error {
+	if err := a.lockRenew(ctx); err != nil {
 		return err
 	}
+	defer a.unlockRenew()
 
-	log.Println("Successfully refreshed access token")
+	if !time.Now().UTC().After(a.expiry(clientID)) {
+		return nil
+	}
+
+	log.Printf("Access token for client %d expired, refreshing...", clientID)
+	if err := a.refreshTracked(ctx, clientID); err != nil {
+		log.Println("Failed to refresh token, logging in again...")
+		if _, err := a.loginTracked(ctx, clientID); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// GetToken returns a valid access token, ensuring it is refreshed if necessary
-func (a *AuthHandler) GetToken() (string, error) {
-	var expiryUTC time.Time
+// RenewToken forces a refresh (or re-login) of clientID's token after a server
+// rejected the token `rejected`, e.g. because it was revoked before expiry. If a
+// concurrent caller already replaced that token, the replacement is returned as is.
+func (a *AuthHandler) RenewToken(ctx context.Context, clientID int, rejected string) (string, error) {
+	if !a.HasClient(clientID) {
+		return "", fmt.Errorf("%w: %d is not configured", ErrClientNotFound, clientID)
+	}
+	if a.loggedOut.Load() {
+		return "", ErrLoggedOut
+	}
+	if err := a.lockRenew(ctx); err != nil {
+		return "", err
+	}
+	defer a.unlockRenew()
+
 	a.mu.Lock()
-	expiryUTC = a.expiry.UTC()
+	current := a.tokens[clientID]
 	a.mu.Unlock()
 
-	if time.Now().UTC().After(expiryUTC) {
-		log.Println("Access token expired, refreshing...")
-		if err := a.RefreshToken(); err != nil {
-			log.Println("Failed to refresh token, logging in again...")
-			if err := a.Login(); err != nil {
+	if current == nil || current.accessToken == rejected {
+		log.Printf("Access token for client %d rejected upstream, renewing...", clientID)
+		if err := a.refreshTracked(ctx, clientID); err != nil {
+			if _, err := a.loginTracked(ctx, clientID); err != nil {
 				return "", err
 			}
 		}
 	}
 
-	a.mu.Lock()
-	token := a.accessToken
-	a.mu.Unlock()
-	return token, nil
+	return a.accessToken(clientID)
 }
 
 // StopRefresher stops the background refresher when the application is shutting down
+// and aborts any background login or refresh in flight
 func (a *AuthHandler) StopRefresher() {
-	close(a.stopChan)
+	a.stop()
 	a.ticker.Stop()
 }
 
-// parseTokenExpiry decodes the JWT token and extracts the "exp" claim
-func parseTokenExpiry(tokenString string) (time.Time, error) {
-	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
-	if err != nil {
-		return time.Time{}, err
-	}
+// parseTokenExpiry decodes the JWT token and derives its expiry on the local clock,
+// verifying the signature first when a JWKS URL is configured
+func (a *AuthHandler) parseTokenExpiry(tokenString string) (time.Time, error) {
+	receivedAt := time.Now()
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok {
-		if exp, ok := claims["exp"].(float64); ok {
-			return time.Unix(int64(exp), 0).UTC(), nil
+	var claims jwt.MapClaims
+	if a.jwks != nil {
+		verified, err := a.verifyToken(tokenString)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("token verification failed: %w", err)
+		}
+		claims = verified
+	} else {
+		token, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
+		if err != nil {
+			return time.Time{}, err
 		}
+		claims, _ = token.Claims.(jwt.MapClaims)
 	}
 
-	return time.Time{}, errors.New("expiration claim 'exp' not found")
+	return a.localExpiry(claims, receivedAt)
 }
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// localExpiry converts the token's exp claim into local-clock time.
+// When iat is present the token lifetime (exp-iat) is measured from receivedAt,
+// so a drifting local clock neither expires tokens early nor keeps them past exp.
+// The skew allowance is subtracted so tokens are replaced slightly before the
+// server considers them expired.
+func (a *AuthHandler) localExpiry(claims jwt.MapClaims, receivedAt time.Time) (time.Time, error) {
+	exp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return time.Time{}, errors.New("expiration claim 'exp' not found")
+	}
+
+	nbf, hasNbf := numericClaim(claims, "nbf")
+	if hasNbf && nbf.After(exp) {
+		return time.Time{}, errors.New("token 'nbf' is after 'exp'")
+	}
+
+	iat, hasIat := numericClaim(claims, "iat")
+	if !hasIat {
+		// Without iat there is nothing to correct against; fall back to exp on the local clock
+		if receivedAt.After(exp.Add(a.cfg.ClockSkew)) {
+			return time.Time{}, errors.New("token is already expired")
+		}
+		return exp.Add(-a.cfg.ClockSkew).UTC(), nil
+	}
+
+	if iat.After(exp) {
+		return time.Time{}, errors.New("token 'iat' is after 'exp'")
+	}
+	if hasNbf && nbf.After(iat.Add(a.cfg.ClockSkew)) {
+		return time.Time{}, errors.New("token 'nbf' is too far after 'iat'")
+	}
+
+	drift := iat.Sub(receivedAt)
+	a.offset.Store(int64(drift))
+	a.hasOffset.Store(true)
+	if drift > a.cfg.ClockDriftWarn || drift < -a.cfg.ClockDriftWarn {
+		log.Printf("WARNING: local clock differs from token issuer by %s; check NTP on this host", drift.Round(time.Second))
+	}
+
+	return receivedAt.Add(exp.Sub(iat) - a.cfg.ClockSkew).UTC(), nil
+}
+
+// numericClaim reads a NumericDate claim such as exp, nbf or iat
+func numericClaim(claims jwt.MapClaims, name string) (time.Time, bool) {
+	v, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(v), 0).UTC(), true
+}
+
+// ClockOffset estimates how far the token issuer's clock is ahead of the local clock
+// (negative when behind), from the iat of the most recent token. The estimate carries
+// iat's one-second resolution plus request latency; ok is false before any token with iat.
+func (a *AuthHandler) ClockOffset() (offset time.Duration, ok bool) {
+	return time.Duration(a.offset.Load()), a.hasOffset.Load()
+}
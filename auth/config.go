@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds everything an AuthHandler needs. Build it directly when embedding
+// the package, or with ConfigFromEnv from the AUTH_* environment variables.
+type Config struct {
+	// Credentials used to log in
+	Credentials Credentials
+
+	// Auth API endpoints; LogoutEndpoint is optional
+	LoginEndpoint   string
+	RefreshEndpoint string
+	LogoutEndpoint  string
+
+	// HTTPClient performs the auth calls; nil uses a client with a 10s timeout
+	HTTPClient *http.Client
+
+	// Retry behaviour for login and refresh
+	RetryMaxAttempts int           // attempts per renewal (default 5)
+	RetryBaseDelay   time.Duration // first backoff delay, doubled per attempt (default 1s)
+	RetryMaxDelay    time.Duration // backoff ceiling (default 30s)
+	StartupRetry     bool          // retry the initial login until it succeeds
+	LazyLogin        bool          // return from NewAuthHandler before the first login
+
+	// Optional signature verification; issuer and audience checks require JWKSURL
+	JWKSURL      string
+	JWKSCacheTTL time.Duration // default 1h
+	JWTIssuer    string
+	JWTAudience  string
+
+	// Clock tolerance for token timestamps
+	ClockSkew      time.Duration // margin subtracted from token expiry; zero disables it
+	ClockDriftWarn time.Duration // warn when issuer and local clock differ by more (default 2m)
+
+	// Optional persistence
+	TokenFile       string // latest refresh tokens, for resuming after restarts
+	SharedCacheFile string // tokens shared by replicas, renewals coordinated by a file lock
+}
+
+const (
+	defaultLoginEndpoint   = "https://api.systemiq.ai/auth/login"
+	defaultRefreshEndpoint = "https://api.systemiq.ai/auth/refresh-token"
+)
+
+// withDefaults fills zero values with defaults and validates the result
+func (c Config) withDefaults() (Config, error) {
+	creds := c.Credentials
+	if creds.Email == "" || creds.Password == "" || len(creds.ClientIDs) == 0 {
+		return c, errors.New("auth: credentials need an email, password and at least one client ID")
+	}
+	c.Credentials.ClientIDs = slices.Clone(creds.ClientIDs)
+
+	if c.LoginEndpoint == "" {
+		c.LoginEndpoint = defaultLoginEndpoint
+	}
+	if c.RefreshEndpoint == "" {
+		c.RefreshEndpoint = defaultRefreshEndpoint
+	}
+	if c.HTTPClient == nil {
+		c.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	if c.RetryMaxAttempts == 0 {
+		c.RetryMaxAttempts = 5
+	}
+	if c.RetryBaseDelay == 0 {
+		c.RetryBaseDelay = 1 * time.Second
+	}
+	if c.RetryMaxDelay == 0 {
+		c.RetryMaxDelay = 30 * time.Second
+	}
+	if c.RetryMaxAttempts < 0 || c.RetryBaseDelay < 0 || c.RetryMaxDelay < c.RetryBaseDelay {
+		return c, errors.New("auth: retry settings need positive attempts and a max delay no smaller than the base delay")
+	}
+
+	if c.JWKSURL == "" && (c.JWTIssuer != "" || c.JWTAudience != "") {
+		return c, errors.New("auth: JWT issuer/audience checks require a JWKS URL")
+	}
+	if c.JWKSCacheTTL == 0 {
+		c.JWKSCacheTTL = 1 * time.Hour
+	}
+
+	if c.ClockSkew < 0 {
+		return c, errors.New("auth: clock skew must not be negative")
+	}
+	if c.ClockDriftWarn == 0 {
+		c.ClockDriftWarn = 2 * time.Minute
+	}
+	return c, nil
+}
+
+// ConfigFromEnv reads the AUTH_* environment variables (see README) into a Config
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		Credentials: Credentials{
+			Email:    os.Getenv("AUTH_EMAIL"),
+			Password: os.Getenv("AUTH_PASSWORD"),
+		},
+		LoginEndpoint:   os.Getenv("AUTH_LOGIN_ENDPOINT"),
+		RefreshEndpoint: os.Getenv("AUTH_REFRESH_ENDPOINT"),
+		LogoutEndpoint:  os.Getenv("AUTH_LOGOUT_ENDPOINT"),
+		StartupRetry:    envBool("AUTH_STARTUP_RETRY"),
+		LazyLogin:       envBool("AUTH_LAZY_LOGIN"),
+		JWKSURL:         os.Getenv("AUTH_JWKS_URL"),
+		JWTIssuer:       os.Getenv("AUTH_JWT_ISSUER"),
+		JWTAudience:     os.Getenv("AUTH_JWT_AUDIENCE"),
+		TokenFile:       os.Getenv("AUTH_TOKEN_FILE"),
+		SharedCacheFile: os.Getenv("AUTH_SHARED_CACHE_FILE"),
+	}
+
+	clientIDStr := os.Getenv("AUTH_CLIENT_ID")
+	if clientIDStr == "" {
+		return cfg, errors.New("AUTH_CLIENT_ID is not set")
+	}
+
+	// A comma-separated list configures several clients under the same credentials
+	for _, field := range strings.Split(clientIDStr, ",") {
+		clientID, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || clientID == 0 {
+			return cfg, errors.New("AUTH_CLIENT_ID must be a valid integer or comma-separated list of integers")
+		}
+		if !slices.Contains(cfg.Credentials.ClientIDs, clientID) {
+			cfg.Credentials.ClientIDs = append(cfg.Credentials.ClientIDs, clientID)
+		}
+	}
+
+	if cfg.Credentials.Email == "" || cfg.Credentials.Password == "" {
+		return cfg, errors.New("AUTH_EMAIL and AUTH_PASSWORD must be set")
+	}
+
+	var err error
+	if v := os.Getenv("AUTH_RETRY_MAX_ATTEMPTS"); v != "" {
+		if cfg.RetryMaxAttempts, err = strconv.Atoi(v); err != nil || cfg.RetryMaxAttempts < 1 {
+			return cfg, errors.New("AUTH_RETRY_MAX_ATTEMPTS must be a positive integer")
+		}
+	}
+
+	durations := []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"AUTH_RETRY_BASE_DELAY", &cfg.RetryBaseDelay},
+		{"AUTH_RETRY_MAX_DELAY", &cfg.RetryMaxDelay},
+		{"AUTH_JWKS_CACHE_TTL", &cfg.JWKSCacheTTL},
+		{"AUTH_CLOCK_DRIFT_WARN", &cfg.ClockDriftWarn},
+	}
+	for _, d := range durations {
+		if *d.dst, err = envDuration(d.name); err != nil {
+			return cfg, err
+		}
+	}
+
+	cfg.ClockSkew = 30 * time.Second
+	if v := os.Getenv("AUTH_CLOCK_SKEW"); v != "" {
+		if cfg.ClockSkew, err = time.ParseDuration(v); err != nil || cfg.ClockSkew < 0 {
+			return cfg, errors.New("AUTH_CLOCK_SKEW must be a non-negative duration (e.g. 30s)")
+		}
+	}
+
+	if cfg.HTTPClient, err = newHTTPClientFromEnv(); err != nil {
+		return cfg, fmt.Errorf("auth HTTP client: %w", err)
+	}
+
+	return cfg.withDefaults()
+}
+
+// envDuration parses an optional positive duration; unset yields zero (the default)
+func envDuration(name string) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration (e.g. 30s)", name)
+	}
+	return d, nil
+}
+
+// envBool reports whether name is set to "true" or "1"
+func envBool(name string) bool {
+	v := os.Getenv(name)
+	return strings.ToLower(v) == "true" || v == "1"
+}
@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// LoadCredentialSets reads named credential sets from a JSON file of the form
+//
+//	{"tenant-a": {"email": "...", "password": "...", "client_ids": [3]}, ...}
+func LoadCredentialSets(path string) (map[string]Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var sets map[string]Credentials
+	if err := json.Unmarshal(data, &sets); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	for name, creds := range sets {
+		if name == "" {
+			return nil, fmt.Errorf("%s: credential set names must not be empty", path)
+		}
+		if creds.Email == "" || creds.Password == "" || len(creds.ClientIDs) == 0 {
+			return nil, fmt.Errorf("%s: credential set %q needs email, password and client_ids", path, name)
+		}
+	}
+	return sets, nil
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Sentinel errors returned (wrapped) by Login, RefreshToken and GetToken.
+// Match them with errors.Is.
+var (
+	// ErrInvalidCredentials means the auth API rejected AUTH_EMAIL/AUTH_PASSWORD
+	ErrInvalidCredentials = errors.New("auth: invalid credentials")
+	// ErrClientNotFound means the credentials are valid but not for AUTH_CLIENT_ID
+	ErrClientNotFound = errors.New("auth: client_id not found")
+	// ErrRefreshRejected means the refresh token was refused and a full login is needed
+	ErrRefreshRejected = errors.New("auth: refresh token rejected")
+	// ErrAuthUnreachable means the auth API could not be reached or failed server-side
+	ErrAuthUnreachable = errors.New("auth: endpoint unreachable")
+	// ErrRefreshReused means the auth API detected reuse of a rotated refresh token
+	// (e.g. another process refreshed with it first); it also matches ErrRefreshRejected
+	ErrRefreshReused = fmt.Errorf("%w: reuse of a rotated refresh token detected", ErrRefreshRejected)
+	// ErrNotReady means a lazy-login handler has not completed its first login yet
+	ErrNotReady = errors.New("auth: initial login still in progress")
+	// ErrLoggedOut means Logout was called; the handler hands out no more tokens
+	ErrLoggedOut = errors.New("auth: logged out")
+)
+
+// statusError maps a non-200 auth response to a sentinel error; rejected is
+// returned for 4xx statuses that mean the submitted credentials were refused
+func statusError(op string, resp *http.Response, rejected error) error {
+	switch {
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %s: %s", ErrAuthUnreachable, op, resp.Status)
+	case resp.StatusCode == http.StatusBadRequest,
+		resp.StatusCode == http.StatusUnauthorized,
+		resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%w: %s: %s", rejected, op, resp.Status)
+	}
+	return fmt.Errorf("auth: %s: unexpected response %s", op, resp.Status)
+}
+
+// reuseMarkers are error codes auth backends use when a rotated refresh token is replayed
+var reuseMarkers = []string{"reuse", "reused", "invalid_grant", "revoked"}
+
+// refreshError maps a non-200 refresh response, telling reuse detection apart
+// from other rejections by inspecting the (bounded) response body
+func refreshError(resp *http.Response) error {
+	err := statusError("refresh", resp, ErrRefreshRejected)
+	if !errors.Is(err, ErrRefreshRejected) {
+		return err
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	lower := strings.ToLower(string(body))
+	for _, marker := range reuseMarkers {
+		if strings.Contains(lower, marker) {
+			return fmt.Errorf("%w: %s: %s", ErrRefreshReused, resp.Status, strings.TrimSpace(string(body)))
+		}
+	}
+	return err
+}
+
+// isPermanent reports whether retrying err with the same credentials (or the
+// same refresh token) is pointless
+func isPermanent(err error) bool {
+	return errors.Is(err, ErrInvalidCredentials) ||
+		errors.Is(err, ErrClientNotFound) ||
+		errors.Is(err, ErrRefreshRejected)
+}
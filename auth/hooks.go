@@ -0,0 +1,60 @@
+package auth
+
+import "time"
+
+// hooks holds the callbacks registered on an AuthHandler
+type hooks struct {
+	onLogin   []func(clientID int, expiry time.Time)
+	onRefresh []func(clientID int, expiry time.Time)
+	onFailure []func(clientID int, err error)
+}
+
+// OnLogin registers fn to run after every successful login with the client and its new token's expiry.
+// Callbacks run synchronously on the authenticating goroutine and must not block.
+func (a *AuthHandler) OnLogin(fn func(clientID int, expiry time.Time)) {
+	a.hooksMu.Lock()
+	defer a.hooksMu.Unlock()
+	a.hooks.onLogin = append(a.hooks.onLogin, fn)
+}
+
+// OnRefresh registers fn to run after every successful token refresh with the client and new expiry
+func (a *AuthHandler) OnRefresh(fn func(clientID int, expiry time.Time)) {
+	a.hooksMu.Lock()
+	defer a.hooksMu.Unlock()
+	a.hooks.onRefresh = append(a.hooks.onRefresh, fn)
+}
+
+// OnAuthFailure registers fn to run whenever a login or refresh attempt for a client fails.
+// Use errors.Is with the package's sentinel errors to tell failures apart.
+func (a *AuthHandler) OnAuthFailure(fn func(clientID int, err error)) {
+	a.hooksMu.Lock()
+	defer a.hooksMu.Unlock()
+	a.hooks.onFailure = append(a.hooks.onFailure, fn)
+}
+
+// fireSuccess runs the login or refresh hooks with the client's current token expiry
+func (a *AuthHandler) fireSuccess(clientID int, refreshed bool) {
+	expiry := a.expiry(clientID)
+
+	a.hooksMu.Lock()
+	fns := a.hooks.onLogin
+	if refreshed {
+		fns = a.hooks.onRefresh
+	}
+	a.hooksMu.Unlock()
+
+	for _, fn := range fns {
+		fn(clientID, expiry)
+	}
+}
+
+// fireFailure runs the failure hooks with err
+func (a *AuthHandler) fireFailure(clientID int, err error) {
+	a.hooksMu.Lock()
+	fns := a.hooks.onFailure
+	a.hooksMu.Unlock()
+
+	for _, fn := range fns {
+		fn(clientID, err)
+	}
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// newHTTPClientFromEnv configures timeout, proxy and TLS settings for the auth endpoints
+// from the AUTH_HTTP_* and AUTH_TLS_* environment variables
+func newHTTPClientFromEnv() (*http.Client, error) {
+	timeout := 10 * time.Second
+	if v := os.Getenv("AUTH_HTTP_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, errors.New("AUTH_HTTP_TIMEOUT must be a positive duration (e.g. 10s)")
+		}
+		timeout = d
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	// An explicit proxy overrides HTTP(S)_PROXY from the environment
+	if v := os.Getenv("AUTH_HTTP_PROXY"); v != "" {
+		proxyURL, err := url.Parse(v)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("AUTH_HTTP_PROXY is not a valid URL: %q", v)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig, err := newTLSConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Timeout: timeout, Transport: transport}, nil
+}
+
+// newTLSConfigFromEnv applies custom CA, client certificate and verification settings
+func newTLSConfigFromEnv() (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: os.Getenv("AUTH_TLS_SERVER_NAME"),
+	}
+
+	if caFile := os.Getenv("AUTH_TLS_CA_FILE"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read AUTH_TLS_CA_FILE: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("AUTH_TLS_CA_FILE contains no PEM certificates")
+		}
+		cfg.RootCAs = pool
+	}
+
+	certFile, keyFile := os.Getenv("AUTH_TLS_CERT_FILE"), os.Getenv("AUTH_TLS_KEY_FILE")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load auth client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if v := os.Getenv("AUTH_TLS_INSECURE_SKIP_VERIFY"); strings.ToLower(v) == "true" || v == "1" {
+		log.Println("WARNING: TLS verification for auth endpoints is disabled")
+		cfg.InsecureSkipVerify = true
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Logout revokes every client's tokens at the logout endpoint (a no-op when unset or
+// when the tokens are shared with other replicas) and forgets them locally; GetToken
+// and RenewToken fail with ErrLoggedOut from then on. Call it after StopRefresher during graceful shutdown,
+// with a ctx that bounds how long shutdown may wait for the auth API.
+func (a *AuthHandler) Logout(ctx context.Context) error {
+	a.mu.Lock()
+	a.loggedOut.Store(true)
+	tokens := a.tokens
+	a.tokens = make(map[int]*tokenState)
+	a.mu.Unlock()
+
+	if a.cfg.LogoutEndpoint == "" {
+		return nil
+	}
+	if a.cfg.SharedCacheFile != "" {
+		// Other replicas adopted these tokens from the shared cache and still use them
+		log.Printf("Not revoking tokens shared through %s", a.cfg.SharedCacheFile)
+		return nil
+	}
+
+	var firstErr error
+	for clientID, state := range tokens {
+		if err := a.revoke(ctx, state); err != nil {
+			log.Printf("Failed to revoke tokens for client %d: %v", clientID, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		log.Printf("Revoked tokens for client %d", clientID)
+	}
+	return firstErr
+}
+
+// revoke posts the refresh token to the logout endpoint, authenticated with the access token
+func (a *AuthHandler) revoke(ctx context.Context, state *tokenState) error {
+	payloadBytes, err := json.Marshal(map[string]string{
+		"refresh_token": state.refreshToken,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", a.cfg.LogoutEndpoint, bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+state.accessToken)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrAuthUnreachable, err)
+	}
+	defer resp.Body.Close()
+
+	// Already-invalid tokens are as good as revoked
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("auth: logout: unexpected response %s", resp.Status)
+	}
+	return nil
+}
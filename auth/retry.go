@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const retryJitter = 0.2 // ±20% randomisation of each delay
+
+// backoffDelay returns the jittered delay to wait before retry number attempt (0-based)
+func (a *AuthHandler) backoffDelay(attempt int) time.Duration {
+	return Backoff(a.cfg.RetryBaseDelay, a.cfg.RetryMaxDelay, attempt)
+}
+
+// Backoff returns the delay before retry number attempt (0-based): base doubled per
+// attempt up to max, randomised by ±20% so retrying clients do not move in lockstep
+func Backoff(base, max time.Duration, attempt int) time.Duration {
+	delay := float64(base) * math.Pow(2, float64(attempt))
+	if delay > float64(max) {
+		delay = float64(max)
+	}
+	delay *= 1 + retryJitter*(2*rand.Float64()-1)
+	return time.Duration(delay)
+}
+
+// retryWithBackoff runs op until it succeeds, fails permanently, maxAttempts is
+// reached (0 means unlimited) or the handler is stopped, sleeping with exponential
+// backoff in between
+func (a *AuthHandler) retryWithBackoff(name string, maxAttempts int, op func() error) error {
+	var err error
+	for attempt := 0; maxAttempts == 0 || attempt < maxAttempts; attempt++ {
+		if err = op(); err == nil {
+			return nil
+		}
+		if isPermanent(err) || (maxAttempts != 0 && attempt == maxAttempts-1) {
+			break
+		}
+
+		delay := a.backoffDelay(attempt)
+		log.Printf("%s attempt %d failed: %v (retrying in %s)", name, attempt+1, err, delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-a.ctx.Done():
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"systemiq.ai/filelock"
+)
+
+// The shared cache file lets replicas sharing a client ID share one set of tokens.
+// Whoever holds the lock renews and publishes; the others adopt the result instead
+// of refreshing themselves and invalidating each other's rotated refresh tokens.
+
+// sharedCacheLockWait bounds how long a renewal waits for a peer holding the cache
+// lock before renewing locally, so a stuck peer or a hung network lock cannot stall calls
+const sharedCacheLockWait = 2 * time.Second
+
+// sharedToken is a cache entry as stored in the shared cache file
+type sharedToken struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// withSharedCache runs renew for clientID while holding the cache lock, unless a
+// fresh enough token published by another replica can be adopted instead
+func (a *AuthHandler) withSharedCache(ctx context.Context, clientID int, renew func() error) error {
+	path := a.cfg.SharedCacheFile
+	if path == "" {
+		return renew()
+	}
+
+	lockCtx, cancel := context.WithTimeout(ctx, sharedCacheLockWait)
+	defer cancel()
+	lock, err := filelock.AcquireContext(lockCtx, path+".lock", 50*time.Millisecond)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("Shared token cache unavailable, renewing locally: %v", err)
+		return renew()
+	}
+	defer lock.Release()
+
+	cache, err := readSharedCache(path)
+	if err != nil {
+		log.Printf("Ignoring unreadable shared token cache: %v", err)
+		cache = map[string]sharedToken{}
+	}
+
+	if a.adoptShared(clientID, cache[a.tokenFileKey(clientID)]) {
+		return nil
+	}
+
+	if err := renew(); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	for id, state := range a.tokens {
+		cache[a.tokenFileKey(id)] = sharedToken{AccessToken: state.accessToken, RefreshToken: state.refreshToken}
+	}
+	a.mu.Unlock()
+
+	if err := writeFileAtomic(path, cache); err != nil {
+		log.Printf("Failed to publish tokens to shared cache: %v", err)
+	}
+	return nil
+}
+
+// adoptShared takes over a cached token that another replica renewed. It returns
+// true when that token is good beyond the refresh window; otherwise it still adopts
+// the cached refresh token, which is the latest one in the rotation.
+func (a *AuthHandler) adoptShared(clientID int, cached sharedToken) bool {
+	if cached.AccessToken == "" {
+		return false
+	}
+
+	a.mu.Lock()
+	current, ok := a.tokens[clientID]
+	a.mu.Unlock()
+	if ok && current.accessToken == cached.AccessToken {
+		return false // our own token; nothing newer to adopt
+	}
+
+	expiry, err := a.parseTokenExpiry(cached.AccessToken)
+	if err != nil {
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if time.Until(expiry) < refreshWindow {
+		if cached.RefreshToken != "" {
+			state := tokenState{refreshToken: cached.RefreshToken}
+			if current != nil {
+				state.accessToken, state.expiry = current.accessToken, current.expiry
+			}
+			a.tokens[clientID] = &state
+		}
+		return false
+	}
+
+	a.tokens[clientID] = &tokenState{
+		accessToken:  cached.AccessToken,
+		refreshToken: cached.RefreshToken,
+		expiry:       expiry,
+	}
+	log.Printf("Adopted token for client %d from shared cache", clientID)
+	return true
+}
+
+// readSharedCache loads the shared cache; a missing file is empty
+func readSharedCache(path string) (map[string]sharedToken, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return map[string]sharedToken{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cache := map[string]sharedToken{}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// tokenFileMu serialises read-modify-write cycles from handlers sharing the file
+var tokenFileMu sync.Mutex
+
+// tokenFileKey identifies a client's refresh token across credential sets
+func (a *AuthHandler) tokenFileKey(clientID int) string {
+	return fmt.Sprintf("%s/%d", a.cfg.Credentials.Email, clientID)
+}
+
+// restoreRefreshTokens seeds the handler with persisted refresh tokens and reports
+// whether every configured client had one
+func (a *AuthHandler) restoreRefreshTokens() bool {
+	if a.cfg.TokenFile == "" {
+		return false
+	}
+
+	tokenFileMu.Lock()
+	stored, err := readTokenFile(a.cfg.TokenFile)
+	tokenFileMu.Unlock()
+	if err != nil {
+		log.Printf("Ignoring token file %s: %v", a.cfg.TokenFile, err)
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, clientID := range a.clientIDs {
+		refreshToken, ok := stored[a.tokenFileKey(clientID)]
+		if !ok || refreshToken == "" {
+			return false
+		}
+		a.tokens[clientID] = &tokenState{refreshToken: refreshToken}
+	}
+	return true
+}
+
+// persistRefreshTokens atomically writes the handler's current refresh tokens to
+// the token file, so a restart resumes with the latest rotated token
+func (a *AuthHandler) persistRefreshTokens() {
+	if a.cfg.TokenFile == "" {
+		return
+	}
+
+	tokenFileMu.Lock()
+	defer tokenFileMu.Unlock()
+
+	stored, err := readTokenFile(a.cfg.TokenFile)
+	if err != nil {
+		stored = map[string]string{}
+	}
+
+	a.mu.Lock()
+	for clientID, state := range a.tokens {
+		stored[a.tokenFileKey(clientID)] = state.refreshToken
+	}
+	a.mu.Unlock()
+
+	if err := writeFileAtomic(a.cfg.TokenFile, stored); err != nil {
+		log.Printf("Failed to persist refresh tokens: %v", err)
+	}
+}
+
+// readTokenFile loads the persisted refresh tokens; a missing file is empty
+func readTokenFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stored := map[string]string{}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// writeFileAtomic writes v as JSON via a temp file and rename, so readers and
+// crashes never observe a partially written file
+func writeFileAtomic(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
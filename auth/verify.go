@@ -0,0 +1,26 @@
+package auth
+
+import (
+	"errors"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// verifyToken checks the signature, issuer and audience of tokenString against the JWKS
+func (a *AuthHandler) verifyToken(tokenString string) (jwt.MapClaims, error) {
+	// Time-based claims are checked by localExpiry with the configured skew allowance
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+
+	claims := jwt.MapClaims{}
+	if _, err := parser.ParseWithClaims(tokenString, claims, a.jwks.Keyfunc); err != nil {
+		return nil, err
+	}
+
+	if a.cfg.JWTIssuer != "" && !claims.VerifyIssuer(a.cfg.JWTIssuer, true) {
+		return nil, errors.New("token issuer mismatch")
+	}
+	if a.cfg.JWTAudience != "" && !claims.VerifyAudience(a.cfg.JWTAudience, true) {
+		return nil, errors.New("token audience mismatch")
+	}
+	return claims, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+	"systemiq.ai/metrics"
+)
+
+// bandwidthLimiter shapes forwarded bytes/second globally and per caller: calls wait for
+// enough budget (up to the method deadline) rather than failing straight away
+type bandwidthLimiter struct {
+	global    *rate.Limiter
+	perCaller *callerBuckets
+	keyBy     string
+	methods   methodConfig
+}
+
+// bandwidthLimiterFromEnv reads BANDWIDTH_LIMIT_BPS and BANDWIDTH_LIMIT_PER_CALLER_BPS;
+// nil when neither is set. Buckets hold one second's worth of bytes.
+func bandwidthLimiterFromEnv(methods methodConfig) (*bandwidthLimiter, error) {
+	global, err := envInt("BANDWIDTH_LIMIT_BPS", 0)
+	if err != nil {
+		return nil, err
+	}
+	perCaller, err := envInt("BANDWIDTH_LIMIT_PER_CALLER_BPS", 0)
+	if err != nil {
+		return nil, err
+	}
+	if global == 0 && perCaller == 0 {
+		return nil, nil
+	}
+
+	l := &bandwidthLimiter{methods: methods}
+	if global > 0 {
+		l.global = rate.NewLimiter(rate.Limit(global), global)
+		log.Printf("Limiting forwarded bytes to %d B/s overall", global)
+	}
+	if perCaller > 0 {
+		if l.keyBy, err = callerKeyFromEnv(); err != nil {
+			return nil, err
+		}
+		l.perCaller = newCallerBuckets(rate.Limit(perCaller), perCaller)
+		log.Printf("Limiting forwarded bytes to %d B/s per caller (keyed by %s)", perCaller, l.keyBy)
+	}
+	return l, nil
+}
+
+// requestSize is the encoded size of a decoded or raw request
+func requestSize(req any) int {
+	switch m := req.(type) {
+	case *rawMessage:
+		return len(m.buf)
+	case proto.Message:
+		return proto.Size(m)
+	}
+	return 0
+}
+
+// bytesDelay is how long lim takes to admit n bytes from empty, the retry hint for a
+// call that could not be admitted
+func bytesDelay(lim rate.Limit, n int) time.Duration {
+	return time.Duration(float64(n) / float64(lim) * float64(time.Second))
+}
+
+// waitBytes takes n bytes from lim, in burst-sized chunks so messages larger than
+// one second's budget are delayed proportionally instead of rejected
+func waitBytes(ctx context.Context, lim *rate.Limiter, n int) error {
+	for n > 0 {
+		chunk := min(n, lim.Burst())
+		if err := lim.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// unaryInterceptor waits until the caller and global budgets cover the request; a call
+// that cannot be admitted within its method deadline gets RESOURCE_EXHAUSTED
+func (l *bandwidthLimiter) unaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		n := requestSize(req)
+		waitCtx, cancel := context.WithTimeout(ctx, l.methods.lookup(info.FullMethod).Timeout)
+		defer cancel()
+
+		if l.perCaller != nil {
+			if err := waitBytes(waitCtx, l.perCaller.get(callerKey(ctx, l.keyBy)), n); err != nil {
+				metrics.BandwidthLimited.Inc()
+				return nil, detailedError(codes.ResourceExhausted, reasonBandwidth, bytesDelay(l.perCaller.limit, n), fmt.Sprintf("per-caller bandwidth limit: %v", err))
+			}
+		}
+		if l.global != nil {
+			if err := waitBytes(waitCtx, l.global, n); err != nil {
+				metrics.BandwidthLimited.Inc()
+				return nil, detailedError(codes.ResourceExhausted, reasonBandwidth, bytesDelay(l.global.Limit(), n), fmt.Sprintf("bandwidth limit: %v", err))
+			}
+		}
+		return handler(ctx, req)
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"systemiq.ai/auth"
+	"systemiq.ai/protos"
+)
+
+// benchClientID is the single client the benchmark auth stub issues tokens for
+const benchClientID = 1
+
+// benchObserver accepts every observation
+type benchObserver struct {
+	protos.UnimplementedDataObserverServer
+}
+
+func (benchObserver) ObserveData(context.Context, *protos.ObservationRequest) (*protos.ObservationResponse, error) {
+	return &protos.ObservationResponse{Status: "success"}, nil
+}
+
+// benchWire is an encoded request of 64 readings of ~1 KiB each
+var benchWire = func() []byte {
+	data := make([]string, 64)
+	for i := range data {
+		data[i] = fmt.Sprintf(`{"sensor":%d,"values":"%s"}`, i, strings.Repeat("x", 1000))
+	}
+	wire, _ := proto.Marshal(&protos.ObservationRequest{Data: data, Indicator: "bench"})
+	return wire
+}()
+
+// benchmark is one measurement of the bench subcommand; bench_test.go runs the same
+// ones under go test -bench
+type benchmark struct {
+	name string
+	fn   func(b *testing.B)
+}
+
+// benchmarks are the forwarding hot path against in-process stubs, and the buffer
+var benchmarks = func() []benchmark {
+	list := []benchmark{
+		{"TokenAcquisition", benchTokenAcquisition},
+		{"RewriteDecoded", benchRewriteDecoded},
+		{"RewritePassthrough", benchRewritePassthrough},
+		{"ForwardDecoded", benchForwardDecoded},
+		{"ForwardPassthrough", benchForwardPassthrough},
+		{"SpoolAppend/plain", func(b *testing.B) { benchSpoolAppend(b, false) }},
+		{"SpoolAppend/encrypted", func(b *testing.B) { benchSpoolAppend(b, true) }},
+		{"SpoolRead", benchSpoolRead},
+	}
+	for _, backend := range []string{backendFile, backendSQLite, backendPebble} {
+		list = append(list,
+			benchmark{"SpoolBackends/" + backend + "/append", func(b *testing.B) { benchBackendAppend(b, backend) }},
+			benchmark{"SpoolBackends/" + backend + "/append-parallel", func(b *testing.B) { benchBackendAppendParallel(b, backend) }},
+			benchmark{"SpoolBackends/" + backend + "/forward", func(b *testing.B) { benchBackendForward(b, backend) }},
+		)
+	}
+	return list
+}()
+
+// runBench is the bench subcommand: it prints results in `go test -bench` format
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	run := fs.String("run", "", "only benchmarks whose name matches this regular expression, e.g. Spool")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: observer_middleware bench [-run regexp]\n\nSpool benchmarks write to TMPDIR; point it at the disk the buffer will use.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	match, err := regexp.Compile(*run)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "-run:", err)
+		return 2
+	}
+	width := 0
+	for _, bm := range benchmarks {
+		width = max(width, len(bm.name))
+	}
+	for _, bm := range benchmarks {
+		if !match.MatchString(bm.name) {
+			continue
+		}
+		r := testing.Benchmark(bm.fn)
+		if r.N == 0 {
+			fmt.Fprintf(os.Stderr, "Benchmark%s failed\n", bm.name)
+			return 1
+		}
+		fmt.Printf("Benchmark%-*s %s\t%s\n", width, bm.name, r, r.MemString())
+	}
+	return 0
+}
+
+// discardLogs keeps login, dial and buffer logs out of the results
+func discardLogs(tb testing.TB) {
+	log.SetOutput(io.Discard)
+	tb.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+// newStubServer wires a middleware to an in-process auth stub and observer
+func newStubServer(tb testing.TB, observer protos.DataObserverServer) *ObserverMiddlewareServer {
+	tb.Helper()
+	discardLogs(tb)
+
+	authSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := jwt.MapClaims{"iat": time.Now().Unix(), "exp": time.Now().Add(time.Hour).Unix()}
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("bench"))
+		json.NewEncoder(w).Encode(auth.LoginResponse{Clients: []auth.ClientToken{
+			{ClientID: benchClientID, AccessToken: token, RefreshToken: "bench"},
+		}})
+	}))
+	tb.Cleanup(authSrv.Close)
+
+	authHandler, err := auth.NewAuthHandler(auth.Config{
+		Credentials:     auth.Credentials{Email: "bench", Password: "bench", ClientIDs: []int{benchClientID}},
+		LoginEndpoint:   authSrv.URL,
+		RefreshEndpoint: authSrv.URL,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(authHandler.StopRefresher)
+
+	lis := bufconn.Listen(1 << 20)
+	grpcSrv := grpc.NewServer()
+	protos.RegisterDataObserverServer(grpcSrv, observer)
+	go grpcSrv.Serve(lis)
+	tb.Cleanup(grpcSrv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bench",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithChainUnaryInterceptor(methodConfig{}.unaryInterceptor()),
+	)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+
+	single := &upstream{endpoint: "bench"}
+	single.conn.Store(conn)
+	return &ObserverMiddlewareServer{
+		upstream:    newUpstreamSet([]*upstream{single}, nil, 0, slowStartConfig{}),
+		authHandler: authHandler,
+	}
+}
+
+func benchTokenAcquisition(b *testing.B) {
+	srv := newStubServer(b, benchObserver{})
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := srv.authHandler.GetTokenFor(context.Background(), benchClientID); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func benchRewriteDecoded(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchWire)))
+	for b.Loop() {
+		req := new(protos.ObservationRequest)
+		if err := proto.Unmarshal(benchWire, req); err != nil {
+			b.Fatal(err)
+		}
+		token := "bench-token"
+		req.Token = &token
+		if _, err := proto.Marshal(req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchRewritePassthrough(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchWire)))
+	for b.Loop() {
+		req := new(rawMessage)
+		if err := (rawCodec{}).Unmarshal(benchWire, req); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := (rawCodec{}).Marshal(req.withToken("bench-token", nil)); err != nil {
+			b.Fatal(err)
+		}
+		putRawBuf(req.buf)
+	}
+}
+
+func benchForwardDecoded(b *testing.B) {
+	srv := newStubServer(b, benchObserver{})
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchWire)))
+	for b.Loop() {
+		req := new(protos.ObservationRequest)
+		proto.Unmarshal(benchWire, req)
+		if _, err := srv.ObserveData(context.Background(), req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchForwardPassthrough(b *testing.B) {
+	srv := newStubServer(b, benchObserver{})
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchWire)))
+	for b.Loop() {
+		req := new(rawMessage)
+		(rawCodec{}).Unmarshal(benchWire, req)
+		if _, err := srv.observeRaw(context.Background(), req); err != nil {
+			b.Fatal(err)
+		}
+		putRawBuf(req.buf)
+	}
+}
+
+// benchSpoolAppend measures the buffer's durable writes: one fsync per observation
+func benchSpoolAppend(b *testing.B, encrypted bool) {
+	discardLogs(b)
+	var c *spoolCipher
+	if encrypted {
+		key := make([]byte, 32)
+		rand.Read(key)
+		file := filepath.Join(b.TempDir(), "key")
+		if err := os.WriteFile(file, []byte(hex.EncodeToString(key)), 0o600); err != nil {
+			b.Fatal(err)
+		}
+		b.Setenv("BUFFER_KEY_FILE", file)
+		var err error
+		if c, err = spoolCipherFromEnv(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	spool, err := openSpool(b.TempDir(), 64<<20, c)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer spool.close()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchWire)))
+	for b.Loop() {
+		if err := spool.append(benchWire); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchSpoolRead measures reading buffered observations back, as forwarding does
+func benchSpoolRead(b *testing.B) {
+	spool, err := openSpool(b.TempDir(), 64<<20, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for range 256 {
+		if err := spool.append(benchWire); err != nil {
+			b.Fatal(err)
+		}
+	}
+	spool.complete()
+	files, _ := spoolFiles(spool.dir, false)
+	b.ReportAllocs()
+	b.SetBytes(256 * int64(len(benchWire)))
+	for b.Loop() {
+		err := readSegment(files[0], nil, func(rec []byte) error {
+			return proto.Unmarshal(rec[8:], new(protos.ObservationRequest))
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// openBenchBuffer opens an empty buffer with backend, as BUFFER_BACKEND selects it
+func openBenchBuffer(b *testing.B, backend string) *observationSpool {
+	discardLogs(b)
+	b.Setenv("BUFFER_BACKEND", backend)
+	spool, err := openBuffer(b.TempDir(), 64<<20, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { spool.close() })
+	return spool
+}
+
+// benchBackendAppend measures appends by one producer, each durable on return
+func benchBackendAppend(b *testing.B, backend string) {
+	spool := openBenchBuffer(b, backend)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchWire)))
+	for b.Loop() {
+		if err := spool.append(benchWire); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchBackendAppendParallel measures appends by several producers at once
+func benchBackendAppendParallel(b *testing.B, backend string) {
+	spool := openBenchBuffer(b, backend)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchWire)))
+	b.SetParallelism(4)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := spool.append(benchWire); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// benchBackendForward measures forwarding 256 buffered observations and deleting them
+func benchBackendForward(b *testing.B, backend string) {
+	spool := openBenchBuffer(b, backend)
+	b.ReportAllocs()
+	b.SetBytes(256 * int64(len(benchWire)))
+	for b.Loop() {
+		b.StopTimer()
+		for range 256 {
+			if err := spool.append(benchWire); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := spool.complete(); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		sent, err := spool.forward(func(rec []byte) error {
+			_, err := decodeRecord(rec)
+			return err
+		})
+		if err != nil || sent != 256 {
+			b.Fatalf("forwarded %d (%v), want 256", sent, err)
+		}
+	}
+}
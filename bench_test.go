@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// runBenchmarks runs the bench subcommand's benchmarks named name, or under it as
+// sub-benchmarks, so go test and the binary measure the same
+func runBenchmarks(b *testing.B, name string) {
+	for _, bm := range benchmarks {
+		if bm.name == name {
+			bm.fn(b)
+		} else if sub, ok := strings.CutPrefix(bm.name, name+"/"); ok {
+			b.Run(sub, bm.fn)
+		}
+	}
+}
+
+func BenchmarkTokenAcquisition(b *testing.B)   { runBenchmarks(b, "TokenAcquisition") }
+func BenchmarkRewriteDecoded(b *testing.B)     { runBenchmarks(b, "RewriteDecoded") }
+func BenchmarkRewritePassthrough(b *testing.B) { runBenchmarks(b, "RewritePassthrough") }
+func BenchmarkForwardDecoded(b *testing.B)     { runBenchmarks(b, "ForwardDecoded") }
+func BenchmarkForwardPassthrough(b *testing.B) { runBenchmarks(b, "ForwardPassthrough") }
+func BenchmarkSpoolAppend(b *testing.B)        { runBenchmarks(b, "SpoolAppend") }
+func BenchmarkSpoolRead(b *testing.B)          { runBenchmarks(b, "SpoolRead") }
+
+// BenchmarkSpoolBackends compares the BUFFER_BACKEND stores through the spool: appends
+// one at a time and from many producers at once, then forwarding 256 back out
+func BenchmarkSpoolBackends(b *testing.B) { runBenchmarks(b, "SpoolBackends") }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"systemiq.ai/metrics"
+)
+
+// spoolStats summarises what a spool holds
+type spoolStats struct {
+	observations int
+	bytes        int64
+	oldest       time.Time // arrival of the oldest observation, zero when empty
+	alert        string    // why the alert thresholds are exceeded, empty when they are not
+}
+
+// segmentStats is the count of a segment, valid while its size and mtime are unchanged
+type segmentStats struct {
+	size    int64
+	modTime time.Time
+	records int
+	first   time.Time
+}
+
+// bufferAlert makes the middleware not ready while its buffer holds more than maxBytes
+// or an observation older than maxAge, so the orchestrator or a load balancer notices
+type bufferAlert struct {
+	maxBytes int64         // 0 = no limit
+	maxAge   time.Duration // 0 = no limit
+}
+
+// bufferAlertFromEnv reads BUFFER_ALERT_MB and BUFFER_ALERT_AGE (both unset: no alert)
+func bufferAlertFromEnv() (bufferAlert, error) {
+	var a bufferAlert
+	mb, err := envInt("BUFFER_ALERT_MB", 0)
+	if err != nil {
+		return a, err
+	}
+	a.maxBytes = int64(mb) << 20
+	if os.Getenv("BUFFER_ALERT_AGE") != "" {
+		if a.maxAge, err = envDuration("BUFFER_ALERT_AGE", 0); err != nil {
+			return a, err
+		}
+	}
+	return a, nil
+}
+
+// check returns why st exceeds the thresholds, or ""
+func (a bufferAlert) check(st spoolStats, now time.Time) string {
+	switch {
+	case a.maxBytes > 0 && st.bytes > a.maxBytes:
+		return fmt.Sprintf("buffer holds %d MB, over BUFFER_ALERT_MB (%d)", st.bytes>>20, a.maxBytes>>20)
+	case a.maxAge > 0 && !st.oldest.IsZero() && now.Sub(st.oldest) > a.maxAge:
+		return fmt.Sprintf("oldest buffered observation arrived %v ago, over BUFFER_ALERT_AGE (%v)", now.Sub(st.oldest).Round(time.Second), a.maxAge)
+	}
+	return ""
+}
+
+// recordArrival is the arrival time stored with a spool record
+func recordArrival(rec []byte) time.Time {
+	if len(rec) < 8 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(rec)))
+}
+
+// lastStats returns the stats monitor last published, nil before (or without a spool)
+func (s *observationSpool) lastStats() *spoolStats {
+	if s == nil {
+		return nil
+	}
+	return s.last.Load()
+}
+
+// monitor publishes the spool's stats as metrics at each interval, starting right away,
+// and marks the middleware not ready while they exceed alert
+func (s *observationSpool) monitor(alert bufferAlert, interval time.Duration) {
+	alerting := false
+	for {
+		now := time.Now()
+		st := s.stats()
+		st.alert = alert.check(st, now)
+		s.last.Store(&st)
+
+		metrics.BufferObservations.Set(float64(st.observations))
+		metrics.BufferBytes.Set(float64(st.bytes))
+		if st.oldest.IsZero() {
+			metrics.BufferOldestAge.Set(0)
+		} else {
+			metrics.BufferOldestAge.Set(now.Sub(st.oldest).Seconds())
+		}
+		if (st.alert != "") != alerting {
+			alerting = !alerting
+			if alerting {
+				log.Printf("WARNING: %s; not ready until it drains", st.alert)
+			} else {
+				log.Printf("Buffer back under its alert thresholds; ready")
+			}
+			metrics.SetNotReady(st.alert)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// stats counts the observations in the spool; segments are only read again once they
+// change, and the one being written is counted as it grows
+func (s *observationSpool) stats() spoolStats {
+	if s.store != nil {
+		return s.statsStored()
+	}
+	s.mu.Lock()
+	current, currentStats := "", segmentStats{records: s.fileRecords, first: s.fileFirst}
+	if s.file != nil {
+		current = s.file.Name()
+	}
+	s.mu.Unlock()
+
+	var st spoolStats
+	files, err := spoolFiles(s.dir, true)
+	if err != nil {
+		log.Printf("WARNING: buffer stats: %v", err)
+		return st
+	}
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	counted := make(map[string]segmentStats, len(files))
+	for _, name := range files {
+		info, err := os.Stat(name)
+		if err != nil {
+			continue // forwarded or completed meanwhile
+		}
+		seg, ok := s.segments[name]
+		switch {
+		case name == current:
+			seg = currentStats
+		case !ok || seg.size != info.Size() || !seg.modTime.Equal(info.ModTime()):
+			seg = segmentStats{size: info.Size(), modTime: info.ModTime()}
+			readSegment(name, s.cipher, func(rec []byte) error {
+				if seg.records == 0 {
+					seg.first = recordArrival(rec)
+				}
+				seg.records++
+				return nil
+			})
+			counted[name] = seg
+		default:
+			counted[name] = seg
+		}
+		st.observations += seg.records
+		st.bytes += info.Size()
+		if !seg.first.IsZero() && (st.oldest.IsZero() || seg.first.Before(st.oldest)) {
+			st.oldest = seg.first
+		}
+	}
+	s.segments = counted
+	return st
+}
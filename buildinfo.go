@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"systemiq.ai/metrics"
+)
+
+// Build information, set at link time:
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// commit and buildDate fall back to the VCS stamp go build embeds from a checkout
+// (marked -dirty when the tree had local changes).
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// versionMetadataKey carries the middleware version on every response to producers
+const versionMetadataKey = "x-middleware-version"
+
+func init() {
+	if info, ok := debug.ReadBuildInfo(); ok && commit == "" {
+		var dirty bool
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				commit = s.Value
+			case "vcs.time":
+				if buildDate == "" {
+					buildDate = s.Value
+				}
+			case "vcs.modified":
+				dirty = s.Value == "true"
+			}
+		}
+		if dirty && commit != "" {
+			commit += "-dirty"
+		}
+	}
+	metrics.BuildInfo.WithLabelValues(version, commit, buildDate, runtime.Version()).Set(1)
+}
+
+// versionString is the one-line form printed by --version and sent in response metadata
+func versionString() string {
+	s := version
+	if commit != "" {
+		s += " (" + shortCommit() + ")"
+	}
+	return s
+}
+
+// shortCommit abbreviates the revision the way git does
+func shortCommit() string {
+	if rev, dirty, ok := strings.Cut(commit, "-"); ok && len(rev) > 12 {
+		return rev[:12] + "-" + dirty
+	}
+	if len(commit) > 12 {
+		return commit[:12]
+	}
+	return commit
+}
+
+// printVersion is --version
+func printVersion() {
+	fmt.Printf("observer_middleware %s\ncommit:     %s\nbuild date: %s\ngo:         %s %s/%s\n",
+		version, orUnknown(commit), orUnknown(buildDate), runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// versionHeaderInterceptor sends x-middleware-version with every response, errors included
+func versionHeaderInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	grpc.SetHeader(ctx, metadata.Pairs(versionMetadataKey, versionString()))
+	return handler(ctx, req)
+}
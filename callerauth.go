@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"systemiq.ai/jwks"
+)
+
+// callerIdentity is who an authenticated local caller is, and how they proved it
+type callerIdentity struct {
+	Name   string
+	Method string // "mtls", "spiffe", "api-key" or "jwt"
+}
+
+type callerIdentityKey struct{}
+
+// callerFrom returns the identity attached by the caller-auth interceptor
+func callerFrom(ctx context.Context) (callerIdentity, bool) {
+	id, ok := ctx.Value(callerIdentityKey{}).(callerIdentity)
+	return id, ok
+}
+
+type apiKey struct {
+	identity string
+	key      []byte
+}
+
+// callerAuth authenticates local callers by mTLS certificate, API key or bearer JWT;
+// a call is accepted if any configured method succeeds
+type callerAuth struct {
+	mtls    bool
+	spiffe  bool // client certificates are SVIDs checked against CALLER_SPIFFE_IDS
+	apiKeys []apiKey
+
+	jwks             *jwks.Set
+	issuer, audience string
+}
+
+// callerAuthFromEnv reads CALLER_API_KEYS, CALLER_JWKS_URL/_JWT_ISSUER/_JWT_AUDIENCE and
+// whether mTLS client verification is on; nil when no method is configured
+func callerAuthFromEnv(mtls bool) (*callerAuth, error) {
+	a := &callerAuth{mtls: mtls, spiffe: mtls && os.Getenv("CALLER_SPIFFE_IDS") != ""}
+
+	if v := os.Getenv("CALLER_API_KEYS"); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			identity, key, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || identity == "" || key == "" {
+				return nil, errors.New("CALLER_API_KEYS must be identity=key pairs separated by commas")
+			}
+			a.apiKeys = append(a.apiKeys, apiKey{identity: identity, key: []byte(key)})
+		}
+	}
+
+	a.issuer, a.audience = os.Getenv("CALLER_JWT_ISSUER"), os.Getenv("CALLER_JWT_AUDIENCE")
+	if url := os.Getenv("CALLER_JWKS_URL"); url != "" {
+		a.jwks = jwks.New(url, &http.Client{Timeout: 10 * time.Second}, time.Hour)
+	} else if a.issuer != "" || a.audience != "" {
+		return nil, errors.New("CALLER_JWT_ISSUER/CALLER_JWT_AUDIENCE require CALLER_JWKS_URL")
+	}
+
+	if !a.mtls && len(a.apiKeys) == 0 && a.jwks == nil {
+		return nil, nil
+	}
+
+	var methods []string
+	if a.spiffe {
+		methods = append(methods, "SPIFFE mTLS")
+	} else if a.mtls {
+		methods = append(methods, "mTLS")
+	}
+	if len(a.apiKeys) > 0 {
+		methods = append(methods, fmt.Sprintf("%d API key(s)", len(a.apiKeys)))
+	}
+	if a.jwks != nil {
+		methods = append(methods, "JWT")
+	}
+	log.Printf("Caller authentication required: %s", strings.Join(methods, ", "))
+	return a, nil
+}
+
+// authenticate returns the caller's identity or an UNAUTHENTICATED status
+func (a *callerAuth) authenticate(ctx context.Context) (callerIdentity, error) {
+	if a.mtls {
+		if p, ok := peer.FromContext(ctx); ok {
+			if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+				if len(info.State.VerifiedChains) > 0 {
+					return callerIdentity{Name: info.State.VerifiedChains[0][0].Subject.CommonName, Method: "mtls"}, nil
+				}
+				// SVIDs are verified against the SPIFFE bundle during the handshake, which
+				// leaves no verified chain; the identity is the SPIFFE ID
+				if a.spiffe && len(info.State.PeerCertificates) > 0 {
+					if id, err := x509svid.IDFromCert(info.State.PeerCertificates[0]); err == nil {
+						return callerIdentity{Name: id.String(), Method: "spiffe"}, nil
+					}
+				}
+			}
+		}
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	if v := md.Get(apiKeyMetadataKey); len(a.apiKeys) > 0 && len(v) > 0 {
+		for _, k := range a.apiKeys {
+			if subtle.ConstantTimeCompare([]byte(v[0]), k.key) == 1 {
+				return callerIdentity{Name: k.identity, Method: "api-key"}, nil
+			}
+		}
+		return callerIdentity{}, status.Error(codes.Unauthenticated, "invalid API key")
+	}
+
+	if v := md.Get("authorization"); a.jwks != nil && len(v) > 0 {
+		tokenString, ok := strings.CutPrefix(v[0], "Bearer ")
+		if !ok {
+			return callerIdentity{}, status.Error(codes.Unauthenticated, "authorization must be a Bearer token")
+		}
+		claims, err := a.verifyJWT(tokenString)
+		if err != nil {
+			return callerIdentity{}, status.Errorf(codes.Unauthenticated, "invalid caller token: %v", err)
+		}
+		sub, _ := claims["sub"].(string)
+		return callerIdentity{Name: sub, Method: "jwt"}, nil
+	}
+
+	return callerIdentity{}, status.Error(codes.Unauthenticated, "caller credentials required")
+}
+
+// verifyJWT checks the signature, validity window, issuer and audience of a caller token
+func (a *callerAuth) verifyJWT(tokenString string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(tokenString, claims, a.jwks.Keyfunc); err != nil {
+		return nil, err
+	}
+	if a.issuer != "" && !claims.VerifyIssuer(a.issuer, true) {
+		return nil, errors.New("token issuer mismatch")
+	}
+	if a.audience != "" && !claims.VerifyAudience(a.audience, true) {
+		return nil, errors.New("token audience mismatch")
+	}
+	return claims, nil
+}
+
+// unaryInterceptor rejects unauthenticated calls and attaches the caller identity
+func (a *callerAuth) unaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		id, err := a.authenticate(ctx)
+		if err != nil {
+			return nil, withDetails(status.Convert(err), reasonCallerAuth, 0).Err()
+		}
+		return handler(context.WithValue(ctx, callerIdentityKey{}, id), req)
+	}
+}
+
+// serverTLSFromEnv loads SERVER_TLS_CERT_FILE/KEY_FILE; with SERVER_TLS_CLIENT_CA_FILE,
+// client certificates signed by that CA are verified and mtls is reported true.
+// The certificate is served through the returned reloader so it can be rotated, or by
+// acmeCfg when ACME is configured, or is the workload's SPIFFE SVID when neither is;
+// CALLER_SPIFFE_IDS verifies callers' SVIDs instead of a CA file.
+// Returns nil credentials when TLS is not configured.
+func serverTLSFromEnv(acmeCfg *acmeConfig) (creds credentials.TransportCredentials, certs *certReloader, mtls bool, err error) {
+	certFile, keyFile := os.Getenv("SERVER_TLS_CERT_FILE"), os.Getenv("SERVER_TLS_KEY_FILE")
+	caFile, callerIDs := os.Getenv("SERVER_TLS_CLIENT_CA_FILE"), os.Getenv("CALLER_SPIFFE_IDS")
+	if err := spiffeConfigError(); err != nil {
+		return nil, nil, false, err
+	}
+	if caFile != "" && callerIDs != "" {
+		return nil, nil, false, errors.New("SERVER_TLS_CLIENT_CA_FILE and CALLER_SPIFFE_IDS are mutually exclusive")
+	}
+	svids, err := workloadSVIDs()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	cfg := &tls.Config{}
+	if err := applyTLSPolicy(cfg, "SERVER"); err != nil {
+		return nil, nil, false, err
+	}
+	switch {
+	case acmeCfg != nil:
+		acmeCfg.apply(cfg)
+	case certFile != "" || keyFile != "":
+		certs, err = newCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		cfg.GetCertificate = certs.getCertificate
+	case svids != nil:
+		cfg.GetCertificate = tlsconfig.GetCertificate(svids)
+	default:
+		if caFile != "" {
+			return nil, nil, false, errors.New("SERVER_TLS_CLIENT_CA_FILE requires SERVER_TLS_CERT_FILE and SERVER_TLS_KEY_FILE")
+		}
+		return nil, nil, false, nil
+	}
+
+	if callerIDs != "" {
+		if err := applyCallerSVIDs(cfg, svids, callerIDs); err != nil {
+			return nil, nil, false, err
+		}
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, nil, false, fmt.Errorf("read SERVER_TLS_CLIENT_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, false, errors.New("SERVER_TLS_CLIENT_CA_FILE contains no PEM certificates")
+		}
+		cfg.ClientCAs = pool
+		// Certificate-less callers may still authenticate by API key or JWT
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return credentials.NewTLS(cfg), certs, caFile != "" || callerIDs != "", nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/status"
+	"systemiq.ai/protos"
+)
+
+// capabilitiesTimeout bounds one handshake call
+const capabilitiesTimeout = 5 * time.Second
+
+// observerCaps is what an Observer advertised in the capabilities handshake; Observers
+// without the ObserverInfo service get the zero value (plain, unlimited calls)
+type observerCaps struct {
+	version     string
+	compressor  string // compressor used for forwarded calls, "" for none
+	maxMsgBytes int    // 0 when not advertised
+	methods     []string
+	encodings   []string // payload encodings the Observer reassembles
+}
+
+// newObserverCaps picks the settings the middleware can use from what the Observer offers
+func newObserverCaps(c *protos.Capabilities) *observerCaps {
+	caps := &observerCaps{
+		version:     c.GetVersion(),
+		maxMsgBytes: int(c.GetMaxMessageBytes()),
+		methods:     c.GetMethods(),
+		encodings:   c.GetPayloadEncodings(),
+	}
+	if slices.Contains(c.GetCompression(), gzip.Name) {
+		caps.compressor = gzip.Name
+	}
+	return caps
+}
+
+// callOptions adapts a forwarded call: compress when the Observer accepts it and reject
+// requests over its size limit locally instead of after the upload
+func (c *observerCaps) callOptions() []grpc.CallOption {
+	if c == nil {
+		return nil
+	}
+	var opts []grpc.CallOption
+	if c.compressor != "" {
+		opts = append(opts, grpc.UseCompressor(c.compressor))
+	}
+	if c.maxMsgBytes > 0 {
+		opts = append(opts, grpc.MaxCallSendMsgSize(c.maxMsgBytes))
+	}
+	return opts
+}
+
+// String summarises the capabilities for logs
+func (c *observerCaps) String() string {
+	var parts []string
+	if c.version != "" {
+		parts = append(parts, "version "+c.version)
+	}
+	if c.compressor != "" {
+		parts = append(parts, c.compressor)
+	}
+	if c.maxMsgBytes > 0 {
+		parts = append(parts, fmt.Sprintf("max %d bytes", c.maxMsgBytes))
+	}
+	if len(c.methods) > 0 {
+		parts = append(parts, fmt.Sprintf("%d method(s)", len(c.methods)))
+	}
+	parts = append(parts, c.encodings...)
+	if len(parts) == 0 {
+		return "none advertised"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// handshake asks the Observer on conn for its capabilities; UNIMPLEMENTED means an
+// Observer that predates the handshake
+func handshake(ctx context.Context, conn *grpc.ClientConn) (*observerCaps, error) {
+	ctx, cancel := context.WithTimeout(ctx, capabilitiesTimeout)
+	defer cancel()
+	c, err := protos.NewObserverInfoClient(conn).GetCapabilities(ctx, &protos.CapabilitiesRequest{ClientVersion: version})
+	if status.Code(err) == codes.Unimplemented {
+		return &observerCaps{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newObserverCaps(c), nil
+}
+
+// watchCapabilities repeats the handshake whenever the connection becomes READY after
+// a re-dial or a failure, since a restarted Observer may be a different version
+func (u *upstream) watchCapabilities(ctx context.Context) {
+	var asked *grpc.ClientConn
+	for ctx.Err() == nil {
+		conn := u.Conn()
+		state := conn.GetState()
+		switch {
+		case state == connectivity.TransientFailure:
+			asked = nil
+		case state == connectivity.Ready && conn != asked && !testMode.Load():
+			caps, err := handshake(ctx, conn)
+			if err != nil {
+				// Keep forwarding with the previous settings; retried on the next reconnect
+				log.Printf("Observer %s capabilities: %v", u.Endpoint(), err)
+			} else if old := u.caps.Swap(caps); old == nil || old.String() != caps.String() {
+				log.Printf("Observer %s capabilities: %v", u.Endpoint(), caps)
+			}
+			asked = conn
+		}
+		// Bounded wait so a connection swapped by a re-dial is picked up
+		waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+		conn.WaitForStateChange(waitCtx, state)
+		cancel()
+	}
+}
+
+// supports reports whether every endpoint advertised the payload encoding, so any
+// of them can reassemble what is sent
+func (s *upstreamSet) supports(encoding string) bool {
+	for _, m := range s.members {
+		if caps := m.caps.Load(); caps == nil || !slices.Contains(caps.encodings, encoding) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// certReloader serves the server certificate from disk and swaps it when the files
+// change, so short-lived certificates (cert-manager, Vault) roll without a restart.
+// Only new handshakes pick up the new certificate; established connections are kept.
+type certReloader struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+	stamp             string // mtimes and sizes of the files last loaded
+}
+
+// newCertReloader loads the key pair once; failing here is fatal, later failures are not
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// fileStamp identifies the current contents of the cert and key files; following
+// symlinks catches the ..data swap Kubernetes does on secret updates
+func (r *certReloader) fileStamp() string {
+	stamp := ""
+	for _, name := range []string{r.certFile, r.keyFile} {
+		if fi, err := os.Stat(name); err == nil {
+			stamp += fmt.Sprintf("%d/%d;", fi.ModTime().UnixNano(), fi.Size())
+		}
+	}
+	return stamp
+}
+
+func (r *certReloader) load() error {
+	stamp := r.fileStamp()
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load server certificate: %w", err)
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	}
+	r.cert.Store(&cert)
+	r.stamp = stamp
+	return nil
+}
+
+// getCertificate is the tls.Config hook consulted on every handshake
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// reload swaps in the certificate on disk, keeping the old one when it does not load
+// (e.g. the cert was written but the key not yet)
+func (r *certReloader) reload(reason string) {
+	if err := r.load(); err != nil {
+		log.Printf("WARNING: server certificate reload (%s) failed, keeping the current one: %v", reason, err)
+		return
+	}
+	leaf := r.cert.Load().Leaf
+	if leaf == nil {
+		log.Printf("Reloaded server certificate (%s)", reason)
+		return
+	}
+	log.Printf("Reloaded server certificate (%s): %s, expires %s", reason, leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+}
+
+// watch checks the files every interval and reloads on change, and reloads
+// unconditionally on SIGHUP
+func (r *certReloader) watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.reload("SIGHUP")
+		case <-ticker.C:
+			if stamp := r.fileStamp(); stamp != r.stamp {
+				r.reload("files changed")
+			}
+		}
+	}
+}
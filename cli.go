@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// command is one subcommand of the binary
+type command struct {
+	summary string
+	run     func(args []string) int
+}
+
+// commands is filled in init because usage refers back to it
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"serve":   {"run the middleware (the default without a command)", runServe},
+		"send":    {"submit observations from a file or flags, through a middleware or directly", runSend},
+		"token":   {"log in with the configured credentials and print token metadata", runToken},
+		"status":  {"show the state of a running middleware via its admin API", runStatus},
+		"admin":   {"control a running middleware via its admin API", runAdminCLI},
+		"audit":   {"verify the hash chain of an audit log", runAudit},
+		"export":  {"pack the offline buffer into one file for transfer", runExport},
+		"upload":  {"send buffered observations (offline buffer or export files) to the Observer", runUpload},
+		"import":  {"add export files to a buffer directory, e.g. to recover a failed host", runImport},
+		"queue":   {"list, show, purge and repair buffered observations", runQueue},
+		"doctor":  {"check configuration, Observer connectivity, auth login, buffer directories and clock, then exit", runDoctor},
+		"bench":   {"benchmark the forwarding hot path and the buffer backends against in-process stubs", runBench},
+		"version": {"print version, commit, build date and Go version", func([]string) int { printVersion(); return 0 }},
+	}
+}
+
+// runCommand dispatches to a subcommand; no command (or only flags) means serve, so
+// existing deployments configured purely by environment keep working
+func runCommand(args []string) int {
+	if len(args) > 0 && (args[0] == "-version" || args[0] == "--version") {
+		args[0] = "version"
+	}
+	if len(args) == 0 || (strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "--help") {
+		return runServe(args)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		if args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+			usage()
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		usage()
+		return 2
+	}
+	return cmd.run(args[1:])
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: observer_middleware [command] [flags]\n\ncommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun 'observer_middleware <command> -h' for its flags.")
+}
+
+// configVars are the environment variables the middleware is configured by; each can
+// also be given to serve and doctor as a flag, e.g. --observer-endpoint for OBSERVER_ENDPOINT
+var configVars = []string{
+	"ADMIN_ADDR", "ADMIN_TOKEN", "AUDIT_LOG_FILE",
+	"AUTH_CLIENT_ID", "AUTH_CLIENT_ID_BY_INDICATOR", "AUTH_CLOCK_DRIFT_WARN",
+	"AUTH_CLOCK_SKEW", "AUTH_CREDENTIALS_FILE", "AUTH_EMAIL", "AUTH_HTTP_PROXY",
+	"AUTH_HTTP_TIMEOUT", "AUTH_JWKS_CACHE_TTL", "AUTH_JWKS_URL", "AUTH_JWT_AUDIENCE",
+	"AUTH_JWT_ISSUER", "AUTH_LAZY_LOGIN", "AUTH_LOGIN_ENDPOINT",
+	"AUTH_LOGOUT_ENDPOINT", "AUTH_PASSWORD", "AUTH_REFRESH_ENDPOINT",
+	"AUTH_RETRY_BASE_DELAY", "AUTH_RETRY_MAX_ATTEMPTS", "AUTH_RETRY_MAX_DELAY",
+	"AUTH_SHARED_CACHE_FILE", "AUTH_STARTUP_RETRY", "AUTH_TENANT_METADATA_KEY",
+	"AUTH_TLS_CA_FILE", "AUTH_TLS_CERT_FILE", "AUTH_TLS_INSECURE_SKIP_VERIFY",
+	"AUTH_TLS_KEY_FILE", "AUTH_TLS_SERVER_NAME", "AUTH_TOKEN_FILE",
+	"BANDWIDTH_LIMIT_BPS", "BANDWIDTH_LIMIT_PER_CALLER_BPS",
+	"BUFFER_ALERT_AGE", "BUFFER_ALERT_MB", "BUFFER_BACKEND", "BUFFER_DIR", "BUFFER_DRAIN_ON_EXIT",
+	"BUFFER_KEY_FILE", "BUFFER_MAX_AGE", "BUFFER_MAX_MB",
+	"CALLER_API_KEYS", "CALLER_JWKS_URL", "CALLER_JWT_AUDIENCE", "CALLER_JWT_ISSUER",
+	"CALLER_POLICY_FILE", "CALLER_SPIFFE_IDS",
+	"CONFIG_MAP_NAME",
+	"CONSUL_HTTP_ADDR", "CONSUL_HTTP_TOKEN",
+	"CRASH_REPORT_DSN", "CRASH_REPORT_ENVIRONMENT", "CRASH_REPORT_FAILURE_THRESHOLD",
+	"DEDUP_MAX_ENTRIES", "DEDUP_REDIS_URL", "DEDUP_WINDOW",
+	"DELTA_ENCODING", "DELTA_KEYFRAME_INTERVAL", "DELTA_MAX_KEYS", "DRY_RUN",
+	"ENRICH_HOST", "ENRICH_K8S", "ENRICH_K8S_NODE_LABELS",
+	"ENRICH_K8S_POD_LABELS_FILE",
+	"GEOIP_DB", "GEOIP_FIELDS",
+	"HEARTBEAT_INDICATOR", "HEARTBEAT_INTERVAL",
+	"IDEMPOTENCY_TOKEN_BUCKET", "IDEMPOTENCY_TOKENS",
+	"LARGE_REQUEST_THRESHOLD_KB",
+	"LEADER_ELECTION", "LEADER_IDENTITY", "LEADER_LEASE_DURATION", "LEADER_LEASE_NAME",
+	"LEADER_LOCK_FILE",
+	"LISTEN_ALLOW_CIDRS", "LISTEN_DENY_CIDRS",
+	"LOAD_SHED_QUEUE_DEPTH", "LOG_LEVEL",
+	"MAX_IN_FLIGHT", "MAX_IN_FLIGHT_ADAPTIVE", "MAX_IN_FLIGHT_FAIR",
+	"MAX_IN_FLIGHT_LATENCY_TOLERANCE", "MAX_IN_FLIGHT_MAX", "MAX_IN_FLIGHT_MIN",
+	"MAX_IN_FLIGHT_WEIGHTS", "MAX_QUEUED",
+	"METRICS_ADDR",
+	"OBSERVATION_LABELS",
+	"OBSERVER_ALTS_TARGET_SERVICE_ACCOUNTS", "OBSERVER_AUTHORITY", "OBSERVER_DNS_MIN_INTERVAL",
+	"OBSERVER_ENDPOINT", "OBSERVER_ENDPOINTS", "OBSERVER_ERROR_MAP", "OBSERVER_ERROR_MESSAGES",
+	"OBSERVER_FAILBACK_PROBES",
+	"OBSERVER_FAILBACK_WINDOW", "OBSERVER_INITIAL_CONN_WINDOW_KB", "OBSERVER_INITIAL_WINDOW_KB",
+	"OBSERVER_MAX_MSG_SIZE_MB",
+	"OBSERVER_METHOD_CONFIG", "OBSERVER_OUTLIER_EJECTION_TIME",
+	"OBSERVER_OUTLIER_FAILURE_PERCENT", "OBSERVER_OUTLIER_INTERVAL",
+	"OBSERVER_OUTLIER_MIN_REQUESTS", "OBSERVER_PASSTHROUGH", "OBSERVER_PROBE_INTERVAL",
+	"OBSERVER_READ_BUFFER_KB", "OBSERVER_SERVICE_CONFIG", "OBSERVER_SHADOW_COMPARE_FIELDS",
+	"OBSERVER_SHADOW_ENDPOINT", "OBSERVER_SHADOW_MAX_IN_FLIGHT",
+	"OBSERVER_SHADOW_MISMATCH_FILE", "OBSERVER_SHADOW_MISMATCH_SAMPLE_RATE",
+	"OBSERVER_SHADOW_TIMEOUT", "OBSERVER_SKIP_HANDSHAKE", "OBSERVER_SLOW_START_STEP",
+	"OBSERVER_SLOW_START_STEPS", "OBSERVER_SPIFFE_ID", "OBSERVER_SRV", "OBSERVER_SRV_REFRESH",
+	"OBSERVER_SWITCH_MARGIN_PERCENT", "OBSERVER_TLS", "OBSERVER_TLS_CIPHER_SUITES",
+	"OBSERVER_TLS_MIN_VERSION", "OBSERVER_TRANSPORT_SECURITY", "OBSERVER_UPLOAD_CHUNK_KB",
+	"OBSERVER_UPLOAD_MAX_RESUMES", "OBSERVER_UPLOAD_THRESHOLD_MB", "OBSERVER_WAIT_FOR_READY",
+	"OBSERVER_WATCHDOG_TIMEOUT", "OBSERVER_WRITE_BUFFER_KB",
+	"OFFLINE_DIR", "OFFLINE_SEGMENT_INTERVAL", "OFFLINE_SEGMENT_MB",
+	"PAYLOAD_SIGNING_KEY_FILE", "PAYLOAD_SIGNING_KEY_ID",
+	"RATE_LIMIT_BURST", "RATE_LIMIT_KEY", "RATE_LIMIT_RPS",
+	"REMOTE_FLAGS_INTERVAL", "REMOTE_FLAGS_URL",
+	"REQUEST_MAX_DATA_KB", "REQUEST_MAX_JSON_DEPTH", "REQUEST_VALIDATION",
+	"RESPONSE_CACHE_MAX_ENTRIES", "RESPONSE_CACHE_TTL",
+	"RUNTIME_AUTO_LIMITS", "RUNTIME_MEMLIMIT_RATIO",
+	"SERVER_ACME_CA_FILE", "SERVER_ACME_CACHE_DIR", "SERVER_ACME_DIRECTORY_URL",
+	"SERVER_ACME_DOMAINS", "SERVER_ACME_EMAIL", "SERVER_ACME_HTTP_ADDR",
+	"SERVER_INITIAL_CONN_WINDOW_KB", "SERVER_INITIAL_WINDOW_KB", "SERVER_IP_FAMILY",
+	"SERVER_KEEPALIVE_MIN_TIME", "SERVER_KEEPALIVE_PERMIT_WITHOUT_STREAM",
+	"SERVER_LISTENERS", "SERVER_MAX_CONCURRENT_STREAMS", "SERVER_MAX_CONNECTION_AGE",
+	"SERVER_MAX_CONNECTION_AGE_GRACE",
+	"SERVER_MAX_CONNECTION_IDLE", "SERVER_READ_BUFFER_KB", "SERVER_TLS_CERT_FILE",
+	"SERVER_TLS_CIPHER_SUITES", "SERVER_TLS_CLIENT_CA_FILE", "SERVER_TLS_KEY_FILE",
+	"SERVER_TLS_MIN_VERSION", "SERVER_TLS_RELOAD_INTERVAL",
+	"SERVER_WRITE_BUFFER_KB",
+	"SLOW_REQUEST_THRESHOLD", "SPIFFE_ENDPOINT_SOCKET",
+	"TEST_MODE",
+	"TIMESTAMP_DRIFT", "TIMESTAMP_DRIFT_THRESHOLD", "TIMESTAMP_FIELDS",
+	"TIMESTAMP_INVALID", "TIMESTAMP_MAX_AGE", "TIMESTAMP_MAX_FUTURE",
+	"TIMESTAMP_RECEIVED_FIELD", "TRACE_SAMPLE_ON_ERROR", "TRACE_SAMPLE_RATIO",
+	"UNKNOWN_FIELDS",
+}
+
+// flagName maps OBSERVER_ENDPOINT to observer-endpoint
+func flagName(envVar string) string {
+	return strings.ToLower(strings.ReplaceAll(envVar, "_", "-"))
+}
+
+// configFlags registers one flag per configuration variable on fs; a flag that is set
+// overrides the environment, so it also reaches code that reads the variable directly
+func configFlags(fs *flag.FlagSet) {
+	for _, name := range configVars {
+		fs.Func(flagName(name), "sets "+name, func(v string) error { return os.Setenv(name, v) })
+	}
+}
+
+// parseServeFlags applies serve's flags to the environment and reports --preflight
+func parseServeFlags(args []string) (preflight bool, err error) {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.BoolVar(&preflight, "preflight", false, "run the doctor checks first and exit 1 unless all pass")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: observer_middleware [serve] [--preflight] [--flag=value ...]\n\nEvery flag mirrors the environment variable of the same name (see README) and wins over it.")
+		fs.PrintDefaults()
+	}
+	configFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return false, err
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(fs.Output(), "serve: unexpected argument %q\n", fs.Arg(0))
+		return false, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	return preflight, nil
+}
+
+// flagExit is the exit code for a flag parsing error: 0 when help was asked for
+func flagExit(err error) int {
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	return 2
+}
+
+// runStatus is "admin status"
+func runStatus(args []string) int {
+	return runAdminCLI(append(args, "status"))
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"systemiq.ai/limiter"
+	"systemiq.ai/metrics"
+)
+
+// upstreamLimiter is the in-flight limiter plus how calls are assigned to fair-queuing flows
+type upstreamLimiter struct {
+	*limiter.Limiter
+	fair    bool               // queue per caller instead of one FIFO
+	weights map[string]float64 // per-flow weights, default 1
+	shed    *deadlineShedder   // nil without LOAD_SHED_QUEUE_DEPTH
+}
+
+// defaultAdaptiveStart is the initial limit when adaptive limiting is on without MAX_IN_FLIGHT
+const defaultAdaptiveStart = 20
+
+// inFlightLimiterFromEnv builds the upstream concurrency cap from MAX_IN_FLIGHT/MAX_QUEUED
+// and the adaptive and fair-queuing MAX_IN_FLIGHT_* settings; nil when neither a cap nor
+// adaptive is set
+func inFlightLimiterFromEnv() (*upstreamLimiter, error) {
+	adaptive := envBool("MAX_IN_FLIGHT_ADAPTIVE")
+
+	limit := defaultAdaptiveStart
+	if v := os.Getenv("MAX_IN_FLIGHT"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			return nil, fmt.Errorf("MAX_IN_FLIGHT must be a positive integer")
+		}
+	} else if !adaptive {
+		return nil, nil
+	}
+
+	maxQueued, err := envInt("MAX_QUEUED", 10*limit)
+	if err != nil {
+		return nil, err
+	}
+	l := &upstreamLimiter{Limiter: limiter.New(limit, maxQueued), fair: envBool("MAX_IN_FLIGHT_FAIR")}
+
+	if v := os.Getenv("MAX_IN_FLIGHT_WEIGHTS"); v != "" {
+		l.fair, l.weights = true, map[string]float64{}
+		for _, pair := range strings.Split(v, ",") {
+			flow, w, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			weight, err := strconv.ParseFloat(w, 64)
+			if !ok || flow == "" || err != nil || weight <= 0 {
+				return nil, fmt.Errorf("MAX_IN_FLIGHT_WEIGHTS must be caller=weight pairs with positive weights")
+			}
+			l.weights[flow] = weight
+		}
+	}
+	if l.shed, err = shedderFromEnv(); err != nil {
+		return nil, err
+	}
+	if l.shed != nil {
+		log.Printf("Shedding calls that cannot meet their deadline while %d or more are queued", l.shed.depth)
+	}
+	if l.fair {
+		log.Printf("Fair queuing upstream calls across callers (%d weighted)", len(l.weights))
+	}
+
+	if !adaptive {
+		log.Printf("Limiting upstream calls to %d in flight (%d queued)", limit, maxQueued)
+		return l, nil
+	}
+
+	a := limiter.Adaptive{Tolerance: 2}
+	if a.Min, err = envInt("MAX_IN_FLIGHT_MIN", 1); err != nil {
+		return nil, err
+	}
+	if a.Max, err = envInt("MAX_IN_FLIGHT_MAX", 10*limit); err != nil {
+		return nil, err
+	}
+	if v := os.Getenv("MAX_IN_FLIGHT_LATENCY_TOLERANCE"); v != "" {
+		if a.Tolerance, err = strconv.ParseFloat(v, 64); err != nil || a.Tolerance <= 1 {
+			return nil, fmt.Errorf("MAX_IN_FLIGHT_LATENCY_TOLERANCE must be a number above 1")
+		}
+	}
+	l.SetAdaptive(a)
+
+	log.Printf("Adaptive upstream concurrency: starting at %d, range %d-%d (%d queued)", limit, a.Min, a.Max, maxQueued)
+	return l, nil
+}
+
+// flow names the caller an upstream call is made for: its authenticated identity,
+// otherwise its address
+func flow(ctx context.Context) string {
+	if id, ok := callerFrom(ctx); ok {
+		return id.Name
+	}
+	return strings.TrimPrefix(callerKey(ctx, "peer"), "peer:")
+}
+
+// inFlightInterceptor holds a limiter slot for the duration of each upstream call and
+// feeds its latency and outcome back for adaptive limiting and load shedding; waiting
+// for a slot counts against the call's deadline
+func inFlightInterceptor(l *upstreamLimiter) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, callOpts ...grpc.CallOption) error {
+		var (
+			release func()
+			err     error
+		)
+		if err := l.shed.admit(ctx, l.Limiter); err != nil {
+			metrics.LoadShed.Inc()
+			return err
+		}
+		if l.fair {
+			// The call context descends from the local server call, so the caller is known
+			f := flow(ctx)
+			release, err = l.AcquireFlow(ctx, f, l.weights[f])
+		} else {
+			release, err = l.Acquire(ctx)
+		}
+		if errors.Is(err, limiter.ErrQueueFull) {
+			metrics.InFlightRejected.Inc()
+			return detailedError(codes.ResourceExhausted, reasonQueueFull, queueRetryDelay, "too many concurrent requests")
+		}
+		if err != nil {
+			return status.FromContextError(err).Err()
+		}
+		defer release()
+
+		start := time.Now()
+		err = invoker(ctx, method, req, reply, cc, callOpts...)
+		l.shed.observe(time.Since(start))
+		switch status.Code(err) {
+		case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+			l.Observe(time.Since(start), true)
+		default:
+			l.Observe(time.Since(start), false)
+		}
+		return err
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/connectivity"
+	"systemiq.ai/metrics"
+	"systemiq.ai/protos"
+)
+
+// maxTransitions is how many recent state changes the admin status keeps
+const maxTransitions = 20
+
+// transitionLog keeps the recent connectivity changes of all endpoints for the admin API
+type transitionLog struct {
+	mu     sync.Mutex
+	events []*protos.ConnectivityEvent
+}
+
+func (l *transitionLog) add(e *protos.ConnectivityEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.events) == maxTransitions {
+		l.events = append(l.events[:0], l.events[1:]...)
+	}
+	l.events = append(l.events, e)
+}
+
+// recent returns the kept events, oldest first
+func (l *transitionLog) recent() []*protos.ConnectivityEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]*protos.ConnectivityEvent(nil), l.events...)
+}
+
+// connState is the last connectivity state seen on an endpoint's channel and since when
+type connState struct {
+	state connectivity.State
+	since time.Time
+}
+
+// watchConnectivity logs and counts every state change of the endpoint's channel with
+// the time spent in the state it left; a re-dialled connection continues the sequence
+func (s *upstreamSet) watchConnectivity(ctx context.Context, m *member) {
+	cur := connState{state: m.Conn().GetState(), since: time.Now()}
+	m.connState.Store(&cur)
+	metrics.ObserverConnectivityState.WithLabelValues(m.Endpoint(), cur.state.String()).Set(1)
+	for ctx.Err() == nil {
+		conn := m.Conn()
+		// Bounded wait so a connection swapped by a re-dial is picked up
+		waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+		conn.WaitForStateChange(waitCtx, cur.state)
+		cancel()
+
+		state := m.Conn().GetState()
+		if state == cur.state || ctx.Err() != nil {
+			continue
+		}
+		now := time.Now()
+		spent := now.Sub(cur.since)
+		endpoint := m.Endpoint()
+		metrics.ObserverConnectivityTransitions.WithLabelValues(endpoint, cur.state.String(), state.String()).Inc()
+		metrics.ObserverConnectivitySeconds.WithLabelValues(endpoint, cur.state.String()).Add(spent.Seconds())
+		metrics.ObserverConnectivityState.WithLabelValues(endpoint, cur.state.String()).Set(0)
+		metrics.ObserverConnectivityState.WithLabelValues(endpoint, state.String()).Set(1)
+		s.transitions.add(&protos.ConnectivityEvent{
+			Endpoint:     endpoint,
+			From:         cur.state.String(),
+			To:           state.String(),
+			AtUnixMs:     now.UnixMilli(),
+			AfterSeconds: spent.Seconds(),
+		})
+		log.Printf("Observer %s connectivity %s -> %s after %v", endpoint, cur.state, state, spent.Round(time.Millisecond))
+
+		cur = connState{state: state, since: now}
+		m.connState.Store(&cur)
+	}
+}
+
+// connectivityState returns the endpoint's last seen state and since when
+func (m *member) connectivityState() connState {
+	if st := m.connState.Load(); st != nil {
+		return *st
+	}
+	return connState{state: m.Conn().GetState()}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+)
+
+// consulRoundRobin spreads calls over every healthy instance instead of pinning the first
+const consulRoundRobin = `{"loadBalancingConfig":[{"round_robin":{}}]}`
+
+// consulResolverBuilder resolves "consul:///<service>[?tag=..&dc=..]" targets to the
+// passing instances of a Consul service, following changes with blocking queries
+type consulResolverBuilder struct {
+	addr  string // agent base URL, from CONSUL_HTTP_ADDR
+	token string // ACL token, from CONSUL_HTTP_TOKEN
+	http  *http.Client
+}
+
+// consulResolverFromEnv reads the standard CONSUL_HTTP_ADDR and CONSUL_HTTP_TOKEN
+func consulResolverFromEnv() *consulResolverBuilder {
+	addr := os.Getenv("CONSUL_HTTP_ADDR")
+	if addr == "" {
+		addr = "127.0.0.1:8500"
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	// No overall timeout: blocking queries hold the request for up to consulWait
+	return &consulResolverBuilder{addr: strings.TrimSuffix(addr, "/"), token: os.Getenv("CONSUL_HTTP_TOKEN"), http: &http.Client{}}
+}
+
+func (b *consulResolverBuilder) Scheme() string { return "consul" }
+
+func (b *consulResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	service := strings.TrimPrefix(target.URL.Path, "/")
+	if service == "" {
+		return nil, fmt.Errorf("consul target %q has no service name", target.URL.String())
+	}
+	query := url.Values{"passing": {"true"}}
+	for _, k := range []string{"tag", "dc"} {
+		if v := target.URL.Query().Get(k); v != "" {
+			query.Set(k, v)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &consulResolver{builder: b, service: service, query: query, cc: cc, cancel: cancel}
+	go r.watch(ctx)
+	return r, nil
+}
+
+// consulWait is how long each blocking query waits for a change
+const consulWait = 5 * time.Minute
+
+type consulResolver struct {
+	builder *consulResolverBuilder
+	service string
+	query   url.Values
+	cc      resolver.ClientConn
+	cancel  context.CancelFunc
+}
+
+// ResolveNow is a no-op: the watch already delivers every change
+func (r *consulResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (r *consulResolver) Close() { r.cancel() }
+
+// watch long-polls the health endpoint, pushing the instance list on every change
+func (r *consulResolver) watch(ctx context.Context) {
+	var index uint64
+	delay := time.Second
+	for ctx.Err() == nil {
+		addrs, next, err := r.fetch(ctx, index)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			r.cc.ReportError(fmt.Errorf("consul %s: %w", r.service, err))
+			select {
+			case <-ctx.Done():
+			case <-time.After(delay):
+			}
+			delay = min(delay*2, 30*time.Second)
+			continue
+		}
+		delay = time.Second
+
+		// A lower index means Consul state was reset; start the watch over
+		if next < index {
+			next = 0
+		}
+		if next != index || index == 0 {
+			r.cc.UpdateState(resolver.State{Addresses: addrs, ServiceConfig: r.cc.ParseServiceConfig(consulRoundRobin)})
+		}
+		index = next
+	}
+}
+
+// fetch runs one blocking query, returning the passing instances and the X-Consul-Index
+func (r *consulResolver) fetch(ctx context.Context, index uint64) ([]resolver.Address, uint64, error) {
+	q := url.Values{}
+	for k, v := range r.query {
+		q[k] = v
+	}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", consulWait.String())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.builder.addr+"/v1/health/service/"+url.PathEscape(r.service)+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.builder.token != "" {
+		req.Header.Set("X-Consul-Token", r.builder.token)
+	}
+	resp, err := r.builder.http.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("health query: %s", resp.Status)
+	}
+
+	var entries []struct {
+		Node    struct{ Address string }
+		Service struct {
+			Address string
+			Port    int
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, fmt.Errorf("decode health response: %w", err)
+	}
+
+	addrs := make([]resolver.Address, 0, len(entries))
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address // service registered without its own address
+		}
+		addrs = append(addrs, resolver.Address{Addr: net.JoinHostPort(host, strconv.Itoa(e.Service.Port))})
+	}
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	return addrs, next, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// crashReporter sends panics and sustained forwarding failures to a Sentry-compatible
+// store endpoint, so problems at edge sites surface without anyone mailing logs.
+// Events never carry payloads or tokens, and messages are scrubbed of secrets.
+type crashReporter struct {
+	storeURL    string
+	auth        string // X-Sentry-Auth header
+	environment string
+	hostname    string
+	threshold   int // consecutive forwarding failures that trigger a report
+	client      *http.Client
+
+	mu       sync.Mutex
+	failures int  // consecutive upstream failures
+	reported bool // reported the current streak already
+}
+
+// crashReporterFromEnv reads CRASH_REPORT_DSN (a Sentry DSN, e.g.
+// https://key@sentry.example.com/42; off when unset), CRASH_REPORT_ENVIRONMENT and
+// CRASH_REPORT_FAILURE_THRESHOLD
+func crashReporterFromEnv() (*crashReporter, error) {
+	dsn := os.Getenv("CRASH_REPORT_DSN")
+	if dsn == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.User.Username() == "" || u.Host == "" {
+		return nil, fmt.Errorf("CRASH_REPORT_DSN must look like https://key@host/project")
+	}
+	i := strings.LastIndex(u.Path, "/")
+	project := u.Path[i+1:]
+	if project == "" {
+		return nil, fmt.Errorf("CRASH_REPORT_DSN has no project ID")
+	}
+	threshold, err := envInt("CRASH_REPORT_FAILURE_THRESHOLD", 50)
+	if err != nil || threshold == 0 {
+		return nil, fmt.Errorf("CRASH_REPORT_FAILURE_THRESHOLD must be a positive integer")
+	}
+	hostname, _ := os.Hostname()
+	r := &crashReporter{
+		storeURL:    fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, u.Path[:i], project),
+		auth:        fmt.Sprintf("Sentry sentry_version=7, sentry_client=observer-middleware/%s, sentry_key=%s", version, u.User.Username()),
+		environment: os.Getenv("CRASH_REPORT_ENVIRONMENT"),
+		hostname:    hostname,
+		threshold:   threshold,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+	log.Printf("Reporting panics and %d+ consecutive forwarding failures to %s", threshold, u.Host)
+	return r, nil
+}
+
+// secretPatterns match what must never leave the site: JWTs, bearer tokens and
+// key=value pairs with a secret-looking key
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+	regexp.MustCompile(`(?i)bearer\s+\S+`),
+	regexp.MustCompile(`(?i)((?:password|passwd|secret|token|api[-_]?key)["']?\s*[:=]\s*)("[^"]*"|\S+)`),
+}
+
+// scrub redacts secrets from s
+func scrub(s string) string {
+	s = secretPatterns[0].ReplaceAllString(s, "[token]")
+	s = secretPatterns[1].ReplaceAllString(s, "Bearer [scrubbed]")
+	return secretPatterns[2].ReplaceAllString(s, "${1}[scrubbed]")
+}
+
+// sentryFrame and the types below are the subset of the Sentry event schema we send
+type sentryFrame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+}
+
+type sentryException struct {
+	Type       string `json:"type"`
+	Value      string `json:"value"`
+	Stacktrace struct {
+		Frames []sentryFrame `json:"frames"`
+	} `json:"stacktrace"`
+}
+
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Logger      string            `json:"logger"`
+	Release     string            `json:"release"`
+	Environment string            `json:"environment,omitempty"`
+	ServerName  string            `json:"server_name"`
+	Message     string            `json:"message,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Exception   *struct {
+		Values []sentryException `json:"values"`
+	} `json:"exception,omitempty"`
+}
+
+// send posts one event; failures are only logged
+func (r *crashReporter) send(e *sentryEvent) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	e.EventID = hex.EncodeToString(id)
+	e.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	e.Platform, e.Logger, e.Release = "go", "observer-middleware", version
+	e.Environment, e.ServerName = r.environment, r.hostname
+
+	body, _ := json.Marshal(e)
+	req, err := http.NewRequest(http.MethodPost, r.storeURL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("crash report: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", r.auth)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		log.Printf("crash report: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("crash report: %s", resp.Status)
+	}
+}
+
+// panicEvent describes a recovered panic with the stack of the panicking goroutine
+func panicEvent(v any, where string) *sentryEvent {
+	exc := sentryException{Type: "panic", Value: scrub(fmt.Sprint(v))}
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for top := true; ; {
+		f, more := frames.Next()
+		// Skip the panic machinery so the panicking function is the innermost frame
+		if top = top && strings.HasPrefix(f.Function, "runtime."); top && more {
+			continue
+		}
+		// Sentry lists the outermost frame first
+		exc.Stacktrace.Frames = append([]sentryFrame{{Function: f.Function, Filename: f.File, Lineno: f.Line}}, exc.Stacktrace.Frames...)
+		if !more {
+			break
+		}
+	}
+	e := &sentryEvent{Level: "fatal", Tags: map[string]string{"where": where}}
+	e.Exception = &struct {
+		Values []sentryException `json:"values"`
+	}{Values: []sentryException{exc}}
+	return e
+}
+
+// recoverAndReport reports a panic unwinding runServe, then lets it crash the process
+func (r *crashReporter) recoverAndReport() {
+	if r == nil {
+		return
+	}
+	if v := recover(); v != nil {
+		r.send(panicEvent(v, "main")) // before the process dies
+		panic(v)
+	}
+}
+
+// callFinished tracks the streak of upstream failures, reporting once per streak when it
+// reaches the threshold
+func (r *crashReporter) callFinished(err error) {
+	r.mu.Lock()
+	// RESOURCE_EXHAUSTED mostly comes from local limits, not the Observer
+	if code := status.Code(err); !isUpstreamFailure(err) || code == codes.ResourceExhausted {
+		r.failures, r.reported = 0, false
+		r.mu.Unlock()
+		return
+	}
+	r.failures++
+	if r.failures < r.threshold || r.reported {
+		r.mu.Unlock()
+		return
+	}
+	r.reported = true
+	e := &sentryEvent{
+		Level:   "error",
+		Message: scrub(fmt.Sprintf("%d consecutive forwarding failures, last: %s: %s", r.failures, status.Code(err), status.Convert(err).Message())),
+		Tags:    map[string]string{"code": status.Code(err).String()},
+	}
+	r.mu.Unlock()
+	go r.send(e)
+}
+
+// unaryInterceptor turns a panicking call into INTERNAL (keeping the server up) and
+// reports it, and watches forwarding outcomes for sustained failures
+func (r *crashReporter) unaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				log.Printf("panic in %s: %v", info.FullMethod, v)
+				go r.send(panicEvent(v, info.FullMethod))
+				resp, err = nil, status.Error(codes.Internal, "internal error")
+			}
+		}()
+		resp, err = handler(ctx, req)
+		r.callFinished(err)
+		return resp, err
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"systemiq.ai/metrics"
+	"systemiq.ai/protos"
+)
+
+// deduper suppresses byte-identical observations from the same caller within a window,
+// for exporters that re-send unchanged snapshots. Only successfully forwarded payloads
+// are remembered, so a caller retrying after an error is never swallowed.
+type deduper struct {
+	window time.Duration
+	max    int
+	shared *redisDedup // nil without DEDUP_REDIS_URL
+
+	mu       sync.Mutex
+	claims   map[[sha256.Size]byte]bool      // held in Redis by calls still forwarding
+	current  map[[sha256.Size]byte]time.Time // forwarding time by payload hash
+	previous map[[sha256.Size]byte]time.Time // the generation before; dropped on rotation
+	rotated  time.Time
+}
+
+// dedupFromEnv reads DEDUP_WINDOW (off when unset), DEDUP_MAX_ENTRIES and DEDUP_REDIS_URL
+func dedupFromEnv() (*deduper, error) {
+	if os.Getenv("DEDUP_WINDOW") == "" {
+		return nil, nil
+	}
+	window, err := envDuration("DEDUP_WINDOW", 0)
+	if err != nil {
+		return nil, err
+	}
+	max, err := envInt("DEDUP_MAX_ENTRIES", 100000)
+	if err != nil || max == 0 {
+		return nil, fmt.Errorf("DEDUP_MAX_ENTRIES must be a positive integer")
+	}
+	shared, err := redisDedupFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Suppressing identical observations repeated within %v", window)
+	return &deduper{window: window, max: max, shared: shared, claims: map[[sha256.Size]byte]bool{}, current: map[[sha256.Size]byte]time.Time{}, rotated: time.Now()}, nil
+}
+
+// payloadKey hashes the caller and the payload as received, before labels and stages
+func payloadKey(ctx context.Context, req observation) [sha256.Size]byte {
+	h := sha256.New()
+	writeField := func(b []byte) {
+		h.Write(binary.AppendUvarint(nil, uint64(len(b))))
+		h.Write(b)
+	}
+	writeField([]byte(flow(ctx)))
+	switch r := req.(type) {
+	case *rawMessage:
+		writeField(r.buf)
+	case *protos.ObservationRequest:
+		writeField([]byte(r.GetIndicator()))
+		writeField(binary.AppendVarint(nil, int64(r.GetElementId())))
+		writeField([]byte(r.GetAction()))
+		for _, data := range r.GetData() {
+			writeField([]byte(data))
+		}
+	}
+	return [sha256.Size]byte(h.Sum(nil))
+}
+
+// duplicate reports whether key was forwarded within the window, here or by another
+// replica sharing DEDUP_REDIS_URL, counting suppressions. A new key is claimed in
+// Redis until the call forwards it or releases it.
+func (d *deduper) duplicate(key [sha256.Size]byte) bool {
+	if !d.seen(key) {
+		held, duplicate := d.shared.claim(key, d.window)
+		if !duplicate {
+			if held {
+				d.mu.Lock()
+				d.claims[key] = true
+				d.mu.Unlock()
+			}
+			return false
+		}
+	}
+	metrics.DedupSuppressed.Inc()
+	return true
+}
+
+// release gives up the Redis claim on key unless it was forwarded; deferred by callers
+// of duplicate
+func (d *deduper) release(key [sha256.Size]byte) {
+	d.mu.Lock()
+	held := d.claims[key]
+	delete(d.claims, key)
+	d.mu.Unlock()
+	if held {
+		d.shared.release(key)
+	}
+}
+
+// seen reports whether this replica forwarded key within the window
+func (d *deduper) seen(key [sha256.Size]byte) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	at, ok := d.current[key]
+	if !ok {
+		at, ok = d.previous[key]
+	}
+	return ok && time.Since(at) < d.window
+}
+
+// forwarded remembers key, keeping its Redis claim until it expires. Entries live in
+// two generations rotated every window (or when the current one is full), bounding
+// memory without scanning for expired entries.
+func (d *deduper) forwarded(key [sha256.Size]byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.claims, key)
+	now := time.Now()
+	if now.Sub(d.rotated) >= d.window || len(d.current) >= d.max {
+		d.previous, d.current, d.rotated = d.current, make(map[[sha256.Size]byte]time.Time, len(d.current)), now
+	}
+	d.current[key] = now
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"systemiq.ai/metrics"
+)
+
+// redisDedupTimeout bounds each Redis round trip; a slow Redis costs this much latency
+// at most before the call is forwarded as if it were new
+const redisDedupTimeout = 250 * time.Millisecond
+
+// redisDedupCooldown is how long Redis is left alone after a failure, each replica
+// deduplicating on its own meanwhile, so an outage does not add a timeout to every call
+const redisDedupCooldown = 30 * time.Second
+
+// redisDedupPrefix namespaces the payload hashes in a shared Redis
+const redisDedupPrefix = "middleware:dedup:"
+
+// redisDedup shares forwarded payload hashes between replicas behind a load balancer.
+// A replica claims a hash with one SET NX before forwarding, so two replicas
+// receiving the same payload at once cannot both pass, and releases it if forwarding
+// fails. Redis errors never suppress an observation; the local window still applies.
+type redisDedup struct {
+	client    *redis.Client
+	addr      string
+	downUntil atomic.Int64 // Unix nanoseconds; Redis is skipped until then
+}
+
+// redisDedupFromEnv reads DEDUP_REDIS_URL (redis:// or rediss://, with optional
+// credentials and database number); nil when unset
+func redisDedupFromEnv() (*redisDedup, error) {
+	v := os.Getenv("DEDUP_REDIS_URL")
+	if v == "" {
+		return nil, nil
+	}
+	opts, err := redis.ParseURL(v)
+	if err != nil {
+		return nil, fmt.Errorf("DEDUP_REDIS_URL must look like redis://[user:password@]host:port[/db] (rediss:// for TLS): %w", err)
+	}
+	opts.DialTimeout, opts.ReadTimeout, opts.WriteTimeout = redisDedupTimeout, redisDedupTimeout, redisDedupTimeout
+	opts.MaxRetries = -1 // a failure starts the cool-down instead
+	r := &redisDedup{client: redis.NewClient(opts), addr: opts.Addr}
+	log.Printf("Sharing the dedup window with other replicas through Redis at %s", r.addr)
+	return r, nil
+}
+
+func redisDedupKey(key [sha256.Size]byte) string {
+	return redisDedupPrefix + hex.EncodeToString(key[:])
+}
+
+// claim atomically stores key for window unless another call did so first: held when
+// this call now owns it and must release it unless forwarded, duplicate when the key
+// was already there. Both are false while Redis is unavailable.
+func (r *redisDedup) claim(key [sha256.Size]byte, window time.Duration) (held, duplicate bool) {
+	if r == nil || r.coolingDown() {
+		return false, false
+	}
+	ok, err := r.client.SetNX(context.Background(), redisDedupKey(key), 1, window).Result()
+	if err != nil {
+		r.fail(err)
+		return false, false
+	}
+	return ok, !ok
+}
+
+// release deletes a claim whose observation was not forwarded, so a retry passes
+func (r *redisDedup) release(key [sha256.Size]byte) {
+	if r.coolingDown() {
+		return
+	}
+	if err := r.client.Del(context.Background(), redisDedupKey(key)).Err(); err != nil {
+		r.fail(err)
+	}
+}
+
+func (r *redisDedup) coolingDown() bool {
+	return time.Now().UnixNano() < r.downUntil.Load()
+}
+
+// fail starts the cool-down, warning once for each
+func (r *redisDedup) fail(err error) {
+	metrics.DedupRedisErrors.Inc()
+	now := time.Now()
+	if last := r.downUntil.Load(); now.UnixNano() >= last && r.downUntil.CompareAndSwap(last, now.Add(redisDedupCooldown).UnixNano()) {
+		log.Printf("WARNING: dedup Redis %s: %v (deduplicating per replica for %v)", r.addr, err, redisDedupCooldown)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"systemiq.ai/protos"
+)
+
+// deltaEncodingName is the capability an Observer advertises when it reassembles deltas
+const deltaEncodingName = "json-merge-patch"
+
+// Delta labels. The reassembly contract for the Observer:
+//   - every request carrying delta.key stores its reassembled data as the base for that
+//     key, together with delta.seq;
+//   - a request also carrying delta.encoding=json-merge-patch has each data entry replaced
+//     by an RFC 7386 merge patch against the same entry of the base with seq delta.base;
+//   - if the stored base has another seq (or none), the Observer answers FAILED_PRECONDITION
+//     and the middleware resends the full payload.
+const (
+	deltaKeyLabel      = "delta.key"
+	deltaSeqLabel      = "delta.seq"
+	deltaBaseLabel     = "delta.base"
+	deltaEncodingLabel = "delta.encoding"
+)
+
+// deltaEncoder replaces repetitive JSON payloads with merge patches against the last
+// payload forwarded for the same caller, indicator and element
+type deltaEncoder struct {
+	keyframeEvery int // deltas in a row before a full payload is sent again
+	maxKeys       int
+	seq           atomic.Uint64 // starts at the startup time, so it never repeats across restarts
+
+	mu                sync.Mutex
+	current, previous map[string]*deltaBase // two generations, rotated when current is full
+}
+
+// deltaBase is the last payload the Observer accepted for a key
+type deltaBase struct {
+	seq    uint64
+	data   []string
+	deltas int // deltas sent since the last full payload
+}
+
+// deltaFrame is one encoded request, committed as the new base once forwarded
+type deltaFrame struct {
+	key     string
+	base    deltaBase // the new base: this request's full data
+	patched bool
+}
+
+// deltaFromEnv reads DELTA_ENCODING, DELTA_KEYFRAME_INTERVAL and DELTA_MAX_KEYS
+func deltaFromEnv() (*deltaEncoder, error) {
+	if !envBool("DELTA_ENCODING") {
+		return nil, nil
+	}
+	keyframeEvery, err := envInt("DELTA_KEYFRAME_INTERVAL", 50)
+	if err != nil {
+		return nil, err
+	}
+	maxKeys, err := envInt("DELTA_MAX_KEYS", 10000)
+	if err != nil || maxKeys == 0 {
+		return nil, fmt.Errorf("DELTA_MAX_KEYS must be a positive integer")
+	}
+	d := &deltaEncoder{keyframeEvery: keyframeEvery, maxKeys: maxKeys, current: map[string]*deltaBase{}}
+	d.seq.Store(uint64(time.Now().UnixNano()))
+	log.Printf("Delta-encoding repetitive payloads for Observers that support %s (full payload every %d)", deltaEncodingName, keyframeEvery+1)
+	return d, nil
+}
+
+// encode labels req for delta tracking and, when a base is known and the patches at
+// least halve the payload, replaces its data with merge patches
+func (d *deltaEncoder) encode(ctx context.Context, req *protos.ObservationRequest) *deltaFrame {
+	h := sha256.New()
+	h.Write([]byte(flow(ctx)))
+	h.Write([]byte{0})
+	h.Write([]byte(req.GetIndicator()))
+	h.Write(binary.AppendVarint(nil, int64(req.GetElementId())))
+	f := &deltaFrame{
+		key:  hex.EncodeToString(h.Sum(nil)[:8]),
+		base: deltaBase{seq: d.seq.Add(1), data: slices.Clone(req.Data)},
+	}
+	if req.Labels == nil {
+		req.Labels = map[string]string{}
+	}
+	req.Labels[deltaKeyLabel] = f.key
+	req.Labels[deltaSeqLabel] = strconv.FormatUint(f.base.seq, 10)
+
+	base := d.lookup(f.key)
+	if base == nil || base.deltas >= d.keyframeEvery || len(base.data) != len(req.Data) {
+		return f
+	}
+	patches := make([]string, len(req.Data))
+	var full, patched int
+	for i, data := range req.Data {
+		patch, ok := mergePatch(base.data[i], data)
+		if !ok {
+			return f
+		}
+		patches[i] = patch
+		full += len(data)
+		patched += len(patch)
+	}
+	if 2*patched > full {
+		return f
+	}
+
+	req.Data = patches
+	req.Labels[deltaEncodingLabel] = deltaEncodingName
+	req.Labels[deltaBaseLabel] = strconv.FormatUint(base.seq, 10)
+	f.base.deltas = base.deltas + 1
+	f.patched = true
+	return f
+}
+
+// undo restores the full payload, keeping the labels that make it the next base
+func (f *deltaFrame) undo(req *protos.ObservationRequest) {
+	req.Data = slices.Clone(f.base.data)
+	delete(req.Labels, deltaEncodingLabel)
+	delete(req.Labels, deltaBaseLabel)
+	f.base.deltas = 0
+	f.patched = false
+}
+
+// full returns a copy of req carrying the whole payload, for a receiver that never saw
+// the base (the shadow Observer); req itself keeps its patches
+func (f *deltaFrame) full(req *protos.ObservationRequest) *protos.ObservationRequest {
+	req = proto.Clone(req).(*protos.ObservationRequest)
+	if f != nil && f.patched {
+		req.Data = slices.Clone(f.base.data)
+		delete(req.Labels, deltaEncodingLabel)
+		delete(req.Labels, deltaBaseLabel)
+	}
+	return req
+}
+
+// commit makes the frame's payload the base for later requests with its key
+func (d *deltaEncoder) commit(f *deltaFrame) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.current) >= d.maxKeys {
+		d.previous, d.current = d.current, make(map[string]*deltaBase, len(d.current))
+	}
+	base := f.base
+	d.current[f.key] = &base
+}
+
+// lookup returns the base for key, promoting it from the previous generation
+func (d *deltaEncoder) lookup(key string) *deltaBase {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if base, ok := d.current[key]; ok {
+		return base
+	}
+	base, ok := d.previous[key]
+	if ok && len(d.current) < d.maxKeys {
+		d.current[key] = base
+	}
+	return base
+}
+
+// mergePatch returns the RFC 7386 merge patch turning the JSON object base into next;
+// payloads that are not objects, or contain nulls (which a merge patch cannot carry),
+// are reported as not patchable
+func mergePatch(base, next string) (string, bool) {
+	a, ok := decodeObject(base)
+	if !ok {
+		return "", false
+	}
+	b, ok := decodeObject(next)
+	if !ok || containsNull(b) {
+		return "", false
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if enc.Encode(diffObjects(a, b)) != nil {
+		return "", false
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), true
+}
+
+// diffObjects returns the members of b that differ from a, with null for removed ones
+func diffObjects(a, b map[string]any) map[string]any {
+	patch := map[string]any{}
+	for k, bv := range b {
+		av, ok := a[k]
+		if ok && reflect.DeepEqual(av, bv) {
+			continue
+		}
+		aObj, aIsObj := av.(map[string]any)
+		bObj, bIsObj := bv.(map[string]any)
+		if aIsObj && bIsObj {
+			patch[k] = diffObjects(aObj, bObj)
+		} else {
+			patch[k] = bv
+		}
+	}
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			patch[k] = nil
+		}
+	}
+	return patch
+}
+
+func decodeObject(data string) (map[string]any, bool) {
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+	var obj map[string]any
+	if dec.Decode(&obj) != nil || obj == nil {
+		return nil, false
+	}
+	return obj, true
+}
+
+func containsNull(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case map[string]any:
+		for _, e := range v {
+			if containsNull(e) {
+				return true
+			}
+		}
+	case []any:
+		return slices.ContainsFunc(v, containsNull)
+	}
+	return false
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"systemiq.ai/auth"
+)
+
+// clockFloor is earlier than any correct clock reading: a host showing an earlier time
+// has lost its clock (dead RTC battery, no NTP yet), and TLS and tokens will fail
+var clockFloor = time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// doctorCheck is one named check; detail is printed on success
+type doctorCheck struct {
+	name string
+	run  func(ctx context.Context) (detail string, err error)
+	soft bool // cheap and not repeated by serve's own startup, so run at every start
+}
+
+// runDoctor checks what serve needs at startup without serving, printing one
+// PASS/FAIL line per check; the exit code is 1 if any check failed
+func runDoctor(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	timeout := fs.Duration("timeout", 10*time.Second, "time allowed per check")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: observer_middleware doctor [-timeout d] [--flag=value ...]\n\nTakes the same configuration flags as serve.")
+		fs.PrintDefaults()
+	}
+	configFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return flagExit(err)
+	}
+	if printChecks(doctorChecks(), *timeout) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// printChecks runs checks with a timeout each, printing PASS/FAIL lines and a summary of
+// failures, and returns the number that failed
+func printChecks(checks []doctorCheck, timeout time.Duration) int {
+	// The checks report their own outcome; dial and login logs would only interleave
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	failed := 0
+	for _, check := range checks {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		detail, err := check.run(ctx)
+		cancel()
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL  %s: %v\n", check.name, err)
+			continue
+		}
+		if detail != "" {
+			detail = ": " + detail
+		}
+		fmt.Printf("PASS  %s%s\n", check.name, detail)
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d check(s) failed\n", failed, len(checks))
+	} else {
+		fmt.Printf("All %d check(s) passed\n", len(checks))
+	}
+	return failed
+}
+
+// softPreflight runs the soft checks at every start, logging failures as warnings
+func softPreflight() {
+	for _, check := range doctorChecks() {
+		if !check.soft {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		if _, err := check.run(ctx); err != nil {
+			log.Printf("WARNING: preflight: %s: %v", check.name, err)
+		}
+		cancel()
+	}
+}
+
+// doctorChecks lists the checks for the current configuration; offline mode needs
+// neither the Observer nor auth
+func doctorChecks() []doctorCheck {
+	var checks []doctorCheck
+	for _, dir := range []string{"OFFLINE_DIR", "BUFFER_DIR"} {
+		if path := os.Getenv(dir); path != "" {
+			checks = append(checks, doctorCheck{"write " + dir, func(context.Context) (string, error) {
+				return checkWritable(path)
+			}, true})
+		}
+	}
+	if os.Getenv("BUFFER_KEY_FILE") != "" {
+		checks = append(checks, doctorCheck{"buffer key", func(context.Context) (string, error) {
+			c, err := spoolCipherFromEnv()
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("key %x", c.fingerprint), nil
+		}, true})
+	}
+	checks = append(checks, doctorCheck{"local clock", checkClockFloor, true})
+	if os.Getenv("OFFLINE_DIR") != "" {
+		return checks
+	}
+
+	endpoints, _, err := endpointsFromEnv(observerEndpointFromEnv())
+	if err != nil {
+		checks = append(checks, doctorCheck{"observer endpoints", func(context.Context) (string, error) { return "", err }, true})
+		endpoints = nil
+	}
+	for _, endpoint := range endpoints {
+		if host, _, err := net.SplitHostPort(endpoint); err == nil && net.ParseIP(host) == nil && !strings.Contains(endpoint, "://") {
+			checks = append(checks, doctorCheck{"resolve " + host, func(ctx context.Context) (string, error) {
+				addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+				return strings.Join(addrs, ", "), err
+			}, true})
+		}
+		checks = append(checks, doctorCheck{"connect " + endpoint, func(ctx context.Context) (string, error) {
+			return checkObserver(ctx, endpoint)
+		}, false})
+	}
+
+	// The clock is compared with the issuer's once login has produced a token
+	var login *auth.AuthHandler
+	var driftWarn time.Duration
+	checks = append(checks, doctorCheck{"auth login", func(ctx context.Context) (string, error) {
+		h, cfg, detail, err := checkLogin(ctx)
+		login, driftWarn = h, cfg.ClockDriftWarn
+		return detail, err
+	}, false})
+	checks = append(checks, doctorCheck{"clock vs. token issuer", func(context.Context) (string, error) {
+		if login == nil {
+			return "", errors.New("skipped, no login")
+		}
+		offset, ok := login.ClockOffset()
+		if !ok {
+			return "token carries no iat, cannot compare", nil
+		}
+		if offset > driftWarn || offset < -driftWarn {
+			return "", fmt.Errorf("local clock differs from the token issuer by %s (more than AUTH_CLOCK_DRIFT_WARN %s); check NTP", offset.Round(time.Second), driftWarn)
+		}
+		return "offset " + offset.Round(time.Second).String(), nil
+	}, false})
+	return checks
+}
+
+// checkObserver dials endpoint like serve does and waits for READY, then asks for
+// the Observer's capabilities
+func checkObserver(ctx context.Context, endpoint string) (string, error) {
+	srvRefresh, err := envDuration("OBSERVER_SRV_REFRESH", 30*time.Second)
+	if err != nil {
+		return "", err
+	}
+	channel, err := observerChannelFromEnv()
+	if err != nil {
+		return "", err
+	}
+	conn, err := dialObserver(endpoint, methodConfig{}, nil,
+		append(channel, grpc.WithResolvers(consulResolverFromEnv(), &srvResolverBuilder{interval: srvRefresh}))...)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.Connect()
+	if !waitForReady(ctx, conn) {
+		return "", fmt.Errorf("not READY (%s)", conn.GetState())
+	}
+	caps, err := handshake(ctx, conn)
+	if err != nil {
+		return "", fmt.Errorf("capabilities: %w", err)
+	}
+	return fmt.Sprintf("READY over %s, capabilities: %v", strings.ToUpper(observerTransportSecurity(endpoint)), caps), nil
+}
+
+// checkLogin logs in once with the configured credentials, without retries
+func checkLogin(context.Context) (*auth.AuthHandler, auth.Config, string, error) {
+	cfg, err := auth.ConfigFromEnv()
+	if err != nil {
+		return nil, cfg, "", err
+	}
+	cfg.LazyLogin, cfg.StartupRetry, cfg.RetryMaxAttempts = false, false, 1
+	h, err := auth.NewAuthHandler(cfg)
+	if err != nil {
+		return nil, cfg, "", err
+	}
+	h.StopRefresher()
+	return h, cfg, fmt.Sprintf("client(s) %v", h.ClientIDs()), nil
+}
+
+// checkWritable creates dir if needed and writes, syncs and removes a probe file in it
+func checkWritable(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(dir, ".preflight-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(make([]byte, 4096))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// checkClockFloor catches hosts whose clock was reset to the distant past
+func checkClockFloor(context.Context) (string, error) {
+	now := time.Now()
+	if now.Before(clockFloor) {
+		return "", fmt.Errorf("local clock reads %s; set the time or enable NTP", now.UTC().Format(time.RFC3339))
+	}
+	return now.UTC().Format(time.RFC3339), nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"systemiq.ai/metrics"
+	"systemiq.ai/protos"
+)
+
+// dryRunLogLimit caps the logged form of each observation
+const dryRunLogLimit = 2048
+
+// dryRun is set by DRY_RUN: observations pass through the whole pipeline, token
+// acquisition included, but are logged instead of sent to the Observer
+var dryRun bool
+
+// errDryRun is returned by forward in place of the Observer's answer; callers turn it
+// into a success response
+var errDryRun = errors.New("dry run: not forwarded")
+
+// dryRunSuccess is the response given for an observation that was not forwarded
+var dryRunSuccess = &protos.ObservationResponse{Status: "success"}
+
+// logDryRun logs the observation forward would have sent
+func (s *ObserverMiddlewareServer) logDryRun(method string, req observation, clientID int) {
+	metrics.DryRunForwards.Inc()
+	var final proto.Message
+	switch r := req.(type) {
+	case *protos.ObservationRequest:
+		final = r
+	case *rawMessage:
+		// Labels are appended to raw requests at send time
+		decoded, err := decodeLenient(append(bytes.Clone(r.buf), s.labels.Load().encoded()...))
+		if err != nil {
+			log.Printf("DRY RUN: would forward %q for client %d via %s (%d bytes, undecodable: %v)", req.GetIndicator(), clientID, path.Base(method), len(r.buf), err)
+			return
+		}
+		final = decoded
+	}
+	text, _ := protojson.Marshal(final)
+	if len(text) > dryRunLogLimit {
+		text = fmt.Appendf(text[:dryRunLogLimit:dryRunLogLimit], "... (%d bytes)", len(text))
+	}
+	log.Printf("DRY RUN: would forward %q for client %d via %s: %s", req.GetIndicator(), clientID, path.Base(method), text)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// errorDomain is the ErrorInfo domain of statuses the middleware produces itself
+const errorDomain = "middleware.systemiq.ai"
+
+// ErrorInfo reasons, so producers can branch on failures without matching messages
+const (
+	reasonAuthPending     = "AUTH_PENDING"     // still logging in after start
+	reasonAuthUnavailable = "AUTH_UNAVAILABLE" // auth service unreachable
+	reasonAuthExpired     = "AUTH_EXPIRED"     // session expired and could not be renewed yet
+	reasonAuthRejected    = "AUTH_REJECTED"    // middleware credentials refused
+	reasonCallerAuth      = "CALLER_UNAUTHENTICATED"
+	reasonCallerDenied    = "CALLER_NOT_ALLOWED"
+	reasonRateLimited     = "RATE_LIMITED"
+	reasonBandwidth       = "BANDWIDTH_LIMITED"
+	reasonQueueFull       = "QUEUE_FULL"
+	reasonOverloaded      = "OVERLOADED"
+	reasonRampingUp       = "UPSTREAM_RAMPING_UP"
+	reasonUpstreamDown    = "UPSTREAM_DOWN"
+	reasonStandby         = "STANDBY"
+)
+
+// Backoff hints where the middleware cannot tell when capacity comes back
+const (
+	authRetryDelay     = 2 * time.Second
+	queueRetryDelay    = 500 * time.Millisecond
+	upstreamRetryDelay = time.Second
+)
+
+// detailedError returns a status with an ErrorInfo for reason and, when retryAfter is
+// positive, a RetryInfo backoff hint
+func detailedError(code codes.Code, reason string, retryAfter time.Duration, msg string) error {
+	return withDetails(status.New(code, msg), reason, retryAfter).Err()
+}
+
+// withDetails attaches ErrorInfo and RetryInfo to st; st is returned unchanged if the
+// details cannot be encoded
+func withDetails(st *status.Status, reason string, retryAfter time.Duration) *status.Status {
+	details := []protoadapt.MessageV1{&errdetails.ErrorInfo{Reason: reason, Domain: errorDomain}}
+	if retryAfter > 0 {
+		details = append(details, &errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)})
+	}
+	if d, err := st.WithDetails(details...); err == nil {
+		return d
+	}
+	return st
+}
+
+// upstreamDown marks forwarding errors that carry no details of their own as
+// UPSTREAM_DOWN when they are UNAVAILABLE (connection refused, no healthy endpoint) or
+// a deadline that ran out waiting for a failing connection
+func upstreamDown(err error, conn *grpc.ClientConn) error {
+	st, ok := status.FromError(err)
+	if !ok || len(st.Details()) > 0 {
+		return err
+	}
+	switch st.Code() {
+	case codes.Unavailable:
+	case codes.DeadlineExceeded:
+		if conn.GetState() != connectivity.TransientFailure {
+			return err
+		}
+	default:
+		return err
+	}
+	return withDetails(st, reasonUpstreamDown, upstreamRetryDelay).Err()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"systemiq.ai/metrics"
+)
+
+// reasonUpstreamError marks Observer errors translated by the error map
+const reasonUpstreamError = "UPSTREAM_ERROR"
+
+// defaultErrorMap turns Observer-side faults into a retryable UNAVAILABLE, so their
+// messages (stack traces, internal host names) do not reach producers
+const defaultErrorMap = "INTERNAL=UNAVAILABLE,UNKNOWN=UNAVAILABLE,DATA_LOSS=UNAVAILABLE"
+
+// codeNames are the canonical names of gRPC codes, indexed by code
+var codeNames = []string{
+	"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED", "NOT_FOUND",
+	"ALREADY_EXISTS", "PERMISSION_DENIED", "RESOURCE_EXHAUSTED", "FAILED_PRECONDITION",
+	"ABORTED", "OUT_OF_RANGE", "UNIMPLEMENTED", "INTERNAL", "UNAVAILABLE", "DATA_LOSS",
+	"UNAUTHENTICATED",
+}
+
+// parseCode accepts a canonical code name
+func parseCode(name string) (codes.Code, error) {
+	i := slices.Index(codeNames, strings.ToUpper(strings.TrimSpace(name)))
+	if i <= 0 {
+		return 0, fmt.Errorf("unknown gRPC code %q", name)
+	}
+	return codes.Code(i), nil
+}
+
+// errorRule translates an Observer status with code from, and contains in its message
+// when set, to code to
+type errorRule struct {
+	from     codes.Code
+	contains string
+	to       codes.Code
+}
+
+// errorMap translates Observer errors into statuses meant for local producers
+type errorMap struct {
+	rules        []errorRule
+	keepMessages bool
+}
+
+// errorMapFromEnv reads OBSERVER_ERROR_MAP, comma-separated FROM[~text]=TO rules tried
+// in order ("none" turns mapping off), and OBSERVER_ERROR_MESSAGES
+func errorMapFromEnv() (*errorMap, error) {
+	spec := envString("OBSERVER_ERROR_MAP", defaultErrorMap)
+	if spec == "none" {
+		return nil, nil
+	}
+	m := &errorMap{keepMessages: envBool("OBSERVER_ERROR_MESSAGES")}
+	for _, entry := range strings.Split(spec, ",") {
+		left, right, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("OBSERVER_ERROR_MAP: %q is not FROM=TO", entry)
+		}
+		var r errorRule
+		left, r.contains, _ = strings.Cut(left, "~")
+		var err error
+		if r.from, err = parseCode(left); err != nil {
+			return nil, fmt.Errorf("OBSERVER_ERROR_MAP: %w", err)
+		}
+		if r.to, err = parseCode(right); err != nil {
+			return nil, fmt.Errorf("OBSERVER_ERROR_MAP: %w", err)
+		}
+		m.rules = append(m.rules, r)
+	}
+	return m, nil
+}
+
+// apply translates err if it came from the Observer and a rule matches; the Observer's
+// message is logged and, unless OBSERVER_ERROR_MESSAGES is set, replaced
+func (m *errorMap) apply(err error) error {
+	st, ok := status.FromError(err)
+	if m == nil || !ok || st.Code() == codes.OK || ourError(st) {
+		return err
+	}
+	i := slices.IndexFunc(m.rules, func(r errorRule) bool {
+		return r.from == st.Code() && strings.Contains(st.Message(), r.contains)
+	})
+	if i < 0 {
+		return err
+	}
+	r := m.rules[i]
+	metrics.ObserverErrorsMapped.WithLabelValues(r.from.String(), r.to.String()).Inc()
+	log.Printf("Observer returned %s: %s (answering %s)", codeNames[r.from], st.Message(), codeNames[r.to])
+
+	msg := "Observer failed with " + codeNames[r.from]
+	if m.keepMessages {
+		msg += ": " + st.Message()
+	}
+	details := []protoadapt.MessageV1{&errdetails.ErrorInfo{
+		Reason: reasonUpstreamError, Domain: errorDomain, Metadata: map[string]string{"upstream_code": codeNames[r.from]},
+	}}
+	if retryable(r.to) {
+		details = append(details, &errdetails.RetryInfo{RetryDelay: durationpb.New(upstreamRetryDelay)})
+	}
+	mapped, derr := status.New(r.to, msg).WithDetails(details...)
+	if derr != nil {
+		return status.Error(r.to, msg)
+	}
+	return mapped.Err()
+}
+
+// ourError reports statuses the middleware produced itself (its client interceptors run
+// inside the forwarded call)
+func ourError(st *status.Status) bool {
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.GetDomain() == errorDomain {
+			return true
+		}
+	}
+	return false
+}
+
+// retryable reports codes a producer should retry after a backoff
+func retryable(c codes.Code) bool {
+	return c == codes.Unavailable || c == codes.ResourceExhausted || c == codes.Aborted
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// failbackConfig makes an endpoint that lost traffic to a failure prove itself stable
+// before traffic may return, so two flaky endpoints don't ping-pong
+type failbackConfig struct {
+	probes int           // consecutive healthy probes required; 0 = fail back at once
+	window time.Duration // minimum time those probes must span
+}
+
+// failbackFromEnv reads OBSERVER_FAILBACK_PROBES and OBSERVER_FAILBACK_WINDOW
+func failbackFromEnv() (failbackConfig, error) {
+	var c failbackConfig
+	var err error
+	if c.probes, err = envInt("OBSERVER_FAILBACK_PROBES", 0); err != nil {
+		return c, err
+	}
+	c.window, err = envDuration("OBSERVER_FAILBACK_WINDOW", 0)
+	return c, err
+}
+
+// distrust marks the endpoint as failed; it needs a fresh streak of healthy probes
+func (m *member) distrust() {
+	m.streak.Store(0)
+	m.suspect.Store(true)
+}
+
+// probed extends or breaks the endpoint's streak of healthy probes
+func (m *member) probed(healthy bool) {
+	if !healthy {
+		m.distrust()
+		return
+	}
+	if m.streak.Add(1) == 1 {
+		m.streakStart.Store(time.Now().UnixNano())
+	}
+}
+
+// confirmed reports whether traffic may move to the endpoint: it never failed, or has
+// since passed enough probes in a row over the window
+func (m *member) confirmed(c failbackConfig) bool {
+	if c.probes == 0 || !m.suspect.Load() {
+		return true
+	}
+	streak := int(m.streak.Load())
+	if streak < c.probes || time.Since(time.Unix(0, m.streakStart.Load())) < c.window {
+		return false
+	}
+	m.suspect.Store(false)
+	log.Printf("Observer endpoint %s passed %d health probes in a row; eligible for traffic again", m.Endpoint(), streak)
+	return true
+}
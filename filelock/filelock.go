@@ -0,0 +1,65 @@
+// Package filelock provides advisory, inter-process file locks.
+package filelock
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+// ErrLocked is returned by TryLock when another process holds the lock
+var ErrLocked = errors.New("filelock: already locked")
+
+// Lock is a held advisory lock on a file
+type Lock struct {
+	f *os.File
+}
+
+// Acquire blocks until the exclusive lock on path is held, creating the file if needed
+func Acquire(path string) (*Lock, error) {
+	return acquire(path, true)
+}
+
+// TryLock takes the exclusive lock on path without blocking, returning ErrLocked if it is held elsewhere
+func TryLock(path string) (*Lock, error) {
+	return acquire(path, false)
+}
+
+// AcquireContext retries TryLock every interval until the lock is held or ctx is done
+func AcquireContext(ctx context.Context, path string, interval time.Duration) (*Lock, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		l, err := TryLock(path)
+		if !errors.Is(err, ErrLocked) {
+			return l, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func acquire(path string, block bool) (*Lock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f, block); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Lock{f: f}, nil
+}
+
+// Release unlocks and closes the lock file
+func (l *Lock) Release() error {
+	if err := unlockFile(l.f); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
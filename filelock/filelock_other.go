@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package filelock
+
+import (
+	"errors"
+	"os"
+)
+
+var errUnsupported = errors.New("filelock: not supported on this platform")
+
+func lockFile(*os.File, bool) error { return errUnsupported }
+
+func unlockFile(*os.File) error { return errUnsupported }
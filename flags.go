@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"systemiq.ai/metrics"
+	"systemiq.ai/protos"
+)
+
+// reasonSourceDisabled marks calls from a source switched off by the remote flags
+const reasonSourceDisabled = "SOURCE_DISABLED"
+
+// flagDocument is the feature-flag document served at REMOTE_FLAGS_URL
+type flagDocument struct {
+	// SampleRates forwards only this fraction of the observations whose indicator
+	// matches the glob (first match in key order; "*" for the rest), answering the
+	// others with success
+	SampleRates map[string]float64 `json:"sample_rates"`
+	// DisabledSources rejects calls from these callers (authenticated identity, else IP)
+	DisabledSources []string `json:"disabled_sources"`
+	// Buffered writes observations to BUFFER_DIR instead of forwarding them, for
+	// Observer incidents; they are forwarded once the flag is cleared
+	Buffered bool `json:"buffered"`
+
+	patterns []string // keys of SampleRates, sorted
+}
+
+// remoteFlags polls a flag document so a fleet can be steered centrally; the last good
+// document stays in force while the URL is unreachable
+type remoteFlags struct {
+	url      string
+	interval time.Duration
+	client   *http.Client
+	current  atomic.Pointer[flagDocument]
+	etag     string
+	raw      []byte
+
+	buffer    *observationSpool // nil without BUFFER_DIR
+	retention spoolRetention
+	alert     bufferAlert
+	exitDrain time.Duration // 0: leave BUFFER_DIR for the next start
+	drain     func(ctx context.Context, req *protos.ObservationRequest, key string) error
+	draining  atomic.Bool
+}
+
+// remoteFlagsFromEnv reads REMOTE_FLAGS_URL (off when unset), REMOTE_FLAGS_INTERVAL,
+// BUFFER_DIR, its retention and alert thresholds and BUFFER_DRAIN_ON_EXIT
+func remoteFlagsFromEnv() (*remoteFlags, error) {
+	u := os.Getenv("REMOTE_FLAGS_URL")
+	if u == "" {
+		return nil, nil
+	}
+	interval, err := envDuration("REMOTE_FLAGS_INTERVAL", 30*time.Second)
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("REMOTE_FLAGS_INTERVAL must be a positive duration")
+	}
+	f := &remoteFlags{url: u, interval: interval, client: &http.Client{Timeout: 10 * time.Second}}
+	f.current.Store(&flagDocument{})
+	if dir := os.Getenv("BUFFER_DIR"); dir != "" {
+		c, err := spoolCipherFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		if f.retention, err = spoolRetentionFromEnv(); err != nil {
+			return nil, err
+		}
+		if f.alert, err = bufferAlertFromEnv(); err != nil {
+			return nil, err
+		}
+		if os.Getenv("BUFFER_DRAIN_ON_EXIT") != "" {
+			if f.exitDrain, err = envDuration("BUFFER_DRAIN_ON_EXIT", 0); err != nil {
+				return nil, err
+			}
+		}
+		if f.buffer, err = openBuffer(dir, 64<<20, c); err != nil {
+			return nil, fmt.Errorf("BUFFER_DIR: %w", err)
+		}
+	}
+	return f, nil
+}
+
+// run polls the document until ctx is done and forwards buffered observations whenever
+// the buffered flag is off (except in dry-run mode, which would discard them)
+func (f *remoteFlags) run(ctx context.Context) {
+	log.Printf("Polling feature flags from %s every %v", f.url, f.interval)
+	if f.buffer != nil {
+		go f.buffer.retain(f.retention, time.Minute)
+		go f.buffer.monitor(f.alert, 15*time.Second)
+	}
+	for {
+		if err := f.poll(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("WARNING: feature flags: %v (keeping the last document)", err)
+		}
+		if f.buffer != nil && !dryRun && !f.current.Load().Buffered && f.draining.CompareAndSwap(false, true) {
+			go func() {
+				defer f.draining.Store(false)
+				f.drainBuffer(ctx)
+			}()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(f.interval):
+		}
+	}
+}
+
+// poll fetches the document and applies it if it changed
+func (f *remoteFlags) poll(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.url, nil)
+	if err != nil {
+		return err
+	}
+	if f.etag != "" {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", f.url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	f.etag = resp.Header.Get("ETag")
+	if string(body) == string(f.raw) {
+		return nil
+	}
+	doc, err := parseFlagDocument(body)
+	if err != nil {
+		return err
+	}
+	if doc.Buffered && f.buffer == nil {
+		log.Printf("WARNING: feature flags ask for buffered mode, but BUFFER_DIR is not set; forwarding as usual")
+	}
+	f.raw = body
+	f.current.Store(doc)
+	summary := fmt.Sprintf("sample_rates=%v disabled_sources=%v buffered=%v", doc.SampleRates, doc.DisabledSources, doc.Buffered)
+	log.Printf("Applied feature flags: %s", summary)
+	auditTrail.record("flags", f.url, summary)
+	return nil
+}
+
+// parseFlagDocument validates a flag document
+func parseFlagDocument(body []byte) (*flagDocument, error) {
+	doc := new(flagDocument)
+	if err := json.Unmarshal(body, doc); err != nil {
+		return nil, err
+	}
+	for pattern, rate := range doc.SampleRates {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("sample_rates: %q: %w", pattern, err)
+		}
+		if rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("sample_rates: %q: rate %v is not between 0 and 1", pattern, rate)
+		}
+		if pattern != "*" {
+			doc.patterns = append(doc.patterns, pattern)
+		}
+	}
+	slices.Sort(doc.patterns)
+	if _, ok := doc.SampleRates["*"]; ok {
+		doc.patterns = append(doc.patterns, "*")
+	}
+	return doc, nil
+}
+
+// sampleRate is the fraction of indicator's observations to forward
+func (d *flagDocument) sampleRate(indicator string) float64 {
+	for _, pattern := range d.patterns {
+		if ok, _ := path.Match(pattern, indicator); ok {
+			return d.SampleRates[pattern]
+		}
+	}
+	return 1
+}
+
+// unaryInterceptor applies the current flags to ObserveData calls before anything is
+// forwarded: disabled sources are rejected, sampled-out observations answered with
+// success, and in buffered mode observations are written to BUFFER_DIR
+func (f *remoteFlags) unaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		obs, ok := req.(observation)
+		if !ok {
+			return handler(ctx, req)
+		}
+		doc := f.current.Load()
+		if source := flow(ctx); slices.Contains(doc.DisabledSources, source) {
+			metrics.FlagRejected.Inc()
+			return nil, detailedError(codes.PermissionDenied, reasonSourceDisabled, 0, "source "+source+" is disabled by feature flags")
+		}
+		if rate := doc.sampleRate(obs.GetIndicator()); rate < 1 && rand.Float64() >= rate {
+			metrics.SampledOut.Inc()
+			return successFor(req), nil
+		}
+		if doc.Buffered && f.buffer != nil {
+			rec, err := encodedObservation(req)
+			if err == nil {
+				err = f.buffer.append(rec)
+			}
+			if err != nil {
+				log.Printf("WARNING: buffer: %v", err)
+				return nil, detailedError(codes.Unavailable, reasonBufferFailed, time.Second, "could not buffer observation: "+err.Error())
+			}
+			metrics.OfflineBuffered.Inc()
+			return successFor(req), nil
+		}
+		return handler(ctx, req)
+	}
+}
+
+// successFor is the success response in the form the call's codec expects
+func successFor(req any) any {
+	resp := &protos.ObservationResponse{Status: "success"}
+	if _, ok := req.(*rawMessage); ok {
+		buf, _ := proto.Marshal(resp)
+		return &rawMessage{buf: buf}
+	}
+	return resp
+}
+
+// encodedObservation is the wire form of a decoded or raw request
+func encodedObservation(req any) ([]byte, error) {
+	if r, ok := req.(*rawMessage); ok {
+		return r.buf, nil
+	}
+	return proto.Marshal(req.(proto.Message))
+}
+
+// drainBuffer forwards buffered observations in arrival order, each with an
+// idempotency key derived from its record; it stops at the first failure and resumes
+// on the next poll
+func (f *remoteFlags) drainBuffer(ctx context.Context) {
+	if err := f.buffer.complete(); err != nil {
+		log.Printf("WARNING: buffer: %v", err)
+	}
+	f.buffer.forward(func(rec []byte) error {
+		if f.current.Load().Buffered {
+			return fmt.Errorf("buffered mode switched on again")
+		}
+		req, err := decodeRecord(rec)
+		if err != nil {
+			return err
+		}
+		if err := f.drain(ctx, req, spoolRecordKey(rec)); err != nil {
+			return err
+		}
+		metrics.BufferForwarded.Inc()
+		return nil
+	})
+}
+
+// drainBeforeExit forwards what BUFFER_DIR holds once the server has stopped taking
+// calls, for planned decommissioning; it gives up after BUFFER_DRAIN_ON_EXIT, leaving
+// the rest for export or the next start
+func (f *remoteFlags) drainBeforeExit() {
+	if f == nil || f.buffer == nil || f.exitDrain == 0 {
+		return
+	}
+	if f.current.Load().Buffered {
+		log.Printf("WARNING: buffered mode is on, leaving buffered observations in %s", f.buffer.dir)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), f.exitDrain)
+	defer cancel()
+	for !f.draining.CompareAndSwap(false, true) { // the poll loop is forwarding already
+		select {
+		case <-ctx.Done():
+			log.Printf("WARNING: buffer still being forwarded after BUFFER_DRAIN_ON_EXIT (%v)", f.exitDrain)
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	defer f.draining.Store(false)
+
+	log.Printf("Forwarding buffered observations before exit (at most %v)...", f.exitDrain)
+	f.drainBuffer(ctx)
+	if st := f.buffer.stats(); st.observations > 0 {
+		log.Printf("WARNING: %d buffered observations left in %s", st.observations, f.buffer.dir)
+	}
+}
+
+// closeBuffer completes BUFFER_DIR's segment, or closes its store, at exit
+func (f *remoteFlags) closeBuffer() {
+	if f == nil || f.buffer == nil {
+		return
+	}
+	if err := f.buffer.close(); err != nil {
+		log.Printf("WARNING: buffer: %v", err)
+	}
+}
+
+// drainVia forwards a buffered observation through srv as if its producer had sent it
+// with an idempotency key
+func drainVia(srv *ObserverMiddlewareServer) func(ctx context.Context, req *protos.ObservationRequest, key string) error {
+	return func(ctx context.Context, req *protos.ObservationRequest, key string) error {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(idempotencyKeyMetadataKey, key))
+		_, err := srv.ObserveData(ctx, req)
+		return err
+	}
+}
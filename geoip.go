@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+	"systemiq.ai/protos"
+)
+
+// geoRecord is the subset of GeoLite2/GeoIP2 City and ASN records we forward
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// geoIP adds a "<field>_geo" object next to each configured IP field of JSON data
+type geoIP struct {
+	dbs    []*maxminddb.Reader
+	fields [][]string // dot paths split into keys
+}
+
+// geoIPFromEnv opens the GEOIP_DB files (comma-separated, e.g. City and ASN) for the
+// GEOIP_FIELDS paths; nil when GEOIP_DB is unset
+func geoIPFromEnv() (*geoIP, error) {
+	dbList := os.Getenv("GEOIP_DB")
+	if dbList == "" {
+		return nil, nil
+	}
+	fieldList := os.Getenv("GEOIP_FIELDS")
+	if fieldList == "" {
+		return nil, fmt.Errorf("GEOIP_DB requires GEOIP_FIELDS")
+	}
+
+	g := &geoIP{}
+	for _, path := range strings.Split(dbList, ",") {
+		db, err := maxminddb.Open(strings.TrimSpace(path))
+		if err != nil {
+			return nil, err
+		}
+		g.dbs = append(g.dbs, db)
+	}
+	for _, f := range strings.Split(fieldList, ",") {
+		g.fields = append(g.fields, strings.Split(strings.TrimSpace(f), "."))
+	}
+	log.Printf("GeoIP enrichment of %s from %d database(s)", fieldList, len(g.dbs))
+	return g, nil
+}
+
+// lookup merges the records of every database for ip; ok is false when none knows it
+func (g *geoIP) lookup(ip net.IP) (map[string]any, bool) {
+	var rec geoRecord
+	for _, db := range g.dbs {
+		if err := db.Lookup(ip, &rec); err != nil {
+			return nil, false
+		}
+	}
+
+	geo := map[string]any{}
+	if rec.Country.ISOCode != "" {
+		geo["country"] = rec.Country.ISOCode
+	}
+	if city := rec.City.Names["en"]; city != "" {
+		geo["city"] = city
+	}
+	if rec.Location.Latitude != 0 || rec.Location.Longitude != 0 {
+		geo["lat"], geo["lon"] = rec.Location.Latitude, rec.Location.Longitude
+	}
+	if rec.ASN != 0 {
+		geo["asn"] = rec.ASN
+	}
+	if rec.ASOrg != "" {
+		geo["as_org"] = rec.ASOrg
+	}
+	return geo, len(geo) > 0
+}
+
+// enrich is a stage; data entries that are not JSON objects, or lack the fields, pass unchanged
+func (g *geoIP) enrich(req *protos.ObservationRequest) error {
+	for i, data := range req.Data {
+		dec := json.NewDecoder(strings.NewReader(data))
+		dec.UseNumber()
+		var obj map[string]any
+		if dec.Decode(&obj) != nil {
+			continue
+		}
+
+		changed := false
+		for _, path := range g.fields {
+			parent, key := walk(obj, path)
+			s, _ := parent[key].(string)
+			ip := net.ParseIP(s)
+			if ip == nil {
+				continue
+			}
+			if geo, ok := g.lookup(ip); ok {
+				parent[key+"_geo"] = geo
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(obj); err == nil {
+			req.Data[i] = strings.TrimSuffix(buf.String(), "\n")
+		}
+	}
+	return nil
+}
+
+// walk returns the object holding the last key of path, or nil
+func walk(obj map[string]any, path []string) (map[string]any, string) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := obj[key].(map[string]any)
+		if !ok {
+			return nil, ""
+		}
+		obj = next
+	}
+	return obj, path[len(path)-1]
+}
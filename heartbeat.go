@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"runtime"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"systemiq.ai/auth"
+	"systemiq.ai/protos"
+)
+
+// startedAt is used for the uptime in heartbeats
+var startedAt = time.Now()
+
+// heartbeatStatus is the payload of a heartbeat observation; besides liveness it carries
+// the health summary and error aggregates a site without Prometheus would otherwise lack
+type heartbeatStatus struct {
+	Version       string              `json:"version"`
+	Commit        string              `json:"commit,omitempty"`
+	UptimeSeconds int64               `json:"uptime_seconds"`
+	AuthReady     bool                `json:"auth_ready"`
+	ObserverState string              `json:"observer_state"`
+	InFlight      int                 `json:"in_flight"`
+	QueueDepth    int                 `json:"queue_depth"`
+	Buffer        *heartbeatBuffer    `json:"buffer,omitempty"` // with BUFFER_DIR
+	Calls         uint64              `json:"calls"`            // forwarded since the previous heartbeat
+	Errors        map[string]uint64   `json:"errors,omitempty"` // failed forwards since the previous heartbeat, by gRPC code
+	Endpoints     []heartbeatEndpoint `json:"endpoints,omitempty"`
+	Goroutines    int                 `json:"goroutines"`
+	HeapBytes     uint64              `json:"heap_bytes"`
+}
+
+// heartbeatBuffer is what BUFFER_DIR holds for forwarding later; queue_depth only counts
+// calls waiting for an in-flight slot
+type heartbeatBuffer struct {
+	Observations     int    `json:"observations"`
+	Bytes            int64  `json:"bytes"`
+	OldestAgeSeconds int64  `json:"oldest_age_seconds,omitempty"`
+	Alert            string `json:"alert,omitempty"`
+}
+
+// heartbeatEndpoint summarises one Observer endpoint (with several configured)
+type heartbeatEndpoint struct {
+	Endpoint     string  `json:"endpoint"`
+	Active       bool    `json:"active"`
+	ProbeHealthy bool    `json:"probe_healthy"`
+	Ejected      bool    `json:"ejected"`
+	Score        float64 `json:"score"`
+	ProbeMs      float64 `json:"probe_ms"`
+}
+
+// runHeartbeat forwards a synthetic observation every interval until ctx is done, so
+// the Observer can tell a quiet site from a dead one
+func (s *ObserverMiddlewareServer) runHeartbeat(ctx context.Context, interval time.Duration, indicator string, authHandler *auth.AuthHandler, inFlight *upstreamLimiter, buffer *observationSpool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var prevCalls uint64
+	prevErrors := map[codes.Code]uint64{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !s.leader.IsLeader() {
+			continue // only the leader reports
+		}
+
+		st := heartbeatStatus{
+			Version:       version,
+			Commit:        commit,
+			UptimeSeconds: int64(time.Since(startedAt).Seconds()),
+			AuthReady:     authHandler.Ready(),
+			ObserverState: s.upstream.Conn().GetState().String(),
+		}
+		if inFlight != nil {
+			st.InFlight, st.QueueDepth, _ = inFlight.Stats()
+		}
+		if b := buffer.lastStats(); b != nil {
+			st.Buffer = &heartbeatBuffer{Observations: b.observations, Bytes: b.bytes, Alert: b.alert}
+			if !b.oldest.IsZero() {
+				st.Buffer.OldestAgeSeconds = int64(time.Since(b.oldest).Seconds())
+			}
+		}
+
+		// Aggregates are reported as deltas, so the Observer can sum them over any period
+		var calls uint64
+		for _, m := range s.upstream.members {
+			n, _ := m.totals()
+			calls += n
+		}
+		st.Calls, prevCalls = calls-prevCalls, calls
+		errs := s.upstream.errorTotals()
+		for code, n := range errs {
+			if n > prevErrors[code] {
+				if st.Errors == nil {
+					st.Errors = map[string]uint64{}
+				}
+				st.Errors[code.String()] = n - prevErrors[code]
+			}
+		}
+		prevErrors = errs
+
+		if len(s.upstream.members) > 1 {
+			active := s.upstream.active.Load()
+			for _, m := range s.upstream.members {
+				st.Endpoints = append(st.Endpoints, heartbeatEndpoint{
+					Endpoint:     m.Endpoint(),
+					Active:       m == active,
+					ProbeHealthy: m.healthy.Load(),
+					Ejected:      m.ejected(),
+					Score:        m.health().score,
+					ProbeMs:      float64(m.latency.Load()) / 1e6,
+				})
+			}
+		}
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		st.Goroutines, st.HeapBytes = runtime.NumGoroutine(), mem.HeapAlloc
+		data, _ := json.Marshal(st)
+
+		if _, err := s.ObserveData(ctx, &protos.ObservationRequest{Data: []string{string(data)}, Indicator: indicator}); err != nil {
+			log.Printf("heartbeat: %v", err)
+		}
+	}
+}
+
+// heartbeatFromEnv reads HEARTBEAT_INTERVAL (0 = off) and HEARTBEAT_INDICATOR
+func heartbeatFromEnv() (time.Duration, string, error) {
+	interval, err := envDuration("HEARTBEAT_INTERVAL", 0)
+	if err != nil {
+		return 0, "", err
+	}
+	indicator := os.Getenv("HEARTBEAT_INDICATOR")
+	if indicator == "" {
+		indicator = "middleware.heartbeat"
+	}
+	return interval, indicator, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// idempotencyTokens forwards an idempotency key with every observation so the Observer
+// can drop duplicates however many hops retried them. Producers may send their own in
+// x-idempotency-key; otherwise one is derived from the caller, the payload and the
+// arrival time bucket, so retries within a bucket carry the same key.
+type idempotencyTokens struct {
+	bucket time.Duration
+}
+
+// idempotencyTokensFromEnv reads IDEMPOTENCY_TOKENS (off by default) and
+// IDEMPOTENCY_TOKEN_BUCKET
+func idempotencyTokensFromEnv() (*idempotencyTokens, error) {
+	if !envBool("IDEMPOTENCY_TOKENS") {
+		return nil, nil
+	}
+	bucket, err := envDuration("IDEMPOTENCY_TOKEN_BUCKET", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	if bucket <= 0 {
+		return nil, errors.New("IDEMPOTENCY_TOKEN_BUCKET must be positive")
+	}
+	log.Printf("Forwarding idempotency keys (generated per %v where producers send none)", bucket)
+	return &idempotencyTokens{bucket: bucket}, nil
+}
+
+// key returns the producer's idempotency key, or generates one from the payload as
+// received; empty when keys are off
+func (t *idempotencyTokens) key(ctx context.Context, req observation) string {
+	if t == nil {
+		return ""
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(idempotencyKeyMetadataKey); len(v) > 0 && v[0] != "" {
+		return v[0]
+	}
+	return t.generate(ctx, req, time.Now())
+}
+
+// generate hashes caller and payload (as payloadKey) with the index of the time bucket
+func (t *idempotencyTokens) generate(ctx context.Context, req observation, now time.Time) string {
+	key := payloadKey(ctx, req)
+	sum := sha256.Sum256(binary.BigEndian.AppendUint64(key[:], uint64(now.UnixNano()/int64(t.bucket))))
+	return "mw-" + hex.EncodeToString(sum[:16])
+}
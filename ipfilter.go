@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// ipFilter admits connections by source address: deny rules win, and when allow rules
+// exist the address must match one of them
+type ipFilter struct {
+	allow, deny []netip.Prefix
+}
+
+// ipFilterFromEnv parses LISTEN_ALLOW_CIDRS/LISTEN_DENY_CIDRS; nil when both are unset
+func ipFilterFromEnv() (*ipFilter, error) {
+	allow, err := parseCIDRs("LISTEN_ALLOW_CIDRS")
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseCIDRs("LISTEN_DENY_CIDRS")
+	if err != nil {
+		return nil, err
+	}
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	log.Printf("Listener IP filter: %d allow, %d deny rule(s)", len(allow), len(deny))
+	return &ipFilter{allow: allow, deny: deny}, nil
+}
+
+// parseCIDRs reads a comma-separated list of CIDRs (bare addresses are taken as /32 or /128)
+func parseCIDRs(name string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(os.Getenv(name), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid address %q", name, s)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid CIDR %q", name, s)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// allowed reports whether addr may connect
+func (f *ipFilter) allowed(addr net.Addr) bool {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := ap.Addr().Unmap()
+
+	for _, p := range f.deny {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, p := range f.allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// wrap returns a listener that closes connections from disallowed addresses on accept
+func (f *ipFilter) wrap(lis net.Listener) net.Listener {
+	if f == nil {
+		return lis
+	}
+	return &filteredListener{Listener: lis, filter: f}
+}
+
+type filteredListener struct {
+	net.Listener
+	filter *ipFilter
+}
+
+func (l *filteredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.filter.allowed(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		log.Printf("Rejected connection from %s on %s (IP filter)", conn.RemoteAddr(), l.Addr())
+		conn.Close()
+	}
+}
@@ -0,0 +1,164 @@
+// Package kube is a minimal in-cluster Kubernetes API client using the pod's service account.
+package kube
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serviceAccountDir holds the token, CA bundle and namespace mounted into every pod
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// ErrNotInCluster is returned outside a pod (no KUBERNETES_SERVICE_HOST)
+var ErrNotInCluster = errors.New("kube: not running in a cluster")
+
+// ErrNotFound and ErrConflict wrap 404 and 409 responses; a 409 on update means the
+// object changed since it was read (stale resourceVersion)
+var (
+	ErrNotFound = errors.New("kube: not found")
+	ErrConflict = errors.New("kube: conflict")
+)
+
+// Client talks to the API server with the service account token
+type Client struct {
+	host      string
+	namespace string
+	http      *http.Client
+}
+
+// InCluster builds a Client from the service account mount and KUBERNETES_SERVICE_* env
+func InCluster() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, ErrNotInCluster
+	}
+
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("kube: read CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("kube: service account CA contains no certificates")
+	}
+	namespace, _ := os.ReadFile(serviceAccountDir + "/namespace")
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: pool}
+
+	return &Client{
+		host:      "https://" + net.JoinHostPort(host, port),
+		namespace: strings.TrimSpace(string(namespace)),
+		// No overall timeout: watches are long-lived; Get callers pass a deadline
+		http: &http.Client{Transport: &tokenTransport{base: transport}},
+	}, nil
+}
+
+// Namespace is the namespace of the pod's service account
+func (c *Client) Namespace() string { return c.namespace }
+
+// Get fetches path (e.g. "/api/v1/nodes/n1") and decodes the JSON response into out
+func (c *Client) Get(ctx context.Context, path string, out any) error {
+	body, err := c.Stream(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return json.NewDecoder(body).Decode(out)
+}
+
+// Stream issues a GET and returns the response body, e.g. for "?watch=1" requests
+func (c *Client) Stream(ctx context.Context, path string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, statusError(http.MethodGet, path, resp)
+	}
+	return resp.Body, nil
+}
+
+// Send issues method (POST, PUT, ...) with in as the JSON body and decodes the
+// response into out unless out is nil
+func (c *Client) Send(ctx context.Context, method, path string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.host+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return statusError(method, path, resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// statusError describes a non-2xx response, wrapping ErrNotFound/ErrConflict
+func statusError(method, path string, resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	msg := strings.TrimSpace(string(b))
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return fmt.Errorf("%w: %s %s: %s", ErrNotFound, method, path, msg)
+	case http.StatusConflict:
+		return fmt.Errorf("%w: %s %s: %s", ErrConflict, method, path, msg)
+	}
+	return fmt.Errorf("kube: %s %s: %s: %s", method, path, resp.Status, msg)
+}
+
+// tokenTransport adds the service account token, re-reading it periodically because
+// projected tokens are rotated by the kubelet
+type tokenTransport struct {
+	base http.RoundTripper
+
+	mu       sync.Mutex
+	token    string
+	loadedAt time.Time
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	if time.Since(t.loadedAt) > time.Minute {
+		b, err := os.ReadFile(serviceAccountDir + "/token")
+		if err != nil {
+			t.mu.Unlock()
+			return nil, fmt.Errorf("kube: read token: %w", err)
+		}
+		t.token, t.loadedAt = strings.TrimSpace(string(b)), time.Now()
+	}
+	token := t.token
+	t.mu.Unlock()
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req)
+}
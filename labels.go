@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"systemiq.ai/kube"
+	"systemiq.ai/protos"
+)
+
+// labelsFieldNumber is ObservationRequest.labels
+const labelsFieldNumber = 6
+
+// labelsCapability is the payload encoding an Observer advertises when it reads the
+// labels map; Observers built before field 6 existed would drop it as an unknown field
+const labelsCapability = "labels"
+
+// labelsWithheld logs once that an Observer does not take labels
+var labelsWithheld sync.Once
+
+// labelSet is the fixed set of labels merged into every forwarded observation; its
+// values override labels of the same name sent by producers
+type labelSet struct {
+	labels map[string]string
+	wire   []byte // the labels as encoded map entries, appended to raw requests
+}
+
+func newLabelSet(labels map[string]string) *labelSet {
+	if len(labels) == 0 {
+		return nil
+	}
+	l := &labelSet{labels: labels}
+	for _, k := range slices.Sorted(maps.Keys(labels)) {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, labels[k])
+
+		l.wire = protowire.AppendTag(l.wire, labelsFieldNumber, protowire.BytesType)
+		l.wire = protowire.AppendBytes(l.wire, entry)
+	}
+	return l
+}
+
+// apply merges the labels into a decoded request
+func (l *labelSet) apply(req *protos.ObservationRequest) {
+	if l == nil {
+		return
+	}
+	if req.Labels == nil {
+		req.Labels = make(map[string]string, len(l.labels))
+	}
+	maps.Copy(req.Labels, l.labels)
+}
+
+// forwardedLabels returns the labels to add to forwarded observations: none unless every
+// Observer endpoint advertised labelsCapability in its handshake
+func (s *ObserverMiddlewareServer) forwardedLabels() *labelSet {
+	l := s.labels.Load()
+	if l == nil || s.upstream.supports(labelsCapability) {
+		return l
+	}
+	labelsWithheld.Do(func() {
+		log.Printf("WARNING: Observer does not advertise %q in its capabilities; forwarding observations without OBSERVATION_LABELS and origin labels", labelsCapability)
+	})
+	return nil
+}
+
+// encoded returns the labels in wire form (later map entries win, so appending overrides)
+func (l *labelSet) encoded() []byte {
+	if l == nil {
+		return nil
+	}
+	return l.wire
+}
+
+// staticLabelsFromEnv parses OBSERVATION_LABELS ("site=berlin-3,env=prod")
+func staticLabelsFromEnv() (map[string]string, error) {
+	labels, err := parseLabels(os.Getenv("OBSERVATION_LABELS"))
+	if err != nil {
+		return nil, fmt.Errorf("OBSERVATION_LABELS: %w", err)
+	}
+	return labels, nil
+}
+
+// parseLabels parses "key=value,..." label lists
+func parseLabels(v string) (map[string]string, error) {
+	labels := map[string]string{}
+	if v == "" {
+		return labels, nil
+	}
+	for _, pair := range strings.Split(v, ",") {
+		k, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid entry %q, want key=value", pair)
+		}
+		labels[k] = val
+	}
+	return labels, nil
+}
+
+// originLabelsFromEnv collects host (ENRICH_HOST) and Kubernetes (ENRICH_K8S) origin labels,
+// named after the OpenTelemetry resource conventions
+func originLabelsFromEnv() (map[string]string, error) {
+	labels := map[string]string{}
+
+	if envBool("ENRICH_HOST") {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("hostname: %w", err)
+		}
+		labels["host.name"] = host
+	}
+
+	if !envBool("ENRICH_K8S") {
+		return labels, nil
+	}
+
+	// POD_NAME/POD_NAMESPACE/NODE_NAME come from the downward API (fieldRef env vars)
+	client, err := kube.InCluster()
+	if err != nil && !errors.Is(err, kube.ErrNotInCluster) {
+		log.Printf("Kubernetes API unavailable for enrichment: %v", err)
+	}
+	for label, value := range map[string]string{
+		"k8s.pod.name":       os.Getenv("POD_NAME"),
+		"k8s.namespace.name": os.Getenv("POD_NAMESPACE"),
+		"k8s.node.name":      os.Getenv("NODE_NAME"),
+	} {
+		if value != "" {
+			labels[label] = value
+		}
+	}
+	if _, ok := labels["k8s.namespace.name"]; !ok && client != nil {
+		labels["k8s.namespace.name"] = client.Namespace()
+	}
+	if _, ok := labels["k8s.pod.name"]; !ok && client != nil {
+		labels["k8s.pod.name"], _ = os.Hostname()
+	}
+
+	// Pod labels from a downward API volume (key="value" per line)
+	if file := os.Getenv("ENRICH_K8S_POD_LABELS_FILE"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("ENRICH_K8S_POD_LABELS_FILE: %w", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			k, v, ok := strings.Cut(line, "=")
+			if !ok {
+				continue
+			}
+			if unquoted, err := strconv.Unquote(v); err == nil {
+				v = unquoted
+			}
+			labels["k8s.pod.label."+k] = v
+		}
+	}
+
+	// Node labels need the API (RBAC: get nodes)
+	if node := labels["k8s.node.name"]; envBool("ENRICH_K8S_NODE_LABELS") && node != "" {
+		if client == nil {
+			return nil, fmt.Errorf("ENRICH_K8S_NODE_LABELS needs in-cluster API access")
+		}
+		var obj struct {
+			Metadata struct {
+				Labels map[string]string `json:"labels"`
+			} `json:"metadata"`
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := client.Get(ctx, "/api/v1/nodes/"+node, &obj); err != nil {
+			return nil, err
+		}
+		for k, v := range obj.Metadata.Labels {
+			labels["k8s.node.label."+k] = v
+		}
+	}
+	return labels, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"systemiq.ai/filelock"
+	"systemiq.ai/kube"
+	"systemiq.ai/metrics"
+)
+
+// errStandby is returned by standby replicas so callers retry against the leader
+var errStandby = detailedError(codes.Unavailable, reasonStandby, 0, "standby replica, not the leader")
+
+// leaderElector tracks whether this replica may forward; a nil elector (leader
+// election off) is always the leader
+type leaderElector struct {
+	identity string
+	what     string // lock description for logs
+	retry    time.Duration
+	try      func(ctx context.Context) (bool, error) // acquire or renew
+	release  func()                                  // give up leadership on shutdown
+
+	leader atomic.Bool
+}
+
+// IsLeader reports whether observations should be forwarded
+func (l *leaderElector) IsLeader() bool { return l == nil || l.leader.Load() }
+
+// run keeps trying to acquire or renew leadership until ctx is done, then releases it
+// so a standby can take over without waiting for the lease to expire
+func (l *leaderElector) run(ctx context.Context) {
+	defer l.release()
+	for {
+		ok, err := l.try(ctx)
+		if err != nil && ctx.Err() == nil {
+			// Step down rather than risk two leaders while the lock state is unknown
+			log.Printf("leader election: %v", err)
+		}
+		l.set(ok && err == nil)
+
+		select {
+		case <-ctx.Done():
+			l.set(false)
+			return
+		case <-time.After(l.retry):
+		}
+	}
+}
+
+func (l *leaderElector) set(leader bool) {
+	if l.leader.Swap(leader) == leader {
+		return
+	}
+	if leader {
+		metrics.Leader.Set(1)
+		log.Printf("Became leader (%s) as %s; forwarding observations", l.what, l.identity)
+	} else {
+		metrics.Leader.Set(0)
+		log.Printf("Lost leadership (%s); standing by", l.what)
+	}
+}
+
+// leaderElectorFromEnv builds the elector from LEADER_*; nil when LEADER_ELECTION is unset
+func leaderElectorFromEnv() (*leaderElector, error) {
+	mode := os.Getenv("LEADER_ELECTION")
+	if mode == "" || mode == "off" {
+		return nil, nil
+	}
+
+	identity := os.Getenv("LEADER_IDENTITY")
+	if identity == "" {
+		identity = os.Getenv("POD_NAME")
+	}
+	if identity == "" {
+		host, _ := os.Hostname()
+		identity = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+
+	switch mode {
+	case "file":
+		path := os.Getenv("LEADER_LOCK_FILE")
+		if path == "" {
+			return nil, errors.New("LEADER_ELECTION=file requires LEADER_LOCK_FILE")
+		}
+		try, release := fileLock(path)
+		return &leaderElector{identity: identity, what: "lock file " + path, retry: 2 * time.Second, try: try, release: release}, nil
+
+	case "lease":
+		duration, err := envDuration("LEADER_LEASE_DURATION", 15*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		if duration < 3*time.Second {
+			return nil, errors.New("LEADER_LEASE_DURATION must be at least 3s")
+		}
+		name := os.Getenv("LEADER_LEASE_NAME")
+		if name == "" {
+			name = "observer-middleware"
+		}
+		client, err := kube.InCluster()
+		if err != nil {
+			return nil, err
+		}
+		lease := &leaseLock{client: client, name: name, identity: identity, duration: duration}
+		return &leaderElector{
+			identity: identity,
+			what:     "lease " + client.Namespace() + "/" + name,
+			retry:    duration / 3,
+			try:      lease.tryAcquire,
+			release:  lease.release,
+		}, nil
+	}
+	return nil, fmt.Errorf("LEADER_ELECTION must be off, lease or file, got %q", mode)
+}
+
+/* ---------- lock file ---------- */
+
+// fileLock elects the replica holding the lock on path; the kernel drops the lock
+// if the process dies, so a standby takes over without a stale-lock timeout
+func fileLock(path string) (try func(context.Context) (bool, error), release func()) {
+	var lock *filelock.Lock
+	try = func(context.Context) (bool, error) {
+		if lock != nil {
+			return true, nil
+		}
+		l, err := filelock.TryLock(path)
+		if errors.Is(err, filelock.ErrLocked) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("lock %s: %w", path, err)
+		}
+		lock = l
+		return true, nil
+	}
+	release = func() {
+		if lock != nil {
+			lock.Release()
+		}
+	}
+	return try, release
+}
+
+/* ---------- Kubernetes lease ---------- */
+
+// lease is the subset of a coordination.k8s.io/v1 Lease used for election
+type lease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions"`
+	} `json:"spec"`
+}
+
+// microTime is the Kubernetes MicroTime wire format
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// leaseLock implements election on a Lease object; updates carry the read
+// resourceVersion so two replicas cannot both win a takeover
+type leaseLock struct {
+	client   *kube.Client
+	name     string
+	identity string
+	duration time.Duration
+}
+
+func (l *leaseLock) path() string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + url.PathEscape(l.client.Namespace()) + "/leases"
+}
+
+// tryAcquire creates the lease, renews it if held, or takes it over once expired
+func (l *leaseLock) tryAcquire(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, l.duration/3)
+	defer cancel()
+	now := time.Now()
+
+	var cur lease
+	err := l.client.Get(ctx, l.path()+"/"+url.PathEscape(l.name), &cur)
+	if errors.Is(err, kube.ErrNotFound) {
+		cur.APIVersion, cur.Kind = "coordination.k8s.io/v1", "Lease"
+		cur.Metadata.Name, cur.Metadata.Namespace = l.name, l.client.Namespace()
+		cur.Spec.HolderIdentity = l.identity
+		cur.Spec.LeaseDurationSeconds = int(l.duration.Seconds())
+		cur.Spec.AcquireTime = now.UTC().Format(microTime)
+		cur.Spec.RenewTime = cur.Spec.AcquireTime
+		err = l.client.Send(ctx, "POST", l.path(), &cur, nil)
+		if errors.Is(err, kube.ErrConflict) {
+			return false, nil // another replica created it first
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if cur.Spec.HolderIdentity != l.identity {
+		renewed, _ := time.Parse(time.RFC3339Nano, cur.Spec.RenewTime)
+		expiry := renewed.Add(time.Duration(cur.Spec.LeaseDurationSeconds) * time.Second)
+		if cur.Spec.HolderIdentity != "" && now.Before(expiry) {
+			return false, nil
+		}
+		cur.Spec.HolderIdentity = l.identity
+		cur.Spec.AcquireTime = now.UTC().Format(microTime)
+		cur.Spec.LeaseTransitions++
+	}
+	cur.Spec.LeaseDurationSeconds = int(l.duration.Seconds())
+	cur.Spec.RenewTime = now.UTC().Format(microTime)
+
+	err = l.client.Send(ctx, "PUT", l.path()+"/"+url.PathEscape(l.name), &cur, nil)
+	if errors.Is(err, kube.ErrConflict) {
+		return false, nil // lost the race to another replica
+	}
+	return err == nil, err
+}
+
+// release clears the holder if it is still us, letting a standby take over at once
+func (l *leaseLock) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var cur lease
+	if err := l.client.Get(ctx, l.path()+"/"+url.PathEscape(l.name), &cur); err != nil || cur.Spec.HolderIdentity != l.identity {
+		return
+	}
+	cur.Spec.HolderIdentity = ""
+	if err := l.client.Send(ctx, "PUT", l.path()+"/"+url.PathEscape(l.name), &cur, nil); err != nil {
+		log.Printf("leader election: release lease: %v", err)
+	}
+}
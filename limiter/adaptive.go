@@ -0,0 +1,70 @@
+package limiter
+
+import (
+	"log"
+	"time"
+)
+
+// Adaptive bounds and tunes the AIMD limit adjustment
+type Adaptive struct {
+	Min, Max  int     // range the limit moves in
+	Tolerance float64 // latency above Tolerance × baseline counts as congestion
+}
+
+// adaptiveState tracks the fractional limit and latency baseline
+type adaptiveState struct {
+	Adaptive
+	limit     float64
+	baseline  time.Duration // lowest recent latency, drifting up slowly so it can recover
+	decreased time.Time     // last multiplicative decrease
+}
+
+// SetAdaptive lets the limit move between a.Min and a.Max based on Observe feedback,
+// starting from the current limit
+func (l *Limiter) SetAdaptive(a Adaptive) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a.Min = max(a.Min, 1)
+	a.Max = max(a.Max, a.Min)
+	if a.Tolerance <= 1 {
+		a.Tolerance = 2
+	}
+	l.limit = min(max(l.limit, a.Min), a.Max)
+	l.adaptive = &adaptiveState{Adaptive: a, limit: float64(l.limit)}
+}
+
+// Observe feeds one completed call back into the adaptive limit: congestion (an
+// overload error or latency well above the baseline) shrinks it multiplicatively,
+// healthy calls grow it by roughly one per limit's worth of calls. Calls already in
+// flight at the last decrease do not shrink it again, so one congestion event costs
+// 10% once per round trip rather than once per call that saw it
+func (l *Limiter) Observe(latency time.Duration, overloaded bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a := l.adaptive
+	if a == nil {
+		return
+	}
+
+	if a.baseline == 0 || latency < a.baseline {
+		a.baseline = latency
+	} else {
+		a.baseline += (latency - a.baseline) / 1000
+	}
+
+	prev := l.limit
+	if overloaded || float64(latency) > float64(a.baseline)*a.Tolerance {
+		if now := time.Now(); now.Add(-latency).After(a.decreased) {
+			a.limit = max(float64(a.Min), a.limit*0.9)
+			a.decreased = now
+		}
+	} else {
+		a.limit = min(float64(a.Max), a.limit+1/a.limit)
+	}
+	l.limit = int(a.limit)
+
+	if l.limit != prev {
+		log.Printf("Upstream concurrency limit %d → %d (latency %v, baseline %v)", prev, l.limit, latency, a.baseline)
+	}
+	l.grant()
+}
@@ -0,0 +1,151 @@
+// Package limiter caps concurrent upstream calls, queueing a bounded number of waiters.
+package limiter
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrQueueFull is returned when the limit is reached and the wait queue is full
+var ErrQueueFull = errors.New("limiter: wait queue full")
+
+// Limiter admits at most limit concurrent holders; up to maxQueue further callers
+// wait for a slot. Waiters are served by weighted fair queuing across flows (FIFO
+// within a flow, and overall when every caller uses the same flow).
+type Limiter struct {
+	mu       sync.Mutex
+	limit    int
+	maxQueue int
+	inFlight int
+	waiters  waitQueue
+	adaptive *adaptiveState // nil unless SetAdaptive was called
+
+	// WFQ state: virtual time advances to the finish tag of each admitted waiter
+	vtime      float64
+	lastFinish map[string]float64
+}
+
+// waiter is one queued Acquire; finish orders service, seq breaks ties FIFO
+type waiter struct {
+	ready  chan struct{}
+	finish float64
+	seq    uint64
+	index  int
+}
+
+// New returns a Limiter admitting limit concurrent holders with maxQueue waiters
+func New(limit, maxQueue int) *Limiter {
+	return &Limiter{limit: max(limit, 1), maxQueue: max(maxQueue, 0), lastFinish: map[string]float64{}}
+}
+
+// Acquire blocks until a slot is free or ctx is done; the returned func releases it
+func (l *Limiter) Acquire(ctx context.Context) (func(), error) {
+	return l.AcquireFlow(ctx, "", 1)
+}
+
+// AcquireFlow is Acquire for one flow (e.g. a caller identity) with the given weight:
+// while saturated, a flow of weight 2 is admitted twice as often as one of weight 1
+func (l *Limiter) AcquireFlow(ctx context.Context, flow string, weight float64) (func(), error) {
+	if weight <= 0 {
+		weight = 1
+	}
+
+	l.mu.Lock()
+	if l.inFlight < l.limit && l.waiters.Len() == 0 {
+		l.inFlight++
+		l.mu.Unlock()
+		return l.release, nil
+	}
+	if l.waiters.Len() >= l.maxQueue {
+		l.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	w := &waiter{ready: make(chan struct{}), finish: max(l.vtime, l.lastFinish[flow]) + 1/weight, seq: l.waiters.seq}
+	l.waiters.seq++
+	l.lastFinish[flow] = w.finish
+	heap.Push(&l.waiters, w)
+	l.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return l.release, nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if w.index >= 0 {
+			heap.Remove(&l.waiters, w.index)
+			return nil, ctx.Err()
+		}
+		// Granted a slot while giving up: hand it on
+		l.inFlight--
+		l.grant()
+		return nil, ctx.Err()
+	}
+}
+
+// Stats returns the current number of holders and waiters and the limit
+func (l *Limiter) Stats() (inFlight, queued, limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight, l.waiters.Len(), l.limit
+}
+
+func (l *Limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	l.grant()
+}
+
+// grant admits waiters in finish-tag order while slots are free; l.mu must be held
+func (l *Limiter) grant() {
+	for l.inFlight < l.limit && l.waiters.Len() > 0 {
+		w := heap.Pop(&l.waiters).(*waiter)
+		l.vtime = w.finish
+		l.inFlight++
+		close(w.ready)
+	}
+	if l.waiters.Len() == 0 {
+		// Every flow's tags are now in the past, so their history no longer matters
+		clear(l.lastFinish)
+	}
+}
+
+// waitQueue is a min-heap of waiters by finish tag, then arrival
+type waitQueue struct {
+	items []*waiter
+	seq   uint64
+}
+
+func (q *waitQueue) Len() int { return len(q.items) }
+
+func (q *waitQueue) Less(i, j int) bool {
+	a, b := q.items[i], q.items[j]
+	if a.finish != b.finish {
+		return a.finish < b.finish
+	}
+	return a.seq < b.seq
+}
+
+func (q *waitQueue) Swap(i, j int) {
+	q.items[i], q.items[j] = q.items[j], q.items[i]
+	q.items[i].index = i
+	q.items[j].index = j
+}
+
+func (q *waitQueue) Push(x any) {
+	w := x.(*waiter)
+	w.index = len(q.items)
+	q.items = append(q.items, w)
+}
+
+func (q *waitQueue) Pop() any {
+	n := len(q.items) - 1
+	w := q.items[n]
+	q.items[n] = nil
+	q.items = q.items[:n]
+	w.index = -1
+	return w
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+)
+
+// bindAddr is one socket to open: a network ("tcp", "tcp4", "tcp6") and its address
+type bindAddr struct {
+	network, addr string
+}
+
+// bindAddrsFromEnv expands a ":port" address per SERVER_IP_FAMILY: auto binds Go's
+// default "tcp" wildcard (dual-stack where the platform allows it, IPv4-only on hosts
+// without IPv6 or dual-stack sockets), v4 and v6 bind one family only, and both opens
+// separate IPv4 and IPv6-only sockets so neither depends on the platform
+func bindAddrsFromEnv(addr string) ([]bindAddr, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	v4 := bindAddr{"tcp4", net.JoinHostPort("0.0.0.0", port)}
+	v6 := bindAddr{"tcp6", net.JoinHostPort("::", port)}
+	switch family := envString("SERVER_IP_FAMILY", "auto"); family {
+	case "auto":
+		return []bindAddr{{"tcp", addr}}, nil
+	case "v4":
+		return []bindAddr{v4}, nil
+	case "v6":
+		return []bindAddr{v6}, nil
+	case "both":
+		return []bindAddr{v4, v6}, nil
+	default:
+		return nil, fmt.Errorf("SERVER_IP_FAMILY must be auto, v4, v6 or both, not %q", family)
+	}
+}
+
+// listen opens n listeners on addr for each address family selected by SERVER_IP_FAMILY;
+// with n > 1 they share the port via SO_REUSEPORT so parallel accept loops can absorb
+// heavy connection churn
+func listen(addr string, n int) ([]net.Listener, error) {
+	binds, err := bindAddrsFromEnv(addr)
+	if err != nil {
+		return nil, err
+	}
+	var lc net.ListenConfig
+	if n > 1 {
+		lc.Control = setReusePort
+	}
+	listeners := make([]net.Listener, 0, n*len(binds))
+	for _, b := range binds {
+		for range max(n, 1) {
+			lis, err := lc.Listen(context.Background(), b.network, b.addr)
+			if err != nil {
+				for _, l := range listeners {
+					l.Close()
+				}
+				return nil, err
+			}
+			listeners = append(listeners, lis)
+		}
+		if n > 1 {
+			log.Printf("Opened %d SO_REUSEPORT listeners on %s", n, b.addr)
+		} else if b.network != "tcp" {
+			log.Printf("Listening on %s", b.addr)
+		}
+	}
+	return listeners, nil
+}
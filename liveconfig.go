@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"time"
+
+	"systemiq.ai/kube"
+)
+
+// liveSetting applies one ConfigMap key; present is false when the key is missing
+// (or the ConfigMap deleted), in which case the startup value is restored
+type liveSetting struct {
+	key   string
+	apply func(value string, present bool) error
+}
+
+// liveConfig watches a ConfigMap and applies its keys, named after the environment
+// variables they override, without a restart
+type liveConfig struct {
+	client   *kube.Client
+	name     string
+	settings []liveSetting
+
+	applied map[string]*string // last applied value per key; nil entry = startup value
+}
+
+// liveConfigFromEnv builds the watcher for CONFIG_MAP_NAME; nil when unset
+func liveConfigFromEnv() (*liveConfig, error) {
+	name := os.Getenv("CONFIG_MAP_NAME")
+	if name == "" {
+		return nil, nil
+	}
+	client, err := kube.InCluster()
+	if err != nil {
+		return nil, fmt.Errorf("CONFIG_MAP_NAME needs in-cluster API access: %w", err)
+	}
+	return &liveConfig{client: client, name: name, applied: map[string]*string{}}, nil
+}
+
+// add registers a key; call before run
+func (c *liveConfig) add(key string, apply func(value string, present bool) error) {
+	c.settings = append(c.settings, liveSetting{key: key, apply: apply})
+}
+
+// run keeps a watch open on the ConfigMap until ctx is done, re-listing after errors
+func (c *liveConfig) run(ctx context.Context) {
+	log.Printf("Watching ConfigMap %s/%s for live configuration", c.client.Namespace(), c.name)
+	for ctx.Err() == nil {
+		if err := c.watch(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("ConfigMap %s: %v", c.name, err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+type configMap struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Data map[string]string `json:"data"`
+}
+
+// watch reads the current ConfigMap, then applies every change until the stream ends
+func (c *liveConfig) watch(ctx context.Context) error {
+	base := "/api/v1/namespaces/" + url.PathEscape(c.client.Namespace()) + "/configmaps"
+
+	var cm configMap
+	getCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	err := c.client.Get(getCtx, base+"/"+url.PathEscape(c.name), &cm)
+	cancel()
+	if err != nil {
+		return err
+	}
+	c.apply(cm.Data)
+
+	q := url.Values{
+		"watch":           {"1"},
+		"fieldSelector":   {"metadata.name=" + c.name},
+		"resourceVersion": {cm.Metadata.ResourceVersion},
+	}
+	body, err := c.client.Stream(ctx, base+"?"+q.Encode())
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	dec := json.NewDecoder(body)
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := dec.Decode(&event); err != nil {
+			return fmt.Errorf("watch: %w", err)
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			var cm configMap
+			if err := json.Unmarshal(event.Object, &cm); err != nil {
+				return fmt.Errorf("decode ConfigMap: %w", err)
+			}
+			c.apply(cm.Data)
+		case "DELETED":
+			c.apply(nil)
+		case "ERROR":
+			// Usually 410 Gone after a long disconnect; start over from a fresh read
+			return fmt.Errorf("watch error: %s", event.Object)
+		}
+	}
+}
+
+// apply hands every changed key to its setting; a rejected value leaves the previous one in force
+func (c *liveConfig) apply(data map[string]string) {
+	for _, s := range c.settings {
+		value, present := data[s.key]
+		prev := c.applied[s.key]
+		if (prev == nil && !present) || (prev != nil && present && *prev == value) {
+			continue
+		}
+		if err := s.apply(value, present); err != nil {
+			log.Printf("ConfigMap %s: %s rejected, keeping previous value: %v", c.name, s.key, err)
+			continue
+		}
+		if present {
+			c.applied[s.key] = &value
+			log.Printf("ConfigMap %s: applied %s", c.name, s.key)
+			auditTrail.record("live-config", "ConfigMap "+c.name, s.key+"="+value)
+		} else {
+			delete(c.applied, s.key)
+			log.Printf("ConfigMap %s: %s removed, restored startup value", c.name, s.key)
+			auditTrail.record("live-config", "ConfigMap "+c.name, s.key+" removed")
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// debugLogging enables per-call debug logs; set by LOG_LEVEL, SIGUSR1/SIGUSR2 or the admin API
+var debugLogging atomic.Bool
+
+// debugf logs only while the level is debug
+func debugf(format string, args ...any) {
+	if debugLogging.Load() {
+		log.Printf("DEBUG "+format, args...)
+	}
+}
+
+// logLevel reports the current level, "debug" or "info"
+func logLevel() string {
+	if debugLogging.Load() {
+		return "debug"
+	}
+	return "info"
+}
+
+// setLogLevel switches between "debug" and "info", logging the change
+func setLogLevel(level, source string) error {
+	switch level {
+	case "debug", "info":
+	default:
+		return fmt.Errorf("log level must be debug or info, got %q", level)
+	}
+	if debugLogging.Swap(level == "debug") != (level == "debug") {
+		log.Printf("Log level set to %s (%s)", level, source)
+	}
+	return nil
+}
+
+// logLevelFromEnv applies LOG_LEVEL (default info)
+func logLevelFromEnv() error {
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		return setLogLevel(v, "LOG_LEVEL")
+	}
+	return nil
+}
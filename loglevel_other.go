@@ -0,0 +1,6 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+// watchLogLevelSignals is a no-op where SIGUSR1/SIGUSR2 do not exist; use the admin API instead
+func watchLogLevelSignals() {}
@@ -0,0 +1,25 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchLogLevelSignals switches to debug on SIGUSR1 and back to info on SIGUSR2
+func watchLogLevelSignals() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for s := range sig {
+			level, name := "info", "SIGUSR2"
+			if s == syscall.SIGUSR1 {
+				level, name = "debug", "SIGUSR1"
+			}
+			setLogLevel(level, name)
+			auditTrail.record("log-level", "signal "+name, level)
+		}
+	}()
+}
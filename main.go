@@ -2,33 +2,83 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"maps"
 	"net"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/alts"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver/dns"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	"systemiq.ai/auth"
+	"systemiq.ai/metrics"
 	"systemiq.ai/protos"
 )
 
-var testMode bool
+// testMode stubs out Observer calls; toggled by TEST_MODE or the admin API
+var testMode atomic.Bool
+
+// legacyPickFirstWarning is logged once however many Observer channels are dialed
+var legacyPickFirstWarning sync.Once
 
 // dialObserver dials once and returns a READY-to-use client/stub.
-func dialObserver(endpoint string) (*grpc.ClientConn, protos.DataObserverClient, error) {
-	var opts []grpc.DialOption
-	if strings.HasSuffix(endpoint, ":443") {
+func dialObserver(endpoint string, methods methodConfig, inFlight *upstreamLimiter, extra ...grpc.DialOption) (*grpc.ClientConn, error) {
+	opts := append([]grpc.DialOption(nil), extra...)
+
+	// Happy Eyeballs (RFC 8305): pick_first interleaves the resolved IPv6 and IPv4
+	// addresses and starts the next attempt every 250 ms until one connects, and host
+	// names handed to the dialer as-is (SRV targets) get Go's 300 ms fallback. The legacy
+	// policy instead spends the whole connect deadline on an unreachable first address.
+	if strings.EqualFold(os.Getenv("GRPC_EXPERIMENTAL_ENABLE_NEW_PICK_FIRST"), "false") {
+		legacyPickFirstWarning.Do(func() {
+			log.Println("WARNING: GRPC_EXPERIMENTAL_ENABLE_NEW_PICK_FIRST=false disables dual-stack dialing; a broken IPv6 route to the Observer can stall or fail connects")
+		})
+	}
+	switch security := observerTransportSecurity(endpoint); security {
+	case "tls":
 		log.Println("Using TLS for Observer connection")
-		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(nil)))
-	} else {
-		log.Println("Using insecure connection for Observer (non-443 endpoint)")
+		tlsCfg := &tls.Config{}
+		if err := applyTLSPolicy(tlsCfg, "OBSERVER"); err != nil {
+			return nil, err
+		}
+		if err := applyObserverSVID(tlsCfg); err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg)))
+	case "alts":
+		// Only works on Google Cloud, where the hypervisor runs the ALTS handshaker
+		log.Println("Using ALTS for Observer connection")
+		altsOpts := alts.DefaultClientOptions()
+		if accounts := os.Getenv("OBSERVER_ALTS_TARGET_SERVICE_ACCOUNTS"); accounts != "" {
+			altsOpts.TargetServiceAccounts = strings.Split(accounts, ",")
+		}
+		opts = append(opts, grpc.WithTransportCredentials(alts.NewClientCreds(altsOpts)))
+	case "insecure":
+		log.Println("Using insecure connection for Observer")
 		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	default:
+		return nil, fmt.Errorf("OBSERVER_TRANSPORT_SECURITY must be insecure, tls or alts, not %q", security)
 	}
 
 	// Keep-alive pings even when idle to detect half-opens.
@@ -50,19 +100,102 @@ func dialObserver(endpoint string) (*grpc.ClientConn, protos.DataObserverClient,
 		MinConnectTimeout: 5 * time.Second,
 	}))
 
-	conn, err := grpc.NewClient(endpoint, opts...)
-	if err != nil {
-		return nil, nil, err
+	// Per-method deadlines, WaitForReady and retries
+	opts = append(opts,
+		grpc.WithChainUnaryInterceptor(methods.unaryInterceptor()),
+		grpc.WithChainStreamInterceptor(methods.streamInterceptor()),
+	)
+	if inFlight != nil {
+		// Chained after the method config so each attempt holds its own slot
+		opts = append(opts, grpc.WithChainUnaryInterceptor(inFlightInterceptor(inFlight)))
+	}
+
+	return grpc.NewClient(endpoint, opts...)
+}
+
+// observerEndpointFromEnv reads OBSERVER_ENDPOINT, or OBSERVER_SRV as an srv:/// target
+func observerEndpointFromEnv() string {
+	if name := os.Getenv("OBSERVER_SRV"); name != "" {
+		return "srv:///" + name
+	}
+	if endpoint := os.Getenv("OBSERVER_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+	return "observer.systemiq.ai:443"
+}
+
+// observerTransportSecurity is OBSERVER_TRANSPORT_SECURITY (insecure, tls or alts) when
+// set, else "tls" or "insecure" as observerTLS decides
+func observerTransportSecurity(endpoint string) string {
+	if v := os.Getenv("OBSERVER_TRANSPORT_SECURITY"); v != "" {
+		return strings.ToLower(v)
+	}
+	if observerTLS(endpoint) {
+		return "tls"
+	}
+	return "insecure"
+}
+
+// observerTLS applies OBSERVER_TLS (true/false) when set, otherwise TLS for ":443" targets;
+// discovered targets such as consul:/// carry no port, so they need the explicit setting
+func observerTLS(endpoint string) bool {
+	if v := os.Getenv("OBSERVER_TLS"); v != "" {
+		return envBool("OBSERVER_TLS")
 	}
-	return conn, protos.NewDataObserverClient(conn), nil
+	return strings.HasSuffix(endpoint, ":443")
+}
+
+// observerChannelFromEnv reads OBSERVER_AUTHORITY, sent as :authority and verified as the
+// TLS server name instead of the target host (SNI-routing gateways, CNAME targets),
+// OBSERVER_DNS_MIN_INTERVAL, the minimum time between DNS re-resolutions of the target,
+// and OBSERVER_SERVICE_CONFIG, a gRPC service config used unless the resolver (consul,
+// SRV) supplies its own. The options are for the primary Observer channels only, not
+// the shadow.
+func observerChannelFromEnv() ([]grpc.DialOption, error) {
+	if os.Getenv("OBSERVER_DNS_MIN_INTERVAL") != "" {
+		d, err := envDuration("OBSERVER_DNS_MIN_INTERVAL", 0)
+		if err != nil || d <= 0 {
+			return nil, errors.New("OBSERVER_DNS_MIN_INTERVAL must be a positive duration")
+		}
+		dns.SetMinResolutionInterval(d)
+	}
+	var opts []grpc.DialOption
+	if authority := os.Getenv("OBSERVER_AUTHORITY"); authority != "" {
+		log.Printf("Using %s as the Observer authority and TLS server name", authority)
+		opts = append(opts, grpc.WithAuthority(authority))
+	}
+	if sc := os.Getenv("OBSERVER_SERVICE_CONFIG"); sc != "" {
+		if !json.Valid([]byte(sc)) {
+			return nil, errors.New("OBSERVER_SERVICE_CONFIG is not valid JSON")
+		}
+		log.Println("Using the gRPC service config from OBSERVER_SERVICE_CONFIG")
+		opts = append(opts, grpc.WithDefaultServiceConfig(sc))
+	}
+	return opts, nil
 }
 
 /* -------------------- gRPC server -------------------- */
 
 type ObserverMiddlewareServer struct {
 	protos.UnimplementedDataObserverServer
-	client      protos.DataObserverClient
-	authHandler *auth.AuthHandler
+	upstream          *upstreamSet
+	methods           methodConfig
+	authHandler       *auth.AuthHandler
+	clientByIndicator atomic.Pointer[map[string]int] // swapped by the live config
+	tenants           map[string]*auth.AuthHandler
+	tenantKey         string
+	labels            atomic.Pointer[labelSet]
+	stages            []stage
+	leader            *leaderElector      // nil without leader election
+	shadow            *shadow             // nil without OBSERVER_SHADOW_ENDPOINT
+	unknownFields     *unknownFieldWarner // nil unless UNKNOWN_FIELDS=warn
+	dedup             *deduper            // nil without DEDUP_WINDOW
+	responses         *responseCache      // nil without RESPONSE_CACHE_TTL
+	idempotency       *idempotencyTokens  // nil without IDEMPOTENCY_TOKENS
+	delta             *deltaEncoder       // nil without DELTA_ENCODING
+	uploads           *uploader
+	signer            *payloadSigner // nil without PAYLOAD_SIGNING_KEY_FILE
+	errorMap          *errorMap      // nil with OBSERVER_ERROR_MAP=none
 }
 
 func (s *ObserverMiddlewareServer) ObserveData(
@@ -71,34 +204,216 @@ func (s *ObserverMiddlewareServer) ObserveData(
 ) (*protos.ObservationResponse, error) {
 
 	// Test-mode short-circuit
-	if testMode {
+	if testMode.Load() {
 		return &protos.ObservationResponse{Status: "success"}, nil
 	}
+	if !s.leader.IsLeader() {
+		return nil, errStandby
+	}
 
-	// Fresh JWT each call
-	token, err := s.authHandler.GetToken()
-	if err != nil {
+	s.unknownFields.check(req)
+	var dedupKey [sha256.Size]byte
+	if s.dedup != nil {
+		if dedupKey = payloadKey(ctx, req); s.dedup.duplicate(dedupKey) {
+			debugf("Suppressed duplicate %q observation", req.GetIndicator())
+			return &protos.ObservationResponse{Status: "success"}, nil
+		}
+		defer s.dedup.release(dedupKey)
+	}
+	// Keyed before stages and delta encoding change req, so retries get the same key
+	idempotencyKey := s.idempotency.key(ctx, req)
+
+	var encoded []byte // the response, for the cache
+	if s.responses != nil {
+		cached, finish, err := s.responses.lookup(ctx, s.responses.key(ctx, req))
+		if err != nil {
+			return nil, err
+		}
+		if cached != nil {
+			debugf("Answered retried %q observation from cache", req.GetIndicator())
+			resp := new(protos.ObservationResponse)
+			return resp, proto.Unmarshal(cached, resp)
+		}
+		defer func() { finish(encoded) }()
+	}
+	s.forwardedLabels().apply(req)
+	if err := s.runStages(req); err != nil {
 		return nil, err
 	}
-	req.Token = &token
 
-	// 5-second deadline & WaitForReady so first call after restart waits
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	var delta *deltaFrame
+	if s.delta != nil && s.upstream.supports(deltaEncodingName) {
+		delta = s.delta.encode(ctx, req)
+	}
+
+	var resp *protos.ObservationResponse
+	var sentToken *string // set once a call went out, for the shadow
+	send := func() error {
+		if size := proto.Size(req); s.uploads.wants(s.upstream, size) {
+			req.Token = nil // travels in the first chunk instead
+			payload, err := proto.Marshal(req)
+			if err != nil {
+				return err
+			}
+			debugf("Uploading %d-byte %q observation in chunks", size, req.GetIndicator())
+			return s.forward(ctx, protos.ObservationUpload_Upload_FullMethodName, req, idempotencyKey, func(ctx context.Context, token string) error {
+				sentToken = &token
+				ctx = s.signer.signRequest(ctx, req)
+				return s.upstream.call(ctx, func(conn *grpc.ClientConn, opts ...grpc.CallOption) (err error) {
+					resp, err = s.uploads.upload(ctx, conn, payload, token, opts...)
+					return err
+				})
+			})
+		}
+		return s.forward(ctx, protos.DataObserver_ObserveData_FullMethodName, req, idempotencyKey, func(ctx context.Context, token string) error {
+			req.Token, sentToken = &token, &token
+			ctx = s.signer.signRequest(ctx, req)
+			return s.upstream.call(ctx, func(conn *grpc.ClientConn, opts ...grpc.CallOption) (err error) {
+				resp, err = protos.NewDataObserverClient(conn).ObserveData(ctx, req, opts...)
+				return err
+			})
+		})
+	}
+	err := send()
+	if err == errDryRun {
+		resp, err = dryRunSuccess, nil
+	}
+	if delta != nil {
+		if delta.patched && status.Code(err) == codes.FailedPrecondition {
+			// The Observer does not hold our base (restart, lost call); send it whole
+			debugf("Observer rejected delta for %q: %v", req.GetIndicator(), err)
+			delta.undo(req)
+			err = send()
+		}
+		if err == nil {
+			s.delta.commit(delta)
+		}
+	}
+	if s.shadow != nil && sentToken != nil {
+		req.Token = sentToken // an upload sent it in its first chunk
+		s.shadow.mirror(delta.full(req), req.GetIndicator(), resp, err)
+	}
+	if s.dedup != nil && err == nil {
+		s.dedup.forwarded(dedupKey)
+	}
+	if s.responses != nil && err == nil {
+		encoded, _ = proto.Marshal(resp)
+	}
+	return resp, err
+}
+
+// forward picks credentials for req and runs call with a fresh token, renewing it
+// and calling once more if Observer answers UNAUTHENTICATED; a non-empty
+// idempotencyKey travels with the upstream call
+func (s *ObserverMiddlewareServer) forward(ctx context.Context, method string, req observation, idempotencyKey string, call func(ctx context.Context, token string) error) error {
+	// The method deadline (5s by default) covers token acquisition too; WaitForReady
+	// and retries are applied to the upstream call by the method-config interceptor
+	ctx, cancel := context.WithTimeout(ctx, s.methods.lookup(method).Timeout)
 	defer cancel()
+	if idempotencyKey != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, idempotencyKeyMetadataKey, idempotencyKey)
+	}
+
+	authHandler, clientID, err := s.credentialsFor(ctx, req)
+	if err != nil {
+		return err
+	}
 
-	return s.client.ObserveData(ctx, req, grpc.WaitForReady(true))
+	// Fresh JWT each call
+	token, err := authHandler.GetTokenFor(ctx, clientID)
+	if err != nil {
+		return tokenError(err)
+	}
+	if dryRun {
+		s.logDryRun(method, req, clientID)
+		return errDryRun
+	}
+
+	start := time.Now()
+	err = call(ctx, token)
+	debugf("Forwarded %q for client %d in %v: %v", req.GetIndicator(), clientID, time.Since(start), status.Code(err))
+	if status.Code(err) != codes.Unauthenticated {
+		return upstreamDown(s.errorMap.apply(err), s.upstream.Conn())
+	}
+
+	// Token revoked early or rejected for another reason: renew and retry exactly once
+	debugf("Observer rejected token for client %d, renewing", clientID)
+	token, err = authHandler.RenewToken(ctx, clientID, token)
+	if err != nil {
+		return tokenError(err)
+	}
+	return upstreamDown(s.errorMap.apply(call(ctx, token)), s.upstream.Conn())
+}
+
+// tokenError maps auth failures to gRPC statuses local producers can act on
+func tokenError(err error) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, "deadline exceeded while acquiring a token")
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, "call cancelled while acquiring a token")
+	case errors.Is(err, auth.ErrNotReady):
+		return detailedError(codes.Unavailable, reasonAuthPending, authRetryDelay, "middleware is still logging in, retry shortly")
+	case errors.Is(err, auth.ErrLoggedOut):
+		return detailedError(codes.Unavailable, reasonAuthUnavailable, authRetryDelay, "middleware is shutting down, retry against another instance")
+	case errors.Is(err, auth.ErrRefreshRejected):
+		return detailedError(codes.Unavailable, reasonAuthExpired, authRetryDelay, "auth session expired: "+err.Error())
+	case errors.Is(err, auth.ErrAuthUnreachable):
+		return detailedError(codes.Unavailable, reasonAuthUnavailable, authRetryDelay, "auth temporarily unavailable: "+err.Error())
+	case errors.Is(err, auth.ErrInvalidCredentials), errors.Is(err, auth.ErrClientNotFound):
+		return detailedError(codes.Unauthenticated, reasonAuthRejected, 0, "middleware credentials rejected: "+err.Error())
+	}
+	return status.Errorf(codes.Internal, "token acquisition failed: %v", err)
 }
 
 func main() {
+	os.Exit(runCommand(os.Args[1:]))
+}
+
+// runServe runs the middleware until SIGINT/SIGTERM; flags override the environment
+func runServe(args []string) int {
+	preflight, err := parseServeFlags(args)
+	if err != nil {
+		return flagExit(err)
+	}
+
 	/* ---------- configuration ---------- */
+	if err := logLevelFromEnv(); err != nil {
+		log.Fatalf("log level: %v", err)
+	}
+	// --preflight runs every doctor check and refuses to serve on a failure; otherwise
+	// the cheap ones run and only warn
+	if preflight {
+		if printChecks(doctorChecks(), 10*time.Second) > 0 {
+			log.Println("Preflight failed, not serving")
+			return 1
+		}
+	} else {
+		softPreflight()
+	}
+	if auditTrail, err = auditLogFromEnv(); err != nil {
+		log.Fatal(err)
+	}
+	auditTrail.record("start", "", "version "+version+", pid "+strconv.Itoa(os.Getpid()))
+	watchLogLevelSignals()
+	applyRuntimeLimits()
+
+	if dir := os.Getenv("OFFLINE_DIR"); dir != "" {
+		return runOffline(dir)
+	}
+
 	if v := os.Getenv("TEST_MODE"); strings.ToLower(v) == "true" || v == "1" {
-		testMode = true
+		testMode.Store(true)
 		log.Println("Running in TEST MODE – external Observer calls are skipped")
 	}
+	if dryRun = envBool("DRY_RUN"); dryRun {
+		log.Println("Running in DRY RUN mode – observations are processed and logged but not forwarded")
+	}
 
-	endpoint := os.Getenv("OBSERVER_ENDPOINT")
-	if endpoint == "" {
-		endpoint = "observer.systemiq.ai:443"
+	endpoint := observerEndpointFromEnv()
+	srvRefresh, err := envDuration("OBSERVER_SRV_REFRESH", 30*time.Second)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	maxMsg := 4 << 20 // 4 MiB default
@@ -108,36 +423,581 @@ func main() {
 		}
 	}
 
+	methods, err := methodConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	uploads, err := uploaderFromEnv(methods)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	validator, err := requestValidatorFromEnv()
+	if err != nil {
+		log.Fatalf("request validation: %v", err)
+	}
+	rateLimit, err := rateLimiterFromEnv()
+	if err != nil {
+		log.Fatalf("rate limit: %v", err)
+	}
+
+	bandwidth, err := bandwidthLimiterFromEnv(methods)
+	if err != nil {
+		log.Fatalf("bandwidth limit: %v", err)
+	}
+
+	slowRequests, err := slowLogFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	traces, err := traceSamplerFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	crashes, err := crashReporterFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer crashes.recoverAndReport()
+
+	inFlight, err := inFlightLimiterFromEnv()
+	if err != nil {
+		log.Fatalf("concurrency limit: %v", err)
+	}
+	if inFlight != nil {
+		metrics.InFlight(inFlight.Stats)
+	}
+
+	acmeCfg, err := acmeFromEnv()
+	if err != nil {
+		log.Fatalf("ACME: %v", err)
+	}
+	if acmeCfg != nil {
+		if err := acmeCfg.serveHTTPChallenges(); err != nil {
+			log.Fatalf("ACME challenge listen: %v", err)
+		}
+	}
+	serverCreds, serverCerts, mtls, err := serverTLSFromEnv(acmeCfg)
+	if err != nil {
+		log.Fatalf("server TLS: %v", err)
+	}
+	certReloadInterval, err := envDuration("SERVER_TLS_RELOAD_INTERVAL", 30*time.Second)
+	if err != nil || certReloadInterval <= 0 {
+		log.Fatalf("SERVER_TLS_RELOAD_INTERVAL must be a positive duration")
+	}
+	callers, err := callerAuthFromEnv(mtls)
+	if err != nil {
+		log.Fatalf("caller auth: %v", err)
+	}
+
+	keepaliveOpts, err := serverKeepaliveFromEnv()
+	if err != nil {
+		log.Fatalf("server keepalive: %v", err)
+	}
+
+	ipFilter, err := ipFilterFromEnv()
+	if err != nil {
+		log.Fatalf("IP filter: %v", err)
+	}
+
+	originLabels, err := originLabelsFromEnv()
+	if err != nil {
+		log.Fatalf("enrichment: %v", err)
+	}
+	staticLabels, err := staticLabelsFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	labels := maps.Clone(originLabels)
+	maps.Copy(labels, staticLabels) // configured labels win over detected ones
+	if len(labels) > 0 {
+		log.Printf("Adding %d label(s) to every observation", len(labels))
+	}
+
+	var stages []stage
+	geo, err := geoIPFromEnv()
+	if err != nil {
+		log.Fatalf("GeoIP: %v", err)
+	}
+	if geo != nil {
+		stages = append(stages, geo.enrich)
+	}
+
+	leader, err := leaderElectorFromEnv()
+	if err != nil {
+		log.Fatalf("leader election: %v", err)
+	}
+
+	unknownFields, err := unknownFieldsFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	dedup, err := dedupFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	responses, err := responseCacheFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	idempotency, err := idempotencyTokensFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	delta, err := deltaFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	signer, err := payloadSignerFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	errMap, err := errorMapFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	flags, err := remoteFlagsFromEnv()
+	if err != nil {
+		log.Fatalf("feature flags: %v", err)
+	}
+
+	/* ---------- metrics ---------- */
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		metricsLis, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatalf("metrics listen: %v", err)
+		}
+		go metrics.Serve(ipFilter.wrap(metricsLis))
+	}
+
 	/* ---------- auth ---------- */
-	authHandler, err := auth.NewAuthHandler()
+	authCfg, err := auth.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("auth config: %v", err)
+	}
+	authHandler, err := auth.NewAuthHandler(authCfg)
 	if err != nil {
 		log.Fatalf("auth init: %v", err)
 	}
 
+	ts, err := timestampsFromEnv(authHandler.ClockOffset)
+	if err != nil {
+		log.Fatalf("timestamps: %v", err)
+	}
+	if ts != nil {
+		stages = append(stages, ts.apply)
+	}
+
+	clientByIndicator, err := parseClientMapping(os.Getenv("AUTH_CLIENT_ID_BY_INDICATOR"), authHandler)
+	if err != nil {
+		log.Fatalf("AUTH_CLIENT_ID_BY_INDICATOR: %v", err)
+	}
+
+	tenants, err := loadTenants(os.Getenv("AUTH_CREDENTIALS_FILE"), authCfg)
+	if err != nil {
+		log.Fatalf("AUTH_CREDENTIALS_FILE: %v", err)
+	}
+
+	tenantKey := os.Getenv("AUTH_TENANT_METADATA_KEY")
+	if tenantKey == "" {
+		tenantKey = "x-tenant"
+	}
+	tenantKey = strings.ToLower(tenantKey)
+
+	var filePolicy *callerPolicy
+	if file := os.Getenv("CALLER_POLICY_FILE"); file != "" {
+		if callers == nil {
+			log.Fatal("CALLER_POLICY_FILE requires caller authentication (mTLS, CALLER_API_KEYS or CALLER_JWKS_URL)")
+		}
+		if filePolicy, err = loadPolicy(file, tenantKey); err != nil {
+			log.Fatalf("CALLER_POLICY_FILE: %v", err)
+		}
+	}
+	var policy atomic.Pointer[callerPolicy]
+	policy.Store(filePolicy)
+
+	live, err := liveConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	/* ---------- dial Observer once ---------- */
-	conn, client, err := dialObserver(endpoint)
+	// consul:///<service> targets resolve to the service's passing instances,
+	// srv:///<name> targets to weighted SRV records
+	dialOpts := []grpc.DialOption{grpc.WithResolvers(consulResolverFromEnv(), &srvResolverBuilder{interval: srvRefresh})}
+	readBuf, writeBuf, err := bufferSizesFromEnv("OBSERVER")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if readBuf >= 0 {
+		dialOpts = append(dialOpts, grpc.WithReadBufferSize(readBuf))
+	}
+	if writeBuf >= 0 {
+		dialOpts = append(dialOpts, grpc.WithWriteBufferSize(writeBuf))
+	}
+	streamWindow, connWindow, err := windowSizesFromEnv("OBSERVER")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if streamWindow > 0 {
+		dialOpts = append(dialOpts, grpc.WithInitialWindowSize(streamWindow))
+	}
+	if connWindow > 0 {
+		dialOpts = append(dialOpts, grpc.WithInitialConnWindowSize(connWindow))
+	}
+
+	channel, err := observerChannelFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	primaryOpts := slices.Concat(dialOpts, channel)
+
+	var upstreams []*upstream
+	endpoints, weights, err := endpointsFromEnv(endpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, endpoint := range endpoints {
+		u, err := newUpstream(endpoint, func(endpoint string) (*grpc.ClientConn, error) {
+			return dialObserver(endpoint, methods, inFlight, primaryOpts...)
+		})
+		if err != nil {
+			log.Fatalf("dial Observer %s: %v", endpoint, err)
+		}
+		upstreams = append(upstreams, u)
+	}
+	switchMargin, err := envInt("OBSERVER_SWITCH_MARGIN_PERCENT", 20)
+	if err != nil || switchMargin >= 100 {
+		log.Fatal("OBSERVER_SWITCH_MARGIN_PERCENT must be between 0 and 99")
+	}
+	slowStart, err := slowStartFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	observer := newUpstreamSet(upstreams, weights, float64(switchMargin)/100, slowStart)
+	defer observer.Close()
+	if observer.failback, err = failbackFromEnv(); err != nil {
+		log.Fatal(err)
+	}
+
+	// The shadow gets no in-flight slots: mirrored calls must not delay real ones
+	shadow, err := shadowFromEnv(func(endpoint string) (*grpc.ClientConn, error) {
+		return dialObserver(endpoint, methods, nil, dialOpts...)
+	})
+	if err != nil {
+		log.Fatalf("shadow Observer: %v", err)
+	}
+	if shadow != nil {
+		defer shadow.Close()
+	}
+
+	watchdogTimeout, err := envDuration("OBSERVER_WATCHDOG_TIMEOUT", 2*time.Minute)
 	if err != nil {
-		log.Fatalf("dial Observer: %v", err)
+		log.Fatal(err)
+	}
+	probeInterval, err := envDuration("OBSERVER_PROBE_INTERVAL", 30*time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+	outliers, err := outlierConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
 	}
-	defer conn.Close()
 
 	/* ---------- start local gRPC server ---------- */
-	lis, err := net.Listen("tcp", ":50051")
+	numListeners, err := envInt("SERVER_LISTENERS", 1)
+	if err != nil {
+		log.Fatal(err)
+	}
+	listeners, err := listen(":50051", numListeners)
 	if err != nil {
 		log.Fatalf("listen: %v", err)
 	}
-	grpcServer := grpc.NewServer(
+	serverOpts := []grpc.ServerOption{
 		grpc.MaxRecvMsgSize(maxMsg),
 		grpc.MaxSendMsgSize(maxMsg),
-	)
+	}
+	serverOpts = append(serverOpts, keepaliveOpts...)
+	readBuf, writeBuf, err = bufferSizesFromEnv("SERVER")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if readBuf >= 0 {
+		serverOpts = append(serverOpts, grpc.ReadBufferSize(readBuf))
+	}
+	if writeBuf >= 0 {
+		serverOpts = append(serverOpts, grpc.WriteBufferSize(writeBuf))
+	}
+	streamWindow, connWindow, err = windowSizesFromEnv("SERVER")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if streamWindow > 0 {
+		serverOpts = append(serverOpts, grpc.InitialWindowSize(streamWindow))
+	}
+	if connWindow > 0 {
+		serverOpts = append(serverOpts, grpc.InitialConnWindowSize(connWindow))
+	}
+	maxStreams, err := envInt("SERVER_MAX_CONCURRENT_STREAMS", 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if maxStreams > 0 {
+		serverOpts = append(serverOpts, grpc.MaxConcurrentStreams(uint32(maxStreams)))
+	}
+	if serverCreds != nil {
+		serverOpts = append(serverOpts, grpc.Creds(serverCreds))
+	}
+	serverOpts = append(serverOpts, grpc.ChainUnaryInterceptor(versionHeaderInterceptor, traces.unaryInterceptor()))
+	if crashes != nil {
+		serverOpts = append(serverOpts, grpc.ChainUnaryInterceptor(crashes.unaryInterceptor()))
+	}
+	if callers != nil {
+		serverOpts = append(serverOpts, grpc.ChainUnaryInterceptor(callers.unaryInterceptor()))
+	}
+	if slowRequests != nil {
+		serverOpts = append(serverOpts, grpc.ChainUnaryInterceptor(slowRequests.unaryInterceptor()))
+	}
+	if filePolicy != nil || (live != nil && callers != nil) {
+		serverOpts = append(serverOpts, grpc.ChainUnaryInterceptor(policyInterceptor(&policy)))
+	}
+	if validator != nil {
+		serverOpts = append(serverOpts, grpc.ChainUnaryInterceptor(validator.unaryInterceptor()))
+	}
+	if flags != nil {
+		serverOpts = append(serverOpts, grpc.ChainUnaryInterceptor(flags.unaryInterceptor()))
+	}
+	if rateLimit != nil {
+		serverOpts = append(serverOpts, grpc.ChainUnaryInterceptor(rateLimit.unaryInterceptor()))
+	}
+	if bandwidth != nil {
+		serverOpts = append(serverOpts, grpc.ChainUnaryInterceptor(bandwidth.unaryInterceptor()))
+	}
+	passthrough := envBool("OBSERVER_PASSTHROUGH")
+	if passthrough {
+		serverOpts = append(serverOpts, grpc.ForceServerCodec(rawCodec{}))
+	}
+	grpcServer := grpc.NewServer(serverOpts...)
 
-	protos.RegisterDataObserverServer(grpcServer, &ObserverMiddlewareServer{
-		client:      client,
-		authHandler: authHandler,
-	})
+	srv := &ObserverMiddlewareServer{
+		upstream:      observer,
+		methods:       methods,
+		authHandler:   authHandler,
+		tenants:       tenants,
+		tenantKey:     tenantKey,
+		stages:        stages,
+		leader:        leader,
+		shadow:        shadow,
+		unknownFields: unknownFields,
+		dedup:         dedup,
+		responses:     responses,
+		idempotency:   idempotency,
+		delta:         delta,
+		uploads:       uploads,
+		signer:        signer,
+		errorMap:      errMap,
+	}
+	srv.clientByIndicator.Store(&clientByIndicator)
+	srv.labels.Store(newLabelSet(labels))
+	if passthrough {
+		// Requests are forwarded in wire form with the token appended, skipping decode/re-encode
+		log.Println("Passthrough forwarding enabled")
+		if delta != nil {
+			log.Println("DELTA_ENCODING has no effect with OBSERVER_PASSTHROUGH")
+		}
+		grpcServer.RegisterService(&passthroughServiceDesc, srv)
+	} else {
+		protos.RegisterDataObserverServer(grpcServer, srv)
+	}
+
+	// Background senders stop before the server drains
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+
+	heartbeatInterval, heartbeatIndicator, err := heartbeatFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if heartbeatInterval > 0 {
+		log.Printf("Sending %q heartbeats every %v", heartbeatIndicator, heartbeatInterval)
+		var buffer *observationSpool
+		if flags != nil {
+			buffer = flags.buffer
+		}
+		go srv.runHeartbeat(bgCtx, heartbeatInterval, heartbeatIndicator, authHandler, inFlight, buffer)
+	}
+	if serverCerts != nil {
+		go serverCerts.watch(bgCtx, certReloadInterval)
+	}
+	if flags != nil {
+		flags.drain = drainVia(srv)
+		go flags.run(bgCtx)
+	}
+	skipHandshake := envBool("OBSERVER_SKIP_HANDSHAKE")
+	for _, m := range observer.members {
+		go observer.watchConnectivity(bgCtx, m)
+		go m.watchdog(bgCtx, watchdogTimeout)
+		if !skipHandshake {
+			go m.watchCapabilities(bgCtx)
+		}
+		if m.ramp != nil {
+			go m.watchRecovery(bgCtx)
+		}
+	}
+	if observer.weighted {
+		log.Printf("Splitting traffic across %d Observer endpoints by weight %v", len(observer.members), weights)
+	} else if len(observer.members) > 1 {
+		log.Printf("Forwarding to the fastest of %d Observer endpoints, probed every %v", len(observer.members), probeInterval)
+	}
+	if len(observer.members) > 1 {
+		go observer.runProbes(bgCtx, probeInterval)
+		go observer.runOutlierDetection(bgCtx, outliers)
+	}
+
+	// Standbys keep dialling and logging in so a takeover forwards immediately
+	leaderDone := make(chan struct{})
+	if leader != nil {
+		go func() {
+			leader.run(bgCtx)
+			close(leaderDone)
+		}()
+	} else {
+		close(leaderDone)
+	}
+
+	/* ---------- live configuration ---------- */
+	// ConfigMap keys override the environment variable of the same name; removing a
+	// key restores the startup value
+	if live != nil {
+		live.add("AUTH_CLIENT_ID_BY_INDICATOR", func(v string, present bool) error {
+			if !present {
+				v = os.Getenv("AUTH_CLIENT_ID_BY_INDICATOR")
+			}
+			mapping, err := parseClientMapping(v, authHandler)
+			if err != nil {
+				return err
+			}
+			srv.clientByIndicator.Store(&mapping)
+			return nil
+		})
+		live.add("OBSERVATION_LABELS", func(v string, present bool) error {
+			if !present {
+				v = os.Getenv("OBSERVATION_LABELS")
+			}
+			static, err := parseLabels(v)
+			if err != nil {
+				return err
+			}
+			labels := maps.Clone(originLabels)
+			maps.Copy(labels, static)
+			srv.labels.Store(newLabelSet(labels))
+			return nil
+		})
+		if callers != nil {
+			live.add("CALLER_POLICY", func(v string, present bool) error {
+				if !present {
+					policy.Store(filePolicy)
+					return nil
+				}
+				p, err := parsePolicy([]byte(v), tenantKey)
+				if err != nil {
+					return err
+				}
+				policy.Store(p)
+				return nil
+			})
+		}
+		live.add("LOG_LEVEL", func(v string, present bool) error {
+			if !present {
+				if v = os.Getenv("LOG_LEVEL"); v == "" {
+					v = "info"
+				}
+			}
+			return setLogLevel(v, "ConfigMap")
+		})
+		go live.run(bgCtx)
+	}
+
+	/* ---------- admin API ---------- */
+	if addr := os.Getenv("ADMIN_ADDR"); addr != "" {
+		// The admin API can redirect traffic, tokens included; only loopback goes without a token
+		token := os.Getenv("ADMIN_TOKEN")
+		if token == "" && !loopbackAddr(addr) {
+			log.Fatalf("ADMIN_TOKEN is required when ADMIN_ADDR (%s) is not a loopback address", addr)
+		}
+		adminLis, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatalf("admin listen: %v", err)
+		}
+		var adminOpts []grpc.ServerOption
+		if token != "" {
+			adminOpts = append(adminOpts, grpc.UnaryInterceptor(adminTokenInterceptor(token)), grpc.StreamInterceptor(adminTokenStreamInterceptor(token)))
+		}
+		adminGRPC := grpc.NewServer(adminOpts...)
+		admin := &adminServer{upstream: observer, authHandler: authHandler, leader: leader, inFlight: inFlight}
+		if flags != nil {
+			admin.buffer = flags.buffer
+		}
+		protos.RegisterAdminServer(adminGRPC, admin)
+		go func() {
+			<-bgCtx.Done()
+			adminGRPC.Stop()
+		}()
+		go func() {
+			log.Printf("Admin API listening on %s", adminLis.Addr())
+			if err := adminGRPC.Serve(ipFilter.wrap(adminLis)); err != nil {
+				log.Printf("admin server: %v", err)
+			}
+		}()
+	}
+
+	/* ---------- graceful shutdown ---------- */
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		name := "SIGTERM"
+		if <-sig == syscall.SIGINT {
+			name = "SIGINT"
+		}
+		log.Println("Shutting down, draining in-flight calls...")
+		sdNotify("STOPPING=1")
+		auditTrail.record("stop", "signal "+name, "")
+		if flags == nil || flags.exitDrain == 0 {
+			stopBackground()
+		} // else once the buffer is forwarded below, keeping leadership until then
+		grpcServer.GracefulStop()
+	}()
 
 	log.Println("ObserverMiddleware gRPC server is listening on port 50051...")
-	if err := grpcServer.Serve(lis); err != nil {
+	// Logged in and listening: ready as far as systemd is concerned
+	sdNotify("READY=1")
+	go runSdWatchdog()
+	for _, lis := range listeners[1:] {
+		go func() {
+			if err := grpcServer.Serve(ipFilter.wrap(lis)); err != nil {
+				log.Fatalf("serve: %v", err)
+			}
+		}()
+	}
+	if err := grpcServer.Serve(ipFilter.wrap(listeners[0])); err != nil {
 		log.Fatalf("serve: %v", err)
 	}
+	flags.drainBeforeExit() // no-op without BUFFER_DRAIN_ON_EXIT
+	stopBackground()
+	flags.closeBuffer()
+	<-leaderDone // leadership released so a standby takes over without waiting out the lease
+
+	// Revoke tokens so they don't outlive the process (no-op without AUTH_LOGOUT_ENDPOINT)
+	handlers := []*auth.AuthHandler{authHandler}
+	for _, tenantHandler := range tenants {
+		handlers = append(handlers, tenantHandler)
+	}
+	logoutCtx, cancelLogout := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelLogout()
+	for _, h := range handlers {
+		h.StopRefresher()
+		_ = h.Logout(logoutCtx) // failures are logged by Logout
+	}
+	log.Println("Shutdown complete")
+	return 0
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"systemiq.ai/auth"
+)
+
+// methodOptions are the call settings applied to one upstream method
+type methodOptions struct {
+	Timeout      time.Duration // per-call deadline (caller deadlines that are earlier still win)
+	WaitForReady bool          // queue the call while the channel is connecting instead of failing fast
+	MaxRetries   int           // extra attempts on UNAVAILABLE, within the deadline
+}
+
+// defaultMethodOptions matches the historic single-observation behaviour
+var defaultMethodOptions = methodOptions{Timeout: 5 * time.Second, WaitForReady: true}
+
+// Backoff between max_retries attempts, as the auth retries do
+const (
+	methodRetryBaseDelay = 100 * time.Millisecond
+	methodRetryMaxDelay  = 2 * time.Second
+)
+
+// waitForReadyMetadataKey lets a producer choose per call between queueing while the
+// Observer channel connects ("true") and failing fast ("false")
+const waitForReadyMetadataKey = "x-wait-for-ready"
+
+// methodConfig maps full ("/protos.DataObserver/ObserveData") or bare ("ObserveData")
+// method names to options; "*" overrides the defaults for unlisted methods
+type methodConfig map[string]methodOptions
+
+// methodConfigFromEnv reads OBSERVER_WAIT_FOR_READY, the WaitForReady default of every
+// method (true unless set), and OBSERVER_METHOD_CONFIG
+func methodConfigFromEnv() (methodConfig, error) {
+	base := defaultMethodOptions
+	if os.Getenv("OBSERVER_WAIT_FOR_READY") != "" {
+		base.WaitForReady = envBool("OBSERVER_WAIT_FOR_READY")
+	}
+	cfg, err := parseMethodConfig(os.Getenv("OBSERVER_METHOD_CONFIG"), base)
+	if err != nil {
+		return nil, fmt.Errorf("OBSERVER_METHOD_CONFIG: %w", err)
+	}
+	if _, ok := cfg["*"]; !ok {
+		cfg["*"] = base
+	}
+	return cfg, nil
+}
+
+// parseMethodConfig parses OBSERVER_METHOD_CONFIG on top of base, e.g.
+//
+//	{"ObserveData": {"timeout": "3s", "wait_for_ready": false, "max_retries": 2}}
+func parseMethodConfig(v string, base methodOptions) (methodConfig, error) {
+	cfg := methodConfig{}
+	if v == "" {
+		return cfg, nil
+	}
+
+	var raw map[string]struct {
+		Timeout      string `json:"timeout"`
+		WaitForReady *bool  `json:"wait_for_ready"`
+		MaxRetries   int    `json:"max_retries"`
+	}
+	if err := json.Unmarshal([]byte(v), &raw); err != nil {
+		return nil, err
+	}
+
+	for method, r := range raw {
+		opts := base
+		if r.Timeout != "" {
+			d, err := time.ParseDuration(r.Timeout)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("%s: timeout must be a positive duration", method)
+			}
+			opts.Timeout = d
+		}
+		if r.WaitForReady != nil {
+			opts.WaitForReady = *r.WaitForReady
+		}
+		if r.MaxRetries < 0 {
+			return nil, fmt.Errorf("%s: max_retries must not be negative", method)
+		}
+		opts.MaxRetries = r.MaxRetries
+		cfg[method] = opts
+	}
+	return cfg, nil
+}
+
+// lookup returns the options for fullMethod, falling back to "*" and then the defaults
+func (c methodConfig) lookup(fullMethod string) methodOptions {
+	if opts, ok := c[fullMethod]; ok {
+		return opts
+	}
+	if opts, ok := c[path.Base(fullMethod)]; ok {
+		return opts
+	}
+	if opts, ok := c["*"]; ok {
+		return opts
+	}
+	return defaultMethodOptions
+}
+
+// unaryInterceptor applies the per-method deadline, WaitForReady and retry settings
+func (c methodConfig) unaryInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, callOpts ...grpc.CallOption) error {
+		opts := c.lookup(method)
+
+		ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+		callOpts = append(callOpts, grpc.WaitForReady(callerWaitForReady(ctx, opts)))
+
+		var err error
+		for attempt := 0; attempt <= opts.MaxRetries; attempt++ {
+			if err = invoker(ctx, method, req, reply, cc, callOpts...); status.Code(err) != codes.Unavailable {
+				return err
+			}
+			if attempt == opts.MaxRetries {
+				break
+			}
+			delay := auth.Backoff(methodRetryBaseDelay, methodRetryMaxDelay, attempt)
+			log.Printf("%s unavailable (attempt %d/%d), retrying in %s", method, attempt+1, opts.MaxRetries+1, delay.Round(time.Millisecond))
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return err // the deadline ends the retries, with the last Observer error
+			}
+		}
+		return err
+	}
+}
+
+// streamInterceptor applies the per-method deadline (covering the whole stream) and WaitForReady
+func (c methodConfig) streamInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, callOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+		opts := c.lookup(method)
+
+		ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+		stream, err := streamer(ctx, desc, cc, method, append(callOpts, grpc.WaitForReady(callerWaitForReady(ctx, opts)))...)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		context.AfterFunc(stream.Context(), cancel) // release the timer once the stream finishes
+		return stream, nil
+	}
+}
+
+// callerWaitForReady is the producer's x-wait-for-ready choice for the call being forwarded,
+// else the method's setting
+func callerWaitForReady(ctx context.Context, opts methodOptions) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(waitForReadyMetadataKey); len(v) > 0 {
+		if wait, err := strconv.ParseBool(v[0]); err == nil {
+			return wait
+		}
+	}
+	return opts.WaitForReady
+}
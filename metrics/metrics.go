@@ -0,0 +1,333 @@
+// Package metrics defines the middleware's Prometheus collectors and serves them over HTTP.
+package metrics
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "middleware"
+
+/* -------------------- auth -------------------- */
+
+var (
+	AuthLoginAttempts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_login_attempts_total",
+		Help:      "Login requests sent to the auth API.",
+	})
+	AuthLoginFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_login_failures_total",
+		Help:      "Login requests that did not yield a usable token.",
+	})
+	AuthRefreshAttempts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_refresh_attempts_total",
+		Help:      "Token refresh requests sent to the auth API.",
+	})
+	AuthRefreshFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_refresh_failures_total",
+		Help:      "Token refresh requests that did not yield a usable token.",
+	})
+)
+
+// authClient tracks the token expiry and last successful auth of one client ID
+type authClient struct {
+	expiry, lastSuccess time.Time
+}
+
+// authCollector reports per-client token TTL and time since the last successful auth
+type authCollector struct {
+	mu      sync.Mutex
+	clients map[int]authClient
+
+	ttl, since *prometheus.Desc
+}
+
+var auth = &authCollector{
+	clients: map[int]authClient{},
+	ttl: prometheus.NewDesc(namespace+"_auth_token_ttl_seconds",
+		"Seconds until the client's access token expires (negative once expired).",
+		[]string{"client_id"}, nil),
+	since: prometheus.NewDesc(namespace+"_auth_seconds_since_last_success",
+		"Seconds since the client's last successful login or refresh.",
+		[]string{"client_id"}, nil),
+}
+
+func init() {
+	prometheus.MustRegister(auth)
+}
+
+func (c *authCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.ttl
+	ch <- c.since
+}
+
+func (c *authCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, client := range c.clients {
+		label := strconv.Itoa(id)
+		ch <- prometheus.MustNewConstMetric(c.ttl, prometheus.GaugeValue, time.Until(client.expiry).Seconds(), label)
+		ch <- prometheus.MustNewConstMetric(c.since, prometheus.GaugeValue, time.Since(client.lastSuccess).Seconds(), label)
+	}
+}
+
+// AuthSucceeded records a successful login or refresh for clientID yielding a token valid until expiry
+func AuthSucceeded(clientID int, expiry time.Time) {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	auth.clients[clientID] = authClient{expiry: expiry, lastSuccess: time.Now()}
+}
+
+/* -------------------- server -------------------- */
+
+var (
+	RateLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Caller requests rejected with RESOURCE_EXHAUSTED by the per-caller rate limit.",
+	})
+	InvalidRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "invalid_requests_total",
+		Help:      "Field violations in caller requests rejected with INVALID_ARGUMENT, by rule (required, utf8, json, size).",
+	}, []string{"rule"})
+	BandwidthLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bandwidth_limited_total",
+		Help:      "Caller requests rejected because the bandwidth budget could not admit them before their deadline.",
+	})
+	ObserverRedials = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "observer_redials_total",
+		Help:      "Times the Observer connection was torn down and re-dialled.",
+	})
+	InFlightRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "in_flight_rejected_total",
+		Help:      "Upstream calls rejected with RESOURCE_EXHAUSTED because the wait queue was full.",
+	})
+	LoadShed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "load_shed_total",
+		Help:      "Upstream calls rejected with UNAVAILABLE because the queue ahead of them would outlast their deadline.",
+	})
+	ObserverConnectivityState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "observer_connectivity_state",
+		Help:      "1 for the current gRPC connectivity state of the Observer endpoint's channel, 0 for the others seen.",
+	}, []string{"endpoint", "state"})
+	ObserverConnectivityTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "observer_connectivity_transitions_total",
+		Help:      "Connectivity state changes of the Observer endpoint's channel.",
+	}, []string{"endpoint", "from", "to"})
+	ObserverConnectivitySeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "observer_connectivity_state_seconds_total",
+		Help:      "Time the Observer endpoint's channel spent in each connectivity state, counted when the state is left.",
+	}, []string{"endpoint", "state"})
+	ObserverEndpointLatency = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "observer_endpoint_latency_seconds",
+		Help:      "Smoothed health-probe round trip per Observer endpoint (with OBSERVER_ENDPOINTS).",
+	}, []string{"endpoint"})
+	ObserverEndpointHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "observer_endpoint_healthy",
+		Help:      "1 if the last health probe of the Observer endpoint succeeded.",
+	}, []string{"endpoint"})
+	ObserverEndpointActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "observer_endpoint_active",
+		Help:      "1 for the Observer endpoint observations are currently forwarded to.",
+	}, []string{"endpoint"})
+	ObserverEndpointScore = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "observer_endpoint_score",
+		Help:      "Call success rate of the Observer endpoint over the last outlier window, 0 while ejected.",
+	}, []string{"endpoint"})
+	ObserverEndpointEjections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "observer_endpoint_ejections_total",
+		Help:      "Times the Observer endpoint was ejected from rotation for failing too many calls.",
+	}, []string{"endpoint"})
+	ObserverEndpointCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "observer_endpoint_calls_total",
+		Help:      "Forwarded calls per Observer endpoint and gRPC status code.",
+	}, []string{"endpoint", "code"})
+	ObserverErrorsMapped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "observer_errors_mapped_total",
+		Help:      "Observer errors translated by OBSERVER_ERROR_MAP before reaching the caller, by upstream and returned gRPC code.",
+	}, []string{"from", "to"})
+	ObserverEndpointCallDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "observer_endpoint_call_duration_seconds",
+		Help:      "Latency of forwarded calls per Observer endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint"})
+	ShadowCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "shadow_calls_total",
+		Help:      "Observations mirrored to the shadow Observer, by result: match, mismatch or dropped (too many in flight).",
+	}, []string{"result"})
+	DedupSuppressed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dedup_suppressed_total",
+		Help:      "Observations answered without forwarding because an identical one was forwarded within DEDUP_WINDOW.",
+	})
+	DedupRedisErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dedup_redis_errors_total",
+		Help:      "Failed DEDUP_REDIS_URL claims and releases; each starts a cool-down in which the replica deduplicates on its own.",
+	})
+	OfflineBuffered = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "offline_buffered_total",
+		Help:      "Observations written to the offline buffer (OFFLINE_DIR, or BUFFER_DIR in buffered mode) instead of being forwarded.",
+	})
+	BufferExpired = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "buffer_expired_total",
+		Help:      "Buffered observations deleted unforwarded because of BUFFER_MAX_AGE or BUFFER_MAX_MB.",
+	})
+	BufferForwarded = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "buffer_forwarded_total",
+		Help:      "Buffered observations forwarded from BUFFER_DIR once buffered mode was switched off.",
+	})
+	BufferCorrupt = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "buffer_corrupt_total",
+		Help:      "Buffered observations that could not be read back and were moved to a .corrupt file.",
+	})
+	BufferObservations = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "buffer_observations",
+		Help:      "Observations waiting in OFFLINE_DIR or BUFFER_DIR.",
+	})
+	BufferBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "buffer_bytes",
+		Help:      "Size of the segments in OFFLINE_DIR or BUFFER_DIR.",
+	})
+	BufferOldestAge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "buffer_oldest_age_seconds",
+		Help:      "Time since the oldest buffered observation arrived, 0 when the buffer is empty.",
+	})
+	SampledOut = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sampled_out_total",
+		Help:      "Observations answered without forwarding because of a feature-flag sample rate.",
+	})
+	BuildInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "build_info",
+		Help:      "Always 1; labelled with the version, commit, build date and Go version of the running binary.",
+	}, []string{"version", "commit", "build_date", "go_version"})
+	DryRunForwards = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dry_run_forwards_total",
+		Help:      "Observations logged instead of forwarded because DRY_RUN is set.",
+	})
+	FlagRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "flag_rejected_total",
+		Help:      "Calls rejected because their source is disabled by feature flags.",
+	})
+	ResponseCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "response_cache_hits_total",
+		Help:      "Retried observations answered with the Observer's response to an earlier attempt within RESPONSE_CACHE_TTL.",
+	})
+	UploadResumes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upload_resumes_total",
+		Help:      "Chunked uploads resumed after the upload stream to the Observer broke.",
+	})
+	UnknownFields = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "unknown_fields_total",
+		Help:      "Requests carrying an ObservationRequest field this build does not know, by field number (with UNKNOWN_FIELDS=warn).",
+	}, []string{"field"})
+	Leader = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "leader",
+		Help:      "1 while this replica is the elected leader, 0 on standby (only set with LEADER_ELECTION).",
+	})
+)
+
+// ObserveCallDuration records a forwarded call's latency, with the caller's trace ID as
+// exemplar when it has one, so dashboards can jump from a slow bucket to the trace
+func ObserveCallDuration(endpoint string, d time.Duration, traceID string) {
+	obs := ObserverEndpointCallDuration.WithLabelValues(endpoint)
+	if traceID == "" {
+		obs.Observe(d.Seconds())
+		return
+	}
+	obs.(prometheus.ExemplarObserver).ObserveWithExemplar(d.Seconds(), prometheus.Labels{"trace_id": traceID})
+}
+
+// InFlight reports the upstream limiter's holders, waiters and limit on each scrape
+func InFlight(stats func() (inFlight, queued, limit int)) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "upstream_in_flight",
+		Help:      "Upstream calls currently holding a concurrency slot.",
+	}, func() float64 { n, _, _ := stats(); return float64(n) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "upstream_queued",
+		Help:      "Upstream calls waiting for a concurrency slot.",
+	}, func() float64 { _, n, _ := stats(); return float64(n) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "upstream_concurrency_limit",
+		Help:      "Current upstream concurrency limit (moves when adaptive limiting is on).",
+	}, func() float64 { _, _, n := stats(); return float64(n) })
+}
+
+/* -------------------- HTTP endpoint -------------------- */
+
+// notReady is why /readyz fails, empty while the middleware is ready
+var notReady atomic.Value
+
+// SetNotReady makes /readyz answer 503 with reason; an empty reason makes it ready again
+func SetNotReady(reason string) {
+	notReady.Store(reason)
+}
+
+// Serve exposes /metrics and /readyz on lis; it blocks and should run in its own
+// goroutine. Scrapers asking for OpenMetrics also get the exemplars.
+func Serve(lis net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if reason, _ := notReady.Load().(string); reason != "" {
+			http.Error(w, reason, http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+
+	log.Printf("Metrics endpoint listening on %s/metrics", lis.Addr())
+	if err := http.Serve(lis, mux); err != nil {
+		log.Printf("metrics server: %v", err)
+	}
+}
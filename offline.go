@@ -0,0 +1,743 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"systemiq.ai/metrics"
+	"systemiq.ai/protos"
+)
+
+// Spool segments are written as .open files and renamed to .spool once complete, so
+// export and upload never pick up a file that is still growing
+const (
+	spoolOpenSuffix = ".open"
+	spoolSuffix     = ".spool"
+)
+
+// reasonBufferFailed marks observations an offline middleware could not store
+const reasonBufferFailed = "BUFFER_WRITE_FAILED"
+
+// observationSpool appends observations to segment files in a directory: each record
+// is a varint length, the arrival time (big-endian Unix nanoseconds) and the encoded
+// ObservationRequest (labels applied, no token). The arrival time keeps repeated
+// identical observations apart when upload derives idempotency keys. With a cipher,
+// segments start with its header and records are sealed. With a store, the same
+// records go to a database in the directory instead (BUFFER_BACKEND).
+type observationSpool struct {
+	dir        string
+	segmentMax int64
+	cipher     *spoolCipher // nil without BUFFER_KEY_FILE
+	store      recordStore  // nil: segment files
+
+	mu          sync.Mutex
+	file        *os.File
+	size        int64
+	fileRecords int       // in file
+	fileFirst   time.Time // arrival of the first record in file
+
+	statsMu  sync.Mutex
+	segments map[string]segmentStats // by file name, see stats
+	last     atomic.Pointer[spoolStats]
+}
+
+// openSpool prepares dir, salvaging and completing segments a crashed run left open
+func openSpool(dir string, segmentMax int64, c *spoolCipher) (*observationSpool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	open, err := filepath.Glob(filepath.Join(dir, "*"+spoolOpenSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range open {
+		complete := strings.TrimSuffix(name, spoolOpenSuffix) + spoolSuffix
+		if err := os.Rename(name, complete); err != nil {
+			return nil, err
+		}
+		// The crash may have cut a record short or left garbage behind it
+		if _, _, err := salvageSegment(complete, c); err != nil {
+			log.Printf("WARNING: %s: %v", complete, err)
+		}
+	}
+	if c != nil {
+		log.Printf("Encrypting buffered observations in %s at rest (key %x)", dir, c.fingerprint)
+	}
+	return &observationSpool{dir: dir, segmentMax: segmentMax, cipher: c}, nil
+}
+
+// append stores one observation durably before returning
+func (s *observationSpool) append(obs []byte) error {
+	rec := binary.BigEndian.AppendUint64(make([]byte, 0, 8+len(obs)), uint64(time.Now().UnixNano()))
+	return s.appendRecord(append(rec, obs...))
+}
+
+// appendRecord stores a record as read from another spool, keeping its arrival time
+// and so its idempotency key
+func (s *observationSpool) appendRecord(rec []byte) error {
+	if s.store != nil {
+		return s.store.appendRecords([][]byte{s.sealStored(rec)})
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil && s.size >= s.segmentMax {
+		if err := s.completeLocked(); err != nil {
+			return err
+		}
+	}
+	if s.file == nil {
+		name := filepath.Join(s.dir, "obs-"+time.Now().UTC().Format("20060102T150405.000000000")+spoolOpenSuffix)
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return err
+		}
+		s.file, s.size, s.fileRecords, s.fileFirst = f, 0, 0, recordArrival(rec)
+		if s.cipher != nil {
+			n, err := f.Write(s.cipher.header())
+			if err != nil {
+				return err
+			}
+			s.size += int64(n)
+		}
+	}
+	if s.cipher != nil {
+		rec = s.cipher.seal(rec)
+	}
+	b := protowire.AppendBytes(nil, rec)
+	if _, err := s.file.Write(b); err != nil {
+		return err
+	}
+	s.size += int64(len(b))
+	s.fileRecords++
+	return s.file.Sync()
+}
+
+// close completes the current segment and closes the store
+func (s *observationSpool) close() error {
+	if s.store != nil {
+		return s.store.close()
+	}
+	return s.complete()
+}
+
+// complete completes the current segment, handing it to export, upload and forwarding
+func (s *observationSpool) complete() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	return s.completeLocked()
+}
+
+// completeEvery completes the current segment at each interval, so a quiet middleware
+// still hands its observations to export and upload
+func (s *observationSpool) completeEvery(interval time.Duration) {
+	if s.store != nil {
+		return // every record is complete
+	}
+	for range time.Tick(interval) {
+		if err := s.complete(); err != nil {
+			log.Printf("WARNING: offline buffer: %v", err)
+		}
+	}
+}
+
+// abandon deletes the current segment instead of completing it
+func (s *observationSpool) abandon() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+		s.file = nil
+	}
+}
+
+func (s *observationSpool) completeLocked() error {
+	name := s.file.Name()
+	s.file.Close()
+	s.file = nil
+	return os.Rename(name, strings.TrimSuffix(name, spoolOpenSuffix)+spoolSuffix)
+}
+
+// forwardSegments implements forward for segment files: a segment is deleted once fn
+// accepted all of it; one whose forwarding pauses is compacted to the records not yet
+// accepted, after moving unreadable records aside
+func (s *observationSpool) forwardSegments(fn func(rec []byte) error) (int, error) {
+	files, err := spoolFiles(s.dir, false)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, name := range files {
+		sent := 0
+		err := readSegment(name, s.cipher, func(rec []byte) error {
+			if err := fn(rec); err != nil {
+				return fmt.Errorf("record %d: %w", sent+1, err)
+			}
+			sent++
+			return nil
+		})
+		total += sent
+		if errors.Is(err, os.ErrNotExist) {
+			continue // purged meanwhile
+		}
+		if err != nil {
+			log.Printf("Forwarding buffered observations from %s paused after %d: %v", name, sent, err)
+			if errors.Is(err, errSpoolCorrupt) {
+				// Set the unreadable records aside; the rest is forwarded on the next call
+				if _, _, err := salvageSegment(name, s.cipher); err != nil {
+					log.Printf("WARNING: buffer: %v", err)
+				}
+			}
+			if err := compactSegment(name, s.cipher, sent); err != nil {
+				log.Printf("WARNING: buffer: %v", err)
+			}
+			return total, err
+		}
+		os.Remove(name)
+		log.Printf("Forwarded %d buffered observations from %s", sent, name)
+	}
+	return total, nil
+}
+
+// spoolFiles lists the complete segments in dir, oldest first; with open, also the
+// segments a running (or crashed) middleware has not completed
+func spoolFiles(dir string, open bool) ([]string, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix))
+	if err == nil && open {
+		var growing []string
+		growing, err = filepath.Glob(filepath.Join(dir, "*"+spoolOpenSuffix))
+		names = append(names, growing...)
+	}
+	slices.Sort(names)
+	return names, err
+}
+
+// spoolRecordKey is the idempotency key of a buffered observation, the same wherever
+// the record is uploaded from
+func spoolRecordKey(rec []byte) string {
+	sum := sha256.Sum256(rec)
+	return "spool-" + hex.EncodeToString(sum[:16])
+}
+
+// decodeRecord decodes the observation of a spool record
+func decodeRecord(rec []byte) (*protos.ObservationRequest, error) {
+	if len(rec) < 8 {
+		return nil, fmt.Errorf("%w: too short", errSpoolCorrupt)
+	}
+	req := new(protos.ObservationRequest)
+	if err := proto.Unmarshal(rec[8:], req); err != nil {
+		return nil, fmt.Errorf("%w: %v", errSpoolCorrupt, err)
+	}
+	return req, nil
+}
+
+// readSpool calls fn for each record of r, decrypting those of an encrypted file with c;
+// a truncated final record ends the stream without error, since it was never
+// acknowledged
+func readSpool(r io.Reader, c *spoolCipher, fn func(rec []byte) error) error {
+	br := bufio.NewReader(r)
+	encrypted := false
+	if first, err := br.Peek(1); err == nil && first[0] == 0 {
+		header := make([]byte, len(spoolMagic)+8)
+		if _, err := io.ReadFull(br, header); err != nil || string(header[:len(spoolMagic)]) != spoolMagic {
+			return errors.New("not a spool file")
+		}
+		if err := c.checkHeader(header[len(spoolMagic):]); err != nil {
+			return err
+		}
+		encrypted = true
+	}
+	for {
+		n, err := binary.ReadUvarint(br) // the same encoding as protowire varints
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", errSpoolCorrupt, err)
+		}
+		if n > maxSpoolRecord {
+			return fmt.Errorf("%w: length %d", errSpoolCorrupt, n)
+		}
+		rec := make([]byte, n)
+		if _, err := io.ReadFull(br, rec); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if encrypted {
+			if rec, err = c.open(rec); err != nil {
+				return fmt.Errorf("%w: %v", errSpoolCorrupt, err)
+			}
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// offlineServer accepts observations into the spool instead of forwarding them
+type offlineServer struct {
+	protos.UnimplementedDataObserverServer
+	spool  *observationSpool
+	labels *labelSet
+}
+
+func (s *offlineServer) ObserveData(ctx context.Context, req *protos.ObservationRequest) (*protos.ObservationResponse, error) {
+	s.labels.apply(req)
+	req.Token = nil
+	rec, err := proto.Marshal(req)
+	if err == nil {
+		err = s.spool.append(rec)
+	}
+	if err != nil {
+		log.Printf("WARNING: offline buffer: %v", err)
+		return nil, detailedError(codes.Unavailable, reasonBufferFailed, time.Second, "could not buffer observation: "+err.Error())
+	}
+	metrics.OfflineBuffered.Inc()
+	return &protos.ObservationResponse{Status: "success"}, nil
+}
+
+// runOffline serves producers without auth or Observer, buffering every observation in
+// dir for "export" and "upload"; caller authentication, validation, labels and the IP
+// filter still apply
+func runOffline(dir string) int {
+	segmentMB, err := envInt("OFFLINE_SEGMENT_MB", 64)
+	if err != nil || segmentMB <= 0 {
+		log.Fatal("OFFLINE_SEGMENT_MB must be a positive integer")
+	}
+	interval, err := envDuration("OFFLINE_SEGMENT_INTERVAL", 10*time.Minute)
+	if err != nil || interval <= 0 {
+		log.Fatal("OFFLINE_SEGMENT_INTERVAL must be a positive duration")
+	}
+	c, err := spoolCipherFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	retention, err := spoolRetentionFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	alert, err := bufferAlertFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	spool, err := openBuffer(dir, int64(segmentMB)<<20, c)
+	if err != nil {
+		log.Fatalf("OFFLINE_DIR: %v", err)
+	}
+	go spool.completeEvery(interval)
+	go spool.retain(retention, time.Minute)
+	go spool.monitor(alert, 15*time.Second)
+
+	validator, err := requestValidatorFromEnv()
+	if err != nil {
+		log.Fatalf("request validation: %v", err)
+	}
+	serverCreds, _, mtls, err := serverTLSFromEnv(nil)
+	if err != nil {
+		log.Fatalf("server TLS: %v", err)
+	}
+	callers, err := callerAuthFromEnv(mtls)
+	if err != nil {
+		log.Fatalf("caller auth: %v", err)
+	}
+	ipFilter, err := ipFilterFromEnv()
+	if err != nil {
+		log.Fatalf("IP filter: %v", err)
+	}
+	originLabels, err := originLabelsFromEnv()
+	if err != nil {
+		log.Fatalf("enrichment: %v", err)
+	}
+	staticLabels, err := staticLabelsFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	labels := maps.Clone(originLabels)
+	maps.Copy(labels, staticLabels)
+
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		metricsLis, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatalf("metrics listen: %v", err)
+		}
+		go metrics.Serve(ipFilter.wrap(metricsLis))
+	}
+
+	serverOpts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(versionHeaderInterceptor)}
+	if serverCreds != nil {
+		serverOpts = append(serverOpts, grpc.Creds(serverCreds))
+	}
+	if callers != nil {
+		serverOpts = append(serverOpts, grpc.ChainUnaryInterceptor(callers.unaryInterceptor()))
+	}
+	if validator != nil {
+		serverOpts = append(serverOpts, grpc.ChainUnaryInterceptor(validator.unaryInterceptor()))
+	}
+	grpcServer := grpc.NewServer(serverOpts...)
+	protos.RegisterDataObserverServer(grpcServer, &offlineServer{spool: spool, labels: newLabelSet(labels)})
+
+	listeners, err := listen(":50051", 1)
+	if err != nil {
+		log.Fatalf("listen: %v", err)
+	}
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		name := "SIGTERM"
+		if <-sig == syscall.SIGINT {
+			name = "SIGINT"
+		}
+		log.Println("Shutting down...")
+		sdNotify("STOPPING=1")
+		auditTrail.record("stop", "signal "+name, "")
+		grpcServer.GracefulStop()
+	}()
+
+	log.Printf("OFFLINE MODE: buffering observations in %s, nothing is forwarded; listening on port 50051...", dir)
+	sdNotify("READY=1")
+	go runSdWatchdog()
+	for _, lis := range listeners[1:] {
+		go func() {
+			if err := grpcServer.Serve(ipFilter.wrap(lis)); err != nil {
+				log.Fatalf("serve: %v", err)
+			}
+		}()
+	}
+	if err := grpcServer.Serve(ipFilter.wrap(listeners[0])); err != nil {
+		log.Fatalf("serve: %v", err)
+	}
+	if err := spool.close(); err != nil {
+		log.Printf("WARNING: offline buffer: %v", err)
+	}
+	log.Println("Shutdown complete")
+	return 0
+}
+
+// runExport implements "export": it packs the complete segments of the offline buffer
+// into one file for transfer
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	dir := fs.String("dir", os.Getenv("OFFLINE_DIR"), "offline buffer directory")
+	out := fs.String("o", "", "file to write (- for stdout)")
+	remove := fs.Bool("remove", false, "delete the exported segments afterwards")
+	open := fs.Bool("open", false, "also export segments that were never completed, e.g. on the disk of a failed host")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: observer_middleware export -o file [-dir dir] [-remove] [-open]\n\nSegments still being written by a running middleware are left for the next export;\nuse -open only when no middleware runs on dir.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return flagExit(err)
+	}
+	if *dir == "" || *out == "" {
+		fs.Usage()
+		return 2
+	}
+	c, err := spoolCipherFromEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	spool, err := spoolAt(*dir, c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer spool.close()
+	var files []string
+	if spool.store == nil {
+		if files, err = spoolFiles(*dir, *open); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if c != nil {
+		if _, err := w.Write(c.header()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	records := 0
+	write := func(rec []byte) error {
+		records++
+		if c != nil {
+			rec = c.seal(rec)
+		}
+		_, err := w.Write(protowire.AppendBytes(nil, rec))
+		return err
+	}
+	var exported []uint64
+	if spool.store != nil {
+		err := spool.eachStored(func(id uint64, rec []byte) error {
+			exported = append(exported, id)
+			return write(rec)
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", spool.store.name(), err)
+			return 1
+		}
+	}
+	for _, name := range files {
+		// Re-framing drops a truncated tail instead of passing it on mid-file
+		if err := readSegment(name, c, write); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			return 1
+		}
+	}
+	if f, ok := w.(*os.File); ok && f != os.Stdout {
+		if err := f.Sync(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	from := fmt.Sprintf("%d segments", len(files))
+	if spool.store != nil {
+		from = spool.store.name()
+	}
+	if *remove {
+		for _, name := range files {
+			os.Remove(name)
+		}
+		if len(exported) > 0 {
+			if err := spool.store.remove(exported); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", from, err)
+				return 1
+			}
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d observations from %s\n", records, from)
+	return 0
+}
+
+// runImport implements "import": it adds the observations of export files to a buffer
+// directory as one complete segment (or one store transaction), for the middleware
+// there to forward (BUFFER_DIR)
+// or to export and upload later (OFFLINE_DIR). Records keep their arrival time and so
+// their idempotency keys.
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	dir := fs.String("dir", envString("BUFFER_DIR", os.Getenv("OFFLINE_DIR")), "buffer directory to add to")
+	remove := fs.Bool("remove", false, "delete the export files once imported")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: observer_middleware import [-dir dir] [-remove] export files...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return flagExit(err)
+	}
+	if *dir == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	c, err := spoolCipherFromEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := os.MkdirAll(*dir, 0o700); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	spool, err := spoolAt(*dir, c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer spool.close()
+
+	records := 0
+	var batch [][]byte // for a store, written in one transaction
+	for _, name := range fs.Args() {
+		err := readSegment(name, c, func(rec []byte) error {
+			records++
+			if spool.store != nil {
+				batch = append(batch, spool.sealStored(rec))
+				return nil
+			}
+			return spool.appendRecord(rec)
+		})
+		if err != nil {
+			// Nothing is half imported: the segment is only completed on success
+			spool.abandon()
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			return 1
+		}
+	}
+	if spool.store != nil && len(batch) > 0 {
+		err = spool.store.appendRecords(batch)
+	} else {
+		err = spool.complete()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *remove {
+		for _, name := range fs.Args() {
+			os.Remove(name)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d observations into %s\n", records, *dir)
+	return 0
+}
+
+// runUpload implements "upload": it sends buffered observations straight to the
+// Observer with the configured credentials, each with an idempotency key derived from
+// its record so an interrupted upload can be repeated
+func runUpload(args []string) int {
+	fs := flag.NewFlagSet("upload", flag.ContinueOnError)
+	dir := fs.String("dir", "", "offline buffer directory to upload (default OFFLINE_DIR when no files are given)")
+	clientID := fs.Int("client-id", 0, "client ID to send as (default: the first configured)")
+	timeout := fs.Duration("timeout", 10*time.Second, "deadline per observation")
+	remove := fs.Bool("remove", false, "delete each file once all of its observations are accepted")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: observer_middleware upload [flags] [export files...]\n\nThe configuration flags of serve apply as well.")
+		fs.PrintDefaults()
+	}
+	configFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return flagExit(err)
+	}
+	files := fs.Args()
+	if *dir == "" && len(files) == 0 {
+		*dir = os.Getenv("OFFLINE_DIR")
+	}
+	c, err := spoolCipherFromEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var stored *observationSpool // a dir with a store rather than segments
+	if *dir != "" {
+		spool, err := spoolAt(*dir, c)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer spool.close()
+		if spool.store != nil {
+			stored = spool
+		} else if segments, err := spoolFiles(*dir, false); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		} else {
+			files = append(files, segments...)
+		}
+	}
+	if len(files) == 0 && stored == nil {
+		fmt.Fprintln(os.Stderr, "nothing to upload")
+		return 0
+	}
+
+	observe, err := directSender(*clientID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	total := 0
+	for _, name := range files {
+		sent, err := uploadFile(name, c, observe, *timeout)
+		total += sent
+		if err != nil {
+			fmt.Printf("%s: %v after %d observations; run upload again to resume (earlier ones are resent with the same idempotency keys)\n", name, err, sent)
+			return 1
+		}
+		fmt.Printf("%s: %d observations\n", name, sent)
+		if *remove {
+			os.Remove(name)
+		}
+	}
+	if stored != nil {
+		send := func(rec []byte) error { return uploadRecord(rec, observe, *timeout) }
+		sent := 0
+		if *remove {
+			sent, err = stored.forward(send) // deletes what is accepted as it goes
+		} else {
+			err = stored.eachStored(func(_ uint64, rec []byte) error {
+				if err := send(rec); err != nil {
+					return err
+				}
+				sent++
+				return nil
+			})
+		}
+		total += sent
+		if err != nil {
+			fmt.Printf("%s: %v after %d observations; run upload again to resume (earlier ones are resent with the same idempotency keys)\n", stored.store.name(), err, sent)
+			return 1
+		}
+		fmt.Printf("%s: %d observations\n", stored.store.name(), sent)
+	}
+	fmt.Printf("Uploaded %d observations\n", total)
+	return 0
+}
+
+// uploadFile sends every record of one spool or export file
+func uploadFile(name string, c *spoolCipher, observe func(context.Context, *protos.ObservationRequest) (*protos.ObservationResponse, error), timeout time.Duration) (int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	sent := 0
+	err = readSpool(f, c, func(rec []byte) error {
+		if err := uploadRecord(rec, observe, timeout); err != nil {
+			return fmt.Errorf("record %d: %w", sent+1, err)
+		}
+		sent++
+		return nil
+	})
+	return sent, err
+}
+
+// uploadRecord sends one buffered observation with the idempotency key of its record
+func uploadRecord(rec []byte, observe func(context.Context, *protos.ObservationRequest) (*protos.ObservationResponse, error), timeout time.Duration) error {
+	req, err := decodeRecord(rec)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, idempotencyKeyMetadataKey, spoolRecordKey(rec))
+	_, err = observe(ctx, req)
+	return err
+}
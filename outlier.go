@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"systemiq.ai/metrics"
+)
+
+// maxEjectionDoubling caps how often a repeat offender's cooldown doubles
+const maxEjectionDoubling = 4
+
+// outlierConfig decides when an endpoint is ejected from rotation
+type outlierConfig struct {
+	interval    time.Duration // evaluation window
+	minRequests int           // calls needed in a window before judging
+	failureRate float64       // failure fraction that ejects
+	cooldown    time.Duration // first ejection; doubles on consecutive ejections
+}
+
+// outlierConfigFromEnv reads OBSERVER_OUTLIER_*
+func outlierConfigFromEnv() (outlierConfig, error) {
+	var c outlierConfig
+	var err error
+	if c.interval, err = envDuration("OBSERVER_OUTLIER_INTERVAL", 10*time.Second); err != nil {
+		return c, err
+	}
+	if c.cooldown, err = envDuration("OBSERVER_OUTLIER_EJECTION_TIME", 30*time.Second); err != nil {
+		return c, err
+	}
+	if c.minRequests, err = envInt("OBSERVER_OUTLIER_MIN_REQUESTS", 10); err != nil {
+		return c, err
+	}
+	percent, err := envInt("OBSERVER_OUTLIER_FAILURE_PERCENT", 50)
+	if err != nil || percent == 0 || percent > 100 {
+		return c, fmt.Errorf("OBSERVER_OUTLIER_FAILURE_PERCENT must be between 1 and 100")
+	}
+	c.failureRate = float64(percent) / 100
+	return c, nil
+}
+
+// endpointHealth is one endpoint's outcome over the last evaluation window
+type endpointHealth struct {
+	calls        int
+	failureRate  float64
+	avgLatency   time.Duration
+	score        float64 // success rate, 0 while ejected
+	ejectedUntil time.Time
+}
+
+// callStats accumulates call outcomes for the current window
+type callStats struct {
+	mu        sync.Mutex
+	calls     int
+	failures  int
+	latency   time.Duration
+	ejections int // consecutive windows ending in ejection
+	last      endpointHealth
+
+	total, totalErrors uint64                // since startup, for the admin status
+	byCode             map[codes.Code]uint64 // failed calls since startup, for heartbeats
+}
+
+// isUpstreamFailure reports whether err says the endpoint, not the request, is at fault
+func isUpstreamFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+func (m *member) record(err error, latency time.Duration, traceID string) {
+	m.stats.mu.Lock()
+	defer m.stats.mu.Unlock()
+	m.stats.calls++
+	m.stats.latency += latency
+	m.stats.total++
+	if err != nil {
+		m.stats.totalErrors++
+		if m.stats.byCode == nil {
+			m.stats.byCode = map[codes.Code]uint64{}
+		}
+		m.stats.byCode[status.Code(err)]++
+	}
+	if isUpstreamFailure(err) {
+		m.stats.failures++
+	}
+	metrics.ObserverEndpointCalls.WithLabelValues(m.Endpoint(), status.Code(err).String()).Inc()
+	metrics.ObserveCallDuration(m.Endpoint(), latency, traceID)
+}
+
+// totals returns the calls and errors since startup
+func (m *member) totals() (calls, errors uint64) {
+	m.stats.mu.Lock()
+	defer m.stats.mu.Unlock()
+	return m.stats.total, m.stats.totalErrors
+}
+
+// errorTotals returns the failed calls since startup by status code, over all endpoints
+func (s *upstreamSet) errorTotals() map[codes.Code]uint64 {
+	totals := map[codes.Code]uint64{}
+	for _, m := range s.members {
+		m.stats.mu.Lock()
+		for code, n := range m.stats.byCode {
+			totals[code] += n
+		}
+		m.stats.mu.Unlock()
+	}
+	return totals
+}
+
+// ejected reports whether the endpoint is out of rotation
+func (m *member) ejected() bool {
+	m.stats.mu.Lock()
+	defer m.stats.mu.Unlock()
+	return time.Now().Before(m.stats.last.ejectedUntil)
+}
+
+// health returns the results of the last evaluation
+func (m *member) health() endpointHealth {
+	m.stats.mu.Lock()
+	defer m.stats.mu.Unlock()
+	return m.stats.last
+}
+
+// evaluate closes the window, ejecting the endpoint if it failed too often and
+// canEject allows it; it reports whether it ejected
+func (m *member) evaluate(c outlierConfig, canEject bool) bool {
+	m.stats.mu.Lock()
+	defer m.stats.mu.Unlock()
+
+	h := endpointHealth{calls: m.stats.calls, score: 1, ejectedUntil: m.stats.last.ejectedUntil}
+	if m.stats.calls > 0 {
+		h.failureRate = float64(m.stats.failures) / float64(m.stats.calls)
+		h.avgLatency = m.stats.latency / time.Duration(m.stats.calls)
+		h.score = 1 - h.failureRate
+	}
+	m.stats.calls, m.stats.failures, m.stats.latency = 0, 0, 0
+
+	now := time.Now()
+	ejected := false
+	switch {
+	case now.Before(h.ejectedUntil):
+		// still cooling down
+	case h.calls >= c.minRequests && h.failureRate >= c.failureRate && canEject:
+		h.ejectedUntil = now.Add(c.cooldown << min(m.stats.ejections, maxEjectionDoubling))
+		m.stats.ejections++
+		ejected = true
+	case h.calls >= c.minRequests:
+		m.stats.ejections = 0 // a clean window forgives earlier ejections
+	}
+	if now.Before(h.ejectedUntil) {
+		h.score = 0
+	}
+	m.stats.last = h
+	return ejected
+}
+
+// runOutlierDetection evaluates every endpoint each window, ejecting those failing
+// too often while always keeping at least one in rotation
+func (s *upstreamSet) runOutlierDetection(ctx context.Context, c outlierConfig) {
+	if len(s.members) < 2 {
+		return
+	}
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		inRotation := 0
+		wasEjected := make([]bool, len(s.members))
+		for i, m := range s.members {
+			if wasEjected[i] = m.ejected(); !wasEjected[i] {
+				inRotation++
+			}
+		}
+		for i, m := range s.members {
+			if wasEjected[i] && !m.ejected() {
+				m.ramp.start(m.Endpoint(), "back in rotation")
+			}
+			if m.evaluate(c, inRotation > 1) {
+				inRotation--
+				m.distrust()
+				h := m.health()
+				metrics.ObserverEndpointEjections.WithLabelValues(m.Endpoint()).Inc()
+				log.Printf("Ejecting Observer endpoint %s until %s: %.0f%% of %d calls failed", m.Endpoint(), h.ejectedUntil.Format(time.TimeOnly), h.failureRate*100, h.calls)
+			}
+			metrics.ObserverEndpointScore.WithLabelValues(m.Endpoint()).Set(m.health().score)
+		}
+		s.reselect()
+	}
+}
+
+// call runs fn on the picked endpoint's connection, with call options matching its
+// advertised capabilities, and records the outcome
+func (s *upstreamSet) call(ctx context.Context, fn func(*grpc.ClientConn, ...grpc.CallOption) error) error {
+	m := s.pick()
+	if err := m.ramp.wait(ctx); err != nil {
+		return err
+	}
+	start := time.Now()
+	err := fn(m.Conn(), m.caps.Load().callOptions()...)
+	m.record(err, time.Since(start), traceIDFor(ctx, err))
+	return err
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"systemiq.ai/protos"
+)
+
+// ObservationRequest field numbers used on raw messages
+const (
+	dataFieldNumber      = 1
+	indicatorFieldNumber = 2
+	tokenFieldNumber     = 4
+	actionFieldNumber    = 5
+)
+
+// tokenReserve is spare capacity kept after each raw request so the token can be appended in place
+const tokenReserve = 2048
+
+// maxPooledBuf keeps unusually large request buffers from being pinned by the pool
+const maxPooledBuf = 4 << 20
+
+// rawBufPool recycles raw request buffers between calls
+var rawBufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 16<<10)
+		return &b
+	},
+}
+
+// getRawBuf returns an empty pooled buffer with at least size capacity
+func getRawBuf(size int) []byte {
+	b := *rawBufPool.Get().(*[]byte)
+	if cap(b) < size {
+		rawBufPool.Put(&b)
+		return make([]byte, 0, size)
+	}
+	return b[:0]
+}
+
+// putRawBuf hands a buffer back once nothing references it any more
+func putRawBuf(b []byte) {
+	if cap(b) <= maxPooledBuf {
+		rawBufPool.Put(&b)
+	}
+}
+
+// observation is the part of a request the middleware looks at, decoded or raw
+type observation interface {
+	GetIndicator() string
+}
+
+// rawMessage holds a message in wire form. For requests only the indicator is decoded;
+// the token is injected by appending field 4, which wins over any earlier occurrence.
+type rawMessage struct {
+	buf       []byte // original bytes, with tokenReserve spare capacity
+	indicator string
+	scanned   bool
+}
+
+// GetIndicator decodes field 2 on first use
+func (m *rawMessage) GetIndicator() string {
+	if m.scanned {
+		return m.indicator
+	}
+	m.scanned = true
+	for b := m.buf; len(b) > 0; {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return ""
+		}
+		b = b[n:]
+		if num == indicatorFieldNumber && typ == protowire.BytesType {
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return ""
+			}
+			m.indicator = v
+			b = b[n:]
+			continue
+		}
+		if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+			return ""
+		}
+		b = b[n:]
+	}
+	return m.indicator
+}
+
+// withToken returns the request with token and pre-encoded extra fields appended,
+// reusing the spare capacity
+func (m *rawMessage) withToken(token string, extra []byte) *rawMessage {
+	b := protowire.AppendTag(m.buf, tokenFieldNumber, protowire.BytesType)
+	b = protowire.AppendString(b, token)
+	return &rawMessage{buf: append(b, extra...)}
+}
+
+// rawCodec passes *rawMessage through untouched and handles everything else as protobuf
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	switch m := v.(type) {
+	case *rawMessage:
+		return m.buf, nil
+	case proto.Message:
+		return proto.Marshal(m)
+	}
+	return nil, fmt.Errorf("rawCodec: cannot marshal %T", v)
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	switch m := v.(type) {
+	case *rawMessage:
+		// gRPC recycles data once we return, so one copy (into a pooled buffer) is unavoidable
+		m.buf = append(getRawBuf(len(data)+tokenReserve), data...)
+		return nil
+	case proto.Message:
+		return proto.Unmarshal(data, m)
+	}
+	return fmt.Errorf("rawCodec: cannot unmarshal into %T", v)
+}
+
+func (rawCodec) Name() string { return "proto" }
+
+// passthroughServer is implemented by ObserverMiddlewareServer for the raw service
+type passthroughServer interface {
+	observeRaw(ctx context.Context, req *rawMessage) (*rawMessage, error)
+}
+
+// passthroughServiceDesc serves DataObserver with raw messages instead of decoded ones;
+// the server must use rawCodec (grpc.ForceServerCodec)
+var passthroughServiceDesc = grpc.ServiceDesc{
+	ServiceName: protos.DataObserver_ServiceDesc.ServiceName,
+	HandlerType: (*passthroughServer)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "ObserveData",
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			in := new(rawMessage)
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			// Upstream sends have completed by the time the handler returns
+			defer func() { putRawBuf(in.buf) }()
+
+			if interceptor == nil {
+				return srv.(passthroughServer).observeRaw(ctx, in)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: protos.DataObserver_ObserveData_FullMethodName}
+			return interceptor(ctx, in, info, func(ctx context.Context, req any) (any, error) {
+				return srv.(passthroughServer).observeRaw(ctx, req.(*rawMessage))
+			})
+		},
+	}},
+	Metadata: protos.DataObserver_ServiceDesc.Metadata,
+}
+
+// observeRaw forwards a raw ObservationRequest, appending the token without re-encoding
+func (s *ObserverMiddlewareServer) observeRaw(ctx context.Context, req *rawMessage) (*rawMessage, error) {
+	if testMode.Load() {
+		buf, _ := proto.Marshal(&protos.ObservationResponse{Status: "success"})
+		return &rawMessage{buf: buf}, nil
+	}
+	if !s.leader.IsLeader() {
+		return nil, errStandby
+	}
+
+	s.unknownFields.check(req)
+	var dedupKey [sha256.Size]byte
+	if s.dedup != nil {
+		if dedupKey = payloadKey(ctx, req); s.dedup.duplicate(dedupKey) {
+			debugf("Suppressed duplicate %q observation", req.GetIndicator())
+			buf, _ := proto.Marshal(&protos.ObservationResponse{Status: "success"})
+			return &rawMessage{buf: buf}, nil
+		}
+		defer s.dedup.release(dedupKey)
+	}
+	// Keyed before stages change req, so retries get the same key
+	idempotencyKey := s.idempotency.key(ctx, req)
+
+	var encoded []byte // the response, for the cache
+	if s.responses != nil {
+		cached, finish, err := s.responses.lookup(ctx, s.responses.key(ctx, req))
+		if err != nil {
+			return nil, err
+		}
+		if cached != nil {
+			debugf("Answered retried %q observation from cache", req.GetIndicator())
+			return &rawMessage{buf: cached}, nil
+		}
+		defer func() { finish(encoded) }()
+	}
+	if err := s.runStagesRaw(req); err != nil {
+		return nil, err
+	}
+
+	resp := new(rawMessage)
+	var sent *rawMessage
+	if s.uploads.wants(s.upstream, len(req.buf)) {
+		// The raw request plus labels is exactly the upload payload; the token travels separately
+		payload := append(req.buf, s.forwardedLabels().encoded()...)
+		var primary *protos.ObservationResponse
+		err := s.forward(ctx, protos.ObservationUpload_Upload_FullMethodName, req, idempotencyKey, func(ctx context.Context, token string) error {
+			ctx = s.signer.signRaw(ctx, req)
+			return s.upstream.call(ctx, func(conn *grpc.ClientConn, opts ...grpc.CallOption) (err error) {
+				primary, err = s.uploads.upload(ctx, conn, payload, token, opts...)
+				return err
+			})
+		})
+		if err == errDryRun {
+			primary, err = dryRunSuccess, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if s.dedup != nil {
+			s.dedup.forwarded(dedupKey)
+		}
+		buf, err := proto.Marshal(primary)
+		if err == nil {
+			encoded = buf
+		}
+		return &rawMessage{buf: buf}, err
+	}
+
+	err := s.forward(ctx, protos.DataObserver_ObserveData_FullMethodName, req, idempotencyKey, func(ctx context.Context, token string) error {
+		sent = req.withToken(token, s.forwardedLabels().encoded())
+		ctx = s.signer.signRaw(ctx, req)
+		return s.upstream.call(ctx, func(conn *grpc.ClientConn, opts ...grpc.CallOption) error {
+			return conn.Invoke(ctx, protos.DataObserver_ObserveData_FullMethodName, sent, resp, append(opts, grpc.ForceCodec(rawCodec{}))...)
+		})
+	})
+	if err == errDryRun {
+		resp.buf, err = proto.Marshal(dryRunSuccess)
+	}
+	if s.shadow != nil && sent != nil {
+		var primary *protos.ObservationResponse
+		if err == nil {
+			primary = new(protos.ObservationResponse)
+			proto.Unmarshal(resp.buf, primary)
+		}
+		s.shadow.mirror(cloneRaw(sent), req.GetIndicator(), primary, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.dedup != nil {
+		s.dedup.forwarded(dedupKey)
+	}
+	encoded = resp.buf
+	return resp, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// defaultTenant names the default credentials (no tenant metadata) in a policy
+const defaultTenant = "default"
+
+// policyRule lists what one identity may do; an empty list allows anything
+type policyRule struct {
+	Methods    []string `json:"methods"`    // bare method names, e.g. "ObserveData"
+	Tenants    []string `json:"tenants"`    // credential set names, or "default"
+	Indicators []string `json:"indicators"` // glob patterns, e.g. "temp-*"
+}
+
+// callerPolicy maps caller identities to rules; "*" applies to identities not listed
+type callerPolicy struct {
+	rules     map[string]policyRule
+	tenantKey string
+}
+
+// loadPolicy reads a JSON policy file of the form
+//
+//	{"line1": {"methods": ["ObserveData"], "tenants": ["acme"], "indicators": ["temp-*"]}, "*": {...}}
+func loadPolicy(file, tenantKey string) (*callerPolicy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	p, err := parsePolicy(data, tenantKey)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return p, nil
+}
+
+// parsePolicy parses a JSON policy document (see loadPolicy)
+func parsePolicy(data []byte, tenantKey string) (*callerPolicy, error) {
+	var rules map[string]policyRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
+	}
+	for identity, rule := range rules {
+		for _, pattern := range rule.Indicators {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("identity %q: bad indicator pattern %q", identity, pattern)
+			}
+		}
+	}
+	return &callerPolicy{rules: rules, tenantKey: tenantKey}, nil
+}
+
+// authorize checks the caller's method, tenant and (for observations) indicator
+func (p *callerPolicy) authorize(ctx context.Context, fullMethod string, req any) error {
+	id, ok := callerFrom(ctx)
+	if !ok {
+		return status.Error(codes.PermissionDenied, "caller is not authenticated")
+	}
+	rule, ok := p.rules[id.Name]
+	if !ok {
+		if rule, ok = p.rules["*"]; !ok {
+			return status.Errorf(codes.PermissionDenied, "caller %q has no policy", id.Name)
+		}
+	}
+
+	if method := path.Base(fullMethod); len(rule.Methods) > 0 && !slices.Contains(rule.Methods, method) {
+		return status.Errorf(codes.PermissionDenied, "caller %q may not call %s", id.Name, method)
+	}
+
+	tenant := defaultTenant
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(p.tenantKey); len(v) > 0 {
+		tenant = v[0]
+	}
+	if len(rule.Tenants) > 0 && !slices.Contains(rule.Tenants, tenant) {
+		return status.Errorf(codes.PermissionDenied, "caller %q may not use tenant %q", id.Name, tenant)
+	}
+
+	if obs, ok := req.(observation); ok && len(rule.Indicators) > 0 {
+		indicator := obs.GetIndicator()
+		if !slices.ContainsFunc(rule.Indicators, func(pattern string) bool {
+			matched, _ := path.Match(pattern, indicator)
+			return matched
+		}) {
+			return status.Errorf(codes.PermissionDenied, "caller %q may not submit indicator %q", id.Name, indicator)
+		}
+	}
+	return nil
+}
+
+// policyInterceptor rejects calls the current policy does not allow with PERMISSION_DENIED;
+// the policy can be swapped at runtime, and none allows every authenticated caller
+func policyInterceptor(current *atomic.Pointer[callerPolicy]) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if p := current.Load(); p != nil {
+			if err := p.authorize(ctx, info.FullMethod, req); err != nil {
+				return nil, withDetails(status.Convert(err), reasonCallerDenied, 0).Err()
+			}
+		}
+		return handler(ctx, req)
+	}
+}
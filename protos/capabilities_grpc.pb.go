@@ -0,0 +1,127 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v3.20.3
+// source: capabilities.proto
+
+package protos
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	ObserverInfo_GetCapabilities_FullMethodName = "/protos.ObserverInfo/GetCapabilities"
+)
+
+// ObserverInfoClient is the client API for ObserverInfo service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Optional Observer service describing what the Observer supports, so clients can
+// adapt without coordinated config changes. Observers without it answer UNIMPLEMENTED.
+type ObserverInfoClient interface {
+	GetCapabilities(ctx context.Context, in *CapabilitiesRequest, opts ...grpc.CallOption) (*Capabilities, error)
+}
+
+type observerInfoClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewObserverInfoClient(cc grpc.ClientConnInterface) ObserverInfoClient {
+	return &observerInfoClient{cc}
+}
+
+func (c *observerInfoClient) GetCapabilities(ctx context.Context, in *CapabilitiesRequest, opts ...grpc.CallOption) (*Capabilities, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Capabilities)
+	err := c.cc.Invoke(ctx, ObserverInfo_GetCapabilities_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ObserverInfoServer is the server API for ObserverInfo service.
+// All implementations must embed UnimplementedObserverInfoServer
+// for forward compatibility.
+//
+// Optional Observer service describing what the Observer supports, so clients can
+// adapt without coordinated config changes. Observers without it answer UNIMPLEMENTED.
+type ObserverInfoServer interface {
+	GetCapabilities(context.Context, *CapabilitiesRequest) (*Capabilities, error)
+	mustEmbedUnimplementedObserverInfoServer()
+}
+
+// UnimplementedObserverInfoServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedObserverInfoServer struct{}
+
+func (UnimplementedObserverInfoServer) GetCapabilities(context.Context, *CapabilitiesRequest) (*Capabilities, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCapabilities not implemented")
+}
+func (UnimplementedObserverInfoServer) mustEmbedUnimplementedObserverInfoServer() {}
+func (UnimplementedObserverInfoServer) testEmbeddedByValue()                      {}
+
+// UnsafeObserverInfoServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ObserverInfoServer will
+// result in compilation errors.
+type UnsafeObserverInfoServer interface {
+	mustEmbedUnimplementedObserverInfoServer()
+}
+
+func RegisterObserverInfoServer(s grpc.ServiceRegistrar, srv ObserverInfoServer) {
+	// If the following call pancis, it indicates UnimplementedObserverInfoServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&ObserverInfo_ServiceDesc, srv)
+}
+
+func _ObserverInfo_GetCapabilities_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CapabilitiesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ObserverInfoServer).GetCapabilities(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ObserverInfo_GetCapabilities_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ObserverInfoServer).GetCapabilities(ctx, req.(*CapabilitiesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ObserverInfo_ServiceDesc is the grpc.ServiceDesc for ObserverInfo service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ObserverInfo_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "protos.ObserverInfo",
+	HandlerType: (*ObserverInfoServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetCapabilities",
+			Handler:    _ObserverInfo_GetCapabilities_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "capabilities.proto",
+}
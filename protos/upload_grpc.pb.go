@@ -0,0 +1,161 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v3.20.3
+// source: upload.proto
+
+package protos
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	ObservationUpload_Upload_FullMethodName          = "/protos.ObservationUpload/Upload"
+	ObservationUpload_GetUploadStatus_FullMethodName = "/protos.ObservationUpload/GetUploadStatus"
+)
+
+// ObservationUploadClient is the client API for ObservationUpload service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Optional Observer service for observations too large for a single ObserveData
+// message. The payload is an encoded ObservationRequest without its token; it is
+// streamed in chunks and an interrupted upload resumes at the committed offset.
+type ObservationUploadClient interface {
+	Upload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UploadChunk, UploadStatus], error)
+	GetUploadStatus(ctx context.Context, in *UploadStatusRequest, opts ...grpc.CallOption) (*UploadStatus, error)
+}
+
+type observationUploadClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewObservationUploadClient(cc grpc.ClientConnInterface) ObservationUploadClient {
+	return &observationUploadClient{cc}
+}
+
+func (c *observationUploadClient) Upload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UploadChunk, UploadStatus], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ObservationUpload_ServiceDesc.Streams[0], ObservationUpload_Upload_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[UploadChunk, UploadStatus]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ObservationUpload_UploadClient = grpc.ClientStreamingClient[UploadChunk, UploadStatus]
+
+func (c *observationUploadClient) GetUploadStatus(ctx context.Context, in *UploadStatusRequest, opts ...grpc.CallOption) (*UploadStatus, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(UploadStatus)
+	err := c.cc.Invoke(ctx, ObservationUpload_GetUploadStatus_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ObservationUploadServer is the server API for ObservationUpload service.
+// All implementations must embed UnimplementedObservationUploadServer
+// for forward compatibility.
+//
+// Optional Observer service for observations too large for a single ObserveData
+// message. The payload is an encoded ObservationRequest without its token; it is
+// streamed in chunks and an interrupted upload resumes at the committed offset.
+type ObservationUploadServer interface {
+	Upload(grpc.ClientStreamingServer[UploadChunk, UploadStatus]) error
+	GetUploadStatus(context.Context, *UploadStatusRequest) (*UploadStatus, error)
+	mustEmbedUnimplementedObservationUploadServer()
+}
+
+// UnimplementedObservationUploadServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedObservationUploadServer struct{}
+
+func (UnimplementedObservationUploadServer) Upload(grpc.ClientStreamingServer[UploadChunk, UploadStatus]) error {
+	return status.Errorf(codes.Unimplemented, "method Upload not implemented")
+}
+func (UnimplementedObservationUploadServer) GetUploadStatus(context.Context, *UploadStatusRequest) (*UploadStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUploadStatus not implemented")
+}
+func (UnimplementedObservationUploadServer) mustEmbedUnimplementedObservationUploadServer() {}
+func (UnimplementedObservationUploadServer) testEmbeddedByValue()                           {}
+
+// UnsafeObservationUploadServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ObservationUploadServer will
+// result in compilation errors.
+type UnsafeObservationUploadServer interface {
+	mustEmbedUnimplementedObservationUploadServer()
+}
+
+func RegisterObservationUploadServer(s grpc.ServiceRegistrar, srv ObservationUploadServer) {
+	// If the following call pancis, it indicates UnimplementedObservationUploadServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&ObservationUpload_ServiceDesc, srv)
+}
+
+func _ObservationUpload_Upload_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ObservationUploadServer).Upload(&grpc.GenericServerStream[UploadChunk, UploadStatus]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ObservationUpload_UploadServer = grpc.ClientStreamingServer[UploadChunk, UploadStatus]
+
+func _ObservationUpload_GetUploadStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UploadStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ObservationUploadServer).GetUploadStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ObservationUpload_GetUploadStatus_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ObservationUploadServer).GetUploadStatus(ctx, req.(*UploadStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ObservationUpload_ServiceDesc is the grpc.ServiceDesc for ObservationUpload service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ObservationUpload_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "protos.ObservationUpload",
+	HandlerType: (*ObservationUploadServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetUploadStatus",
+			Handler:    _ObservationUpload_GetUploadStatus_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Upload",
+			Handler:       _ObservationUpload_Upload_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "upload.proto",
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"systemiq.ai/metrics"
+	"systemiq.ai/protos"
+)
+
+// spoolRetention bounds a spool directory so a month-long outage cannot fill the disk:
+// complete segments are deleted, oldest first, once their last write is older than
+// maxAge or while the directory holds more than maxBytes
+type spoolRetention struct {
+	maxAge   time.Duration // 0 = keep forever
+	maxBytes int64         // 0 = unbounded
+}
+
+// spoolRetentionFromEnv reads BUFFER_MAX_AGE and BUFFER_MAX_MB (both unset: no limit)
+func spoolRetentionFromEnv() (spoolRetention, error) {
+	var r spoolRetention
+	if os.Getenv("BUFFER_MAX_AGE") != "" {
+		age, err := envDuration("BUFFER_MAX_AGE", 0)
+		if err != nil {
+			return r, err
+		}
+		r.maxAge = age
+	}
+	mb, err := envInt("BUFFER_MAX_MB", 0)
+	if err != nil {
+		return r, err
+	}
+	r.maxBytes = int64(mb) << 20
+	return r, nil
+}
+
+// retain applies r to the spool at each interval, starting right away
+func (s *observationSpool) retain(r spoolRetention, interval time.Duration) {
+	if r.maxAge == 0 && r.maxBytes == 0 {
+		return
+	}
+	log.Printf("Deleting buffered observations in %s after %v or beyond %d MB (0 = never)", s.dir, r.maxAge, r.maxBytes>>20)
+	for {
+		s.enforce(r, time.Now())
+		time.Sleep(interval)
+	}
+}
+
+// enforce deletes the complete segments r no longer keeps; the segment being written
+// counts towards maxBytes but is never deleted
+func (s *observationSpool) enforce(r spoolRetention, now time.Time) {
+	if s.store != nil {
+		s.enforceStored(r, now)
+		return
+	}
+	all, err := spoolFiles(s.dir, true)
+	if err != nil {
+		log.Printf("WARNING: buffer retention: %v", err)
+		return
+	}
+	var total int64
+	infos := make(map[string]os.FileInfo, len(all))
+	for _, name := range all {
+		if info, err := os.Stat(name); err == nil {
+			infos[name] = info
+			total += info.Size()
+		}
+	}
+	for _, name := range all {
+		info := infos[name]
+		if info == nil || strings.HasSuffix(name, spoolOpenSuffix) {
+			continue
+		}
+		reason := ""
+		switch {
+		case r.maxAge > 0 && now.Sub(info.ModTime()) > r.maxAge:
+			reason = fmt.Sprintf("older than BUFFER_MAX_AGE (%v)", r.maxAge)
+		case r.maxBytes > 0 && total > r.maxBytes:
+			reason = fmt.Sprintf("buffer over BUFFER_MAX_MB (%d MB)", r.maxBytes>>20)
+		default:
+			continue
+		}
+		records := s.countRecords(name)
+		if err := os.Remove(name); err != nil {
+			log.Printf("WARNING: buffer retention: %v", err)
+			continue
+		}
+		total -= info.Size()
+		metrics.BufferExpired.Add(float64(records))
+		log.Printf("WARNING: deleted %d buffered observations in %s: %s", records, name, reason)
+	}
+}
+
+// countRecords counts the readable records of a segment
+func (s *observationSpool) countRecords(name string) int {
+	n := 0
+	readSegment(name, s.cipher, func([]byte) error {
+		n++
+		return nil
+	})
+	return n
+}
+
+// readSegment calls fn for each record of the spool or export file name
+func readSegment(name string, c *spoolCipher, fn func(rec []byte) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return readSpool(f, c, fn)
+}
+
+// rewriteSegment replaces a complete segment with the records keep accepts, deleting
+// it when none are left; the replacement is renamed into place, so a crash leaves
+// either the old or the new segment
+func rewriteSegment(name string, c *spoolCipher, keep func(rec []byte) bool) (kept, dropped int, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	var out []byte
+	if c != nil {
+		out = c.header()
+	}
+	err = readSpool(f, c, func(rec []byte) error {
+		if !keep(rec) {
+			dropped++
+			return nil
+		}
+		kept++
+		if c != nil {
+			rec = c.seal(rec)
+		}
+		out = protowire.AppendBytes(out, rec)
+		return nil
+	})
+	if err != nil || dropped == 0 {
+		return kept, dropped, err
+	}
+	if kept == 0 {
+		return kept, dropped, os.Remove(name)
+	}
+	tmp := name + ".tmp"
+	if err := writeFileSync(tmp, out); err != nil {
+		os.Remove(tmp)
+		return 0, 0, err
+	}
+	return kept, dropped, os.Rename(tmp, name)
+}
+
+// writeFileSync writes a file and syncs it to disk
+func writeFileSync(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// recordFilter selects buffered observations by arrival time, indicator and labels
+type recordFilter struct {
+	before    time.Time // zero = any arrival time
+	indicator string    // glob, "" = any
+	labels    map[string]string
+}
+
+func (f recordFilter) empty() bool {
+	return f.before.IsZero() && f.indicator == "" && len(f.labels) == 0
+}
+
+// match reports whether rec passes every filter; unreadable records never match
+func (f recordFilter) match(rec []byte) bool {
+	if len(rec) < 8 {
+		return false
+	}
+	if !f.before.IsZero() && !recordArrival(rec).Before(f.before) {
+		return false
+	}
+	if f.indicator == "" && len(f.labels) == 0 {
+		return true
+	}
+	req := new(protos.ObservationRequest)
+	if err := proto.Unmarshal(rec[8:], req); err != nil {
+		return false
+	}
+	if f.indicator != "" {
+		if ok, _ := path.Match(f.indicator, req.Indicator); !ok {
+			return false
+		}
+	}
+	for k, v := range f.labels {
+		if req.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// runQueue implements "queue": it inspects and purges a buffer directory, also while
+// a middleware runs on it
+func runQueue(args []string) int {
+	subcommands := map[string]func([]string) int{"list": runQueueList, "show": runQueueShow, "purge": runQueuePurge, "repair": runQueueRepair}
+	if len(args) == 0 || subcommands[args[0]] == nil {
+		fmt.Fprintln(os.Stderr, "usage: observer_middleware queue list | show | purge | repair [flags]")
+		return 2
+	}
+	return subcommands[args[0]](args[1:])
+}
+
+// runQueuePurge implements "queue purge": it deletes the buffered observations
+// matching every filter given
+func runQueuePurge(args []string) int {
+	fs := flag.NewFlagSet("queue purge", flag.ContinueOnError)
+	dir := fs.String("dir", envString("BUFFER_DIR", os.Getenv("OFFLINE_DIR")), "buffer directory")
+	olderThan := fs.Duration("older-than", 0, "only observations that arrived longer ago than this")
+	indicator := fs.String("indicator", "", "only observations whose indicator matches this glob")
+	label := fs.String("label", "", "only observations with these labels (k=v,k=v)")
+	dryRun := fs.Bool("dry-run", false, "only count what would be deleted")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: observer_middleware queue purge [-dir dir] [-older-than d] [-indicator glob] [-label k=v,...] [-dry-run]\n\nSegments still being written are left alone.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return flagExit(err)
+	}
+	filter := recordFilter{indicator: *indicator}
+	if *olderThan > 0 {
+		filter.before = time.Now().Add(-*olderThan)
+	}
+	if *label != "" {
+		filter.labels = map[string]string{}
+		for _, kv := range strings.Split(*label, ",") {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				fmt.Fprintf(os.Stderr, "-label: %q is not k=v\n", kv)
+				return 2
+			}
+			filter.labels[k] = v
+		}
+	}
+	if *dir == "" || filter.empty() {
+		fs.Usage()
+		return 2
+	}
+	if _, err := path.Match(filter.indicator, ""); err != nil {
+		fmt.Fprintf(os.Stderr, "-indicator: %v\n", err)
+		return 2
+	}
+	c, err := spoolCipherFromEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	spool, err := spoolAt(*dir, c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer spool.close()
+	purged, total, err := spool.purge(filter, *dryRun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	verb := "Purged"
+	if *dryRun {
+		verb = "Would purge"
+	}
+	fmt.Fprintf(os.Stderr, "%s %d of %d observations in %s\n", verb, purged, total, *dir)
+	return 0
+}
+
+// purgeSegments implements purge for segment files
+func (s *observationSpool) purgeSegments(filter recordFilter, dryRun bool) (purged, total int, err error) {
+	files, err := spoolFiles(s.dir, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, name := range files {
+		var kept, dropped int
+		var err error
+		if dryRun {
+			err = readSegment(name, s.cipher, func(rec []byte) error {
+				if filter.match(rec) {
+					dropped++
+				} else {
+					kept++
+				}
+				return nil
+			})
+		} else {
+			kept, dropped, err = rewriteSegment(name, s.cipher, func(rec []byte) bool { return !filter.match(rec) })
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			continue // forwarded meanwhile
+		}
+		if err != nil {
+			return purged, total, fmt.Errorf("%s: %w", name, err)
+		}
+		purged += dropped
+		total += kept + dropped
+	}
+	return purged, total, nil
+}
+
+var (
+	// errPageFull stops reading once a page of buffered observations is complete
+	errPageFull = errors.New("page full")
+	// errObservationID rejects a malformed buffered observation ID
+	errObservationID = errors.New("invalid buffered observation ID")
+)
+
+// listBuffered returns up to limit observations of dir, starting at the one with ID
+// start (empty: the oldest), and the ID of the next; segments still being written are
+// included, up to their last complete record
+func listBuffered(dir string, c *spoolCipher, start string, limit, preview int) ([]*protos.BufferedObservation, string, error) {
+	startSegment, startIndex := "", 0
+	if start != "" {
+		var index string
+		var ok bool
+		startSegment, index, ok = strings.Cut(start, "#")
+		if _, err := fmt.Sscan(index, &startIndex); !ok || err != nil {
+			return nil, "", fmt.Errorf("%w %q", errObservationID, start)
+		}
+	}
+	files, err := spoolFiles(dir, true)
+	if err != nil {
+		return nil, "", err
+	}
+	var page []*protos.BufferedObservation
+	next := ""
+	for _, name := range files {
+		segment := filepath.Base(name)
+		id := strings.TrimSuffix(strings.TrimSuffix(segment, spoolSuffix), spoolOpenSuffix)
+		if id < startSegment {
+			continue
+		}
+		index := 0
+		err := readSegment(name, c, func(rec []byte) error {
+			index++
+			if id == startSegment && index < startIndex {
+				return nil
+			}
+			if len(page) == limit {
+				next = fmt.Sprintf("%s#%d", id, index)
+				return errPageFull
+			}
+			page = append(page, bufferedObservation(fmt.Sprintf("%s#%d", id, index), segment, rec, preview))
+			return nil
+		})
+		if errors.Is(err, errPageFull) {
+			break
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) { // forwarded meanwhile
+			return nil, "", fmt.Errorf("%s: %w", segment, err)
+		}
+	}
+	return page, next, nil
+}
+
+// bufferedObservation describes one spool record
+func bufferedObservation(id, segment string, rec []byte, preview int) *protos.BufferedObservation {
+	o := &protos.BufferedObservation{Id: id, Segment: segment, IdempotencyKey: spoolRecordKey(rec)}
+	if len(rec) < 8 {
+		return o
+	}
+	o.ArrivedUnixMs = recordArrival(rec).UnixMilli()
+	o.SizeBytes = int64(len(rec) - 8)
+	req := new(protos.ObservationRequest)
+	if err := proto.Unmarshal(rec[8:], req); err != nil {
+		o.Indicator = "(unreadable: " + err.Error() + ")"
+		return o
+	}
+	o.Indicator, o.Labels, o.DataItems = req.Indicator, req.Labels, int32(len(req.Data))
+	if preview > 0 {
+		data := strings.Join(req.Data, "\n")
+		if len(data) > preview {
+			data = data[:preview]
+		}
+		o.Preview = strings.ToValidUTF8(data, "") // a rune cut in half is dropped
+	}
+	return o
+}
+
+// bufferedLister pages through buffered observations, from a directory or through the
+// admin API of the middleware that owns it
+type bufferedLister func(start string, limit, preview int) ([]*protos.BufferedObservation, string, error)
+
+// queueLister reads -dir, or with -addr asks a running middleware
+func queueLister(dir, addr string) (bufferedLister, func(), error) {
+	if addr == "" {
+		if dir == "" {
+			return nil, nil, errors.New("-dir or -addr is required")
+		}
+		c, err := spoolCipherFromEnv()
+		if err != nil {
+			return nil, nil, err
+		}
+		spool, err := spoolAt(dir, c)
+		if err != nil {
+			return nil, nil, err
+		}
+		return spool.list, func() { spool.close() }, nil
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, nil, err
+	}
+	client := protos.NewAdminClient(conn)
+	return func(start string, limit, preview int) ([]*protos.BufferedObservation, string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, adminTokenMetadataKey, token)
+		}
+		resp, err := client.ListBuffered(ctx, &protos.ListBufferedRequest{PageToken: start, PageSize: int32(limit), PreviewBytes: int32(preview)})
+		return resp.GetObservations(), resp.GetNextPageToken(), err
+	}, func() { conn.Close() }, nil
+}
+
+// runQueueList implements "queue list": one line per buffered observation, oldest first
+func runQueueList(args []string) int {
+	fs := flag.NewFlagSet("queue list", flag.ContinueOnError)
+	dir := fs.String("dir", envString("BUFFER_DIR", os.Getenv("OFFLINE_DIR")), "buffer directory")
+	addr := fs.String("addr", "", "ask the middleware with this admin address instead (its BUFFER_DIR)")
+	after := fs.String("from", "", "ID of the first observation to list")
+	limit := fs.Int("n", 100, "observations per page")
+	all := fs.Bool("all", false, "list every page")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: observer_middleware queue list [-dir dir | -addr host:port] [-from id] [-n count] [-all]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return flagExit(err)
+	}
+	list, done, err := queueLister(*dir, *addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer done()
+
+	next := *after
+	for {
+		page, token, err := list(next, *limit, 0)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, o := range page {
+			fmt.Printf("%-36s %s  %-24s %3d items %7d B  %s\n", o.GetId(), time.UnixMilli(o.GetArrivedUnixMs()).Format(time.DateTime), o.GetIndicator(), o.GetDataItems(), o.GetSizeBytes(), formatLabels(o.GetLabels()))
+		}
+		next = token
+		if next == "" || !*all {
+			break
+		}
+	}
+	if next != "" {
+		fmt.Fprintf(os.Stderr, "more: queue list -from %s\n", next)
+	}
+	return 0
+}
+
+// runQueueShow implements "queue show": everything about one buffered observation
+func runQueueShow(args []string) int {
+	fs := flag.NewFlagSet("queue show", flag.ContinueOnError)
+	dir := fs.String("dir", envString("BUFFER_DIR", os.Getenv("OFFLINE_DIR")), "buffer directory")
+	addr := fs.String("addr", "", "ask the middleware with this admin address instead (its BUFFER_DIR)")
+	preview := fs.Int("preview", 4096, "bytes of the data to print")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: observer_middleware queue show [-dir dir | -addr host:port] [-preview bytes] id")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return flagExit(err)
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	list, done, err := queueLister(*dir, *addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer done()
+	page, _, err := list(fs.Arg(0), 1, *preview)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(page) == 0 || page[0].GetId() != fs.Arg(0) {
+		fmt.Fprintf(os.Stderr, "%s: no such buffered observation (forwarded or purged?)\n", fs.Arg(0))
+		return 1
+	}
+	o := page[0]
+	fmt.Printf("id:              %s\nsegment:         %s\narrived:         %s\nindicator:       %s\nlabels:          %s\ndata items:      %d (%d bytes encoded)\nidempotency key: %s\n",
+		o.GetId(), o.GetSegment(), time.UnixMilli(o.GetArrivedUnixMs()).Format(time.RFC3339Nano), o.GetIndicator(), formatLabels(o.GetLabels()), o.GetDataItems(), o.GetSizeBytes(), o.GetIdempotencyKey())
+	if o.GetPreview() != "" {
+		fmt.Printf("data:\n%s\n", o.GetPreview())
+	}
+	return 0
+}
+
+// formatLabels prints labels as sorted k=v pairs
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// runQueueRepair implements "queue repair": it moves unreadable records out of the
+// complete segments, for export and upload to get past them
+func runQueueRepair(args []string) int {
+	fs := flag.NewFlagSet("queue repair", flag.ContinueOnError)
+	dir := fs.String("dir", envString("BUFFER_DIR", os.Getenv("OFFLINE_DIR")), "buffer directory")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: observer_middleware queue repair [-dir dir]\n\nUnreadable records are moved to <segment>.corrupt.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return flagExit(err)
+	}
+	if *dir == "" {
+		fs.Usage()
+		return 2
+	}
+	c, err := spoolCipherFromEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	spool, err := spoolAt(*dir, c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer spool.close()
+	total, err := spool.repair()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Moved %d unreadable records out of %s\n", total, *dir)
+	return 0
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"systemiq.ai/protos"
+)
+
+// testSpool returns a spool in a temporary directory holding one complete segment per
+// list of indicators
+func testSpool(t *testing.T, c *spoolCipher, segments ...[]string) *observationSpool {
+	t.Helper()
+	spool, err := openSpool(t.TempDir(), 64<<20, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, indicators := range segments {
+		for _, indicator := range indicators {
+			rec, err := proto.Marshal(&protos.ObservationRequest{Indicator: indicator, Data: []string{`{"v":1}`}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := spool.append(rec); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := spool.complete(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return spool
+}
+
+// spooledIndicators lists the indicators of every complete segment, oldest first
+func spooledIndicators(t *testing.T, s *observationSpool) []string {
+	t.Helper()
+	files, err := spoolFiles(s.dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var indicators []string
+	for _, name := range files {
+		err := readSegment(name, s.cipher, func(rec []byte) error {
+			req := new(protos.ObservationRequest)
+			if err := proto.Unmarshal(rec[8:], req); err != nil {
+				return err
+			}
+			indicators = append(indicators, req.Indicator)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return indicators
+}
+
+func TestRewriteSegment(t *testing.T) {
+	t.Setenv("BUFFER_KEY_FILE", writeTestKey(t))
+	c, err := spoolCipherFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool := testSpool(t, c, []string{"keep", "test-a", "keep"}, []string{"test-b"})
+	files, _ := spoolFiles(spool.dir, false)
+	filter := recordFilter{indicator: "test-*"}
+	for _, name := range files {
+		if _, _, err := rewriteSegment(name, c, func(rec []byte) bool { return !filter.match(rec) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := spooledIndicators(t, spool); len(got) != 2 || got[0] != "keep" || got[1] != "keep" {
+		t.Errorf("after purge the spool holds %q, want [keep keep]", got)
+	}
+	if files, _ := spoolFiles(spool.dir, false); len(files) != 1 {
+		t.Errorf("%d segments left, want 1 (the emptied one deleted)", len(files))
+	}
+}
+
+func TestRetention(t *testing.T) {
+	spool := testSpool(t, nil, []string{"a"}, []string{"b"}, []string{"c"})
+	files, _ := spoolFiles(spool.dir, false)
+	info, err := os.Stat(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Room for two segments: the oldest goes
+	spool.enforce(spoolRetention{maxBytes: 2 * info.Size()}, time.Now())
+	if got := spooledIndicators(t, spool); len(got) != 2 || got[0] != "b" {
+		t.Errorf("after BUFFER_MAX_MB the spool holds %q, want [b c]", got)
+	}
+	spool.enforce(spoolRetention{maxAge: time.Hour}, time.Now().Add(2*time.Hour))
+	if got := spooledIndicators(t, spool); len(got) != 0 {
+		t.Errorf("after BUFFER_MAX_AGE the spool holds %q, want nothing", got)
+	}
+}
+
+func TestListBufferedPages(t *testing.T) {
+	spool := testSpool(t, nil, []string{"a", "b"}, []string{"c"})
+	var got []string
+	next := ""
+	for {
+		page, token, err := listBuffered(spool.dir, nil, next, 2, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range page {
+			got = append(got, o.Indicator)
+		}
+		if next = token; next == "" {
+			break
+		}
+	}
+	if len(got) != 3 || got[0] != "a" || got[2] != "c" {
+		t.Errorf("pages list %q, want [a b c]", got)
+	}
+	if _, _, err := listBuffered(spool.dir, nil, "bogus", 2, 0); !errors.Is(err, errObservationID) {
+		t.Errorf("malformed ID: %v, want errObservationID", err)
+	}
+}
+
+func TestSpoolStats(t *testing.T) {
+	spool := testSpool(t, nil, []string{"a", "b"})
+	if err := spool.append([]byte{}); err != nil { // an open segment with one record
+		t.Fatal(err)
+	}
+	st := spool.stats()
+	if st.observations != 3 || st.bytes == 0 || st.oldest.IsZero() {
+		t.Fatalf("stats %+v, want 3 observations", st)
+	}
+
+	files, _ := spoolFiles(spool.dir, false)
+	if _, _, err := rewriteSegment(files[0], nil, func([]byte) bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+	if st := spool.stats(); st.observations != 1 {
+		t.Errorf("after a purge stats count %d observations, want 1", st.observations)
+	}
+	alert := bufferAlert{maxAge: time.Minute}
+	if reason := alert.check(st, st.oldest.Add(2*time.Minute)); reason == "" {
+		t.Error("BUFFER_ALERT_AGE exceeded without alert")
+	}
+}
+
+// writeTestKey writes a BUFFER_KEY_FILE
+func writeTestKey(t testing.TB) string {
+	t.Helper()
+	name := t.TempDir() + "/key"
+	if err := os.WriteFile(name, []byte("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"systemiq.ai/metrics"
+)
+
+// apiKeyMetadataKey carries a caller's API key
+const apiKeyMetadataKey = "x-api-key"
+
+// limiterIdleTTL is how long an unused per-caller bucket is kept before it is dropped
+const limiterIdleTTL = 10 * time.Minute
+
+type callerLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// callerBuckets keeps one token bucket per caller key, dropping idle ones
+type callerBuckets struct {
+	limit rate.Limit
+	burst int
+
+	mu      sync.Mutex
+	callers map[string]*callerLimiter
+}
+
+func newCallerBuckets(limit rate.Limit, burst int) *callerBuckets {
+	b := &callerBuckets{limit: limit, burst: burst, callers: map[string]*callerLimiter{}}
+	go b.sweep()
+	return b
+}
+
+// get returns the caller's bucket, creating it on first use
+func (b *callerBuckets) get(key string) *rate.Limiter {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.callers[key]
+	if !ok {
+		c = &callerLimiter{limiter: rate.NewLimiter(b.limit, b.burst)}
+		b.callers[key] = c
+	}
+	c.lastSeen = time.Now()
+	return c.limiter
+}
+
+// sweep drops buckets of callers that have gone quiet so the map stays bounded
+func (b *callerBuckets) sweep() {
+	for range time.Tick(limiterIdleTTL) {
+		b.mu.Lock()
+		for key, c := range b.callers {
+			if time.Since(c.lastSeen) > limiterIdleTTL {
+				delete(b.callers, key)
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+// rateLimiter keeps one request-count token bucket per caller identity
+type rateLimiter struct {
+	keyBy   string // "peer", "cn" or "api-key"
+	buckets *callerBuckets
+}
+
+// rateLimiterFromEnv builds the limiter from RATE_LIMIT_*; nil when RATE_LIMIT_RPS is unset
+func rateLimiterFromEnv() (*rateLimiter, error) {
+	v := os.Getenv("RATE_LIMIT_RPS")
+	if v == "" {
+		return nil, nil
+	}
+	rps, err := strconv.ParseFloat(v, 64)
+	if err != nil || rps <= 0 {
+		return nil, fmt.Errorf("RATE_LIMIT_RPS must be a positive number")
+	}
+
+	burst := max(int(rps), 1)
+	if v := os.Getenv("RATE_LIMIT_BURST"); v != "" {
+		if burst, err = strconv.Atoi(v); err != nil || burst <= 0 {
+			return nil, fmt.Errorf("RATE_LIMIT_BURST must be a positive integer")
+		}
+	}
+
+	keyBy, err := callerKeyFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	l := &rateLimiter{keyBy: keyBy, buckets: newCallerBuckets(rate.Limit(rps), burst)}
+	log.Printf("Rate limiting callers by %s to %.2f req/s (burst %d)", keyBy, rps, burst)
+	return l, nil
+}
+
+// callerKeyFromEnv reads RATE_LIMIT_KEY, which also keys per-caller bandwidth limits
+func callerKeyFromEnv() (string, error) {
+	switch keyBy := os.Getenv("RATE_LIMIT_KEY"); keyBy {
+	case "":
+		return "peer", nil
+	case "peer", "cn", "api-key":
+		return keyBy, nil
+	}
+	return "", fmt.Errorf("RATE_LIMIT_KEY must be peer, cn or api-key")
+}
+
+// callerKey identifies the caller according to keyBy, falling back to the peer host
+func callerKey(ctx context.Context, keyBy string) string {
+	switch keyBy {
+	case "api-key":
+		md, _ := metadata.FromIncomingContext(ctx)
+		if v := md.Get(apiKeyMetadataKey); len(v) > 0 {
+			return "key:" + v[0]
+		}
+	case "cn":
+		if p, ok := peer.FromContext(ctx); ok {
+			if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.PeerCertificates) > 0 {
+				return "cn:" + info.State.PeerCertificates[0].Subject.CommonName
+			}
+		}
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "peer:unknown"
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		host = p.Addr.String()
+	}
+	return "peer:" + host
+}
+
+// unaryInterceptor rejects calls over the caller's rate with RESOURCE_EXHAUSTED
+func (l *rateLimiter) unaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if bucket := l.buckets.get(callerKey(ctx, l.keyBy)); !bucket.Allow() {
+			metrics.RateLimited.Inc()
+			// Until the bucket holds the next whole token
+			next := time.Duration((1 - bucket.Tokens()) / float64(bucket.Limit()) * float64(time.Second))
+			return nil, detailedError(codes.ResourceExhausted, reasonRateLimited, next, fmt.Sprintf("rate limit exceeded (keyed by %s)", l.keyBy))
+		}
+		return handler(ctx, req)
+	}
+}
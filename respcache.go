@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"systemiq.ai/metrics"
+)
+
+// idempotencyKeyMetadataKey lets producers name retries of the same observation
+const idempotencyKeyMetadataKey = "x-idempotency-key"
+
+// responseCache answers rapid retries with the Observer's response to the first attempt.
+// Calls are keyed by the producer's idempotency key, else by caller and payload; a retry
+// arriving while the first attempt is still in flight waits for its outcome. Failed
+// attempts are never cached.
+type responseCache struct {
+	ttl time.Duration
+	max int
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*cachedResponse
+}
+
+// cachedResponse is an encoded ObservationResponse; done is closed once it is known
+type cachedResponse struct {
+	done chan struct{}
+	resp []byte // nil while in flight
+	at   time.Time
+}
+
+// responseCacheFromEnv reads RESPONSE_CACHE_TTL (off when unset) and
+// RESPONSE_CACHE_MAX_ENTRIES
+func responseCacheFromEnv() (*responseCache, error) {
+	if os.Getenv("RESPONSE_CACHE_TTL") == "" {
+		return nil, nil
+	}
+	ttl, err := envDuration("RESPONSE_CACHE_TTL", 0)
+	if err != nil {
+		return nil, err
+	}
+	max, err := envInt("RESPONSE_CACHE_MAX_ENTRIES", 10000)
+	if err != nil || max <= 0 {
+		return nil, fmt.Errorf("RESPONSE_CACHE_MAX_ENTRIES must be a positive integer")
+	}
+	log.Printf("Answering retries within %v from cached responses", ttl)
+	return &responseCache{ttl: ttl, max: max, entries: map[[sha256.Size]byte]*cachedResponse{}}, nil
+}
+
+// key is the caller's idempotency key, or the payload hash without one
+func (c *responseCache) key(ctx context.Context, req observation) [sha256.Size]byte {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(idempotencyKeyMetadataKey); len(v) > 0 && v[0] != "" {
+		return sha256.Sum256([]byte(flow(ctx) + "\x00" + v[0]))
+	}
+	return payloadKey(ctx, req)
+}
+
+// lookup returns the cached response for key, waiting for one in flight. On a miss the
+// caller owns the key and must call finish with the encoded response, or nil on failure.
+func (c *responseCache) lookup(ctx context.Context, key [sha256.Size]byte) (cached []byte, finish func([]byte), err error) {
+	for {
+		c.mu.Lock()
+		e, ok := c.entries[key]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			return nil, nil, status.FromContextError(ctx.Err()).Err()
+		}
+		if e.resp != nil && time.Since(e.at) < c.ttl {
+			metrics.ResponseCacheHits.Inc()
+			return e.resp, nil, nil
+		}
+		// Failed or expired: drop it unless another caller already replaced it
+		c.mu.Lock()
+		if c.entries[key] == e {
+			delete(c.entries, key)
+		}
+		c.mu.Unlock()
+	}
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= c.max {
+		c.evictExpired()
+		if len(c.entries) >= c.max {
+			return nil, func([]byte) {}, nil
+		}
+	}
+	e := &cachedResponse{done: make(chan struct{})}
+	c.entries[key] = e
+	return nil, func(resp []byte) {
+		c.mu.Lock()
+		if resp == nil {
+			delete(c.entries, key)
+		} else {
+			e.resp, e.at = bytes.Clone(resp), time.Now()
+		}
+		c.mu.Unlock()
+		close(e.done)
+	}, nil
+}
+
+// evictExpired drops settled entries past the TTL; called with mu held
+func (c *responseCache) evictExpired() {
+	for k, e := range c.entries {
+		if e.resp != nil && time.Since(e.at) >= c.ttl {
+			delete(c.entries, k)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setReusePort(string, string, syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
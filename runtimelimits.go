@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is where the container's cgroup (v1 or v2) is mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// applyRuntimeLimits sizes GOMAXPROCS to the container CPU quota and GOMEMLIMIT to a
+// fraction (RUNTIME_MEMLIMIT_RATIO, default 0.9) of its memory limit. Explicit GOMAXPROCS /
+// GOMEMLIMIT variables win, and RUNTIME_AUTO_LIMITS=false turns detection off.
+func applyRuntimeLimits() {
+	if v := os.Getenv("RUNTIME_AUTO_LIMITS"); strings.ToLower(v) == "false" || v == "0" {
+		return
+	}
+
+	if os.Getenv("GOMAXPROCS") == "" {
+		if cpus, ok := cgroupCPUs(); ok {
+			procs := max(1, int(math.Ceil(cpus)))
+			if procs < runtime.GOMAXPROCS(0) {
+				runtime.GOMAXPROCS(procs)
+				log.Printf("GOMAXPROCS set to %d from the cgroup CPU quota (%.2f CPUs)", procs, cpus)
+			}
+		}
+	}
+
+	if os.Getenv("GOMEMLIMIT") == "" {
+		if limit, ok := cgroupMemory(); ok {
+			ratio := 0.9
+			if v := os.Getenv("RUNTIME_MEMLIMIT_RATIO"); v != "" {
+				if r, err := strconv.ParseFloat(v, 64); err == nil && r > 0 && r <= 1 {
+					ratio = r
+				} else {
+					log.Printf("Ignoring RUNTIME_MEMLIMIT_RATIO=%q (want a number in (0, 1])", v)
+				}
+			}
+			memLimit := int64(float64(limit) * ratio)
+			debug.SetMemoryLimit(memLimit)
+			log.Printf("GOMEMLIMIT set to %d MiB (%.0f%% of the %d MiB cgroup limit)", memLimit>>20, ratio*100, limit>>20)
+		}
+	}
+}
+
+// cgroupCPUs returns the CPU quota in cores (cgroup v2 cpu.max, then v1 cfs quota/period)
+func cgroupCPUs() (float64, bool) {
+	if fields := strings.Fields(readCgroupFile("cpu.max")); len(fields) == 2 && fields[0] != "max" {
+		return ratio(fields[0], fields[1])
+	}
+	quota, period := readCgroupFile("cpu/cpu.cfs_quota_us"), readCgroupFile("cpu/cpu.cfs_period_us")
+	if quota != "" && quota != "-1" {
+		return ratio(quota, period)
+	}
+	return 0, false
+}
+
+// cgroupMemory returns the memory limit in bytes (cgroup v2 memory.max, then v1 limit_in_bytes)
+func cgroupMemory() (int64, bool) {
+	v := readCgroupFile("memory.max")
+	if v == "" {
+		v = readCgroupFile("memory/memory.limit_in_bytes")
+	}
+	limit, err := strconv.ParseInt(v, 10, 64)
+	// "max" (v2) fails to parse; v1 reports "unlimited" as a huge page-aligned number
+	if err != nil || limit <= 0 || limit >= 1<<62 {
+		return 0, false
+	}
+	return limit, true
+}
+
+func readCgroupFile(name string) string {
+	b, err := os.ReadFile(cgroupRoot + "/" + name)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func ratio(num, den string) (float64, bool) {
+	n, err1 := strconv.ParseFloat(num, 64)
+	d, err2 := strconv.ParseFloat(den, 64)
+	if err1 != nil || err2 != nil || n <= 0 || d <= 0 {
+		return 0, false
+	}
+	return n / d, true
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state such as READY=1 to systemd; a no-op outside a Type=notify unit
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("WARNING: sd_notify: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("WARNING: sd_notify: %v", err)
+	}
+}
+
+// sdWatchdogInterval is the unit's WatchdogSec, or 0 when the watchdog is off or meant
+// for another process
+func sdWatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runSdWatchdog pings systemd at half the watchdog interval for the life of the process,
+// including a graceful drain, so systemd restarts the unit if the process hangs
+func runSdWatchdog() {
+	interval := sdWatchdogInterval()
+	if interval == 0 || os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	log.Printf("Pinging the systemd watchdog every %v", interval/2)
+	for range time.Tick(interval / 2) {
+		sdNotify("WATCHDOG=1")
+	}
+}
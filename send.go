@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"systemiq.ai/auth"
+	"systemiq.ai/protos"
+)
+
+// sendObservation is the file format of "send --file": one object or an array of them;
+// data entries may be JSON strings or any other JSON value, which is sent as its text
+type sendObservation struct {
+	Indicator string            `json:"indicator"`
+	ElementID *int32            `json:"element_id"`
+	Action    *string           `json:"action"`
+	Labels    map[string]string `json:"labels"`
+	Data      []json.RawMessage `json:"data"`
+}
+
+// labelFlags collects repeated -label k=v flags
+type labelFlags map[string]string
+
+func (l labelFlags) String() string { return fmt.Sprint(map[string]string(l)) }
+
+func (l labelFlags) Set(v string) error {
+	k, val, ok := strings.Cut(v, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("want key=value")
+	}
+	l[k] = val
+	return nil
+}
+
+// runSend submits observations from a file or flags through a running middleware, or
+// with -direct straight to the Observer using the configured credentials
+func runSend(args []string) int {
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	file := fs.String("file", "", "JSON file with one observation or an array of them (- for stdin)")
+	indicator := fs.String("indicator", "", "indicator of a single observation given by flags")
+	var data []string
+	fs.Func("data", "JSON data string (repeatable)", func(v string) error { data = append(data, v); return nil })
+	elementID := fs.Int("element-id", -1, "element ID (unset when negative)")
+	action := fs.String("action", "", "action parameter")
+	labels := labelFlags{}
+	fs.Var(labels, "label", "key=value label (repeatable), added to every observation")
+	addr := fs.String("addr", "localhost:50051", "middleware to submit through")
+	caFile := fs.String("ca", "", "CA file; connects to -addr over TLS when set")
+	apiKey := fs.String("api-key", "", "caller API key sent as "+apiKeyMetadataKey)
+	direct := fs.Bool("direct", false, "send straight to the Observer, logging in with the configured credentials")
+	clientID := fs.Int("client-id", 0, "with -direct, the client ID to send as (default: the first configured)")
+	timeout := fs.Duration("timeout", 10*time.Second, "deadline per observation")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: observer_middleware send (-file obs.json | -indicator name -data '{...}') [flags]\n\nWith -direct, the configuration flags of serve apply as well.")
+		fs.PrintDefaults()
+	}
+	configFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return flagExit(err)
+	}
+
+	var reqs []*protos.ObservationRequest
+	var err error
+	switch {
+	case *file != "" && *indicator != "":
+		err = errors.New("give either -file or -indicator, not both")
+	case *file != "":
+		reqs, err = readObservations(*file)
+	case *indicator != "":
+		req := &protos.ObservationRequest{Indicator: *indicator, Data: data}
+		if *elementID >= 0 {
+			id := int32(*elementID)
+			req.ElementId = &id
+		}
+		if *action != "" {
+			req.Action = action
+		}
+		reqs = append(reqs, req)
+	default:
+		err = errors.New("nothing to send: give -file or -indicator")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	for _, req := range reqs {
+		if len(labels) > 0 {
+			if req.Labels == nil {
+				req.Labels = map[string]string{}
+			}
+			maps.Copy(req.Labels, labels)
+		}
+	}
+
+	var observe func(ctx context.Context, req *protos.ObservationRequest) (*protos.ObservationResponse, error)
+	if *direct {
+		observe, err = directSender(*clientID)
+	} else {
+		observe, err = middlewareSender(*addr, *caFile, *apiKey)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	failed := 0
+	for i, req := range reqs {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		resp, err := observe(ctx, req)
+		cancel()
+		if err != nil {
+			failed++
+			fmt.Printf("%d %q: %v\n", i+1, req.GetIndicator(), err)
+			continue
+		}
+		fmt.Printf("%d %q: %s\n", i+1, req.GetIndicator(), resp.GetStatus())
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// readObservations parses a send file
+func readObservations(path string) ([]*protos.ObservationRequest, error) {
+	var raw []byte
+	var err error
+	if path == "-" {
+		raw, err = io.ReadAll(os.Stdin)
+	} else {
+		raw, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []sendObservation
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &list)
+	} else {
+		list = make([]sendObservation, 1)
+		err = json.Unmarshal(trimmed, &list[0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	reqs := make([]*protos.ObservationRequest, 0, len(list))
+	for i, o := range list {
+		if o.Indicator == "" {
+			return nil, fmt.Errorf("%s: observation %d has no indicator", path, i+1)
+		}
+		req := &protos.ObservationRequest{Indicator: o.Indicator, ElementId: o.ElementID, Action: o.Action, Labels: o.Labels}
+		for _, d := range o.Data {
+			var s string
+			if json.Unmarshal(d, &s) != nil {
+				var buf bytes.Buffer
+				json.Compact(&buf, d)
+				s = buf.String()
+			}
+			req.Data = append(req.Data, s)
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+// middlewareSender submits through the middleware at addr, like any producer
+func middlewareSender(addr, caFile, apiKey string) (func(context.Context, *protos.ObservationRequest) (*protos.ObservationResponse, error), error) {
+	creds := insecure.NewCredentials()
+	if caFile != "" {
+		var err error
+		if creds, err = credentials.NewClientTLSFromFile(caFile, ""); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	client := protos.NewDataObserverClient(conn)
+	return func(ctx context.Context, req *protos.ObservationRequest) (*protos.ObservationResponse, error) {
+		if apiKey != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, apiKeyMetadataKey, apiKey)
+		}
+		return client.ObserveData(ctx, req)
+	}, nil
+}
+
+// directSender logs in and sends to the configured Observer endpoint, skipping the
+// middleware's pipeline (labels, stages, limits)
+func directSender(clientID int) (func(context.Context, *protos.ObservationRequest) (*protos.ObservationResponse, error), error) {
+	log.SetOutput(io.Discard) // login and dial logs would drown the results
+	cfg, err := auth.ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	cfg.LazyLogin, cfg.StartupRetry = false, false
+	authHandler, err := auth.NewAuthHandler(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("login: %w", err)
+	}
+	if clientID == 0 {
+		clientID = authHandler.ClientIDs()[0]
+	} else if !authHandler.HasClient(clientID) {
+		return nil, fmt.Errorf("client ID %d is not among the configured ones %v", clientID, authHandler.ClientIDs())
+	}
+
+	methods, err := methodConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	srvRefresh, err := envDuration("OBSERVER_SRV_REFRESH", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	channel, err := observerChannelFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialObserver(observerEndpointFromEnv(), methods, nil,
+		append(channel, grpc.WithResolvers(consulResolverFromEnv(), &srvResolverBuilder{interval: srvRefresh}))...)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := payloadSignerFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	client := protos.NewDataObserverClient(conn)
+	return func(ctx context.Context, req *protos.ObservationRequest) (*protos.ObservationResponse, error) {
+		token, err := authHandler.GetTokenFor(ctx, clientID)
+		if err != nil {
+			return nil, err
+		}
+		req.Token = &token
+		return client.ObserveData(signer.signRequest(ctx, req), req)
+	}, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// serverKeepaliveFromEnv sets connection-cycling limits for the local server from
+// SERVER_MAX_CONNECTION_IDLE/_AGE/_AGE_GRACE and the client keepalive enforcement policy
+// from SERVER_KEEPALIVE_*; unset values keep gRPC's defaults
+func serverKeepaliveFromEnv() ([]grpc.ServerOption, error) {
+	var (
+		opts   []grpc.ServerOption
+		params keepalive.ServerParameters
+		err    error
+	)
+	if params.MaxConnectionIdle, err = envDuration("SERVER_MAX_CONNECTION_IDLE", 0); err != nil {
+		return nil, err
+	}
+	if params.MaxConnectionAge, err = envDuration("SERVER_MAX_CONNECTION_AGE", 0); err != nil {
+		return nil, err
+	}
+	if params.MaxConnectionAgeGrace, err = envDuration("SERVER_MAX_CONNECTION_AGE_GRACE", 0); err != nil {
+		return nil, err
+	}
+
+	if params != (keepalive.ServerParameters{}) {
+		log.Printf("Server connections: max idle %v, max age %v, age grace %v",
+			params.MaxConnectionIdle, params.MaxConnectionAge, params.MaxConnectionAgeGrace)
+		opts = append(opts, grpc.KeepaliveParams(params))
+	}
+
+	// Callers pinging more often than MinTime (gRPC default 5m) are sent GOAWAY
+	// ("too_many_pings"); so are pings on idle connections unless permitted
+	_, minTimeSet := os.LookupEnv("SERVER_KEEPALIVE_MIN_TIME")
+	_, permitSet := os.LookupEnv("SERVER_KEEPALIVE_PERMIT_WITHOUT_STREAM")
+	if minTimeSet || permitSet {
+		policy := keepalive.EnforcementPolicy{PermitWithoutStream: envBool("SERVER_KEEPALIVE_PERMIT_WITHOUT_STREAM")}
+		if policy.MinTime, err = envDuration("SERVER_KEEPALIVE_MIN_TIME", 5*time.Minute); err != nil {
+			return nil, err
+		}
+		log.Printf("Keepalive enforcement: min ping interval %v, pings without streams permitted: %v",
+			policy.MinTime, policy.PermitWithoutStream)
+		opts = append(opts, grpc.KeepaliveEnforcementPolicy(policy))
+	}
+	return opts, nil
+}
+
+// bufferSizesFromEnv reads <prefix>_READ_BUFFER_KB/_WRITE_BUFFER_KB for a gRPC transport;
+// -1 leaves gRPC's default (32 KiB), 0 disables write buffering
+func bufferSizesFromEnv(prefix string) (read, write int, err error) {
+	read, write = -1, -1
+	for _, b := range []struct {
+		name string
+		size *int
+	}{{prefix + "_READ_BUFFER_KB", &read}, {prefix + "_WRITE_BUFFER_KB", &write}} {
+		if _, ok := os.LookupEnv(b.name); !ok {
+			continue
+		}
+		kb, err := envInt(b.name, 0)
+		if err != nil {
+			return 0, 0, err
+		}
+		*b.size = kb << 10
+	}
+	return read, write, nil
+}
+
+// windowSizesFromEnv reads <prefix>_INITIAL_WINDOW_KB/_INITIAL_CONN_WINDOW_KB, the HTTP/2
+// flow-control windows per stream and per connection; 0 keeps gRPC's dynamic (BDP-probed)
+// windows, which setting either disables
+func windowSizesFromEnv(prefix string) (stream, conn int32, err error) {
+	for _, w := range []struct {
+		name string
+		size *int32
+	}{{prefix + "_INITIAL_WINDOW_KB", &stream}, {prefix + "_INITIAL_CONN_WINDOW_KB", &conn}} {
+		kb, err := envInt(w.name, 0)
+		if err != nil {
+			return 0, 0, err
+		}
+		if kb != 0 && (kb < 64 || kb > 1<<20) {
+			return 0, 0, fmt.Errorf("%s must be between 64 and %d", w.name, 1<<20)
+		}
+		*w.size = int32(kb << 10)
+	}
+	return stream, conn, nil
+}
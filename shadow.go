@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"systemiq.ai/metrics"
+	"systemiq.ai/protos"
+)
+
+// shadow mirrors forwarded observations to a second Observer and compares its
+// answers with the primary's; callers only ever see the primary response
+type shadow struct {
+	endpoint string
+	conn     *grpc.ClientConn
+	timeout  time.Duration
+	fields   []protoreflect.FieldDescriptor // response fields compared besides the status code
+	slots    chan struct{}                  // bounds concurrent shadow calls
+
+	sampleRate float64
+	mu         sync.Mutex // serialises writes to samples
+	samples    *os.File   // nil unless OBSERVER_SHADOW_MISMATCH_FILE is set
+
+	logs rate.Sometimes // mismatch log lines, throttled
+}
+
+// shadowFromEnv dials OBSERVER_SHADOW_ENDPOINT; nil when unset
+func shadowFromEnv(dial func(string) (*grpc.ClientConn, error)) (*shadow, error) {
+	endpoint := os.Getenv("OBSERVER_SHADOW_ENDPOINT")
+	if endpoint == "" {
+		return nil, nil
+	}
+
+	s := &shadow{endpoint: endpoint, logs: rate.Sometimes{First: 10, Interval: time.Minute}}
+	var err error
+	if s.timeout, err = envDuration("OBSERVER_SHADOW_TIMEOUT", 5*time.Second); err != nil {
+		return nil, err
+	}
+	maxInFlight, err := envInt("OBSERVER_SHADOW_MAX_IN_FLIGHT", 64)
+	if err != nil || maxInFlight == 0 {
+		return nil, fmt.Errorf("OBSERVER_SHADOW_MAX_IN_FLIGHT must be a positive integer")
+	}
+	s.slots = make(chan struct{}, maxInFlight)
+
+	fields := os.Getenv("OBSERVER_SHADOW_COMPARE_FIELDS")
+	if fields == "" {
+		fields = "status"
+	}
+	desc := (&protos.ObservationResponse{}).ProtoReflect().Descriptor()
+	for _, name := range strings.Split(fields, ",") {
+		fd := desc.Fields().ByName(protoreflect.Name(strings.TrimSpace(name)))
+		if fd == nil {
+			return nil, fmt.Errorf("OBSERVER_SHADOW_COMPARE_FIELDS: ObservationResponse has no field %q", name)
+		}
+		s.fields = append(s.fields, fd)
+	}
+
+	if file := os.Getenv("OBSERVER_SHADOW_MISMATCH_FILE"); file != "" {
+		if os.Getenv("BUFFER_KEY_FILE") != "" {
+			// Samples carry whole payloads, which BUFFER_KEY_FILE keeps off the disk in clear text
+			return nil, fmt.Errorf("OBSERVER_SHADOW_MISMATCH_FILE writes observations in clear text and cannot be combined with BUFFER_KEY_FILE")
+		}
+		s.sampleRate = 1
+		if v := os.Getenv("OBSERVER_SHADOW_MISMATCH_SAMPLE_RATE"); v != "" {
+			if s.sampleRate, err = strconv.ParseFloat(v, 64); err != nil || s.sampleRate < 0 || s.sampleRate > 1 {
+				return nil, fmt.Errorf("OBSERVER_SHADOW_MISMATCH_SAMPLE_RATE must be between 0 and 1")
+			}
+		}
+		if s.samples, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600); err != nil {
+			return nil, fmt.Errorf("OBSERVER_SHADOW_MISMATCH_FILE: %w", err)
+		}
+	}
+
+	if s.conn, err = dial(endpoint); err != nil {
+		return nil, err
+	}
+	log.Printf("Mirroring observations to shadow Observer %s, comparing status code and %s", endpoint, fields)
+	return s, nil
+}
+
+// mirror sends req (a *protos.ObservationRequest or *rawMessage the caller no longer
+// touches) to the shadow in the background and compares the result with the primary's;
+// it drops the mirror when too many are already in flight
+func (s *shadow) mirror(req any, indicator string, primary *protos.ObservationResponse, primaryErr error) {
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		metrics.ShadowCalls.WithLabelValues("dropped").Inc()
+		return
+	}
+
+	go func() {
+		defer func() { <-s.slots }()
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+		defer cancel()
+
+		resp := new(protos.ObservationResponse)
+		err := s.conn.Invoke(ctx, protos.DataObserver_ObserveData_FullMethodName, req, resp, grpc.ForceCodec(rawCodec{}))
+		if err != nil {
+			resp = nil
+		}
+
+		diff := s.compare(primary, primaryErr, resp, err)
+		if diff == "" {
+			metrics.ShadowCalls.WithLabelValues("match").Inc()
+			return
+		}
+		metrics.ShadowCalls.WithLabelValues("mismatch").Inc()
+		s.logs.Do(func() {
+			log.Printf("shadow %s: %q differs from primary: %s", s.endpoint, indicator, diff)
+		})
+		if s.samples != nil && rand.Float64() < s.sampleRate {
+			s.writeSample(req, indicator, diff, primary, primaryErr, resp, err)
+		}
+	}()
+}
+
+// compare describes how the shadow outcome differs from the primary's, or returns ""
+func (s *shadow) compare(primary *protos.ObservationResponse, primaryErr error, shadow *protos.ObservationResponse, shadowErr error) string {
+	if pc, sc := status.Code(primaryErr), status.Code(shadowErr); pc != sc {
+		return fmt.Sprintf("code %s vs %s", pc, sc)
+	}
+	if primary == nil || shadow == nil {
+		return ""
+	}
+	var diffs []string
+	for _, fd := range s.fields {
+		pv, sv := primary.ProtoReflect().Get(fd), shadow.ProtoReflect().Get(fd)
+		if !pv.Equal(sv) {
+			diffs = append(diffs, fmt.Sprintf("%s %v vs %v", fd.Name(), pv, sv))
+		}
+	}
+	return strings.Join(diffs, ", ")
+}
+
+// writeSample appends one mismatch as a JSON line; the token is stripped from the payload
+func (s *shadow) writeSample(req any, indicator, diff string, primary *protos.ObservationResponse, primaryErr error, shadow *protos.ObservationResponse, shadowErr error) {
+	payload, ok := req.(*protos.ObservationRequest)
+	if raw, isRaw := req.(*rawMessage); isRaw {
+		payload, ok = new(protos.ObservationRequest), true
+		if err := proto.Unmarshal(raw.buf, payload); err != nil {
+			ok = false
+		}
+	}
+	var request json.RawMessage
+	if ok {
+		payload.Token = nil
+		request, _ = protojson.Marshal(payload)
+	}
+
+	line, _ := json.Marshal(struct {
+		Time      time.Time       `json:"time"`
+		Indicator string          `json:"indicator"`
+		Diff      string          `json:"diff"`
+		Primary   json.RawMessage `json:"primary"`
+		Shadow    json.RawMessage `json:"shadow"`
+		Request   json.RawMessage `json:"request,omitempty"`
+	}{time.Now().UTC(), indicator, diff, outcomeJSON(primary, primaryErr), outcomeJSON(shadow, shadowErr), request})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.samples.Write(append(line, '\n')); err != nil {
+		log.Printf("shadow: write mismatch sample: %v", err)
+	}
+}
+
+// outcomeJSON renders a response or error for a mismatch sample
+func outcomeJSON(resp *protos.ObservationResponse, err error) json.RawMessage {
+	if err != nil {
+		b, _ := json.Marshal(map[string]string{"code": status.Code(err).String(), "message": status.Convert(err).Message()})
+		return b
+	}
+	b, _ := protojson.Marshal(resp)
+	return b
+}
+
+// Close closes the shadow connection and sample file
+func (s *shadow) Close() {
+	s.conn.Close()
+	if s.samples != nil {
+		s.samples.Close()
+	}
+}
+
+// cloneRaw copies a raw request so it outlives the pooled buffer it came from
+func cloneRaw(m *rawMessage) *rawMessage { return &rawMessage{buf: bytes.Clone(m.buf)} }
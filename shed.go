@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"systemiq.ai/limiter"
+)
+
+// shedSamples is how many recent upstream latencies the p95 is taken over
+const shedSamples = 512
+
+// deadlineShedder rejects queued calls whose deadline the upstream cannot plausibly
+// meet, so a backlog doesn't turn into work that times out anyway
+type deadlineShedder struct {
+	depth int // queue length from which calls are checked
+
+	mu      sync.Mutex
+	samples [shedSamples]time.Duration
+	n, next int
+}
+
+// shedderFromEnv reads LOAD_SHED_QUEUE_DEPTH (0 = off)
+func shedderFromEnv() (*deadlineShedder, error) {
+	depth, err := envInt("LOAD_SHED_QUEUE_DEPTH", 0)
+	if err != nil || depth == 0 {
+		return nil, err
+	}
+	return &deadlineShedder{depth: depth}, nil
+}
+
+// observe records the latency of a finished upstream call
+func (s *deadlineShedder) observe(d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples[s.next] = d
+	s.next = (s.next + 1) % shedSamples
+	s.n = min(s.n+1, shedSamples)
+}
+
+// p95 returns the 95th percentile of the recent latencies, 0 before any call finished
+func (s *deadlineShedder) p95() time.Duration {
+	s.mu.Lock()
+	recent := slices.Clone(s.samples[:s.n])
+	s.mu.Unlock()
+	if len(recent) == 0 {
+		return 0
+	}
+	slices.Sort(recent)
+	return recent[len(recent)*95/100]
+}
+
+// admit rejects the call with UNAVAILABLE when the queue is at least depth long and the
+// time left before its deadline is under the expected wait plus service time: one p95
+// per full round of the limit ahead of it, plus its own
+func (s *deadlineShedder) admit(ctx context.Context, l *limiter.Limiter) error {
+	if s == nil {
+		return nil
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return nil
+	}
+	_, queued, limit := l.Stats()
+	if queued < s.depth {
+		return nil
+	}
+	p95 := s.p95()
+	expected := time.Duration(float64(p95) * (1 + float64(queued)/float64(limit)))
+	if left := time.Until(deadline); left < expected {
+		return detailedError(codes.Unavailable, reasonOverloaded, expected, fmt.Sprintf("overloaded: %d calls queued, upstream would take about %v but the deadline is in %v",
+			queued, expected.Round(time.Millisecond), left.Round(time.Millisecond)))
+	}
+	return nil
+}
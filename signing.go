@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+	"systemiq.ai/protos"
+)
+
+// payloadSignatureMetadataKey carries the signature of a forwarded observation
+const payloadSignatureMetadataKey = "x-payload-signature"
+
+// payloadSigner signs each forwarded observation with a site key so the Observer can
+// check integrity and origin independently of TLS. The signature covers the indicator
+// and data as sent upstream (labels and the token are not part of it):
+//
+//	observer-payload-v1\n<unix ms>\n<hex sha256(indicator)>\n<hex sha256(data[0])>\n...
+//
+// and travels as "keyid=<id>,alg=<hmac-sha256|ed25519>,ts=<unix ms>,sig=<base64>".
+type payloadSigner struct {
+	alg   string
+	keyID string
+	hmac  []byte             // hmac-sha256
+	ed    ed25519.PrivateKey // ed25519
+}
+
+// payloadSignerFromEnv reads PAYLOAD_SIGNING_KEY_FILE (off when unset) and
+// PAYLOAD_SIGNING_KEY_ID; a PEM PKCS#8 Ed25519 key signs with Ed25519, any other
+// content is used as HMAC-SHA256 secret
+func payloadSignerFromEnv() (*payloadSigner, error) {
+	file := os.Getenv("PAYLOAD_SIGNING_KEY_FILE")
+	if file == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read PAYLOAD_SIGNING_KEY_FILE: %w", err)
+	}
+	p := &payloadSigner{keyID: os.Getenv("PAYLOAD_SIGNING_KEY_ID")}
+	if block, _ := pem.Decode(raw); block != nil {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("PAYLOAD_SIGNING_KEY_FILE: %w", err)
+		}
+		ed, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("PAYLOAD_SIGNING_KEY_FILE: %T keys are not supported, use Ed25519", key)
+		}
+		p.alg, p.ed = "ed25519", ed
+	} else {
+		secret := bytes.TrimSpace(raw)
+		if len(secret) < 32 {
+			return nil, errors.New("PAYLOAD_SIGNING_KEY_FILE: HMAC secret must be at least 32 bytes")
+		}
+		p.alg, p.hmac = "hmac-sha256", secret
+	}
+	if p.keyID == "" {
+		// Derived from the verifying side's view of the key, never from the secret alone
+		sum := sha256.Sum256(append([]byte(p.alg+":"), p.publicMaterial()...))
+		p.keyID = hex.EncodeToString(sum[:8])
+	}
+	log.Printf("Signing observation payloads with %s key %s", p.alg, p.keyID)
+	return p, nil
+}
+
+// publicMaterial is the Ed25519 public key, or a hash of the HMAC secret
+func (p *payloadSigner) publicMaterial() []byte {
+	if p.ed != nil {
+		return p.ed.Public().(ed25519.PublicKey)
+	}
+	sum := sha256.Sum256(p.hmac)
+	return sum[:]
+}
+
+// signedBytes is the canonical form the signature is computed over
+func signedBytes(ts int64, indicator string, data []string) []byte {
+	b := []byte("observer-payload-v1\n")
+	b = strconv.AppendInt(b, ts, 10)
+	for _, s := range append([]string{indicator}, data...) {
+		sum := sha256.Sum256([]byte(s))
+		b = append(b, '\n')
+		b = hex.AppendEncode(b, sum[:])
+	}
+	return b
+}
+
+// sign attaches the signature of indicator and data to the outgoing context
+func (p *payloadSigner) sign(ctx context.Context, indicator string, data []string) context.Context {
+	if p == nil {
+		return ctx
+	}
+	ts := time.Now().UnixMilli()
+	msg := signedBytes(ts, indicator, data)
+	var sig []byte
+	if p.ed != nil {
+		sig = ed25519.Sign(p.ed, msg)
+	} else {
+		mac := hmac.New(sha256.New, p.hmac)
+		mac.Write(msg)
+		sig = mac.Sum(nil)
+	}
+	return metadata.AppendToOutgoingContext(ctx, payloadSignatureMetadataKey,
+		fmt.Sprintf("keyid=%s,alg=%s,ts=%d,sig=%s", p.keyID, p.alg, ts, base64.StdEncoding.EncodeToString(sig)))
+}
+
+// signRequest signs a decoded request
+func (p *payloadSigner) signRequest(ctx context.Context, req *protos.ObservationRequest) context.Context {
+	if p == nil {
+		return ctx
+	}
+	return p.sign(ctx, req.GetIndicator(), req.GetData())
+}
+
+// signRaw signs a raw request, decoding only its data entries
+func (p *payloadSigner) signRaw(ctx context.Context, req *rawMessage) context.Context {
+	if p == nil {
+		return ctx
+	}
+	return p.sign(ctx, req.GetIndicator(), req.data())
+}
+
+// data decodes the repeated field 1; unlike the indicator it is not cached, since only
+// signing needs it
+func (m *rawMessage) data() []string {
+	var data []string
+	for b := m.buf; len(b) > 0; {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return data
+		}
+		b = b[n:]
+		if num == dataFieldNumber && typ == protowire.BytesType {
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return data
+			}
+			data = append(data, v)
+			b = b[n:]
+			continue
+		}
+		if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+			return data
+		}
+		b = b[n:]
+	}
+	return data
+}
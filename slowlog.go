@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// requestIDMetadataKey is honoured on incoming calls so warnings can be matched with
+// the producer's own logs
+const requestIDMetadataKey = "x-request-id"
+
+// slowLog warns about calls over a latency or size threshold, to find problem producers
+// without access logging every call
+type slowLog struct {
+	latency time.Duration // 0 = no latency warnings
+	size    int           // bytes; 0 = no size warnings
+}
+
+// slowLogFromEnv reads SLOW_REQUEST_THRESHOLD and LARGE_REQUEST_THRESHOLD_KB; nil when
+// both are off
+func slowLogFromEnv() (*slowLog, error) {
+	latency, err := envDuration("SLOW_REQUEST_THRESHOLD", 0)
+	if err != nil {
+		return nil, err
+	}
+	sizeKB, err := envInt("LARGE_REQUEST_THRESHOLD_KB", 0)
+	if err != nil {
+		return nil, err
+	}
+	if latency == 0 && sizeKB == 0 {
+		return nil, nil
+	}
+	return &slowLog{latency: latency, size: sizeKB << 10}, nil
+}
+
+// unaryInterceptor times the whole call, including local queueing and limits
+func (l *slowLog) unaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		elapsed := time.Since(start)
+
+		size := requestSize(req)
+		var what string
+		switch {
+		case l.latency > 0 && elapsed >= l.latency && l.size > 0 && size >= l.size:
+			what = "slow, large"
+		case l.latency > 0 && elapsed >= l.latency:
+			what = "slow"
+		case l.size > 0 && size >= l.size:
+			what = "large"
+		default:
+			return resp, err
+		}
+		indicator := ""
+		if o, ok := req.(observation); ok {
+			indicator = o.GetIndicator()
+		}
+		trace := ""
+		if id := traceIDFor(ctx, err); id != "" {
+			trace = " trace_id=" + id
+		}
+		log.Printf("WARNING: %s request id=%s caller=%s method=%s indicator=%q size=%d duration=%v code=%s%s",
+			what, requestID(ctx), flow(ctx), info.FullMethod, indicator, size, elapsed.Round(time.Millisecond), status.Code(err), trace)
+		return resp, err
+	}
+}
+
+// requestID returns the caller's x-request-id, or a fresh random one
+func requestID(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(requestIDMetadataKey); len(v) > 0 && v[0] != "" {
+		return v[0]
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
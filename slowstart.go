@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+)
+
+// slowStartConfig is the ramp applied to an endpoint coming back from an outage
+type slowStartConfig struct {
+	steps []float64 // calls/second per step; unlimited after the last
+	step  time.Duration
+}
+
+// slowStartFromEnv reads OBSERVER_SLOW_START_STEPS ("5,20,100") and OBSERVER_SLOW_START_STEP;
+// no steps means slow start is off
+func slowStartFromEnv() (slowStartConfig, error) {
+	var c slowStartConfig
+	v := os.Getenv("OBSERVER_SLOW_START_STEPS")
+	if v == "" {
+		return c, nil
+	}
+	for _, s := range strings.Split(v, ",") {
+		r, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil || r <= 0 {
+			return c, fmt.Errorf("OBSERVER_SLOW_START_STEPS: %q is not a positive rate", s)
+		}
+		c.steps = append(c.steps, r)
+	}
+	var err error
+	c.step, err = envDuration("OBSERVER_SLOW_START_STEP", 10*time.Second)
+	return c, err
+}
+
+// ramp throttles calls to one endpoint while it works through the slow-start steps
+type ramp struct {
+	cfg slowStartConfig
+
+	mu      sync.Mutex
+	limiter *rate.Limiter // nil when not ramping
+	gen     int           // bumped on every start so a superseded ramp stops advancing
+}
+
+// start (re)starts the ramp from the first step
+func (r *ramp) start(endpoint, reason string) {
+	if r == nil || len(r.cfg.steps) == 0 {
+		return
+	}
+	r.mu.Lock()
+	r.gen++
+	gen := r.gen
+	r.limiter = rate.NewLimiter(rate.Limit(r.cfg.steps[0]), max(int(r.cfg.steps[0]), 1))
+	r.mu.Unlock()
+	log.Printf("Observer %s %s; slow start through %v calls/s, %v per step", endpoint, reason, r.cfg.steps, r.cfg.step)
+
+	go func() {
+		for _, step := range r.cfg.steps[1:] {
+			time.Sleep(r.cfg.step)
+			r.mu.Lock()
+			if r.gen != gen {
+				r.mu.Unlock()
+				return
+			}
+			r.limiter.SetLimit(rate.Limit(step))
+			r.limiter.SetBurst(max(int(step), 1))
+			r.mu.Unlock()
+		}
+		time.Sleep(r.cfg.step)
+		r.mu.Lock()
+		if r.gen == gen {
+			r.limiter = nil
+			log.Printf("Observer %s slow start complete", endpoint)
+		}
+		r.mu.Unlock()
+	}()
+}
+
+// wait blocks for the call's turn while ramping; calls that cannot get one before
+// their deadline fail with RESOURCE_EXHAUSTED
+func (r *ramp) wait(ctx context.Context) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	limiter := r.limiter
+	r.mu.Unlock()
+	if limiter == nil {
+		return nil
+	}
+	if err := limiter.Wait(ctx); err != nil {
+		return detailedError(codes.ResourceExhausted, reasonRampingUp, time.Duration(float64(time.Second)/float64(limiter.Limit())),
+			"Observer endpoint is ramping up after recovery, retry shortly")
+	}
+	return nil
+}
+
+// watchRecovery starts the ramp whenever the endpoint's connection becomes READY
+// again after a failure, including on a freshly re-dialled connection
+func (m *member) watchRecovery(ctx context.Context) {
+	failed := false
+	for ctx.Err() == nil {
+		conn := m.Conn()
+		state := conn.GetState()
+		switch state {
+		case connectivity.TransientFailure:
+			failed = true
+		case connectivity.Ready:
+			if failed {
+				m.ramp.start(m.Endpoint(), "reconnected")
+				failed = false
+			}
+		}
+		// Bounded wait so a connection swapped by a re-dial is picked up
+		waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+		conn.WaitForStateChange(waitCtx, state)
+		cancel()
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// workloadSource is the process-wide X.509-SVID source, shared by the server and every
+// Observer connection; SVIDs and trust bundles rotate in the background
+var workloadSource struct {
+	once sync.Once
+	src  *workloadapi.X509Source
+	err  error
+}
+
+// workloadSVIDs connects to the SPIFFE Workload API at SPIFFE_ENDPOINT_SOCKET on first
+// use and waits for the first SVID; nil when the variable is unset
+func workloadSVIDs() (*workloadapi.X509Source, error) {
+	addr := os.Getenv("SPIFFE_ENDPOINT_SOCKET")
+	if addr == "" {
+		return nil, nil
+	}
+	workloadSource.once.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		src, err := workloadapi.NewX509Source(ctx, workloadapi.WithClientOptions(workloadapi.WithAddr(addr)))
+		if err != nil {
+			workloadSource.err = fmt.Errorf("SPIFFE Workload API %s: %w", addr, err)
+			return
+		}
+		workloadSource.src = src
+		if svid, err := src.GetX509SVID(); err == nil {
+			log.Printf("Using SPIFFE identity %s from %s (current SVID expires %s)", svid.ID, addr, svid.Certificates[0].NotAfter.Format(time.RFC3339))
+		}
+	})
+	return workloadSource.src, workloadSource.err
+}
+
+// spiffeAuthorizer allows the comma-separated SPIFFE IDs in list; an entry without a
+// path (spiffe://example.org) allows every workload of that trust domain
+func spiffeAuthorizer(name, list string) (tlsconfig.Authorizer, error) {
+	var ids []spiffeid.ID
+	var domains []spiffeid.TrustDomain
+	for _, s := range strings.Split(list, ",") {
+		id, err := spiffeid.FromString(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q: %w", name, s, err)
+		}
+		if id.Path() == "" {
+			domains = append(domains, id.TrustDomain())
+		} else {
+			ids = append(ids, id)
+		}
+	}
+	return func(id spiffeid.ID, _ [][]*x509.Certificate) error {
+		if slices.Contains(ids, id) || slices.Contains(domains, id.TrustDomain()) {
+			return nil
+		}
+		return fmt.Errorf("SPIFFE ID %s is not allowed", id)
+	}, nil
+}
+
+// applyCallerSVIDs verifies caller certificates against the SPIFFE trust bundle and
+// CALLER_SPIFFE_IDS; certificate-less callers may still authenticate otherwise
+func applyCallerSVIDs(cfg *tls.Config, src *workloadapi.X509Source, list string) error {
+	authorize, err := spiffeAuthorizer("CALLER_SPIFFE_IDS", list)
+	if err != nil {
+		return err
+	}
+	verify := tlsconfig.VerifyPeerCertificate(src, authorize)
+	cfg.ClientAuth = tls.RequestClientCert
+	cfg.VerifyPeerCertificate = func(raw [][]byte, chains [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return nil
+		}
+		return verify(raw, chains)
+	}
+	return nil
+}
+
+// applyObserverSVID presents the workload SVID to the Observer; with OBSERVER_SPIFFE_ID
+// the Observer must in turn present an SVID with that ID (or of that trust domain)
+// instead of a web PKI certificate
+func applyObserverSVID(cfg *tls.Config) error {
+	if err := spiffeConfigError(); err != nil {
+		return err
+	}
+	src, err := workloadSVIDs()
+	if err != nil || src == nil {
+		return err
+	}
+	if list := os.Getenv("OBSERVER_SPIFFE_ID"); list != "" {
+		authorize, err := spiffeAuthorizer("OBSERVER_SPIFFE_ID", list)
+		if err != nil {
+			return err
+		}
+		tlsconfig.HookMTLSClientConfig(cfg, src, src, authorize)
+		return nil
+	}
+	cfg.GetClientCertificate = tlsconfig.GetClientCertificate(src)
+	return nil
+}
+
+// spiffeConfigError reports SPIFFE settings that need the Workload API socket
+func spiffeConfigError() error {
+	if os.Getenv("SPIFFE_ENDPOINT_SOCKET") != "" {
+		return nil
+	}
+	for _, name := range []string{"CALLER_SPIFFE_IDS", "OBSERVER_SPIFFE_ID"} {
+		if os.Getenv(name) != "" {
+			return errors.New(name + " requires SPIFFE_ENDPOINT_SOCKET")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// spoolMagic starts an encrypted spool segment or export file, followed by the key
+// fingerprint; a plain file starts with the varint length of a non-empty record, so
+// never with a zero byte
+const spoolMagic = "\x00mw-spool-gcm1\n"
+
+// spoolCipher encrypts buffered observations at rest with AES-256-GCM, since they may
+// carry sensitive process data and edge devices get stolen. Each record is stored as a
+// random nonce followed by the sealed record; plain files stay readable, so a key can
+// be introduced while unencrypted segments are still waiting.
+type spoolCipher struct {
+	aead        cipher.AEAD
+	fingerprint []byte // identifies the key in file headers
+}
+
+// spoolCipherFromEnv reads the 256-bit key in BUFFER_KEY_FILE (hex, base64 or 32 raw
+// bytes, e.g. a mounted secret); nil when unset
+func spoolCipherFromEnv() (*spoolCipher, error) {
+	path := os.Getenv("BUFFER_KEY_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("BUFFER_KEY_FILE: %w", err)
+	}
+	key := data
+	if text := bytes.TrimSpace(data); len(text) == 64 {
+		key, err = hex.DecodeString(string(text))
+	} else if len(text) == 44 {
+		key, err = base64.StdEncoding.DecodeString(string(text))
+	}
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("BUFFER_KEY_FILE must hold a 256-bit key: 64 hex digits, base64 or 32 raw bytes")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &spoolCipher{aead: aead, fingerprint: sum[:8]}, nil
+}
+
+// header starts an encrypted file
+func (c *spoolCipher) header() []byte {
+	return append([]byte(spoolMagic), c.fingerprint...)
+}
+
+// seal encrypts one record
+func (c *spoolCipher) seal(rec []byte) []byte {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(rec)+c.aead.Overhead())
+	rand.Read(nonce)
+	return c.aead.Seal(nonce, nonce, rec, nil)
+}
+
+// open decrypts one record sealed by seal
+func (c *spoolCipher) open(sealed []byte) ([]byte, error) {
+	if len(sealed) < c.aead.NonceSize() {
+		return nil, errors.New("encrypted record too short")
+	}
+	n := c.aead.NonceSize()
+	rec, err := c.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return nil, errors.New("encrypted record does not authenticate")
+	}
+	return rec, nil
+}
+
+// checkHeader verifies that an encrypted file's key fingerprint matches c
+func (c *spoolCipher) checkHeader(fingerprint []byte) error {
+	if c == nil {
+		return errors.New("file is encrypted but BUFFER_KEY_FILE is not set")
+	}
+	if !bytes.Equal(fingerprint, c.fingerprint) {
+		return fmt.Errorf("file is encrypted with another key (%x, BUFFER_KEY_FILE is %x)", fingerprint, c.fingerprint)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// pebbleStoreDir is the directory a Pebble buffer keeps in its spool directory
+const pebbleStoreDir = "pebble"
+
+// pebbleScanPage is how many records scan reads per iterator, so none is held open
+// while fn forwards them
+const pebbleScanPage = 256
+
+// errStoreClosed rejects store operations at exit, from background loops still running
+var errStoreClosed = errors.New("buffer store closed")
+
+// pebbleStore keeps spool records in a Pebble LSM tree (BUFFER_BACKEND=pebble), for
+// high-volume sites: keys are big-endian sequence numbers, so appends only ever add to
+// the end of the key space and flushed tables do not overlap, and concurrent appends
+// share their WAL syncs instead of taking turns on one segment file. Only one process
+// can open it; commands ask a running middleware through -addr.
+type pebbleStore struct {
+	db *pebble.DB
+
+	life   sync.RWMutex // held for reading while db is used; Pebble panics once it is closed
+	closed bool
+
+	mu      sync.Mutex // next, and the counts removals keep exact
+	next    uint64
+	records int
+	bytes   int64
+}
+
+// pebbleLogger sends Pebble's informational messages to the debug log
+type pebbleLogger struct{}
+
+func (pebbleLogger) Infof(format string, args ...any) { debugf("pebble: "+format, args...) }
+
+func (pebbleLogger) Fatalf(format string, args ...any) { log.Fatalf("pebble: "+format, args...) }
+
+func openPebbleStore(dir string) (*pebbleStore, error) {
+	db, err := pebble.Open(dir, &pebble.Options{
+		Logger: pebbleLogger{},
+		// Records are written once and soon deleted again from the front: a larger
+		// memtable lets most of them go before they are ever flushed to a table
+		MemTableSize: 64 << 20,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w (is a middleware running on it? queue list and show take -addr)", dir, err)
+	}
+	s := &pebbleStore{db: db, next: 1}
+	iter, err := db.NewIter(nil)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	for iter.First(); iter.Valid(); iter.Next() {
+		s.records++
+		s.bytes += int64(len(iter.Value()))
+		s.next = binary.BigEndian.Uint64(iter.Key()) + 1
+	}
+	if err := iter.Close(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func pebbleKey(id uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, id)
+}
+
+// use holds off close until done is called
+func (s *pebbleStore) use() (done func(), err error) {
+	s.life.RLock()
+	if s.closed {
+		s.life.RUnlock()
+		return nil, errStoreClosed
+	}
+	return s.life.RUnlock, nil
+}
+
+func (s *pebbleStore) appendRecords(recs [][]byte) error {
+	done, err := s.use()
+	if err != nil {
+		return err
+	}
+	defer done()
+	b := s.db.NewBatch()
+	defer b.Close()
+	var bytes int64
+	s.mu.Lock()
+	for _, rec := range recs {
+		b.Set(pebbleKey(s.next), rec, nil)
+		s.next++
+		bytes += int64(len(rec))
+	}
+	s.mu.Unlock()
+	// Outside mu: Pebble groups the syncs of concurrent commits
+	if err := b.Commit(pebble.Sync); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.records += len(recs)
+	s.bytes += bytes
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *pebbleStore) scan(start uint64, fn func(id uint64, rec []byte) error) error {
+	type record struct {
+		id  uint64
+		rec []byte
+	}
+	for {
+		var page []record
+		err := func() error {
+			done, err := s.use()
+			if err != nil {
+				return err
+			}
+			defer done()
+			iter, err := s.db.NewIter(nil)
+			if err != nil {
+				return err
+			}
+			for iter.SeekGE(pebbleKey(start)); iter.Valid() && len(page) < pebbleScanPage; iter.Next() {
+				page = append(page, record{binary.BigEndian.Uint64(iter.Key()), append([]byte(nil), iter.Value()...)})
+			}
+			return iter.Close()
+		}()
+		if err != nil {
+			return err
+		}
+		for _, r := range page {
+			if err := fn(r.id, r.rec); err != nil {
+				return err
+			}
+		}
+		if len(page) < pebbleScanPage {
+			return nil
+		}
+		start = page[len(page)-1].id + 1
+	}
+}
+
+func (s *pebbleStore) remove(ids []uint64) error {
+	done, err := s.use()
+	if err != nil {
+		return err
+	}
+	defer done()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.db.NewBatch()
+	defer b.Close()
+	records, bytes := 0, int64(0)
+	for _, id := range ids {
+		v, closer, err := s.db.Get(pebbleKey(id))
+		if errors.Is(err, pebble.ErrNotFound) {
+			continue // removed meanwhile
+		}
+		if err != nil {
+			return err
+		}
+		records++
+		bytes += int64(len(v))
+		closer.Close()
+		b.Delete(pebbleKey(id), nil)
+	}
+	if err := b.Commit(pebble.Sync); err != nil {
+		return err
+	}
+	s.records -= records
+	s.bytes -= bytes
+	return nil
+}
+
+func (s *pebbleStore) size() (int, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.records, s.bytes, nil
+}
+
+func (s *pebbleStore) name() string { return pebbleStoreDir }
+
+func (s *pebbleStore) close() error {
+	s.life.Lock()
+	defer s.life.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.db.Close()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"systemiq.ai/metrics"
+	"systemiq.ai/protos"
+)
+
+// spoolCorruptSuffix marks what salvageSegment could not read back, kept for inspection
+const spoolCorruptSuffix = ".corrupt"
+
+// maxSpoolRecord bounds the length of a spool record; a longer one can only be read from
+// a corrupt length prefix and is not allocated
+const maxSpoolRecord = 1 << 28
+
+// errSpoolCorrupt marks a record that cannot be read back, as opposed to one that could
+// not be forwarded
+var errSpoolCorrupt = errors.New("corrupt buffer record")
+
+// salvageSegment rewrites a segment with the records that can still be read, moving the
+// others, and everything after a broken length prefix, to name.corrupt; a power loss
+// mid-write or a bad sector so costs the affected records only. It reports how many
+// records were kept and quarantined (the unframeable rest counting as one).
+func salvageSegment(name string, c *spoolCipher) (kept, quarantined int, err error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	var good, bad []byte
+	body, encrypted := data, false
+	if len(data) > 0 && data[0] == 0 {
+		header := len(spoolMagic) + 8
+		if len(data) < header || string(data[:len(spoolMagic)]) != spoolMagic {
+			return 0, 0, errors.New("not a spool file")
+		}
+		if err := c.checkHeader(data[len(spoolMagic):header]); err != nil {
+			return 0, 0, err // readable with the right key
+		}
+		good, bad, body, encrypted = data[:header:header], data[:header:header], data[header:], true
+	}
+	for len(body) > 0 {
+		frame, n := protowire.ConsumeBytes(body)
+		if n < 0 || len(frame) > maxSpoolRecord {
+			quarantined++ // cut short, or a broken length prefix: nothing after it can be framed
+			bad = append(bad, body...)
+			break
+		}
+		body = body[n:]
+		rec := frame
+		if encrypted {
+			if rec, err = c.open(frame); err != nil {
+				rec = nil
+			}
+		}
+		if len(rec) < 8 || proto.Unmarshal(rec[8:], new(protos.ObservationRequest)) != nil {
+			quarantined++
+			bad = protowire.AppendBytes(bad, frame)
+			continue
+		}
+		kept++
+		good = protowire.AppendBytes(good, frame)
+	}
+	if quarantined == 0 {
+		return kept, 0, nil
+	}
+
+	corrupt := name + spoolCorruptSuffix
+	for i := 2; ; i++ { // an earlier salvage's quarantine is kept
+		if _, err := os.Stat(corrupt); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		corrupt = fmt.Sprintf("%s.%d%s", name, i, spoolCorruptSuffix)
+	}
+	if err := writeFileSync(corrupt, bad); err != nil {
+		return 0, 0, err
+	}
+	if kept == 0 {
+		err = os.Remove(name)
+	} else if err = writeFileSync(name+".tmp", good); err == nil {
+		err = os.Rename(name+".tmp", name)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	metrics.BufferCorrupt.Add(float64(quarantined))
+	log.Printf("WARNING: %s: kept %d buffered observations, moved %d unreadable records to %s", name, kept, quarantined, corrupt)
+	return kept, quarantined, nil
+}
+
+// compactSegment drops the first sent records of a segment whose forwarding paused,
+// so a resume does not send them again
+func compactSegment(name string, c *spoolCipher, sent int) error {
+	if sent == 0 {
+		return nil
+	}
+	i := 0
+	_, _, err := rewriteSegment(name, c, func([]byte) bool {
+		i++
+		return i > sent
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("compact %s: %w", name, err)
+	}
+	return nil
+}
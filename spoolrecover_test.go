@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"systemiq.ai/protos"
+)
+
+func TestSalvageSegment(t *testing.T) {
+	t.Setenv("BUFFER_KEY_FILE", writeTestKey(t))
+	c, err := spoolCipherFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := func(indicator string) []byte {
+		rec, err := proto.Marshal(&protos.ObservationRequest{Indicator: indicator})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.seal(append(make([]byte, 8), rec...))
+	}
+	broken := sealed("b")
+	broken[len(broken)-1] ^= 1 // fails authentication
+
+	data := c.header()
+	data = protowire.AppendBytes(data, sealed("a"))
+	data = protowire.AppendBytes(data, broken)
+	data = protowire.AppendBytes(data, sealed("c"))
+	data = protowire.AppendVarint(data, 1<<40) // a length prefix gone wrong
+	data = append(data, "garbage"...)
+	name := filepath.Join(t.TempDir(), "obs-1"+spoolOpenSuffix)
+	if err := os.WriteFile(name, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	kept, quarantined, err := salvageSegment(name, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept != 2 || quarantined != 2 {
+		t.Errorf("kept %d and quarantined %d, want 2 and 2 (a bad record and the garbage after a broken length)", kept, quarantined)
+	}
+	var indicators []string
+	err = readSegment(name, c, func(rec []byte) error {
+		req := new(protos.ObservationRequest)
+		if err := proto.Unmarshal(rec[8:], req); err != nil {
+			return err
+		}
+		indicators = append(indicators, req.Indicator)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("salvaged segment unreadable: %v", err)
+	}
+	if len(indicators) != 2 || indicators[0] != "a" || indicators[1] != "c" {
+		t.Errorf("salvaged segment holds %q, want [a c]", indicators)
+	}
+	if _, err := os.Stat(name + spoolCorruptSuffix); err != nil {
+		t.Errorf("no quarantine file: %v", err)
+	}
+
+	// A crash leaves such a segment open: startup salvages and completes it
+	if err := os.WriteFile(name, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	spool, err := openSpool(filepath.Dir(name), 64<<20, c)
+	if err != nil {
+		t.Fatalf("startup failed on a corrupt segment: %v", err)
+	}
+	if st := spool.stats(); st.observations != 2 {
+		t.Errorf("after startup the spool holds %d observations, want 2", st.observations)
+	}
+}
+
+func TestCompactSegment(t *testing.T) {
+	spool := testSpool(t, nil, []string{"a", "b", "c"})
+	files, _ := spoolFiles(spool.dir, false)
+	if err := compactSegment(files[0], nil, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := spooledIndicators(t, spool); len(got) != 1 || got[0] != "c" {
+		t.Errorf("after forwarding 2 the segment holds %q, want [c]", got)
+	}
+}
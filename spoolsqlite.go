@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+
+	_ "modernc.org/sqlite" // pure Go, registers the "sqlite" driver
+)
+
+// sqliteStoreFile is the database a SQLite buffer keeps in its directory
+const sqliteStoreFile = "buffer.db"
+
+// sqliteScanPage is how many records scan reads per query, so no read transaction is
+// held open while fn forwards them
+const sqliteScanPage = 256
+
+// sqliteStore keeps spool records in one SQLite database (BUFFER_BACKEND=sqlite): a
+// single file, transactional, and open to the sqlite3 shell while the middleware runs,
+//
+//	sqlite3 buffer.db 'SELECT count(*), sum(length(record)) FROM observations'
+//
+// WAL journaling with full sync makes each append durable when it returns.
+type sqliteStore struct {
+	db   *sql.DB
+	path string
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	// Created here so the database, and the WAL that takes its mode, is private
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	db, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)&_pragma=busy_timeout(10000)")
+	if err != nil {
+		return nil, err
+	}
+	// AUTOINCREMENT: IDs are never reused, even once the table was empty
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS observations (id INTEGER PRIMARY KEY AUTOINCREMENT, record BLOB NOT NULL)`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &sqliteStore{db: db, path: path}, nil
+}
+
+func (s *sqliteStore) appendRecords(recs [][]byte) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO observations (record) VALUES (?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, rec := range recs {
+		if _, err := stmt.Exec(rec); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) scan(start uint64, fn func(id uint64, rec []byte) error) error {
+	type row struct {
+		id  int64
+		rec []byte
+	}
+	for {
+		rows, err := s.db.Query(`SELECT id, record FROM observations WHERE id >= ? ORDER BY id LIMIT ?`, int64(start), sqliteScanPage)
+		if err != nil {
+			return err
+		}
+		var page []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.id, &r.rec); err != nil {
+				rows.Close()
+				return err
+			}
+			page = append(page, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, r := range page {
+			if err := fn(uint64(r.id), r.rec); err != nil {
+				return err
+			}
+		}
+		if len(page) < sqliteScanPage {
+			return nil
+		}
+		start = uint64(page[len(page)-1].id) + 1
+	}
+}
+
+func (s *sqliteStore) remove(ids []uint64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for len(ids) > 0 {
+		chunk := ids[:min(len(ids), 500)] // under SQLite's bound parameter limit
+		ids = ids[len(chunk):]
+		args := make([]any, len(chunk))
+		for i, id := range chunk {
+			args[i] = int64(id)
+		}
+		query := `DELETE FROM observations WHERE id IN (?` + strings.Repeat(",?", len(chunk)-1) + `)`
+		if _, err := tx.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) size() (int, int64, error) {
+	var records int
+	var bytes int64
+	err := s.db.QueryRow(`SELECT count(*), coalesce(sum(length(record)), 0) FROM observations`).Scan(&records, &bytes)
+	return records, bytes, err
+}
+
+func (s *sqliteStore) name() string { return sqliteStoreFile }
+
+func (s *sqliteStore) close() error { return s.db.Close() }
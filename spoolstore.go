@@ -0,0 +1,387 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"systemiq.ai/metrics"
+	"systemiq.ai/protos"
+)
+
+// BUFFER_BACKEND values: where OFFLINE_DIR and BUFFER_DIR keep their observations
+const (
+	backendFile   = "file"   // segment files, see observationSpool
+	backendSQLite = "sqlite" // one database file, see sqliteStore
+	backendPebble = "pebble" // an LSM tree for high volumes, see pebbleStore
+)
+
+// recordStore keeps spool records in an embedded database instead of segment files.
+// Records stay in arrival order, each under an ID that grows with it and is never
+// reused, so a listing can resume where it stopped.
+type recordStore interface {
+	// appendRecords stores recs atomically and durably before returning
+	appendRecords(recs [][]byte) error
+	// scan calls fn for each record from ID start on, oldest first, until fn returns
+	// an error; fn may remove records
+	scan(start uint64, fn func(id uint64, rec []byte) error) error
+	// remove deletes records by ID
+	remove(ids []uint64) error
+	// size counts the records and their bytes
+	size() (records int, bytes int64, err error)
+	// name is the database within the spool directory
+	name() string
+	close() error
+}
+
+// spoolBackendFromEnv reads BUFFER_BACKEND; when unset, a store dir already holds
+// decides, else segment files are used. Observations held by another backend are
+// left alone, with a warning.
+func spoolBackendFromEnv(dir string) (string, error) {
+	held := map[string]bool{}
+	if files, _ := spoolFiles(dir, true); len(files) > 0 {
+		held[backendFile] = true
+	}
+	if _, err := os.Stat(filepath.Join(dir, sqliteStoreFile)); err == nil {
+		held[backendSQLite] = true
+	}
+	if _, err := os.Stat(filepath.Join(dir, pebbleStoreDir)); err == nil {
+		held[backendPebble] = true
+	}
+
+	backend := os.Getenv("BUFFER_BACKEND")
+	switch backend {
+	case "":
+		backend = backendFile
+		for _, store := range []string{backendSQLite, backendPebble} {
+			if held[store] {
+				backend = store
+			}
+		}
+	case backendFile, backendSQLite, backendPebble:
+	default:
+		return "", fmt.Errorf("BUFFER_BACKEND must be %s, %s or %s", backendFile, backendSQLite, backendPebble)
+	}
+	for other := range held {
+		if other != backend {
+			log.Printf("WARNING: %s also holds observations buffered with BUFFER_BACKEND=%s; they stay there until it is switched back", dir, other)
+		}
+	}
+	return backend, nil
+}
+
+// openStore opens the store of backend in dir
+func openStore(dir, backend string) (recordStore, error) {
+	switch backend {
+	case backendSQLite:
+		return openSQLiteStore(filepath.Join(dir, sqliteStoreFile))
+	case backendPebble:
+		return openPebbleStore(filepath.Join(dir, pebbleStoreDir))
+	}
+	return nil, fmt.Errorf("no store for BUFFER_BACKEND=%s", backend)
+}
+
+// openBuffer opens the spool in dir with the backend BUFFER_BACKEND selects, salvaging
+// and completing segments a crashed run left open
+func openBuffer(dir string, segmentMax int64, c *spoolCipher) (*observationSpool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	backend, err := spoolBackendFromEnv(dir)
+	if err != nil {
+		return nil, err
+	}
+	if backend == backendFile {
+		return openSpool(dir, segmentMax, c)
+	}
+	store, err := openStore(dir, backend)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Buffering observations in %s (BUFFER_BACKEND=%s)", filepath.Join(dir, store.name()), backend)
+	if c != nil {
+		log.Printf("Encrypting buffered observations in %s at rest (key %x)", dir, c.fingerprint)
+	}
+	return &observationSpool{dir: dir, cipher: c, store: store}, nil
+}
+
+// spoolAt opens dir for a command that may run beside a middleware using it: segments
+// are neither completed nor salvaged, and one still being written is left alone
+func spoolAt(dir string, c *spoolCipher) (*observationSpool, error) {
+	backend, err := spoolBackendFromEnv(dir)
+	if err != nil {
+		return nil, err
+	}
+	if backend == backendFile {
+		return &observationSpool{dir: dir, segmentMax: math.MaxInt64, cipher: c}, nil
+	}
+	store, err := openStore(dir, backend)
+	if err != nil {
+		return nil, err
+	}
+	return &observationSpool{dir: dir, cipher: c, store: store}, nil
+}
+
+// sealStored encrypts a record for a store: a zero byte and the key fingerprint, as in
+// the header of an encrypted file, then the sealed record. A plain record starts with
+// its arrival time, so never with a zero byte.
+func (s *observationSpool) sealStored(rec []byte) []byte {
+	if s.cipher == nil {
+		return rec
+	}
+	return append(append([]byte{0}, s.cipher.fingerprint...), s.cipher.seal(rec)...)
+}
+
+// openStored reverses sealStored
+func (s *observationSpool) openStored(v []byte) ([]byte, error) {
+	if len(v) == 0 || v[0] != 0 {
+		return v, nil
+	}
+	if len(v) < 1+8 {
+		return nil, fmt.Errorf("%w: too short", errSpoolCorrupt)
+	}
+	if err := s.cipher.checkHeader(v[1:9]); err != nil {
+		return nil, err // readable with the right key
+	}
+	rec, err := s.cipher.open(v[9:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errSpoolCorrupt, err)
+	}
+	return rec, nil
+}
+
+// eachStored calls fn for each record of the store, oldest first, stopping at one it
+// cannot read
+func (s *observationSpool) eachStored(fn func(id uint64, rec []byte) error) error {
+	return s.store.scan(0, func(id uint64, v []byte) error {
+		rec, err := s.openStored(v)
+		if err != nil {
+			return fmt.Errorf("observation %d: %w", id, err)
+		}
+		return fn(id, rec)
+	})
+}
+
+// quarantineStored moves an unreadable record out of the store to a .corrupt file, as
+// salvageSegment does for a segment
+func (s *observationSpool) quarantineStored(id uint64, v []byte, cause error) error {
+	corrupt := filepath.Join(s.dir, fmt.Sprintf("%s-%d%s", s.store.name(), id, spoolCorruptSuffix))
+	if err := writeFileSync(corrupt, v); err != nil {
+		return err
+	}
+	if err := s.store.remove([]uint64{id}); err != nil {
+		return err
+	}
+	metrics.BufferCorrupt.Inc()
+	log.Printf("WARNING: %s: moved unreadable observation %d to %s: %v", s.store.name(), id, corrupt, cause)
+	return nil
+}
+
+// forward hands the buffered records to fn, oldest first, deleting them once accepted:
+// whole segments, or a store's records in batches. It stops at fn's first error and
+// returns how many records fn accepted; unreadable records are set aside.
+func (s *observationSpool) forward(fn func(rec []byte) error) (int, error) {
+	if s.store == nil {
+		return s.forwardSegments(fn)
+	}
+	sent := 0
+	var done []uint64
+	flush := func() error {
+		if len(done) == 0 {
+			return nil
+		}
+		err := s.store.remove(done)
+		done = done[:0]
+		return err
+	}
+	err := s.store.scan(0, func(id uint64, v []byte) error {
+		rec, err := s.openStored(v)
+		if err == nil {
+			err = fn(rec)
+		}
+		if errors.Is(err, errSpoolCorrupt) {
+			return s.quarantineStored(id, v, err)
+		}
+		if err != nil {
+			return err
+		}
+		sent++
+		if done = append(done, id); len(done) == 256 {
+			return flush()
+		}
+		return nil
+	})
+	if ferr := flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		log.Printf("Forwarding buffered observations from %s paused after %d: %v", s.store.name(), sent, err)
+	} else if sent > 0 {
+		log.Printf("Forwarded %d buffered observations from %s", sent, s.store.name())
+	}
+	return sent, err
+}
+
+// list returns up to limit buffered observations, starting at the one with ID start
+// (empty: the oldest), and the ID of the next
+func (s *observationSpool) list(start string, limit, preview int) ([]*protos.BufferedObservation, string, error) {
+	if s.store == nil {
+		return listBuffered(s.dir, s.cipher, start, limit, preview)
+	}
+	var first uint64
+	if start != "" {
+		var err error
+		if first, err = strconv.ParseUint(start, 10, 64); err != nil {
+			return nil, "", fmt.Errorf("%w %q", errObservationID, start)
+		}
+	}
+	var page []*protos.BufferedObservation
+	next := ""
+	err := s.store.scan(first, func(id uint64, v []byte) error {
+		if len(page) == limit {
+			next = strconv.FormatUint(id, 10)
+			return errPageFull
+		}
+		rec, err := s.openStored(v)
+		if err != nil {
+			page = append(page, &protos.BufferedObservation{Id: strconv.FormatUint(id, 10), Segment: s.store.name(), Indicator: "(unreadable: " + err.Error() + ")"})
+			return nil
+		}
+		page = append(page, bufferedObservation(strconv.FormatUint(id, 10), s.store.name(), rec, preview))
+		return nil
+	})
+	if err != nil && !errors.Is(err, errPageFull) {
+		return nil, "", err
+	}
+	return page, next, nil
+}
+
+// purge deletes the buffered observations filter matches, or with dryRun only counts
+// them; segments still being written are left alone
+func (s *observationSpool) purge(filter recordFilter, dryRun bool) (purged, total int, err error) {
+	if s.store == nil {
+		return s.purgeSegments(filter, dryRun)
+	}
+	var ids []uint64
+	err = s.eachStored(func(id uint64, rec []byte) error {
+		total++
+		if filter.match(rec) {
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil || dryRun || len(ids) == 0 {
+		return len(ids), total, err
+	}
+	return len(ids), total, s.store.remove(ids)
+}
+
+// repair moves unreadable records out of the complete segments, or out of the store,
+// and returns how many it moved
+func (s *observationSpool) repair() (int, error) {
+	if s.store == nil {
+		files, err := spoolFiles(s.dir, false)
+		if err != nil {
+			return 0, err
+		}
+		total := 0
+		for _, name := range files {
+			_, quarantined, err := salvageSegment(name, s.cipher)
+			if err != nil && !errors.Is(err, os.ErrNotExist) { // forwarded meanwhile
+				return total, fmt.Errorf("%s: %w", name, err)
+			}
+			total += quarantined
+		}
+		return total, nil
+	}
+	total := 0
+	err := s.store.scan(0, func(id uint64, v []byte) error {
+		rec, err := s.openStored(v)
+		if err == nil {
+			_, err = decodeRecord(rec)
+		}
+		if !errors.Is(err, errSpoolCorrupt) {
+			return err
+		}
+		total++
+		return s.quarantineStored(id, v, err)
+	})
+	return total, err
+}
+
+// enforceStored deletes what r no longer keeps from the store, oldest first, by arrival
+// time and record bytes
+func (s *observationSpool) enforceStored(r spoolRetention, now time.Time) {
+	type entry struct {
+		id      uint64
+		size    int64
+		arrival time.Time
+	}
+	var entries []entry
+	var total int64
+	err := s.store.scan(0, func(id uint64, v []byte) error {
+		arrival := time.Time{}
+		if rec, err := s.openStored(v); err == nil {
+			arrival = recordArrival(rec)
+		}
+		entries = append(entries, entry{id, int64(len(v)), arrival})
+		total += int64(len(v))
+		return nil
+	})
+	if err != nil {
+		log.Printf("WARNING: buffer retention: %v", err)
+		return
+	}
+	var aged, over []uint64
+	for _, e := range entries {
+		switch {
+		case r.maxAge > 0 && !e.arrival.IsZero() && now.Sub(e.arrival) > r.maxAge:
+			aged = append(aged, e.id)
+		case r.maxBytes > 0 && total > r.maxBytes:
+			over = append(over, e.id)
+		default:
+			continue
+		}
+		total -= e.size
+	}
+	for _, expired := range []struct {
+		ids    []uint64
+		reason string
+	}{
+		{aged, fmt.Sprintf("older than BUFFER_MAX_AGE (%v)", r.maxAge)},
+		{over, fmt.Sprintf("buffer over BUFFER_MAX_MB (%d MB)", r.maxBytes>>20)},
+	} {
+		if len(expired.ids) == 0 {
+			continue
+		}
+		if err := s.store.remove(expired.ids); err != nil {
+			log.Printf("WARNING: buffer retention: %v", err)
+			return
+		}
+		metrics.BufferExpired.Add(float64(len(expired.ids)))
+		log.Printf("WARNING: deleted %d buffered observations in %s: %s", len(expired.ids), s.store.name(), expired.reason)
+	}
+}
+
+// statsStored counts the observations in the store
+func (s *observationSpool) statsStored() spoolStats {
+	var st spoolStats
+	var err error
+	if st.observations, st.bytes, err = s.store.size(); err != nil {
+		log.Printf("WARNING: buffer stats: %v", err)
+		return st
+	}
+	errFirst := errors.New("first record")
+	s.store.scan(0, func(_ uint64, v []byte) error {
+		if rec, err := s.openStored(v); err == nil {
+			st.oldest = recordArrival(rec)
+		}
+		return errFirst
+	})
+	return st
+}
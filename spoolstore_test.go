@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"systemiq.ai/protos"
+)
+
+// testBackends are the BUFFER_BACKEND values every spool operation is tested with
+var testBackends = []string{backendFile, backendSQLite, backendPebble}
+
+// listedIndicators pages through the spool's observations, oldest first
+func listedIndicators(t *testing.T, s *observationSpool) []string {
+	t.Helper()
+	var indicators []string
+	next := ""
+	for {
+		page, token, err := s.list(next, 2, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range page {
+			indicators = append(indicators, o.Indicator)
+		}
+		if next = token; next == "" {
+			return indicators
+		}
+	}
+}
+
+func TestSpoolBackends(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			t.Setenv("BUFFER_BACKEND", backend)
+			t.Setenv("BUFFER_KEY_FILE", writeTestKey(t))
+			c, err := spoolCipherFromEnv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			spool, err := openBuffer(t.TempDir(), 64<<20, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer spool.close()
+			for _, indicator := range []string{"a", "test-b", "c", "d"} {
+				rec, _ := proto.Marshal(&protos.ObservationRequest{Indicator: indicator, Data: []string{`{"v":1}`}})
+				if err := spool.append(rec); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := spool.complete(); err != nil {
+				t.Fatal(err)
+			}
+
+			if st := spool.stats(); st.observations != 4 || st.bytes == 0 || st.oldest.IsZero() {
+				t.Errorf("stats %+v, want 4 observations", st)
+			}
+			if got := listedIndicators(t, spool); len(got) != 4 || got[1] != "test-b" {
+				t.Errorf("list %q, want [a test-b c d]", got)
+			}
+			if _, _, err := spool.list("bogus", 2, 0); !errors.Is(err, errObservationID) {
+				t.Errorf("malformed ID: %v, want errObservationID", err)
+			}
+			if purged, total, err := spool.purge(recordFilter{indicator: "test-*"}, false); err != nil || purged != 1 || total != 4 {
+				t.Errorf("purge: %d of %d (%v), want 1 of 4", purged, total, err)
+			}
+
+			// The Observer takes one, then fails: the rest stays for the next attempt
+			errDown := errors.New("observer down")
+			n := 0
+			sent, err := spool.forward(func([]byte) error {
+				if n++; n > 1 {
+					return errDown
+				}
+				return nil
+			})
+			if sent != 1 || !errors.Is(err, errDown) {
+				t.Errorf("forward sent %d (%v), want 1 and the failure", sent, err)
+			}
+			if got := listedIndicators(t, spool); len(got) != 2 || got[0] != "c" {
+				t.Errorf("after a paused forward the spool holds %q, want [c d]", got)
+			}
+			if sent, err := spool.forward(func([]byte) error { return nil }); sent != 2 || err != nil {
+				t.Errorf("forward sent %d (%v), want 2", sent, err)
+			}
+			if st := spool.stats(); st.observations != 0 {
+				t.Errorf("%d observations left after forwarding all", st.observations)
+			}
+		})
+	}
+}
+
+func TestStoreQuarantine(t *testing.T) {
+	for _, backend := range testBackends[1:] {
+		t.Run(backend, func(t *testing.T) {
+			t.Setenv("BUFFER_BACKEND", backend)
+			spool, err := openBuffer(t.TempDir(), 64<<20, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer spool.close()
+			rec, _ := proto.Marshal(&protos.ObservationRequest{Indicator: "a"})
+			if err := spool.append(rec); err != nil {
+				t.Fatal(err)
+			}
+			if err := spool.store.appendRecords([][]byte{[]byte("\x18 not a record")}); err != nil {
+				t.Fatal(err)
+			}
+
+			sent, err := spool.forward(func(rec []byte) error {
+				_, err := decodeRecord(rec)
+				return err
+			})
+			if sent != 1 || err != nil {
+				t.Errorf("forward sent %d (%v), want 1 past the corrupt record", sent, err)
+			}
+			if corrupt, _ := filepath.Glob(filepath.Join(spool.dir, "*"+spoolCorruptSuffix)); len(corrupt) != 1 {
+				t.Errorf("quarantine files %q, want one", corrupt)
+			}
+		})
+	}
+}
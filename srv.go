@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+// srvWeightedBalancer picks among SRV targets in proportion to their record weights
+const srvWeightedBalancer = "srv_weighted"
+
+// srvServiceConfig selects the weighted picker for srv:/// targets
+const srvServiceConfig = `{"loadBalancingConfig":[{"` + srvWeightedBalancer + `":{}}]}`
+
+// srvWeightKey stores a record's weight in the address attributes
+type srvWeightKey struct{}
+
+func init() {
+	balancer.Register(base.NewBalancerBuilder(srvWeightedBalancer, srvPickerBuilder{}, base.Config{HealthCheck: true}))
+}
+
+// srvResolverBuilder resolves "srv:///_observer._tcp.example.com" targets from DNS
+// SRV records, re-resolving every interval
+type srvResolverBuilder struct {
+	interval time.Duration
+}
+
+func (b *srvResolverBuilder) Scheme() string { return "srv" }
+
+func (b *srvResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	name := strings.TrimPrefix(target.URL.Path, "/")
+	if name == "" {
+		return nil, fmt.Errorf("srv target %q has no record name", target.URL.String())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &srvResolver{name: name, cc: cc, interval: b.interval, cancel: cancel, now: make(chan struct{}, 1)}
+	go r.watch(ctx)
+	return r, nil
+}
+
+type srvResolver struct {
+	name     string
+	cc       resolver.ClientConn
+	interval time.Duration
+	cancel   context.CancelFunc
+	now      chan struct{} // ResolveNow requests, coalesced
+}
+
+// ResolveNow triggers an early lookup, e.g. after a connection failure
+func (r *srvResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.now <- struct{}{}:
+	default:
+	}
+}
+
+func (r *srvResolver) Close() { r.cancel() }
+
+func (r *srvResolver) watch(ctx context.Context) {
+	for {
+		if addrs, err := r.lookup(ctx); err != nil {
+			r.cc.ReportError(fmt.Errorf("srv %s: %w", r.name, err))
+		} else {
+			r.cc.UpdateState(resolver.State{Addresses: addrs, ServiceConfig: r.cc.ParseServiceConfig(srvServiceConfig)})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.interval):
+		case <-r.now:
+			// Don't hammer DNS when gRPC asks repeatedly while endpoints are down
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// lookup returns the records of the most preferred (lowest) priority with their weights;
+// higher priorities are backups and only used when no preferred record exists
+func (r *srvResolver) lookup(ctx context.Context) ([]resolver.Address, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", r.name)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no SRV records")
+	}
+
+	// LookupSRV sorts by priority, so the first record holds the preferred one
+	var addrs []resolver.Address
+	for _, rec := range records {
+		if rec.Priority != records[0].Priority {
+			break
+		}
+		host := strings.TrimSuffix(rec.Target, ".")
+		addrs = append(addrs, resolver.Address{
+			Addr:       net.JoinHostPort(host, strconv.Itoa(int(rec.Port))),
+			ServerName: host, // verify TLS against the instance, not the SRV name
+			Attributes: attributes.New(srvWeightKey{}, int(rec.Weight)),
+		})
+	}
+	return addrs, nil
+}
+
+// srvPickerBuilder builds weighted pickers over the READY SubConns
+type srvPickerBuilder struct{}
+
+func (srvPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	p := &srvPicker{}
+	for sc, scInfo := range info.ReadySCs {
+		// Weight 0 records still get a small share, as RFC 2782 asks
+		weight, _ := scInfo.Address.Attributes.Value(srvWeightKey{}).(int)
+		p.total += max(weight, 1)
+		p.subConns = append(p.subConns, sc)
+		p.cumulative = append(p.cumulative, p.total)
+	}
+	return p
+}
+
+type srvPicker struct {
+	subConns   []balancer.SubConn
+	cumulative []int
+	total      int
+}
+
+func (p *srvPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	n := rand.IntN(p.total)
+	for i, c := range p.cumulative {
+		if n < c {
+			return balancer.PickResult{SubConn: p.subConns[i]}, nil
+		}
+	}
+	return balancer.PickResult{SubConn: p.subConns[len(p.subConns)-1]}, nil
+}
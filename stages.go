@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"systemiq.ai/protos"
+)
+
+// stage transforms a decoded observation before it is forwarded; returned errors
+// should be gRPC statuses, as they are passed to the caller
+type stage func(req *protos.ObservationRequest) error
+
+// runStages applies every stage in order
+func (s *ObserverMiddlewareServer) runStages(req *protos.ObservationRequest) error {
+	for _, st := range s.stages {
+		if err := st(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runStagesRaw decodes a raw request for the stages and re-encodes it in place;
+// passthrough only saves work while no stage needs the payload
+func (s *ObserverMiddlewareServer) runStagesRaw(req *rawMessage) error {
+	if len(s.stages) == 0 {
+		return nil
+	}
+	decoded := new(protos.ObservationRequest)
+	if err := proto.Unmarshal(req.buf, decoded); err != nil {
+		return err
+	}
+	if err := s.runStages(decoded); err != nil {
+		return err
+	}
+
+	buf, err := proto.MarshalOptions{}.MarshalAppend(getRawBuf(proto.Size(decoded)+tokenReserve), decoded)
+	if err != nil {
+		return err
+	}
+	putRawBuf(req.buf)
+	req.buf = buf
+	return nil
+}
+
+// rewriteJSON lets fn edit data as a JSON object, re-encoding it only when fn reports a
+// change; data that is not a JSON object is returned unchanged
+func rewriteJSON(data string, fn func(obj map[string]any) bool) string {
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+	var obj map[string]any
+	if dec.Decode(&obj) != nil || !fn(obj) {
+		return data
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if enc.Encode(obj) != nil {
+		return data
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
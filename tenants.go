@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"systemiq.ai/auth"
+)
+
+// clientIDMetadataKey lets a caller pick one of the configured client IDs per request
+const clientIDMetadataKey = "x-client-id"
+
+// credentialsFor selects the AuthHandler and client ID a request is forwarded under.
+// The tenant metadata key picks a credential set from AUTH_CREDENTIALS_FILE (default
+// credentials otherwise); x-client-id then picks a client of that set, falling back
+// to the indicator mapping (default credentials only) and finally the set's first client.
+func (s *ObserverMiddlewareServer) credentialsFor(ctx context.Context, req observation) (*auth.AuthHandler, int, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	authHandler := s.authHandler
+	if v := md.Get(s.tenantKey); len(v) > 0 {
+		tenantHandler, ok := s.tenants[v[0]]
+		if !ok {
+			return nil, 0, status.Errorf(codes.PermissionDenied, "tenant %q is not configured", v[0])
+		}
+		authHandler = tenantHandler
+	}
+
+	if v := md.Get(clientIDMetadataKey); len(v) > 0 {
+		clientID, err := strconv.Atoi(v[0])
+		if err != nil {
+			return nil, 0, status.Errorf(codes.InvalidArgument, "%s must be an integer", clientIDMetadataKey)
+		}
+		if !authHandler.HasClient(clientID) {
+			return nil, 0, status.Errorf(codes.PermissionDenied, "client_id %d is not configured", clientID)
+		}
+		return authHandler, clientID, nil
+	}
+
+	if mapping := s.clientByIndicator.Load(); mapping != nil && authHandler == s.authHandler {
+		if clientID, ok := (*mapping)[req.GetIndicator()]; ok {
+			return authHandler, clientID, nil
+		}
+	}
+	return authHandler, authHandler.ClientIDs()[0], nil
+}
+
+// parseClientMapping parses "indicator=clientID,..." into a lookup of configured client IDs
+func parseClientMapping(v string, authHandler *auth.AuthHandler) (map[string]int, error) {
+	mapping := map[string]int{}
+	if v == "" {
+		return mapping, nil
+	}
+	for _, pair := range strings.Split(v, ",") {
+		indicator, idStr, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || indicator == "" {
+			return nil, fmt.Errorf("invalid entry %q, want indicator=clientID", pair)
+		}
+		clientID, err := strconv.Atoi(idStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client ID in %q", pair)
+		}
+		if !authHandler.HasClient(clientID) {
+			return nil, fmt.Errorf("client ID %d is not listed in AUTH_CLIENT_ID", clientID)
+		}
+		mapping[indicator] = clientID
+	}
+	return mapping, nil
+}
+
+// loadTenants logs in every credential set in path (if set), sharing all other
+// settings with base, and returns their handlers by name
+func loadTenants(path string, base auth.Config) (map[string]*auth.AuthHandler, error) {
+	tenants := map[string]*auth.AuthHandler{}
+	if path == "" {
+		return tenants, nil
+	}
+
+	sets, err := auth.LoadCredentialSets(path)
+	if err != nil {
+		return nil, err
+	}
+	for name, creds := range sets {
+		cfg := base
+		cfg.Credentials = creds
+		handler, err := auth.NewAuthHandler(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", name, err)
+		}
+		tenants[name] = handler
+		log.Printf("Loaded credentials for tenant %q (client IDs %v)", name, creds.ClientIDs)
+	}
+	return tenants, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"systemiq.ai/protos"
+)
+
+// timestamps normalizes timestamp fields of JSON data to RFC 3339 UTC, checks them
+// against the (drift-corrected) current time, and optionally stamps receive time
+type timestamps struct {
+	fields        [][]string
+	receivedField string
+	maxFuture     time.Duration
+	maxAge        time.Duration // 0 = unlimited
+	reject        bool          // reject invalid timestamps instead of flagging them
+
+	driftThreshold time.Duration
+	correctDrift   bool                         // shift timestamps by the measured offset
+	clockOffset    func() (time.Duration, bool) // issuer minus local clock
+}
+
+// timestampsFromEnv reads TIMESTAMP_*; nil when neither fields nor a receive field is set
+func timestampsFromEnv(clockOffset func() (time.Duration, bool)) (*timestamps, error) {
+	t := &timestamps{receivedField: os.Getenv("TIMESTAMP_RECEIVED_FIELD"), clockOffset: clockOffset}
+	if v := os.Getenv("TIMESTAMP_FIELDS"); v != "" {
+		for _, f := range strings.Split(v, ",") {
+			t.fields = append(t.fields, strings.Split(strings.TrimSpace(f), "."))
+		}
+	}
+	if len(t.fields) == 0 && t.receivedField == "" {
+		return nil, nil
+	}
+
+	var err error
+	if t.maxFuture, err = envDuration("TIMESTAMP_MAX_FUTURE", 5*time.Minute); err != nil {
+		return nil, err
+	}
+	if t.maxAge, err = envDuration("TIMESTAMP_MAX_AGE", 0); err != nil {
+		return nil, err
+	}
+	if t.driftThreshold, err = envDuration("TIMESTAMP_DRIFT_THRESHOLD", 2*time.Minute); err != nil {
+		return nil, err
+	}
+
+	switch v := os.Getenv("TIMESTAMP_INVALID"); v {
+	case "", "flag":
+	case "reject":
+		t.reject = true
+	default:
+		return nil, fmt.Errorf("TIMESTAMP_INVALID must be flag or reject, got %q", v)
+	}
+	switch v := os.Getenv("TIMESTAMP_DRIFT"); v {
+	case "", "flag":
+	case "correct":
+		t.correctDrift = true
+	default:
+		return nil, fmt.Errorf("TIMESTAMP_DRIFT must be flag or correct, got %q", v)
+	}
+
+	log.Printf("Timestamp stage: %d field(s), invalid→%s, drift→%s",
+		len(t.fields), map[bool]string{false: "flag", true: "reject"}[t.reject],
+		map[bool]string{false: "flag", true: "correct"}[t.correctDrift])
+	return t, nil
+}
+
+// apply is a stage. When the local clock is off by more than the drift threshold the
+// request is labelled clock_drift_seconds, and in correct mode every timestamp
+// (including the receive stamp) is shifted by the offset.
+func (t *timestamps) apply(req *protos.ObservationRequest) error {
+	var correction time.Duration
+	if offset, ok := t.clockOffset(); ok && offset.Abs() > t.driftThreshold {
+		if req.Labels == nil {
+			req.Labels = map[string]string{}
+		}
+		req.Labels["clock_drift_seconds"] = strconv.Itoa(int(offset.Seconds()))
+		if t.correctDrift {
+			correction = offset
+		}
+	}
+	now := time.Now().Add(correction)
+
+	var rejectErr error
+	for i, data := range req.Data {
+		req.Data[i] = rewriteJSON(data, func(obj map[string]any) bool {
+			changed := false
+			if t.receivedField != "" {
+				obj[t.receivedField] = now.UTC().Format(time.RFC3339Nano)
+				changed = true
+			}
+			for _, path := range t.fields {
+				parent, key := walk(obj, path)
+				v, ok := parent[key]
+				if !ok {
+					continue
+				}
+
+				problem := ""
+				ts, ok := parseTimestamp(v)
+				switch {
+				case !ok:
+					problem = "unparseable"
+				case ts.Add(correction).After(now.Add(t.maxFuture)):
+					problem = "future"
+				case t.maxAge > 0 && ts.Add(correction).Before(now.Add(-t.maxAge)):
+					problem = "too_old"
+				}
+
+				if problem != "" {
+					if t.reject {
+						rejectErr = status.Errorf(codes.InvalidArgument, "data[%d].%s: %s timestamp", i, strings.Join(path, "."), problem)
+						return false
+					}
+					parent[key+"_invalid"] = problem
+					changed = true
+					if !ok {
+						continue
+					}
+				}
+				parent[key] = ts.Add(correction).UTC().Format(time.RFC3339Nano)
+				changed = true
+			}
+			return changed
+		})
+		if rejectErr != nil {
+			return rejectErr
+		}
+	}
+	return nil
+}
+
+// parseTimestamp accepts RFC 3339 strings and Unix epoch numbers (or numeric strings)
+// in seconds, milliseconds, microseconds or nanoseconds, told apart by magnitude
+func parseTimestamp(v any) (time.Time, bool) {
+	var s string
+	switch x := v.(type) {
+	case string:
+		if ts, err := time.Parse(time.RFC3339Nano, x); err == nil {
+			return ts, true
+		}
+		s = x
+	case fmt.Stringer: // json.Number
+		s = x.String()
+	default:
+		return time.Time{}, false
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f <= 0 || math.IsInf(f, 0) {
+		return time.Time{}, false
+	}
+	switch {
+	case f < 1e11:
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)), true
+	case f < 1e14:
+		return time.UnixMilli(int64(f)), true
+	case f < 1e17:
+		return time.UnixMicro(int64(f)), true
+	}
+	return time.Unix(0, int64(f)), true
+}
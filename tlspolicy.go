@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// applyTLSPolicy pins cfg to <prefix>_TLS_MIN_VERSION (1.2, the default, or 1.3) and
+// <prefix>_TLS_CIPHER_SUITES, a comma-separated list of IANA suite names, for hardening
+// baselines. Suites only apply to TLS 1.2; Go does not allow choosing TLS 1.3 suites.
+func applyTLSPolicy(cfg *tls.Config, prefix string) error {
+	switch v := os.Getenv(prefix + "_TLS_MIN_VERSION"); v {
+	case "", "1.2":
+		cfg.MinVersion = tls.VersionTLS12
+	case "1.3":
+		cfg.MinVersion = tls.VersionTLS13
+	default:
+		return fmt.Errorf("%s_TLS_MIN_VERSION must be 1.2 or 1.3, got %q", prefix, v)
+	}
+
+	list := os.Getenv(prefix + "_TLS_CIPHER_SUITES")
+	if list == "" {
+		return nil
+	}
+	byName := map[string]uint16{}
+	for _, s := range tls.CipherSuites() {
+		byName[s.Name] = s.ID
+	}
+	cfg.CipherSuites = nil
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("%s_TLS_CIPHER_SUITES: unknown or insecure cipher suite %q", prefix, name)
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+	if cfg.MinVersion == tls.VersionTLS13 {
+		log.Printf("WARNING: %s_TLS_CIPHER_SUITES has no effect with %s_TLS_MIN_VERSION=1.3", prefix, prefix)
+	}
+	return nil
+}
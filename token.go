@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"systemiq.ai/auth"
+)
+
+// runToken logs in (and optionally refreshes) with the configured credentials and
+// prints what the tokens say, to tell auth problems apart from forwarding problems
+func runToken(args []string) int {
+	fs := flag.NewFlagSet("token", flag.ContinueOnError)
+	clientID := fs.Int("client-id", 0, "only this client ID (default: all configured)")
+	refresh := fs.Bool("refresh", false, "also refresh each token and print the result")
+	show := fs.Bool("show", false, "print the raw access tokens (secrets!)")
+	timeout := fs.Duration("timeout", 30*time.Second, "deadline for login and refresh")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: observer_middleware token [-client-id n] [-refresh] [-show] [--flag=value ...]\n\nTakes the same configuration flags as serve.")
+		fs.PrintDefaults()
+	}
+	configFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return flagExit(err)
+	}
+
+	cfg, err := auth.ConfigFromEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// Report the first failure instead of retrying; AUTH_RETRY_MAX_ATTEMPTS still applies
+	cfg.LazyLogin, cfg.StartupRetry = false, false
+	log.SetOutput(io.Discard) // the handler's own logs would drown the report
+	authHandler, err := auth.NewAuthHandler(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "login:", err)
+		return 1
+	}
+	defer authHandler.StopRefresher()
+
+	ids := authHandler.ClientIDs()
+	if *clientID != 0 {
+		if !authHandler.HasClient(*clientID) {
+			fmt.Fprintf(os.Stderr, "client ID %d is not among the configured ones %v\n", *clientID, ids)
+			return 1
+		}
+		ids = []int{*clientID}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if offset, ok := authHandler.ClockOffset(); ok {
+		fmt.Printf("issuer clock offset: %+v\n", offset.Round(time.Millisecond))
+	}
+	status := 0
+	for _, id := range ids {
+		token, err := authHandler.GetTokenFor(ctx, id)
+		if err != nil {
+			fmt.Printf("client %d: %v\n", id, err)
+			status = 1
+			continue
+		}
+		printToken(id, "login", token, *show)
+
+		if *refresh {
+			if token, err = authHandler.RenewToken(ctx, id, token); err != nil {
+				fmt.Printf("client %d refresh: %v\n", id, err)
+				status = 1
+				continue
+			}
+			printToken(id, "refresh", token, *show)
+		}
+	}
+	return status
+}
+
+// printToken prints the claims of interest of an access token without verifying it
+func printToken(clientID int, how, token string, show bool) {
+	fmt.Printf("client %d (%s)\n", clientID, how)
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil {
+		fmt.Printf("  not a JWT: %v\n", err)
+	} else {
+		if v, ok := claims["client_id"]; ok {
+			fmt.Printf("  client_id  %v\n", v)
+		}
+		for _, c := range []struct{ label, claim string }{{"issued", "iat"}, {"expires", "exp"}} {
+			if v, ok := claims[c.claim].(float64); ok {
+				t := time.Unix(int64(v), 0)
+				fmt.Printf("  %-10s %s (%s)\n", c.label, t.Format(time.RFC3339), relative(t))
+			}
+		}
+		for _, c := range []struct{ label, claim string }{{"issuer", "iss"}, {"subject", "sub"}, {"audience", "aud"}} {
+			if v, ok := claims[c.claim]; ok {
+				fmt.Printf("  %-10s %v\n", c.label, v)
+			}
+		}
+		if scopes := tokenScopes(claims); len(scopes) > 0 {
+			fmt.Printf("  scopes     %s\n", strings.Join(scopes, " "))
+		}
+	}
+	if show {
+		fmt.Printf("  token      %s\n", token)
+	} else {
+		fmt.Printf("  token      %d bytes (-show to print)\n", len(token))
+	}
+}
+
+// tokenScopes reads the "scope" (space-separated) or "scopes"/"scp" (list) claims
+func tokenScopes(claims jwt.MapClaims) []string {
+	if s, ok := claims["scope"].(string); ok {
+		return strings.Fields(s)
+	}
+	for _, name := range []string{"scopes", "scp"} {
+		if list, ok := claims[name].([]any); ok {
+			scopes := make([]string, 0, len(list))
+			for _, s := range list {
+				scopes = append(scopes, fmt.Sprint(s))
+			}
+			return scopes
+		}
+	}
+	return nil
+}
+
+// relative describes t as "in 9m59s" or "4s ago"
+func relative(t time.Time) string {
+	d := time.Until(t).Round(time.Second)
+	if d < 0 {
+		return (-d).String() + " ago"
+	}
+	return "in " + d.String()
+}
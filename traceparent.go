@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// W3C Trace Context headers producers may send; both are passed on to the Observer
+const (
+	traceparentMetadataKey = "traceparent"
+	tracestateMetadataKey  = "tracestate"
+)
+
+// traceSampler decides which calls are traced. A call with a W3C traceparent keeps the
+// caller's decision (parent-based); with TRACE_SAMPLE_RATIO set, a call without one
+// starts a trace, sampled head-based by its trace ID, and the Observer continues it.
+// The middleware records no spans itself: the trace ID of a sampled call becomes the
+// exemplar of its latency observation and is added to slow/large request warnings.
+type traceSampler struct {
+	ratio   float64 // share of new traces sampled; negative = start none
+	onError bool    // failed calls get their trace ID recorded even when not sampled
+}
+
+// callTrace is the trace context of one call, stored in its ctx
+type callTrace struct {
+	traceID string
+	sampled bool
+	onError bool
+}
+
+type callTraceKey struct{}
+
+// traceSamplerFromEnv reads TRACE_SAMPLE_RATIO (unset: only callers start traces) and
+// TRACE_SAMPLE_ON_ERROR (default true)
+func traceSamplerFromEnv() (*traceSampler, error) {
+	t := &traceSampler{ratio: -1, onError: true}
+	if v := os.Getenv("TRACE_SAMPLE_RATIO"); v != "" {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			return nil, fmt.Errorf("TRACE_SAMPLE_RATIO must be between 0 and 1")
+		}
+		t.ratio = ratio
+	}
+	if v := os.Getenv("TRACE_SAMPLE_ON_ERROR"); strings.ToLower(v) == "false" || v == "0" {
+		t.onError = false
+	}
+	if t.ratio >= 0 {
+		log.Printf("Starting traces for calls without traceparent, %g of them sampled (failed calls always: %v)", t.ratio, t.onError)
+	}
+	return t, nil
+}
+
+// unaryInterceptor settles the call's trace context before the other interceptors run
+// and passes it on to the Observer
+func (t *traceSampler) unaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if traceID, sampled, ok := parseTraceparent(md.Get(traceparentMetadataKey)); ok {
+			ctx = context.WithValue(ctx, callTraceKey{}, &callTrace{traceID: traceID, sampled: sampled, onError: t.onError})
+			kv := []string{traceparentMetadataKey, md.Get(traceparentMetadataKey)[0]}
+			if state := md.Get(tracestateMetadataKey); len(state) > 0 {
+				kv = append(kv, tracestateMetadataKey, strings.Join(state, ","))
+			}
+			return handler(metadata.AppendToOutgoingContext(ctx, kv...), req)
+		}
+		if t.ratio < 0 {
+			return handler(ctx, req)
+		}
+
+		ids := make([]byte, 24) // trace ID, then the parent ID the Observer sees
+		rand.Read(ids)
+		// As OpenTelemetry's TraceIDRatioBased: compare the trace ID's low 63 bits
+		sampled := binary.BigEndian.Uint64(ids[8:16])>>1 < uint64(t.ratio*(1<<63))
+		tr := &callTrace{traceID: hex.EncodeToString(ids[:16]), sampled: sampled, onError: t.onError}
+		flags := "00"
+		if sampled {
+			flags = "01"
+		}
+		ctx = context.WithValue(ctx, callTraceKey{}, tr)
+		ctx = metadata.AppendToOutgoingContext(ctx, traceparentMetadataKey, "00-"+tr.traceID+"-"+hex.EncodeToString(ids[16:])+"-"+flags)
+		return handler(ctx, req)
+	}
+}
+
+// parseTraceparent returns the trace ID and sampled flag of a valid traceparent
+func parseTraceparent(v []string) (traceID string, sampled, ok bool) {
+	if len(v) == 0 {
+		return "", false, false
+	}
+	// version-traceid-parentid-flags, e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+	parts := strings.Split(strings.TrimSpace(v[0]), "-")
+	if len(parts) < 4 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", false, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return "", false, false
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil || parts[1] == strings.Repeat("0", 32) {
+		return "", false, false
+	}
+	if _, err := hex.DecodeString(parts[2]); err != nil || parts[2] == strings.Repeat("0", 16) {
+		return "", false, false
+	}
+	return parts[1], flags[0]&1 == 1, true
+}
+
+// traceIDFor returns the call's trace ID when it is sampled, or when it failed (err)
+// and failed calls are always recorded (tail-sampling collectors keep those traces)
+func traceIDFor(ctx context.Context, err error) string {
+	tr, _ := ctx.Value(callTraceKey{}).(*callTrace)
+	if tr == nil || !(tr.sampled || err != nil && tr.onError) {
+		return ""
+	}
+	return tr.traceID
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"systemiq.ai/metrics"
+	"systemiq.ai/protos"
+)
+
+// Unknown ObservationRequest fields (from producers built against a newer schema) are
+// always forwarded unchanged: protobuf keeps them through decode, stages and re-encode,
+// and passthrough never decodes them. unknownFieldWarner only makes them visible.
+type unknownFieldWarner struct {
+	fields protoreflect.FieldDescriptors
+	logs   rate.Sometimes
+}
+
+// unknownFieldsFromEnv reads UNKNOWN_FIELDS: "preserve" (default, silent) or "warn"
+func unknownFieldsFromEnv() (*unknownFieldWarner, error) {
+	switch mode := os.Getenv("UNKNOWN_FIELDS"); mode {
+	case "", "preserve":
+		return nil, nil
+	case "warn":
+		log.Println("Warning about unknown ObservationRequest fields (they are still forwarded)")
+		return &unknownFieldWarner{
+			fields: (&protos.ObservationRequest{}).ProtoReflect().Descriptor().Fields(),
+			logs:   rate.Sometimes{First: 10, Interval: time.Minute},
+		}, nil
+	default:
+		return nil, fmt.Errorf("UNKNOWN_FIELDS must be preserve or warn, not %q", mode)
+	}
+}
+
+// check counts and logs the fields of req this build does not know; nil-safe
+func (w *unknownFieldWarner) check(req observation) {
+	if w == nil {
+		return
+	}
+	var wire []byte
+	switch r := req.(type) {
+	case *protos.ObservationRequest:
+		wire = r.ProtoReflect().GetUnknown()
+	case *rawMessage:
+		wire = r.buf
+	}
+
+	unknown := w.unknown(wire)
+	if len(unknown) == 0 {
+		return
+	}
+	for _, num := range unknown {
+		metrics.UnknownFields.WithLabelValues(strconv.Itoa(int(num))).Inc()
+	}
+	w.logs.Do(func() {
+		log.Printf("%q carries unknown field number(s) %v; forwarding unchanged (producer newer than the middleware?)", req.GetIndicator(), unknown)
+	})
+}
+
+// unknown lists the distinct field numbers in wire that the schema does not declare
+func (w *unknownFieldWarner) unknown(wire []byte) []protowire.Number {
+	var nums []protowire.Number
+	seen := map[protowire.Number]bool{}
+	for len(wire) > 0 {
+		num, typ, n := protowire.ConsumeTag(wire)
+		if n < 0 {
+			return nums
+		}
+		wire = wire[n:]
+		if n = protowire.ConsumeFieldValue(num, typ, wire); n < 0 {
+			return nums
+		}
+		wire = wire[n:]
+		if w.fields.ByNumber(num) == nil && !seen[num] {
+			seen[num] = true
+			nums = append(nums, num)
+		}
+	}
+	return nums
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"systemiq.ai/metrics"
+	"systemiq.ai/protos"
+)
+
+// futureField is a field number ObservationRequest does not declare, as sent by a
+// producer built against a newer schema
+const futureField = 99
+
+// recordingObserver keeps the last observation it received
+type recordingObserver struct {
+	protos.UnimplementedDataObserverServer
+	mu   sync.Mutex
+	last *protos.ObservationRequest
+}
+
+func (o *recordingObserver) ObserveData(_ context.Context, req *protos.ObservationRequest) (*protos.ObservationResponse, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.last = req
+	return &protos.ObservationResponse{Status: "success"}, nil
+}
+
+func (o *recordingObserver) received(t *testing.T) *protos.ObservationRequest {
+	t.Helper()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.last == nil {
+		t.Fatal("Observer received nothing")
+	}
+	return o.last
+}
+
+// futureWire encodes an observation followed by an unknown field
+func futureWire(t *testing.T) []byte {
+	t.Helper()
+	wire, err := proto.Marshal(&protos.ObservationRequest{Data: []string{`{"a":1}`}, Indicator: "future"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wire = protowire.AppendTag(wire, futureField, protowire.BytesType)
+	return protowire.AppendString(wire, "from the future")
+}
+
+// checkFutureField fails unless req still carries the unknown field of futureWire
+func checkFutureField(t *testing.T, req *protos.ObservationRequest) {
+	t.Helper()
+	want := protowire.AppendString(protowire.AppendTag(nil, futureField, protowire.BytesType), "from the future")
+	if got := req.ProtoReflect().GetUnknown(); !bytes.Equal(got, want) {
+		t.Fatalf("unknown fields forwarded as %x, want %x", got, want)
+	}
+}
+
+// appendStage changes every request, forcing a re-encode
+func appendStage(req *protos.ObservationRequest) error {
+	req.Data = append(req.Data, `{"b":2}`)
+	return nil
+}
+
+func TestUnknownFieldsSurviveStages(t *testing.T) {
+	observer := new(recordingObserver)
+	srv := newStubServer(t, observer)
+	srv.stages = []stage{appendStage}
+
+	req := new(protos.ObservationRequest)
+	if err := proto.Unmarshal(futureWire(t), req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.ObserveData(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	got := observer.received(t)
+	if len(got.Data) != 2 {
+		t.Fatalf("stage did not run: data %q", got.Data)
+	}
+	checkFutureField(t, got)
+}
+
+func TestUnknownFieldsSurvivePassthrough(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		stages []stage
+	}{
+		{"no stages", nil},
+		{"stages", []stage{appendStage}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			observer := new(recordingObserver)
+			srv := newStubServer(t, observer)
+			srv.stages = tc.stages
+
+			req := new(rawMessage)
+			if err := (rawCodec{}).Unmarshal(futureWire(t), req); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := srv.observeRaw(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+
+			got := observer.received(t)
+			if got.GetToken() == "" {
+				t.Fatal("token was not added")
+			}
+			checkFutureField(t, got)
+		})
+	}
+}
+
+func TestUnknownFieldsWarn(t *testing.T) {
+	t.Setenv("UNKNOWN_FIELDS", "warn")
+	warner, err := unknownFieldsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	observer := new(recordingObserver)
+	srv := newStubServer(t, observer)
+	srv.unknownFields = warner
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	counter := metrics.UnknownFields.WithLabelValues("99")
+	before := testutil.ToFloat64(counter)
+
+	req := new(protos.ObservationRequest)
+	if err := proto.Unmarshal(futureWire(t), req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.ObserveData(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	checkFutureField(t, observer.received(t))
+	if got := testutil.ToFloat64(counter) - before; got != 1 {
+		t.Errorf("unknown_fields_total{field=\"99\"} grew by %v, want 1", got)
+	}
+	if !strings.Contains(logs.String(), "unknown field number(s) [99]") {
+		t.Errorf("no warning logged, got %q", logs.String())
+	}
+}
+
+func TestUnknownFieldsMode(t *testing.T) {
+	for mode, wantWarner := range map[string]bool{"": false, "preserve": false, "warn": true} {
+		t.Setenv("UNKNOWN_FIELDS", mode)
+		warner, err := unknownFieldsFromEnv()
+		if err != nil {
+			t.Fatalf("UNKNOWN_FIELDS=%q: %v", mode, err)
+		}
+		if (warner != nil) != wantWarner {
+			t.Errorf("UNKNOWN_FIELDS=%q: warner %v, want %v", mode, warner != nil, wantWarner)
+		}
+	}
+	t.Setenv("UNKNOWN_FIELDS", "drop")
+	if _, err := unknownFieldsFromEnv(); err == nil {
+		t.Error("UNKNOWN_FIELDS=drop accepted")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"systemiq.ai/metrics"
+	"systemiq.ai/protos"
+)
+
+// uploader streams observations too large for one ObserveData message to Observers
+// serving ObservationUpload, resuming at the committed offset after a dropped stream
+type uploader struct {
+	threshold  int // payloads above this are uploaded; 0 = the Observer's advertised limit
+	chunk      int
+	maxResumes int
+}
+
+// uploaderFromEnv reads OBSERVER_UPLOAD_THRESHOLD_MB, OBSERVER_UPLOAD_CHUNK_KB and
+// OBSERVER_UPLOAD_MAX_RESUMES
+func uploaderFromEnv(methods methodConfig) (*uploader, error) {
+	threshold, err := envInt("OBSERVER_UPLOAD_THRESHOLD_MB", 0)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := envInt("OBSERVER_UPLOAD_CHUNK_KB", 1024)
+	if err != nil || chunk == 0 {
+		return nil, fmt.Errorf("OBSERVER_UPLOAD_CHUNK_KB must be a positive integer")
+	}
+	maxResumes, err := envInt("OBSERVER_UPLOAD_MAX_RESUMES", 5)
+	if err != nil {
+		return nil, err
+	}
+
+	// A huge upload needs longer than the 5s default unless configured otherwise
+	if _, ok := methods["Upload"]; !ok {
+		if _, ok := methods[protos.ObservationUpload_Upload_FullMethodName]; !ok {
+			methods[protos.ObservationUpload_Upload_FullMethodName] = methodOptions{Timeout: 10 * time.Minute, WaitForReady: methods.lookup("*").WaitForReady}
+		}
+	}
+	return &uploader{threshold: threshold << 20, chunk: chunk << 10, maxResumes: maxResumes}, nil
+}
+
+// wants reports whether a payload of size bytes must be uploaded in chunks: every
+// endpoint serves ObservationUpload and the payload exceeds the threshold; a nil uploader
+// never does
+func (u *uploader) wants(set *upstreamSet, size int) bool {
+	if u == nil {
+		return false
+	}
+	limit := u.threshold
+	for _, m := range set.members {
+		caps := m.caps.Load()
+		if caps == nil || !slices.Contains(caps.methods, protos.ObservationUpload_Upload_FullMethodName) {
+			return false
+		}
+		if u.threshold == 0 && caps.maxMsgBytes > 0 && (limit == 0 || caps.maxMsgBytes < limit) {
+			limit = caps.maxMsgBytes
+		}
+	}
+	if limit == 0 {
+		limit = 4 << 20 // gRPC's default receive limit
+	}
+	return size > limit
+}
+
+// upload streams payload (an encoded ObservationRequest without token) and returns the
+// Observer's answer; after a dropped stream it asks for the committed offset and resumes
+func (u *uploader) upload(ctx context.Context, conn *grpc.ClientConn, payload []byte, token string, opts ...grpc.CallOption) (*protos.ObservationResponse, error) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	uploadID := hex.EncodeToString(id)
+	client := protos.NewObservationUploadClient(conn)
+
+	var offset int64
+	for attempt := 0; ; attempt++ {
+		st, err := u.send(ctx, client, uploadID, payload, offset, token, opts)
+		if err == nil {
+			return st.GetResponse(), nil
+		}
+		if attempt >= u.maxResumes || ctx.Err() != nil || !resumable(err) {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(time.Duration(attempt+1) * time.Second):
+		}
+		st, statusErr := client.GetUploadStatus(ctx, &protos.UploadStatusRequest{UploadId: uploadID}, grpc.WaitForReady(true))
+		switch {
+		case statusErr != nil:
+			log.Printf("upload %s: %v; status unknown (%v), resuming at %d", uploadID, err, statusErr, offset)
+		case st.GetComplete():
+			return st.GetResponse(), nil
+		default:
+			offset = st.GetCommittedOffset()
+			log.Printf("upload %s: %v; resuming at %d of %d bytes", uploadID, err, offset, len(payload))
+		}
+		metrics.UploadResumes.Inc()
+	}
+}
+
+// send streams payload from offset on one Upload call
+func (u *uploader) send(ctx context.Context, client protos.ObservationUploadClient, id string, payload []byte, offset int64, token string, opts []grpc.CallOption) (*protos.UploadStatus, error) {
+	stream, err := client.Upload(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	first := true
+	for {
+		end := min(offset+int64(u.chunk), int64(len(payload)))
+		chunk := &protos.UploadChunk{UploadId: id, Offset: offset, Data: payload[offset:end], Last: end == int64(len(payload))}
+		if first {
+			chunk.TotalSize = int64(len(payload))
+			chunk.Token = &token
+			first = false
+		}
+		if err := stream.Send(chunk); err != nil {
+			break // the real error comes from CloseAndRecv
+		}
+		if offset = end; chunk.Last {
+			break
+		}
+	}
+	return stream.CloseAndRecv()
+}
+
+// resumable reports errors from a broken stream, as opposed to a rejected upload
+func resumable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Aborted, codes.Internal, codes.Unknown:
+		return true
+	}
+	return false
+}
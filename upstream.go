@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"systemiq.ai/metrics"
+)
+
+// redialGrace is how long a replaced connection stays open for calls already using it
+const redialGrace = 30 * time.Second
+
+// upstream owns the Observer connection and can replace it at runtime (watchdog,
+// endpoint switches); calls pick up the current connection via Conn
+type upstream struct {
+	dial func(endpoint string) (*grpc.ClientConn, error)
+
+	mu       sync.Mutex // serialises redials
+	endpoint string
+	conn     atomic.Pointer[grpc.ClientConn]
+	caps     atomic.Pointer[observerCaps] // nil until the capabilities handshake answers
+}
+
+func newUpstream(endpoint string, dial func(string) (*grpc.ClientConn, error)) (*upstream, error) {
+	conn, err := dial(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u := &upstream{dial: dial, endpoint: endpoint}
+	u.conn.Store(conn)
+	return u, nil
+}
+
+// Conn returns the current connection
+func (u *upstream) Conn() *grpc.ClientConn { return u.conn.Load() }
+
+// Endpoint returns the current Observer target
+func (u *upstream) Endpoint() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.endpoint
+}
+
+// Redial replaces the connection with a fresh one (re-resolving DNS), switching to
+// endpoint if it is non-empty; the old connection is closed after redialGrace
+func (u *upstream) Redial(endpoint, reason string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if endpoint == "" {
+		endpoint = u.endpoint
+	}
+
+	conn, err := u.dial(endpoint)
+	if err != nil {
+		return err
+	}
+	old := u.conn.Swap(conn)
+	if endpoint != u.endpoint {
+		u.caps.Store(nil) // another Observer; forward plainly until it answers the handshake
+	}
+	u.endpoint = endpoint
+	conn.Connect()
+	metrics.ObserverRedials.Inc()
+	log.Printf("Re-dialled Observer at %s (%s)", endpoint, reason)
+
+	time.AfterFunc(redialGrace, func() { old.Close() })
+	return nil
+}
+
+// Close closes the current connection
+func (u *upstream) Close() error { return u.Conn().Close() }
+
+// watchdog re-dials when the connection sits in TRANSIENT_FAILURE or IDLE for longer
+// than timeout, which gRPC's own backoff does not always recover from after a flap
+func (u *upstream) watchdog(ctx context.Context, timeout time.Duration) {
+	for ctx.Err() == nil {
+		if testMode.Load() {
+			// No Observer traffic is expected; check again later
+			select {
+			case <-ctx.Done():
+			case <-time.After(timeout):
+			}
+			continue
+		}
+
+		conn := u.Conn()
+		state := conn.GetState()
+
+		if state != connectivity.TransientFailure && state != connectivity.Idle {
+			waitCtx, cancel := context.WithTimeout(ctx, timeout)
+			conn.WaitForStateChange(waitCtx, state) // also wakes up if the conn was swapped and closed
+			cancel()
+			continue
+		}
+
+		if state == connectivity.Idle {
+			conn.Connect()
+		}
+		waitCtx, cancel := context.WithTimeout(ctx, timeout)
+		ready := waitForReady(waitCtx, conn)
+		cancel()
+		if ready || ctx.Err() != nil || conn != u.Conn() {
+			continue
+		}
+
+		if err := u.Redial("", "not READY within "+timeout.String()+" of "+state.String()); err != nil {
+			log.Printf("watchdog: re-dial failed: %v", err)
+		}
+	}
+}
+
+// waitForReady reports whether conn reaches READY before ctx is done; cycling through
+// CONNECTING on backoff does not count
+func waitForReady(ctx context.Context, conn *grpc.ClientConn) bool {
+	for {
+		state := conn.GetState()
+		if state == connectivity.Ready {
+			return true
+		}
+		if state == connectivity.Shutdown || !conn.WaitForStateChange(ctx, state) {
+			return false
+		}
+	}
+}
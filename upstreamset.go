@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"systemiq.ai/metrics"
+)
+
+// probeSmoothing weights each new probe in the smoothed latency (EWMA)
+const probeSmoothing = 0.3
+
+// upstreamSet holds every configured Observer endpoint and decides which one calls
+// go to; with several endpoints the fastest healthy one is used, switching only
+// when another is clearly faster
+type upstreamSet struct {
+	members     []*member
+	active      atomic.Pointer[member]
+	margin      float64 // fraction by which a candidate must beat the active endpoint
+	weighted    bool    // split calls by member weight instead of using the active endpoint
+	failback    failbackConfig
+	transitions transitionLog
+}
+
+// member is one endpoint with its probe results and call outcomes
+type member struct {
+	*upstream
+	latency atomic.Int64 // smoothed probe round trip in ns; 0 until the first probe answers
+	healthy atomic.Bool
+	stats   callStats
+	ramp    *ramp // nil without slow start
+	weight  int   // share of calls when splitting by weight
+
+	streak      atomic.Int32 // healthy probes in a row
+	streakStart atomic.Int64 // unix ns of the streak's first probe
+	suspect     atomic.Bool  // failed since last confirmed; see failbackConfig
+	connState   atomic.Pointer[connState]
+}
+
+// usable reports whether calls may go to the endpoint
+func (m *member) usable() bool { return m.healthy.Load() && !m.ejected() }
+
+// rtt is the smoothed probe latency, unknown counting as slowest
+func (m *member) rtt() time.Duration {
+	if l := m.latency.Load(); l > 0 {
+		return time.Duration(l)
+	}
+	return math.MaxInt64
+}
+
+func newUpstreamSet(upstreams []*upstream, weights []int, margin float64, slowStart slowStartConfig) *upstreamSet {
+	s := &upstreamSet{margin: margin, weighted: weights != nil}
+	for i, u := range upstreams {
+		m := &member{upstream: u}
+		if s.weighted {
+			m.weight = weights[i]
+		}
+		if len(slowStart.steps) > 0 {
+			m.ramp = &ramp{cfg: slowStart}
+		}
+		m.healthy.Store(true) // until a probe says otherwise
+		m.stats.last.score = 1
+		s.members = append(s.members, m)
+	}
+	// When splitting, the heaviest endpoint stands in as "active" for status reporting
+	active := s.members[0]
+	for _, m := range s.members {
+		if m.weight > active.weight {
+			active = m
+		}
+	}
+	s.active.Store(active)
+	metrics.ObserverEndpointActive.WithLabelValues(active.Endpoint()).Set(1)
+	return s
+}
+
+// pick chooses the endpoint for one call: the active one, or a weighted random
+// choice among the usable endpoints when splitting
+func (s *upstreamSet) pick() *member {
+	if !s.weighted {
+		return s.active.Load()
+	}
+	total := 0
+	for _, m := range s.members {
+		if m.usable() {
+			total += m.weight
+		}
+	}
+	if total == 0 {
+		return s.active.Load() // nothing usable or all weights zero: fall back rather than fail
+	}
+	n := rand.IntN(total)
+	for _, m := range s.members {
+		if !m.usable() {
+			continue
+		}
+		if n < m.weight {
+			return m
+		}
+		n -= m.weight
+	}
+	return s.active.Load()
+}
+
+// Conn returns the connection of the endpoint calls currently go to
+func (s *upstreamSet) Conn() *grpc.ClientConn { return s.active.Load().Conn() }
+
+// Endpoint returns the target calls currently go to
+func (s *upstreamSet) Endpoint() string { return s.active.Load().Endpoint() }
+
+// Close closes every endpoint's connection
+func (s *upstreamSet) Close() {
+	for _, m := range s.members {
+		m.Close()
+	}
+}
+
+// endpointsFromEnv reads OBSERVER_ENDPOINTS ("a:443,b:443", or "a:443=95,b:443=5" to split
+// traffic by weight), falling back to the single endpoint; weights is nil without splitting
+func endpointsFromEnv(endpoint string) (endpoints []string, weights []int, err error) {
+	for _, e := range strings.Split(os.Getenv("OBSERVER_ENDPOINTS"), ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		target, w, weighted := strings.Cut(e, "=")
+		endpoints = append(endpoints, target)
+		if !weighted {
+			continue
+		}
+		weight, err := strconv.Atoi(w)
+		if err != nil || weight < 0 {
+			return nil, nil, fmt.Errorf("OBSERVER_ENDPOINTS: invalid weight in %q", e)
+		}
+		weights = append(weights, weight)
+	}
+	if len(endpoints) == 0 {
+		return []string{endpoint}, nil, nil
+	}
+	if weights != nil && len(weights) != len(endpoints) {
+		return nil, nil, fmt.Errorf("OBSERVER_ENDPOINTS: give a weight for every endpoint or none")
+	}
+	return endpoints, weights, nil
+}
+
+// runProbes measures every endpoint each interval and re-selects the active one;
+// it returns at once with a single endpoint
+func (s *upstreamSet) runProbes(ctx context.Context, interval time.Duration) {
+	if len(s.members) < 2 {
+		return
+	}
+	for {
+		if !testMode.Load() {
+			for _, m := range s.members {
+				go s.probe(ctx, m, interval)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		s.reselect()
+	}
+}
+
+// probe times a health check; any answer but NOT_SERVING counts as healthy, so
+// Observers without the health service still report their round trip
+func (s *upstreamSet) probe(ctx context.Context, m *member, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := grpc_health_v1.NewHealthClient(m.Conn()).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	rtt := time.Since(start)
+
+	healthy := true
+	switch status.Code(err) {
+	case codes.OK:
+		healthy = resp.GetStatus() != grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled:
+		healthy = false
+	}
+	m.healthy.Store(healthy)
+	m.probed(healthy)
+
+	endpoint := m.Endpoint()
+	metrics.ObserverEndpointHealthy.WithLabelValues(endpoint).Set(boolFloat(healthy))
+	if !healthy {
+		return
+	}
+	smoothed := rtt
+	if prev := time.Duration(m.latency.Load()); prev > 0 {
+		smoothed = time.Duration(probeSmoothing*float64(rtt) + (1-probeSmoothing)*float64(prev))
+	}
+	m.latency.Store(int64(smoothed))
+	metrics.ObserverEndpointLatency.WithLabelValues(endpoint).Set(smoothed.Seconds())
+}
+
+// reselect moves traffic to the fastest usable endpoint if the active one is
+// unhealthy or ejected, or the candidate beats it by more than the margin; endpoints
+// that failed before must be confirmed again first (OBSERVER_FAILBACK_PROBES)
+func (s *upstreamSet) reselect() {
+	if s.weighted {
+		return // weights decide; unusable endpoints are skipped per call
+	}
+	cur := s.active.Load()
+	var best, fallback *member
+	for _, m := range s.members {
+		confirmed := m.confirmed(s.failback)
+		if !m.usable() {
+			continue
+		}
+		if (m == cur || confirmed) && (best == nil || m.rtt() < best.rtt()) {
+			best = m
+		}
+		if fallback == nil || m.rtt() < fallback.rtt() {
+			fallback = m
+		}
+	}
+	if best == nil && !cur.usable() {
+		best = fallback // nothing confirmed yet, but any live endpoint beats a dead one
+	}
+	if best == nil || best == cur {
+		return
+	}
+
+	reason := "unhealthy"
+	if cur.usable() {
+		if best.latency.Load() == 0 || (cur.latency.Load() > 0 && float64(best.rtt()) > float64(cur.rtt())*(1-s.margin)) {
+			return
+		}
+		reason = "slower"
+	} else if cur.healthy.Load() {
+		reason = "ejected"
+	}
+
+	s.active.Store(best)
+	metrics.ObserverEndpointActive.WithLabelValues(cur.Endpoint()).Set(0)
+	metrics.ObserverEndpointActive.WithLabelValues(best.Endpoint()).Set(1)
+	log.Printf("Switching Observer endpoint from %s %s to %s (%v)", reason, cur.Endpoint(), best.Endpoint(), time.Duration(best.latency.Load()).Round(time.Millisecond))
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"systemiq.ai/metrics"
+	"systemiq.ai/protos"
+)
+
+// requestValidator rejects malformed observations before any upstream work, listing
+// every problem as a BadRequest field violation
+type requestValidator struct {
+	maxData  int // total bytes of data entries; 0 = only the gRPC message limit
+	maxDepth int // nesting of JSON data entries; 0 = not checked
+}
+
+// requestValidatorFromEnv reads REQUEST_VALIDATION (off by default), REQUEST_MAX_DATA_KB
+// and REQUEST_MAX_JSON_DEPTH
+func requestValidatorFromEnv() (*requestValidator, error) {
+	if !envBool("REQUEST_VALIDATION") {
+		return nil, nil
+	}
+	maxKB, err := envInt("REQUEST_MAX_DATA_KB", 0)
+	if err != nil {
+		return nil, err
+	}
+	depth, err := envInt("REQUEST_MAX_JSON_DEPTH", 64)
+	if err != nil {
+		return nil, err
+	}
+	return &requestValidator{maxData: maxKB << 10, maxDepth: depth}, nil
+}
+
+// violation is one field problem and the rule it broke, for the metric
+type violation struct {
+	field, rule, description string
+}
+
+// check returns the request's violations, nil when it is valid
+func (v *requestValidator) check(req *protos.ObservationRequest) []violation {
+	var out []violation
+	add := func(field, rule, format string, args ...any) {
+		out = append(out, violation{field, rule, fmt.Sprintf(format, args...)})
+	}
+
+	switch indicator := req.GetIndicator(); {
+	case indicator == "":
+		add("indicator", "required", "indicator is required")
+	case !utf8.ValidString(indicator):
+		add("indicator", "utf8", "indicator is not valid UTF-8")
+	}
+	if req.Action != nil && !utf8.ValidString(req.GetAction()) {
+		add("action", "utf8", "action is not valid UTF-8")
+	}
+	for k, val := range req.GetLabels() {
+		if !utf8.ValidString(k) || !utf8.ValidString(val) {
+			add(fmt.Sprintf("labels[%q]", strings.ToValidUTF8(k, "�")), "utf8", "label is not valid UTF-8")
+		}
+	}
+
+	if len(req.GetData()) == 0 {
+		add("data", "required", "at least one data entry is required")
+	}
+	total := 0
+	for i, d := range req.GetData() {
+		total += len(d)
+		field := fmt.Sprintf("data[%d]", i)
+		switch {
+		case d == "":
+			add(field, "required", "data entry is empty")
+		case !utf8.ValidString(d):
+			add(field, "utf8", "data entry is not valid UTF-8")
+		case v.maxDepth > 0 && (d[0] == '{' || d[0] == '['):
+			if err := checkJSONDepth(d, v.maxDepth); err != nil {
+				add(field, "json", "%v", err)
+			}
+		}
+	}
+	if v.maxData > 0 && total > v.maxData {
+		add("data", "size", "data entries total %d bytes, limit is %d", total, v.maxData)
+	}
+	return out
+}
+
+// checkJSONDepth reports malformed JSON and nesting deeper than max
+func checkJSONDepth(data string, max int) error {
+	dec := json.NewDecoder(strings.NewReader(data))
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("malformed JSON at offset %d: %v", dec.InputOffset(), err)
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			if depth++; depth > max {
+				return fmt.Errorf("JSON nested deeper than %d levels at offset %d", max, dec.InputOffset())
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+}
+
+// unaryInterceptor validates ObserveData calls; passthrough requests are decoded for it
+func (v *requestValidator) unaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		var decoded *protos.ObservationRequest
+		switch r := req.(type) {
+		case *protos.ObservationRequest:
+			decoded = r
+		case *rawMessage:
+			var err error
+			if decoded, err = decodeLenient(r.buf); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "malformed request: %v", err)
+			}
+		default:
+			return handler(ctx, req)
+		}
+
+		violations := v.check(decoded)
+		if len(violations) == 0 {
+			return handler(ctx, req)
+		}
+		br := &errdetails.BadRequest{}
+		for _, vi := range violations {
+			metrics.InvalidRequests.WithLabelValues(vi.rule).Inc()
+			br.FieldViolations = append(br.FieldViolations, &errdetails.BadRequest_FieldViolation{Field: vi.field, Description: vi.description})
+		}
+		msg := violations[0].field + ": " + violations[0].description
+		if len(violations) > 1 {
+			msg += fmt.Sprintf(" (and %d more)", len(violations)-1)
+		}
+		st, err := status.New(codes.InvalidArgument, msg).WithDetails(br)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, msg)
+		}
+		return nil, st.Err()
+	}
+}
+
+// decodeLenient decodes the fields the validator looks at without proto's UTF-8
+// check, which passthrough requests have not been through, so invalid strings can be
+// reported per field
+func decodeLenient(b []byte) (*protos.ObservationRequest, error) {
+	req := new(protos.ObservationRequest)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.BytesType || (num != dataFieldNumber && num != indicatorFieldNumber && num != actionFieldNumber && num != labelsFieldNumber) {
+			if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch num {
+		case dataFieldNumber:
+			req.Data = append(req.Data, string(v))
+		case indicatorFieldNumber:
+			req.Indicator = string(v)
+		case actionFieldNumber:
+			action := string(v)
+			req.Action = &action
+		case labelsFieldNumber:
+			var key, val string
+			for len(v) > 0 {
+				num, typ, n := protowire.ConsumeTag(v)
+				if n < 0 || typ != protowire.BytesType {
+					return nil, errors.New("malformed labels entry")
+				}
+				v = v[n:]
+				s, n := protowire.ConsumeBytes(v)
+				if n < 0 {
+					return nil, protowire.ParseError(n)
+				}
+				v = v[n:]
+				if num == 1 {
+					key = string(s)
+				} else {
+					val = string(s)
+				}
+			}
+			if req.Labels == nil {
+				req.Labels = map[string]string{}
+			}
+			req.Labels[key] = val
+		}
+	}
+	return req, nil
+}